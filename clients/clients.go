@@ -1,12 +1,23 @@
 package clients
 
-import "github.com/sirupsen/logrus"
+import (
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
 
 var infraConfigMapperClient InfraConfigMapperClientImpl
 var osClient OsClientImpl
 var userClient UserClientImpl
 var vaultClient VaultClientImpl
 
+// the clients handed out, tests swap in fakes so services run without touching the host
+var activeOsClient OsClient = &osClient
+var activeUserClient UserClient = &userClient
+
+// the system roles are applied to, "/" unless the agent works on a mounted image or chroot
+var hostRoot = "/"
+
 func Initialize(logger *logrus.Logger, hostname string) {
 
 	infraConfigMapperClient.initialize(logger, hostname)
@@ -19,8 +30,37 @@ func GetInfraConfigMapperClient() InfraConfigMapperClient {
 	return &infraConfigMapperClient
 }
 
-func GetOsClient() OsClient { return &osClient }
+func GetOsClient() OsClient {
+	if hostRoot == "/" {
+		return activeOsClient
+	}
+	return NewRootedOsClient(hostRoot, activeOsClient)
+}
+
+// GetUserClient returns the client users and groups are looked up with, under a host root they are read from the
+// passwd and group files of the root
+func GetUserClient() UserClient {
+	if hostRoot == "/" {
+		return activeUserClient
+	}
+	return NewFileUserClient(GetOsClient())
+}
+
+// GetSystemOsClient returns the client of the system the agent runs on whatever the host root, for the agent's own
+// configuration rather than the files of the roles
+func GetSystemOsClient() OsClient { return activeOsClient }
+
+// SetHostRoot makes every path the agent touches relative to root, a mounted image or chroot for example. Services
+// pick it up when initialized
+func SetHostRoot(root string) { hostRoot = filepath.Clean(root) }
+
+// GetHostRoot returns the root set with SetHostRoot, "/" when the agent manages the system it runs on
+func GetHostRoot() string { return hostRoot }
+
+// SetOsClient replaces the client every host filesystem access goes through, services pick it up when initialized
+func SetOsClient(client OsClient) { activeOsClient = client }
 
-func GetUserClient() UserClient { return &userClient }
+// SetUserClient replaces the client users and groups are looked up with, services pick it up when initialized
+func SetUserClient(client UserClient) { activeUserClient = client }
 
 func GetVaultClient() VaultClient { return &vaultClient }
@@ -10,6 +10,7 @@ type DiskWrapper interface {
 	GetPartitionTable() (partition.Table, error)
 	GetFileSystem(partition int) (FileSystemWrapper, error)
 	StatBackend() (fs.FileInfo, error)
+	Close() error
 }
 
 type DiskWrapperImpl struct {
@@ -36,3 +37,7 @@ func (diskClient *DiskWrapperImpl) GetFileSystem(partition int) (FileSystemWrapp
 func (diskClient *DiskWrapperImpl) StatBackend() (fs.FileInfo, error) {
 	return diskClient.disk.Backend.Stat()
 }
+
+func (diskClient *DiskWrapperImpl) Close() error {
+	return diskClient.disk.Close()
+}
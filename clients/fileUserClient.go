@@ -0,0 +1,88 @@
+package clients
+
+import (
+	"io"
+	"os/user"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const passwdPath = "/etc/passwd"
+const groupPath = "/etc/group"
+
+// FileUserClient looks users and groups up in the passwd and group files it reads through an OsClient, so a rooted
+// client gives the accounts of the image or chroot rather than those of the running system
+type FileUserClient struct {
+	logger   *logrus.Logger
+	osClient OsClient
+}
+
+func NewFileUserClient(osClient OsClient) *FileUserClient {
+	return &FileUserClient{osClient: osClient}
+}
+
+func (userClient *FileUserClient) initialize(logger *logrus.Logger) {
+	userClient.logger = logger
+}
+
+func (userClient *FileUserClient) GetUserByName(username string) (*user.User, error) {
+	entries, readError := userClient.readDatabase(passwdPath)
+
+	if readError != nil {
+		return nil, readError
+	}
+
+	// name:password:uid:gid:gecos:home:shell
+	for _, fields := range entries {
+		if len(fields) < 7 || fields[0] != username {
+			continue
+		}
+		fullName, _, _ := strings.Cut(fields[4], ",")
+		return &user.User{Uid: fields[2], Gid: fields[3], Username: fields[0], Name: fullName, HomeDir: fields[5]}, nil
+	}
+	return nil, user.UnknownUserError(username)
+}
+
+func (userClient *FileUserClient) GetGroupByName(groupName string) (*user.Group, error) {
+	entries, readError := userClient.readDatabase(groupPath)
+
+	if readError != nil {
+		return nil, readError
+	}
+
+	// name:password:gid:members
+	for _, fields := range entries {
+		if len(fields) < 4 || fields[0] != groupName {
+			continue
+		}
+		return &user.Group{Gid: fields[2], Name: fields[0]}, nil
+	}
+	return nil, user.UnknownGroupError(groupName)
+}
+
+// readDatabase splits the lines of a colon separated account file, skipping comments and NIS compat entries
+func (userClient *FileUserClient) readDatabase(path string) ([][]string, error) {
+	file, openError := userClient.osClient.OpenFile(path)
+
+	if openError != nil {
+		return nil, openError
+	}
+	defer file.Close()
+
+	contents, readError := io.ReadAll(file)
+
+	if readError != nil {
+		return nil, readError
+	}
+
+	var entries [][]string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, nil
+}
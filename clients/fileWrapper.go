@@ -56,3 +56,11 @@ func (fileWrapper *FileWrapperImpl) Close() error {
 		return fileWrapper.filesystemFile.Close()
 	}
 }
+
+// Sync flushes os files to stable storage, files on config drives are only ever read so there is nothing to flush
+func (fileWrapper *FileWrapperImpl) Sync() error {
+	if fileWrapper.file != nil {
+		return fileWrapper.file.Sync()
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package clients
 import (
 	"github.com/diskfs/go-diskfs/filesystem"
 	"os"
+	"path"
 )
 
 type FileSystemWrapper interface {
@@ -19,18 +20,23 @@ func NewFileSystemWrapper(system filesystem.FileSystem) FileSystemWrapper {
 	return &FileSystemWrapperImpl{fileSystem: system}
 }
 
-func (filesystemWrapper *FileSystemWrapperImpl) OpenFile(path string, flag int) (FileWrapper, error) {
-	file, openFileError := filesystemWrapper.fileSystem.OpenFile(path, flag)
+func (filesystemWrapper *FileSystemWrapperImpl) OpenFile(filePath string, flag int) (FileWrapper, error) {
+	file, openFileError := filesystemWrapper.fileSystem.OpenFile(rootedPath(filePath), flag)
 	if openFileError != nil {
 		return nil, openFileError
 	}
 	return NewFilesystemFileWrapper(file), nil
 }
 
-func (filesystemWrapper *FileSystemWrapperImpl) ReadDir(path string) ([]os.FileInfo, error) {
-	return filesystemWrapper.fileSystem.ReadDir(path)
+func (filesystemWrapper *FileSystemWrapperImpl) ReadDir(directoryPath string) ([]os.FileInfo, error) {
+	return filesystemWrapper.fileSystem.ReadDir(rootedPath(directoryPath))
 }
 
 func (filesystemWrapper *FileSystemWrapperImpl) GetFilesystemLabel() string {
 	return filesystemWrapper.fileSystem.Label()
 }
+
+// rootedPath resolves paths on a config drive from its root, the filesystems only accept absolute paths
+func rootedPath(filePath string) string {
+	return path.Join("/", filePath)
+}
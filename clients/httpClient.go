@@ -47,10 +47,55 @@ func NewClient(host string, username string, password string, verifyTls bool, aL
 	return &c
 }
 
+// NewClientWithTlsConfig - creates a client presenting its own tls configuration, used for certificate authentication
+func NewClientWithTlsConfig(host string, tlsConfig *tls.Config, aLogger *logrus.Logger) *Client {
+	if host == "" {
+		panic("Host Not Provided!!!!")
+	}
+
+	c := Client{
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		hostURL:               host,
+		enableTLSVerification: !tlsConfig.InsecureSkipVerify,
+		logger:                aLogger,
+		token:                 "",
+	}
+
+	return &c
+}
+
 func (c *Client) doRequest(req *http.Request, contentType string) ([]byte, error) {
 	return c.doRequestWithResponseStatus(req, http.StatusOK, contentType)
 }
 
+// doStreamingRequest copies the response body to writer instead of buffering it, used for large binary payloads
+func (c *Client) doStreamingRequest(req *http.Request, writer io.Writer) (int64, error) {
+	c.logger.Debug(fmt.Sprintf("Making streaming %s request to %s", req.Method, req.URL))
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		// the stream has been copied or refused by now, a failed close loses nothing
+		closeError := Body.Close()
+		if closeError != nil {
+			c.logger.Warn(fmt.Sprintf("Failed to close response body from %s: %s", req.URL.Path, closeError.Error()))
+		}
+	}(res.Body)
+
+	c.logger.Debug(fmt.Sprintf("status code was %d for url %s", res.StatusCode, req.URL.Path))
+	if res.StatusCode != http.StatusOK {
+		// bodies can echo request material back, only the status is logged and returned
+		c.logger.Error(fmt.Sprintf("statusCode: %d for url %s", res.StatusCode, req.URL.Path))
+		return 0, fmt.Errorf("status: %s", res.Status)
+	}
+
+	return io.Copy(writer, res.Body)
+}
+
 func (c *Client) doRequestWithResponseStatus(req *http.Request, expectedResponseStatus int, contentType string) ([]byte, error) {
 	c.logger.Debug(fmt.Sprintf("Making %s request to %s", req.Method, req.URL))
 	req.Header.Set("Accept", "application/json")
@@ -75,8 +120,9 @@ func (c *Client) doRequestWithResponseStatus(req *http.Request, expectedResponse
 
 	c.logger.Debug(fmt.Sprintf("status code was %d for url %s", res.StatusCode, req.URL.Path))
 	if res.StatusCode != expectedResponseStatus {
-		c.logger.Error(fmt.Sprintf("statusCode: %d, status:%s, body: %s", res.StatusCode, res.Status, body))
-		return body, fmt.Errorf("status: %s, body: %s", res.Status, body)
+		// bodies can echo request material back, only the status is logged and returned
+		c.logger.Error(fmt.Sprintf("statusCode: %d for url %s", res.StatusCode, req.URL.Path))
+		return body, fmt.Errorf("status: %s", res.Status)
 	}
 
 	return body, err
@@ -89,52 +89,36 @@ func (infraMapperClient *InfraConfigMapperClientImpl) GetVmDetailsByHostname() (
 }
 
 type ProxmoxVm struct {
-	Acpi                    bool     `json:"acpi"`
-	Bios                    string   `json:"bios"`
-	BootOrder               []string `json:"boot_order"`
-	CloudInitStorageName    string   `json:"cloud_init_storage_name"`
-	Cores                   float64  `json:"cores"`
-	CpuLimit                float64  `json:"cpu_limit"`
-	CpuType                 string   `json:"cpu_type"`
-	DefaultUser             string   `json:"default_user"`
-	Description             string   `json:"description"`
-	HostStartupOrder        float64  `json:"host_startup_order"`
-	Kvm                     bool     `json:"kvm"`
-	Memory                  float64  `json:"memory"`
-	Name                    string   `json:"name"`
-	Nameserver              string   `json:"nameserver"`
-	NodeName                string   `json:"node_name"`
-	NumaActive              bool     `json:"numa_active"`
-	OsType                  string   `json:"os_type"`
-	PerformCloudInitUpgrade bool     `json:"perform_cloud_init_upgrade"`
-	PowerState              string   `json:"power_state"`
-	Protection              bool     `json:"protection"`
-	QemuAgentEnabled        bool     `json:"qemu_agent_enabled"`
-	ScsiHw                  string   `json:"scsi_hw"`
-	Sockets                 float64  `json:"sockets"`
-	SshKeys                 []string `json:"ssh_keys"`
-	StartOnBoot             bool     `json:"start_on_boot"`
-	Tags                    []string `json:"tags"`
-	VmId                    string   `json:"vm_id"`
-	Vmgenid                 string   `json:"vmgenid"`
-	Disk                    []struct {
-		AsyncIo         string `json:"async_io"`
-		BackupEnabled   bool   `json:"backup_enabled"`
-		BusType         string `json:"bus_type"`
-		Cache           string `json:"cache"`
-		DiscardEnabled  bool   `json:"discard_enabled"`
-		Id              int    `json:"id"`
-		ImportFrom      string `json:"import_from"`
-		ImportPath      string `json:"import_path"`
-		IoThread        bool   `json:"io_thread"`
-		Order           int    `json:"order"`
-		ReadOnly        bool   `json:"read_only"`
-		Replicate       bool   `json:"replicate"`
-		Size            string `json:"size"`
-		SsdEmulation    bool   `json:"ssd_emulation"`
-		StorageLocation string `json:"storage_location"`
-	} `json:"disk"`
-	IpConfig []struct {
+	Acpi                    bool          `json:"acpi"`
+	Bios                    string        `json:"bios"`
+	BootOrder               []string      `json:"boot_order"`
+	CloudInitStorageName    string        `json:"cloud_init_storage_name"`
+	Cores                   float64       `json:"cores"`
+	CpuLimit                float64       `json:"cpu_limit"`
+	CpuType                 string        `json:"cpu_type"`
+	DefaultUser             string        `json:"default_user"`
+	Description             string        `json:"description"`
+	HostStartupOrder        float64       `json:"host_startup_order"`
+	Kvm                     bool          `json:"kvm"`
+	Memory                  float64       `json:"memory"`
+	Name                    string        `json:"name"`
+	Nameserver              string        `json:"nameserver"`
+	NodeName                string        `json:"node_name"`
+	NumaActive              bool          `json:"numa_active"`
+	OsType                  string        `json:"os_type"`
+	PerformCloudInitUpgrade bool          `json:"perform_cloud_init_upgrade"`
+	PowerState              string        `json:"power_state"`
+	Protection              bool          `json:"protection"`
+	QemuAgentEnabled        bool          `json:"qemu_agent_enabled"`
+	ScsiHw                  string        `json:"scsi_hw"`
+	Sockets                 float64       `json:"sockets"`
+	SshKeys                 []string      `json:"ssh_keys"`
+	StartOnBoot             bool          `json:"start_on_boot"`
+	Tags                    []string      `json:"tags"`
+	VmId                    string        `json:"vm_id"`
+	Vmgenid                 string        `json:"vmgenid"`
+	Disk                    []ProxmoxDisk `json:"disk"`
+	IpConfig                []struct {
 		Gateway   string `json:"gateway"`
 		IpAddress string `json:"ip_address"`
 		Order     int    `json:"order"`
@@ -148,3 +132,22 @@ type ProxmoxVm struct {
 		Type       string `json:"type"`
 	} `json:"network_interface"`
 }
+
+// ProxmoxDisk is a disk attached to the VM as <BusType><Id>, Order is how roles refer to it
+type ProxmoxDisk struct {
+	AsyncIo         string `json:"async_io"`
+	BackupEnabled   bool   `json:"backup_enabled"`
+	BusType         string `json:"bus_type"`
+	Cache           string `json:"cache"`
+	DiscardEnabled  bool   `json:"discard_enabled"`
+	Id              int    `json:"id"`
+	ImportFrom      string `json:"import_from"`
+	ImportPath      string `json:"import_path"`
+	IoThread        bool   `json:"io_thread"`
+	Order           int    `json:"order"`
+	ReadOnly        bool   `json:"read_only"`
+	Replicate       bool   `json:"replicate"`
+	Size            string `json:"size"`
+	SsdEmulation    bool   `json:"ssd_emulation"`
+	StorageLocation string `json:"storage_location"`
+}
@@ -0,0 +1,742 @@
+package clients
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/sirupsen/logrus"
+)
+
+const memoryMountInfoPath = "/proc/self/mountinfo"
+const maxSymlinkDepth = 40
+
+// MemoryNode is a file, directory or symlink of a MemoryOsClient
+type MemoryNode struct {
+	Mode     os.FileMode
+	Uid      int
+	Gid      int
+	Contents []byte
+	Target   string
+	Xattrs   map[string][]byte
+	ModTime  time.Time
+}
+
+// MemoryMount is a mount made through a MemoryOsClient
+type MemoryMount struct {
+	Device         string
+	Target         string
+	FilesystemType string
+	Options        string
+}
+
+// MemoryOsClient is an OsClient backed by memory so services and roles can be tested without root. It records the
+// modes, owners, extended attributes and mounts it is given rather than applying them, serves the disks added to it
+// and lists its mounts in /proc/self/mountinfo. Commands are recorded and succeed without output. Paths are absolute,
+// relative paths are taken from the root
+type MemoryOsClient struct {
+	lock     sync.Mutex
+	nodes    map[string]*MemoryNode
+	disks    map[string]DiskWrapper
+	images   map[string]string
+	mounts   []MemoryMount
+	commands [][]string
+}
+
+func NewMemoryOsClient() *MemoryOsClient {
+	return &MemoryOsClient{
+		nodes:  map[string]*MemoryNode{"/": {Mode: os.ModeDir | 0755}},
+		disks:  map[string]DiskWrapper{},
+		images: map[string]string{},
+	}
+}
+
+func (memoryClient *MemoryOsClient) initialize(logger *logrus.Logger) {}
+
+// AddDirectory creates a directory and any missing parents, which get mode 0755
+func (memoryClient *MemoryOsClient) AddDirectory(path string, mode os.FileMode) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	memoryClient.addNode(path, &MemoryNode{Mode: os.ModeDir | mode.Perm()})
+}
+
+// AddFile creates a file and any missing parent directories
+func (memoryClient *MemoryOsClient) AddFile(path string, contents []byte, mode os.FileMode) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	memoryClient.addNode(path, &MemoryNode{Mode: mode.Perm(), Contents: append([]byte{}, contents...)})
+}
+
+// AddSymlink creates a symlink pointing at target and any missing parent directories
+func (memoryClient *MemoryOsClient) AddSymlink(path string, target string) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	memoryClient.addNode(path, &MemoryNode{Mode: os.ModeSymlink | 0777, Target: target})
+}
+
+// AddDisk serves disk to OpenDisk and OpenDiskReadOnly at path. Add the raw device with AddFile for it to be probed
+func (memoryClient *MemoryOsClient) AddDisk(path string, disk DiskWrapper) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	memoryClient.disks[cleanMemoryPath(path)] = disk
+}
+
+// memoryConfigDriveSize fits the FAT32 minimum with room for the files of a config drive
+const memoryConfigDriveSize = 40 * 1024 * 1024
+
+// AddConfigDrive builds a FAT32 image labelled label at imagePath holding files, which may sit in subdirectories, and
+// attaches it as /dev/<name> the way a config drive is found by label
+func (memoryClient *MemoryOsClient) AddConfigDrive(imagePath string, name string, label string, files map[string]string) error {
+	configDisk, createError := diskfs.Create(imagePath, memoryConfigDriveSize, diskfs.SectorSizeDefault)
+
+	if createError != nil {
+		return createError
+	}
+
+	configFilesystem, formatError := configDisk.CreateFilesystem(disk.FilesystemSpec{FSType: filesystem.TypeFat32, VolumeLabel: label})
+
+	if formatError != nil {
+		return formatError
+	}
+
+	for fileName, contents := range files {
+		if directory := filepath.Dir("/" + fileName); directory != "/" {
+			mkdirError := configFilesystem.Mkdir(directory)
+
+			if mkdirError != nil {
+				return mkdirError
+			}
+		}
+
+		file, openError := configFilesystem.OpenFile("/"+fileName, os.O_CREATE|os.O_RDWR)
+
+		if openError != nil {
+			return openError
+		}
+
+		_, writeError := file.Write([]byte(contents))
+		closeError := file.Close()
+
+		if writeError != nil || closeError != nil {
+			return errors.Join(writeError, closeError)
+		}
+	}
+
+	closeError := configDisk.Close()
+
+	if closeError != nil {
+		return closeError
+	}
+
+	deviceBytes, readError := os.ReadFile(imagePath)
+
+	if readError != nil {
+		return readError
+	}
+
+	memoryClient.AddFile(filepath.Join("/sys/class/block", name), nil, 0644)
+	memoryClient.AddFile(filepath.Join("/dev", name), deviceBytes, 0660)
+
+	// every open gets its own disk, callers close the disks they are done with
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	memoryClient.images[cleanMemoryPath(filepath.Join("/dev", name))] = imagePath
+	return nil
+}
+
+// Node returns a copy of the node at path without following a final symlink
+func (memoryClient *MemoryOsClient) Node(path string) (MemoryNode, bool) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, false)
+
+	if lookupError != nil {
+		return MemoryNode{}, false
+	}
+	return copyMemoryNode(node), true
+}
+
+// ReadFile returns the contents of the file at path
+func (memoryClient *MemoryOsClient) ReadFile(path string) ([]byte, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, true)
+
+	if lookupError != nil {
+		return nil, pathError("open", path, lookupError)
+	}
+	return append([]byte{}, node.Contents...), nil
+}
+
+// Mounts lists the mounts made, in order
+func (memoryClient *MemoryOsClient) Mounts() []MemoryMount {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	return append([]MemoryMount{}, memoryClient.mounts...)
+}
+
+// Commands returns the arguments of every command run, the command path first
+func (memoryClient *MemoryOsClient) Commands() [][]string {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	return append([][]string{}, memoryClient.commands...)
+}
+
+func (memoryClient *MemoryOsClient) StatFile(path string) (os.FileInfo, error) {
+	return memoryClient.stat("stat", path, true)
+}
+
+func (memoryClient *MemoryOsClient) LstatFile(path string) (os.FileInfo, error) {
+	return memoryClient.stat("lstat", path, false)
+}
+
+func (memoryClient *MemoryOsClient) EvalSymlinks(path string) (string, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	_, resolvedPath, lookupError := memoryClient.lookup(path, true)
+
+	if lookupError != nil {
+		return "", pathError("lstat", path, lookupError)
+	}
+	return resolvedPath, nil
+}
+
+func (memoryClient *MemoryOsClient) Symlink(target string, path string) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	return memoryClient.createNode("symlink", path, &MemoryNode{Mode: os.ModeSymlink | 0777, Target: target}, false)
+}
+
+func (memoryClient *MemoryOsClient) ReadLink(path string) (string, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, false)
+
+	if lookupError != nil {
+		return "", pathError("readlink", path, lookupError)
+	} else if node.Mode&os.ModeSymlink == 0 {
+		return "", pathError("readlink", path, syscall.EINVAL)
+	}
+	return node.Target, nil
+}
+
+func (memoryClient *MemoryOsClient) Mkdir(path string, permissions int) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	return memoryClient.createNode("mkdir", path, &MemoryNode{Mode: os.ModeDir | os.FileMode(permissions).Perm()}, false)
+}
+
+func (memoryClient *MemoryOsClient) OpenDisk(path string) (DiskWrapper, error) {
+	return memoryClient.OpenDiskReadOnly(path)
+}
+
+func (memoryClient *MemoryOsClient) OpenDiskReadOnly(path string) (DiskWrapper, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	disk, known := memoryClient.disks[cleanMemoryPath(path)]
+
+	if known {
+		return disk, nil
+	}
+
+	imagePath, known := memoryClient.images[cleanMemoryPath(path)]
+
+	if !known {
+		return nil, pathError("open", path, syscall.ENOENT)
+	}
+
+	imageDisk, openError := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+
+	if openError != nil {
+		return nil, openError
+	}
+	return NewDiskWrapper(imageDisk), nil
+}
+
+func (memoryClient *MemoryOsClient) CreateFile(path string, permissions int) (FileWrapper, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+
+	node, _, lookupError := memoryClient.lookup(path, true)
+	if lookupError == nil && node.Mode.IsDir() {
+		return nil, pathError("open", path, syscall.EISDIR)
+	} else if lookupError == nil {
+		node.Contents = nil
+		node.ModTime = time.Now()
+		return &memoryFile{client: memoryClient, node: node}, nil
+	}
+
+	node = &MemoryNode{Mode: os.FileMode(permissions).Perm()}
+	createError := memoryClient.createNode("open", path, node, true)
+
+	if createError != nil {
+		return nil, createError
+	}
+	return &memoryFile{client: memoryClient, node: node}, nil
+}
+
+func (memoryClient *MemoryOsClient) SetOwner(path string, ownerId int, groupId int) error {
+	return memoryClient.update("chown", path, true, func(node *MemoryNode) error {
+		setMemoryOwner(node, ownerId, groupId)
+		return nil
+	})
+}
+
+func (memoryClient *MemoryOsClient) SetLinkOwner(path string, ownerId int, groupId int) error {
+	return memoryClient.update("lchown", path, false, func(node *MemoryNode) error {
+		setMemoryOwner(node, ownerId, groupId)
+		return nil
+	})
+}
+
+func (memoryClient *MemoryOsClient) ReadDir(path string) ([]os.DirEntry, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, resolvedPath, lookupError := memoryClient.lookup(path, true)
+
+	if lookupError != nil {
+		return nil, pathError("open", path, lookupError)
+	} else if !node.Mode.IsDir() {
+		return nil, pathError("readdirent", path, syscall.ENOTDIR)
+	}
+
+	var entries []os.DirEntry
+	for _, childPath := range memoryClient.children(resolvedPath) {
+		entries = append(entries, fs.FileInfoToDirEntry(&memoryFileInfo{name: filepath.Base(childPath), node: copyMemoryNode(memoryClient.nodes[childPath])}))
+	}
+	return entries, nil
+}
+
+func (memoryClient *MemoryOsClient) SetPermissions(path string, permissions int) error {
+	return memoryClient.update("chmod", path, true, func(node *MemoryNode) error {
+		node.Mode = node.Mode.Type() | os.FileMode(permissions).Perm()
+		return nil
+	})
+}
+
+func (memoryClient *MemoryOsClient) OpenFile(path string) (HostFile, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, true)
+
+	if lookupError != nil && cleanMemoryPath(path) == memoryMountInfoPath {
+		return &memoryReader{Reader: bytes.NewReader(memoryClient.mountInfo())}, nil
+	} else if lookupError != nil {
+		return nil, pathError("open", path, lookupError)
+	}
+	return &memoryReader{Reader: bytes.NewReader(append([]byte{}, node.Contents...))}, nil
+}
+
+func (memoryClient *MemoryOsClient) WriteFile(path string, data []byte, permissions int) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+
+	node, _, lookupError := memoryClient.lookup(path, true)
+	if lookupError == nil && node.Mode.IsDir() {
+		return pathError("open", path, syscall.EISDIR)
+	} else if lookupError == nil {
+		node.Contents = append([]byte{}, data...)
+		node.ModTime = time.Now()
+		return nil
+	}
+	return memoryClient.createNode("open", path, &MemoryNode{Mode: os.FileMode(permissions).Perm(), Contents: append([]byte{}, data...)}, true)
+}
+
+func (memoryClient *MemoryOsClient) Mount(device string, target string, filesystemType string, options string) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, resolvedTarget, lookupError := memoryClient.lookup(target, true)
+
+	if lookupError != nil {
+		return pathError("mount", target, lookupError)
+	} else if !node.Mode.IsDir() {
+		return pathError("mount", target, syscall.ENOTDIR)
+	}
+	memoryClient.mounts = append(memoryClient.mounts, MemoryMount{Device: device, Target: resolvedTarget, FilesystemType: filesystemType, Options: options})
+	return nil
+}
+
+func (memoryClient *MemoryOsClient) RunCommand(command *exec.Cmd) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	memoryClient.commands = append(memoryClient.commands, append([]string{command.Path}, command.Args[1:]...))
+	return nil
+}
+
+func (memoryClient *MemoryOsClient) Rename(oldPath string, newPath string) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+
+	_, resolvedOld, lookupError := memoryClient.lookup(oldPath, false)
+	if lookupError != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: lookupError}
+	}
+
+	resolvedNew := memoryClient.resolveParent(newPath)
+	if parent, exists := memoryClient.nodes[filepath.Dir(resolvedNew)]; !exists || !parent.Mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.ENOENT}
+	} else if existing, exists := memoryClient.nodes[resolvedNew]; exists && existing.Mode.IsDir() && len(memoryClient.children(resolvedNew)) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.ENOTEMPTY}
+	}
+
+	moved := map[string]*MemoryNode{}
+	for nodePath, node := range memoryClient.nodes {
+		if nodePath == resolvedOld || strings.HasPrefix(nodePath, resolvedOld+"/") {
+			moved[resolvedNew+strings.TrimPrefix(nodePath, resolvedOld)] = node
+			delete(memoryClient.nodes, nodePath)
+		}
+	}
+	for nodePath, node := range moved {
+		memoryClient.nodes[nodePath] = node
+	}
+	return nil
+}
+
+func (memoryClient *MemoryOsClient) Remove(path string) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, resolvedPath, lookupError := memoryClient.lookup(path, false)
+
+	if lookupError != nil {
+		return pathError("remove", path, lookupError)
+	} else if node.Mode.IsDir() && len(memoryClient.children(resolvedPath)) > 0 {
+		return pathError("remove", path, syscall.ENOTEMPTY)
+	}
+	delete(memoryClient.nodes, resolvedPath)
+	return nil
+}
+
+func (memoryClient *MemoryOsClient) RemoveAll(path string) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	resolvedPath := memoryClient.resolveParent(path)
+
+	for nodePath := range memoryClient.nodes {
+		if nodePath != "/" && (nodePath == resolvedPath || strings.HasPrefix(nodePath, resolvedPath+"/")) {
+			delete(memoryClient.nodes, nodePath)
+		}
+	}
+	return nil
+}
+
+func (memoryClient *MemoryOsClient) SetModTime(path string, modTime time.Time) error {
+	return memoryClient.update("chtimes", path, true, func(node *MemoryNode) error {
+		node.ModTime = modTime
+		return nil
+	})
+}
+
+func (memoryClient *MemoryOsClient) GetXattr(path string, name string) ([]byte, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, false)
+
+	if lookupError != nil {
+		return nil, lookupError
+	}
+
+	value, isSet := node.Xattrs[name]
+	if !isSet {
+		return nil, syscall.ENODATA
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (memoryClient *MemoryOsClient) SetXattr(path string, name string, value []byte) error {
+	return memoryClient.update("lsetxattr", path, false, func(node *MemoryNode) error {
+		if node.Xattrs == nil {
+			node.Xattrs = map[string][]byte{}
+		}
+		node.Xattrs[name] = append([]byte{}, value...)
+		return nil
+	})
+}
+
+func (memoryClient *MemoryOsClient) ListXattrs(path string) ([]string, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, false)
+
+	if lookupError != nil {
+		return nil, lookupError
+	}
+
+	var names []string
+	for name := range node.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (memoryClient *MemoryOsClient) RemoveXattr(path string, name string) error {
+	return memoryClient.update("lremovexattr", path, false, func(node *MemoryNode) error {
+		if _, isSet := node.Xattrs[name]; !isSet {
+			return syscall.ENODATA
+		}
+		delete(node.Xattrs, name)
+		return nil
+	})
+}
+
+func (memoryClient *MemoryOsClient) stat(operation string, path string, followSymlink bool) (os.FileInfo, error) {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, resolvedPath, lookupError := memoryClient.lookup(path, followSymlink)
+
+	if lookupError != nil {
+		return nil, pathError(operation, path, lookupError)
+	}
+	return &memoryFileInfo{name: filepath.Base(resolvedPath), node: copyMemoryNode(node)}, nil
+}
+
+// update applies change to the node at path under the lock
+func (memoryClient *MemoryOsClient) update(operation string, path string, followSymlink bool, change func(node *MemoryNode) error) error {
+	memoryClient.lock.Lock()
+	defer memoryClient.lock.Unlock()
+	node, _, lookupError := memoryClient.lookup(path, followSymlink)
+
+	if lookupError != nil {
+		return pathError(operation, path, lookupError)
+	}
+
+	changeError := change(node)
+
+	if changeError != nil {
+		return pathError(operation, path, changeError)
+	}
+	return nil
+}
+
+// addNode creates node at path along with any missing parents, replacing what is there
+func (memoryClient *MemoryOsClient) addNode(path string, node *MemoryNode) {
+	resolvedPath := memoryClient.resolveParent(path)
+	for parent := filepath.Dir(resolvedPath); parent != "/"; parent = filepath.Dir(parent) {
+		if _, exists := memoryClient.nodes[parent]; !exists {
+			memoryClient.nodes[parent] = &MemoryNode{Mode: os.ModeDir | 0755}
+		}
+	}
+	node.ModTime = time.Now()
+	memoryClient.nodes[resolvedPath] = node
+}
+
+// createNode creates node at path, whose parent has to be an existing directory
+func (memoryClient *MemoryOsClient) createNode(operation string, path string, node *MemoryNode, replace bool) error {
+	resolvedPath := memoryClient.resolveParent(path)
+
+	if parent, exists := memoryClient.nodes[filepath.Dir(resolvedPath)]; !exists {
+		return pathError(operation, path, syscall.ENOENT)
+	} else if !parent.Mode.IsDir() {
+		return pathError(operation, path, syscall.ENOTDIR)
+	} else if _, exists := memoryClient.nodes[resolvedPath]; exists && !replace {
+		return pathError(operation, path, syscall.EEXIST)
+	}
+
+	node.ModTime = time.Now()
+	memoryClient.nodes[resolvedPath] = node
+	return nil
+}
+
+// lookup finds the node at path, following symlinks in its directories and, when followSymlink, the path itself
+func (memoryClient *MemoryOsClient) lookup(path string, followSymlink bool) (*MemoryNode, string, error) {
+	resolvedPath, resolveError := memoryClient.resolve(cleanMemoryPath(path), followSymlink, 0)
+
+	if resolveError != nil {
+		return nil, "", resolveError
+	}
+
+	node, exists := memoryClient.nodes[resolvedPath]
+	if !exists {
+		return nil, resolvedPath, syscall.ENOENT
+	}
+	return node, resolvedPath, nil
+}
+
+// resolveParent resolves the symlinks in the directories of path, missing directories are left as they are
+func (memoryClient *MemoryOsClient) resolveParent(path string) string {
+	resolvedPath, resolveError := memoryClient.resolve(cleanMemoryPath(path), false, 0)
+
+	if resolveError != nil {
+		return cleanMemoryPath(path)
+	}
+	return resolvedPath
+}
+
+func (memoryClient *MemoryOsClient) resolve(path string, followSymlink bool, depth int) (string, error) {
+	if depth > maxSymlinkDepth {
+		return "", syscall.ELOOP
+	}
+
+	components := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	current := "/"
+	for index, component := range components {
+		if component == "" {
+			continue
+		}
+
+		next := filepath.Join(current, component)
+		node, exists := memoryClient.nodes[next]
+		isLast := index == len(components)-1
+
+		if !exists {
+			return filepath.Join(append([]string{next}, components[index+1:]...)...), nil
+		} else if node.Mode&os.ModeSymlink != 0 && (!isLast || followSymlink) {
+			target := node.Target
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(current, target)
+			}
+			return memoryClient.resolve(filepath.Join(append([]string{target}, components[index+1:]...)...), followSymlink, depth+1)
+		} else if !isLast && !node.Mode.IsDir() {
+			return "", syscall.ENOTDIR
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func (memoryClient *MemoryOsClient) children(directory string) []string {
+	var childPaths []string
+	for nodePath := range memoryClient.nodes {
+		if nodePath != "/" && filepath.Dir(nodePath) == directory {
+			childPaths = append(childPaths, nodePath)
+		}
+	}
+	sort.Strings(childPaths)
+	return childPaths
+}
+
+// mountInfo lists the mounts in the format of /proc/self/mountinfo
+func (memoryClient *MemoryOsClient) mountInfo() []byte {
+	var mountInfo bytes.Buffer
+	for index, mount := range memoryClient.mounts {
+		options := mount.Options
+		if options == "" {
+			options = "rw"
+		}
+		fmt.Fprintf(&mountInfo, "%d 1 0:%d / %s %s - %s %s rw\n", 100+index, 100+index, mount.Target, options, mount.FilesystemType, mount.Device)
+	}
+	return mountInfo.Bytes()
+}
+
+func cleanMemoryPath(path string) string {
+	return filepath.Clean("/" + path)
+}
+
+func pathError(operation string, path string, err error) error {
+	return &os.PathError{Op: operation, Path: path, Err: err}
+}
+
+func setMemoryOwner(node *MemoryNode, ownerId int, groupId int) {
+	if ownerId != -1 {
+		node.Uid = ownerId
+	}
+	if groupId != -1 {
+		node.Gid = groupId
+	}
+}
+
+func copyMemoryNode(node *MemoryNode) MemoryNode {
+	copied := *node
+	copied.Contents = append([]byte{}, node.Contents...)
+	copied.Xattrs = map[string][]byte{}
+	for name, value := range node.Xattrs {
+		copied.Xattrs[name] = append([]byte{}, value...)
+	}
+	return copied
+}
+
+type memoryFileInfo struct {
+	name string
+	node MemoryNode
+}
+
+func (fileInfo *memoryFileInfo) Name() string       { return fileInfo.name }
+func (fileInfo *memoryFileInfo) Mode() os.FileMode  { return fileInfo.node.Mode }
+func (fileInfo *memoryFileInfo) ModTime() time.Time { return fileInfo.node.ModTime }
+func (fileInfo *memoryFileInfo) IsDir() bool        { return fileInfo.node.Mode.IsDir() }
+
+func (fileInfo *memoryFileInfo) Size() int64 {
+	if fileInfo.node.Mode&os.ModeSymlink != 0 {
+		return int64(len(fileInfo.node.Target))
+	}
+	return int64(len(fileInfo.node.Contents))
+}
+
+// Sys describes the owner the way the host does so ownership can be compared
+func (fileInfo *memoryFileInfo) Sys() any {
+	return &syscall.Stat_t{Uid: uint32(fileInfo.node.Uid), Gid: uint32(fileInfo.node.Gid), Size: fileInfo.Size()}
+}
+
+// memoryFile is a file created through a MemoryOsClient, writes land in the node as they are made
+type memoryFile struct {
+	client *MemoryOsClient
+	node   *MemoryNode
+	offset int64
+}
+
+func (file *memoryFile) Write(toBeWritten []byte) (int, error) {
+	file.client.lock.Lock()
+	defer file.client.lock.Unlock()
+
+	end := file.offset + int64(len(toBeWritten))
+	if end > int64(len(file.node.Contents)) {
+		file.node.Contents = append(file.node.Contents, make([]byte, end-int64(len(file.node.Contents)))...)
+	}
+	copy(file.node.Contents[file.offset:], toBeWritten)
+	file.offset = end
+	file.node.ModTime = time.Now()
+	return len(toBeWritten), nil
+}
+
+func (file *memoryFile) Read(readBuffer []byte) (int, error) {
+	file.client.lock.Lock()
+	defer file.client.lock.Unlock()
+
+	if file.offset >= int64(len(file.node.Contents)) {
+		return 0, io.EOF
+	}
+	bytesRead := copy(readBuffer, file.node.Contents[file.offset:])
+	file.offset += int64(bytesRead)
+	return bytesRead, nil
+}
+
+func (file *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	file.client.lock.Lock()
+	defer file.client.lock.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		offset += int64(len(file.node.Contents))
+	}
+
+	if offset < 0 {
+		return file.offset, syscall.EINVAL
+	}
+	file.offset = offset
+	return offset, nil
+}
+
+func (file *memoryFile) Close() error { return nil }
+
+func (file *memoryFile) Sync() error { return nil }
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (reader *memoryReader) Close() error { return nil }
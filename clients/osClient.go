@@ -1,11 +1,18 @@
 package clients
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/diskfs/go-diskfs"
+	"github.com/moby/sys/mount"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 type OsClient interface {
@@ -13,11 +20,36 @@ type OsClient interface {
 	StatFile(path string) (os.FileInfo, error)
 	Mkdir(path string, permissions int) error
 	OpenDisk(path string) (DiskWrapper, error)
-	CreateFile(path string) (FileWrapper, error)
+	OpenDiskReadOnly(path string) (DiskWrapper, error)
+	CreateFile(path string, permissions int) (FileWrapper, error)
 	SetOwner(path string, ownerId int, groupId int) error
+	SetLinkOwner(path string, ownerId int, groupId int) error
+	LstatFile(path string) (os.FileInfo, error)
+	EvalSymlinks(path string) (string, error)
+	Symlink(target string, path string) error
+	ReadLink(path string) (string, error)
 	ReadDir(path string) ([]os.DirEntry, error)
 	SetPermissions(path string, permissions int) error
-	OpenFile(path string) (*os.File, error)
+	OpenFile(path string) (HostFile, error)
+	WriteFile(path string, data []byte, permissions int) error
+	Mount(device string, target string, filesystemType string, options string) error
+	Rename(oldPath string, newPath string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	SetModTime(path string, modTime time.Time) error
+	GetXattr(path string, name string) ([]byte, error)
+	SetXattr(path string, name string, value []byte) error
+	ListXattrs(path string) ([]string, error)
+	RemoveXattr(path string, name string) error
+	RunCommand(command *exec.Cmd) error
+}
+
+// HostFile is a file of the host opened for reading, block devices are read at offsets
+type HostFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
 }
 
 type OsClientImpl struct {
@@ -38,8 +70,9 @@ func (osClient *OsClientImpl) StatFile(path string) (os.FileInfo, error) {
 	return fileInfo, nil
 }
 
+// Mkdir creates path with permissions before the umask is applied, callers that need the exact mode set it afterwards
 func (osClient *OsClientImpl) Mkdir(path string, permissions int) error {
-	return os.Mkdir(path, 0755)
+	return os.Mkdir(path, os.FileMode(permissions))
 }
 
 func (osClient *OsClientImpl) OpenDisk(path string) (DiskWrapper, error) {
@@ -51,11 +84,22 @@ func (osClient *OsClientImpl) OpenDisk(path string) (DiskWrapper, error) {
 	return NewDiskWrapper(openedDisk), nil
 }
 
-func (osClient *OsClientImpl) CreateFile(path string) (FileWrapper, error) {
+// OpenDiskReadOnly opens a disk without exclusive access, so devices that are mounted or read only can be probed
+func (osClient *OsClientImpl) OpenDiskReadOnly(path string) (DiskWrapper, error) {
+	openedDisk, getDiskError := diskfs.Open(path, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if getDiskError != nil {
+		return nil, getDiskError
+	}
+
+	return NewDiskWrapper(openedDisk), nil
+}
+
+// CreateFile creates or truncates a file, permissions only apply to a file that did not exist
+func (osClient *OsClientImpl) CreateFile(path string, permissions int) (FileWrapper, error) {
 	sanitizedPath := strings.ReplaceAll(path, "//", "/")
 	osClient.logger.Debugf("Creating file %s", sanitizedPath)
 
-	file, getFileError := os.Create(sanitizedPath)
+	file, getFileError := os.OpenFile(sanitizedPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(permissions))
 
 	if getFileError != nil {
 		return nil, getFileError
@@ -68,6 +112,29 @@ func (osClient *OsClientImpl) SetOwner(path string, ownerId int, groupId int) er
 	return os.Chown(path, ownerId, groupId)
 }
 
+// SetLinkOwner changes the owner of a symlink itself rather than of its target
+func (osClient *OsClientImpl) SetLinkOwner(path string, ownerId int, groupId int) error {
+	return os.Lchown(path, ownerId, groupId)
+}
+
+// LstatFile describes a symlink itself rather than its target
+func (osClient *OsClientImpl) LstatFile(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+// EvalSymlinks resolves every symlink in path, which has to exist
+func (osClient *OsClientImpl) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+func (osClient *OsClientImpl) Symlink(target string, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (osClient *OsClientImpl) ReadLink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
 func (osClient *OsClientImpl) ReadDir(path string) ([]os.DirEntry, error) {
 	return os.ReadDir(path)
 }
@@ -76,6 +143,98 @@ func (osClient *OsClientImpl) SetPermissions(path string, permissions int) error
 	return os.Chmod(path, os.FileMode(permissions))
 }
 
-func (osClient *OsClientImpl) OpenFile(path string) (*os.File, error) {
-	return os.Open(path)
+func (osClient *OsClientImpl) OpenFile(path string) (HostFile, error) {
+	file, openFileError := os.Open(path)
+
+	if openFileError != nil {
+		return nil, openFileError
+	}
+	return file, nil
+}
+
+func (osClient *OsClientImpl) WriteFile(path string, data []byte, permissions int) error {
+	return os.WriteFile(path, data, os.FileMode(permissions))
+}
+
+func (osClient *OsClientImpl) Mount(device string, target string, filesystemType string, options string) error {
+	return mount.Mount(device, target, filesystemType, options)
+}
+
+// RunCommand runs command on the running system with the stdin, stdout and stderr it was given
+func (osClient *OsClientImpl) RunCommand(command *exec.Cmd) error {
+	return command.Run()
+}
+
+// CombinedOutput runs command through client and returns its stdout and stderr interleaved, like
+// exec.Cmd.CombinedOutput
+func CombinedOutput(client OsClient, command *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	command.Stdout = &output
+	command.Stderr = &output
+
+	runError := client.RunCommand(command)
+	return output.Bytes(), runError
+}
+
+func (osClient *OsClientImpl) Rename(oldPath string, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osClient *OsClientImpl) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (osClient *OsClientImpl) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osClient *OsClientImpl) SetModTime(path string, modTime time.Time) error {
+	return os.Chtimes(path, modTime, modTime)
+}
+
+func (osClient *OsClientImpl) GetXattr(path string, name string) ([]byte, error) {
+	size, getSizeError := unix.Lgetxattr(path, name, nil)
+
+	if getSizeError != nil {
+		return nil, getSizeError
+	}
+
+	value := make([]byte, size)
+	size, getXattrError := unix.Lgetxattr(path, name, value)
+
+	if getXattrError != nil {
+		return nil, getXattrError
+	}
+	return value[:size], nil
+}
+
+func (osClient *OsClientImpl) SetXattr(path string, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+func (osClient *OsClientImpl) ListXattrs(path string) ([]string, error) {
+	size, getSizeError := unix.Llistxattr(path, nil)
+
+	if getSizeError != nil {
+		return nil, getSizeError
+	}
+
+	names := make([]byte, size)
+	size, listXattrError := unix.Llistxattr(path, names)
+
+	if listXattrError != nil {
+		return nil, listXattrError
+	}
+
+	var xattrs []string
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) > 0 {
+			xattrs = append(xattrs, string(name))
+		}
+	}
+	return xattrs, nil
+}
+
+func (osClient *OsClientImpl) RemoveXattr(path string, name string) error {
+	return unix.Lremovexattr(path, name)
 }
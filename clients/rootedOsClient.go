@@ -0,0 +1,371 @@
+package clients
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// hostPathPrefixes are the kernel interfaces of the running system, a rooted client never takes them from its root
+var hostPathPrefixes = []string{"/dev", "/proc", "/sys"}
+
+// ErrHostRoot is returned for operations that would change the running system rather than the root, commands,
+// writable disks and mounts of its devices
+var ErrHostRoot = errors.New("not available under a host root")
+
+// RootedOsClient is an OsClient that treats root as / so roles can be applied to a mounted image or chroot. Symlinks
+// are resolved within root as they would be after a chroot, an absolute link in an image cannot lead out of it.
+// Paths under /dev, /proc and /sys are passed to the wrapped client as they are since they describe the running
+// system, so mounts are still listed with their host paths. Commands are never run and devices of the running system
+// are only opened read only, see ErrHostRoot
+type RootedOsClient struct {
+	root   string
+	client OsClient
+}
+
+func NewRootedOsClient(root string, client OsClient) *RootedOsClient {
+	return &RootedOsClient{root: filepath.Clean(root), client: client}
+}
+
+func (rootedClient *RootedOsClient) initialize(logger *logrus.Logger) {
+	rootedClient.client.initialize(logger)
+}
+
+// Root returns the host path that is / for this client
+func (rootedClient *RootedOsClient) Root() string {
+	return rootedClient.root
+}
+
+func (rootedClient *RootedOsClient) StatFile(path string) (os.FileInfo, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.StatFile(hostPath)
+}
+
+func (rootedClient *RootedOsClient) LstatFile(path string) (os.FileInfo, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.LstatFile(hostPath)
+}
+
+// EvalSymlinks resolves every symlink in path within root and returns the result as a path of the root
+func (rootedClient *RootedOsClient) EvalSymlinks(path string) (string, error) {
+	cleanPath := filepath.Clean("/" + path)
+	if isHostPath(cleanPath) {
+		return rootedClient.client.EvalSymlinks(cleanPath)
+	}
+
+	resolvedPath, resolveError := rootedClient.resolve(cleanPath, true, 0)
+
+	if resolveError != nil {
+		return "", &os.PathError{Op: "lstat", Path: path, Err: resolveError}
+	}
+
+	_, statError := rootedClient.client.LstatFile(filepath.Join(rootedClient.root, resolvedPath))
+
+	if statError != nil {
+		return "", statError
+	}
+	return resolvedPath, nil
+}
+
+// Symlink creates a link at path, target is stored as it is and so is resolved within root
+func (rootedClient *RootedOsClient) Symlink(target string, path string) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.Symlink(target, hostPath)
+}
+
+func (rootedClient *RootedOsClient) ReadLink(path string) (string, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return "", resolveError
+	}
+	return rootedClient.client.ReadLink(hostPath)
+}
+
+func (rootedClient *RootedOsClient) Mkdir(path string, permissions int) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.Mkdir(hostPath, permissions)
+}
+
+func (rootedClient *RootedOsClient) OpenDisk(path string) (DiskWrapper, error) {
+	if isHostPath(filepath.Clean("/" + path)) {
+		return nil, fmt.Errorf("refusing to open %s for writing under host root %s: %w", path, rootedClient.root, ErrHostRoot)
+	}
+
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.OpenDisk(hostPath)
+}
+
+func (rootedClient *RootedOsClient) OpenDiskReadOnly(path string) (DiskWrapper, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.OpenDiskReadOnly(hostPath)
+}
+
+func (rootedClient *RootedOsClient) CreateFile(path string, permissions int) (FileWrapper, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.CreateFile(hostPath, permissions)
+}
+
+func (rootedClient *RootedOsClient) SetOwner(path string, ownerId int, groupId int) error {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.SetOwner(hostPath, ownerId, groupId)
+}
+
+func (rootedClient *RootedOsClient) SetLinkOwner(path string, ownerId int, groupId int) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.SetLinkOwner(hostPath, ownerId, groupId)
+}
+
+func (rootedClient *RootedOsClient) ReadDir(path string) ([]os.DirEntry, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.ReadDir(hostPath)
+}
+
+func (rootedClient *RootedOsClient) SetPermissions(path string, permissions int) error {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.SetPermissions(hostPath, permissions)
+}
+
+func (rootedClient *RootedOsClient) OpenFile(path string) (HostFile, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.OpenFile(hostPath)
+}
+
+func (rootedClient *RootedOsClient) WriteFile(path string, data []byte, permissions int) error {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.WriteFile(hostPath, data, permissions)
+}
+
+// Mount mounts device at target within root, a device given as a path is looked up like any other path
+func (rootedClient *RootedOsClient) Mount(device string, target string, filesystemType string, options string) error {
+	if isHostPath(filepath.Clean(device)) {
+		return fmt.Errorf("refusing to mount %s under host root %s: %w", device, rootedClient.root, ErrHostRoot)
+	}
+
+	if filepath.IsAbs(device) {
+		hostDevice, resolveError := rootedClient.hostPath(device, true)
+
+		if resolveError != nil {
+			return resolveError
+		}
+		device = hostDevice
+	}
+
+	hostTarget, resolveError := rootedClient.hostPath(target, true)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.Mount(device, hostTarget, filesystemType, options)
+}
+
+// RunCommand refuses every command, a command acts on the running system whatever root it is given
+func (rootedClient *RootedOsClient) RunCommand(command *exec.Cmd) error {
+	return fmt.Errorf("refusing to run %s under host root %s: %w", command.Path, rootedClient.root, ErrHostRoot)
+}
+
+func (rootedClient *RootedOsClient) Rename(oldPath string, newPath string) error {
+	oldHostPath, resolveError := rootedClient.hostPath(oldPath, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+
+	newHostPath, resolveError := rootedClient.hostPath(newPath, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.Rename(oldHostPath, newHostPath)
+}
+
+func (rootedClient *RootedOsClient) Remove(path string) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.Remove(hostPath)
+}
+
+func (rootedClient *RootedOsClient) RemoveAll(path string) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.RemoveAll(hostPath)
+}
+
+func (rootedClient *RootedOsClient) SetModTime(path string, modTime time.Time) error {
+	hostPath, resolveError := rootedClient.hostPath(path, true)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.SetModTime(hostPath, modTime)
+}
+
+func (rootedClient *RootedOsClient) GetXattr(path string, name string) ([]byte, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.GetXattr(hostPath, name)
+}
+
+func (rootedClient *RootedOsClient) SetXattr(path string, name string, value []byte) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.SetXattr(hostPath, name, value)
+}
+
+func (rootedClient *RootedOsClient) ListXattrs(path string) ([]string, error) {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+	return rootedClient.client.ListXattrs(hostPath)
+}
+
+func (rootedClient *RootedOsClient) RemoveXattr(path string, name string) error {
+	hostPath, resolveError := rootedClient.hostPath(path, false)
+
+	if resolveError != nil {
+		return resolveError
+	}
+	return rootedClient.client.RemoveXattr(hostPath, name)
+}
+
+// hostPath maps path onto the host, resolving its symlinks within root and, when followSymlink, the path itself
+func (rootedClient *RootedOsClient) hostPath(path string, followSymlink bool) (string, error) {
+	cleanPath := filepath.Clean("/" + path)
+	if isHostPath(cleanPath) {
+		return cleanPath, nil
+	}
+
+	resolvedPath, resolveError := rootedClient.resolve(cleanPath, followSymlink, 0)
+
+	if resolveError != nil {
+		return "", &os.PathError{Op: "lstat", Path: filepath.Join(rootedClient.root, cleanPath), Err: resolveError}
+	}
+	return filepath.Join(rootedClient.root, resolvedPath), nil
+}
+
+// resolve follows the symlinks of path, a path of the root, one component at a time. Missing components are left
+// as they are so paths about to be created resolve too
+func (rootedClient *RootedOsClient) resolve(path string, followSymlink bool, depth int) (string, error) {
+	if depth > maxSymlinkDepth {
+		return "", syscall.ELOOP
+	}
+
+	components := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	current := "/"
+	for index, component := range components {
+		if component == "" {
+			continue
+		}
+
+		next := filepath.Join(current, component)
+		isLast := index == len(components)-1
+		fileInfo, statError := rootedClient.client.LstatFile(filepath.Join(rootedClient.root, next))
+
+		if errors.Is(statError, fs.ErrNotExist) {
+			return filepath.Join(append([]string{next}, components[index+1:]...)...), nil
+		} else if statError != nil {
+			return "", statError
+		}
+
+		if fileInfo.Mode()&os.ModeSymlink != 0 && (!isLast || followSymlink) {
+			target, readLinkError := rootedClient.client.ReadLink(filepath.Join(rootedClient.root, next))
+
+			if readLinkError != nil {
+				return "", readLinkError
+			}
+
+			// joining onto / drops any .. that would climb out of the root
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(current, target)
+			}
+			return rootedClient.resolve(filepath.Join(append([]string{"/", target}, components[index+1:]...)...), followSymlink, depth+1)
+		} else if !isLast && !fileInfo.IsDir() {
+			return "", syscall.ENOTDIR
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func isHostPath(path string) bool {
+	for _, prefix := range hostPathPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
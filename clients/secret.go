@@ -0,0 +1,162 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redactedPlaceholder = "[REDACTED]"
+
+// secrets shorter than this are not redacted from logs, replacing every occurrence of a couple of characters
+// would mangle log lines without hiding anything useful
+const minimumRedactedLength = 4
+
+var secretRegistry = struct {
+	lock    sync.RWMutex
+	secrets map[*Secret]struct{}
+}{secrets: make(map[*Secret]struct{})}
+
+// Secret holds sensitive material such as unseal keys, tokens and private keys. It always formats as a placeholder
+// so it cannot leak through fmt or json, and its value is redacted from every log entry while it is registered
+type Secret struct {
+	value []byte
+}
+
+// NewSecret takes ownership of value, surrounding whitespace is trimmed and the secret is registered for
+// redaction until Destroy is called
+func NewSecret(value []byte) *Secret {
+	secret := &Secret{value: bytes.TrimSpace(value)}
+	secret.register()
+	return secret
+}
+
+func (secret *Secret) register() {
+	if len(secret.value) >= minimumRedactedLength {
+		secretRegistry.lock.Lock()
+		secretRegistry.secrets[secret] = struct{}{}
+		secretRegistry.lock.Unlock()
+	}
+}
+
+// Bytes returns the secret value itself, callers must not keep or log it
+func (secret *Secret) Bytes() []byte {
+	if secret == nil {
+		return nil
+	}
+	return secret.value
+}
+
+// Reveal returns the value as a string for apis that only accept strings, the copy cannot be zeroed so prefer Bytes
+func (secret *Secret) Reveal() string {
+	return string(secret.Bytes())
+}
+
+func (secret *Secret) IsEmpty() bool {
+	return len(secret.Bytes()) == 0
+}
+
+// Destroy zeroes the value and stops redacting it
+func (secret *Secret) Destroy() {
+	if secret == nil {
+		return
+	}
+
+	secretRegistry.lock.Lock()
+	delete(secretRegistry.secrets, secret)
+	secretRegistry.lock.Unlock()
+
+	ZeroBytes(secret.value)
+	secret.value = nil
+}
+
+func (secret *Secret) String() string {
+	return redactedPlaceholder
+}
+
+func (secret *Secret) GoString() string {
+	return redactedPlaceholder
+}
+
+func (secret *Secret) Format(state fmt.State, verb rune) {
+	_, _ = state.Write([]byte(redactedPlaceholder))
+}
+
+func (secret *Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redactedPlaceholder + `"`), nil
+}
+
+// UnmarshalJSON reads a json string into the secret and registers it, so config fields can be decoded straight into
+// secrets and destroyed once they are used
+func (secret *Secret) UnmarshalJSON(data []byte) error {
+	var value []byte
+	if len(data) >= 2 && data[0] == '"' && !bytes.ContainsRune(data, '\\') {
+		value = bytes.Clone(data[1 : len(data)-1])
+	} else {
+		// the string decoding escapes needs cannot be zeroed, config values rarely have any
+		var decoded string
+		decodeError := json.Unmarshal(data, &decoded)
+
+		if decodeError != nil {
+			return decodeError
+		}
+		value = []byte(decoded)
+	}
+
+	secret.Destroy()
+	secret.value = bytes.TrimSpace(value)
+	secret.register()
+	return nil
+}
+
+// ZeroBytes overwrites a buffer that held secret material
+func ZeroBytes(buffer []byte) {
+	for i := range buffer {
+		buffer[i] = 0
+	}
+}
+
+// Redact replaces every registered secret value in text with a placeholder
+func Redact(text string) string {
+	secretRegistry.lock.RLock()
+	defer secretRegistry.lock.RUnlock()
+
+	for secret := range secretRegistry.secrets {
+		if strings.Contains(text, string(secret.value)) {
+			text = strings.ReplaceAll(text, string(secret.value), redactedPlaceholder)
+		}
+	}
+	return text
+}
+
+// RedactionHook is a logrus hook that redacts registered secrets from the message and fields of every entry
+type RedactionHook struct{}
+
+func NewRedactionHook() *RedactionHook {
+	return &RedactionHook{}
+}
+
+func (hook *RedactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *RedactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	for key, value := range entry.Data {
+		switch typedValue := value.(type) {
+		case *Secret:
+		case string:
+			entry.Data[key] = Redact(typedValue)
+		case error:
+			entry.Data[key] = Redact(typedValue.Error())
+		case fmt.Stringer:
+			entry.Data[key] = Redact(typedValue.String())
+		}
+	}
+	return nil
+}
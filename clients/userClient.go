@@ -8,6 +8,7 @@ import (
 type UserClient interface {
 	initialize(logger *logrus.Logger)
 	GetUserByName(username string) (*user.User, error)
+	GetGroupByName(groupName string) (*user.Group, error)
 }
 
 type UserClientImpl struct {
@@ -21,3 +22,7 @@ func (userClient *UserClientImpl) initialize(logger *logrus.Logger) {
 func (userClient *UserClientImpl) GetUserByName(username string) (*user.User, error) {
 	return user.Lookup(username)
 }
+
+func (userClient *UserClientImpl) GetGroupByName(groupName string) (*user.Group, error) {
+	return user.LookupGroup(groupName)
+}
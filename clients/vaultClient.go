@@ -2,8 +2,10 @@ package clients
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
@@ -11,38 +13,75 @@ import (
 )
 
 type VaultClient interface {
-	SubmitUnsealKey(vaultApiUrl string, unsealKey string) error
+	SubmitUnsealKey(vaultApiUrl string, unsealKey *Secret, migrate bool) error
 	GetVaultStatus(vaultApiUrl string) (*VaultStatusResponse, error)
+	GetLeader(vaultApiUrl string) (*VaultLeaderResponse, error)
+	JoinRaftCluster(vaultApiUrl string, joinRequest RaftJoinRequest) (*RaftJoinResponse, error)
+	GetRaftConfiguration(vaultApiUrl string, token *Secret) (*RaftConfigurationResponse, error)
+	LoginAppRole(vaultApiUrl string, mountPath string, roleId string, secretId *Secret) (*VaultAuthResponse, error)
+	LoginCert(vaultApiUrl string, mountPath string, name string, clientCertificate tls.Certificate) (*VaultAuthResponse, error)
+	IssueCertificate(vaultApiUrl string, token *Secret, mountPath string, role string, issueRequest PkiIssueRequest) (*PkiIssueResponse, error)
+	LookupSelfToken(vaultApiUrl string, token *Secret) (*TokenLookupResponse, error)
+	RenewSelfToken(vaultApiUrl string, token *Secret) (*VaultAuthResponse, error)
+	ReadKvSecret(vaultApiUrl string, token *Secret, secretPath string) (*KvSecretResponse, error)
+	DownloadRaftSnapshot(vaultApiUrl string, token *Secret, writer io.Writer) (int64, error)
+	RestoreRaftSnapshot(vaultApiUrl string, token *Secret, snapshot io.Reader, force bool) error
+	ListAuditDevices(vaultApiUrl string, token *Secret) (map[string]VaultAuditDevice, error)
+	EnableAuditDevice(vaultApiUrl string, token *Secret, path string, auditDevice VaultAuditDevice) error
+	ListAuthMethods(vaultApiUrl string, token *Secret) (map[string]VaultAuthMount, error)
+	EnableAuthMethod(vaultApiUrl string, token *Secret, path string, authMount VaultAuthMount) error
+	ListAclPolicies(vaultApiUrl string, token *Secret) ([]string, error)
+	ReadAclPolicy(vaultApiUrl string, token *Secret, name string) (string, error)
+	WriteAclPolicy(vaultApiUrl string, token *Secret, name string, policy string) error
 }
 
+const snapshotTimeout = 30 * time.Minute
+
+// VaultClientImpl builds an http client per call, the scheduler calls it from several goroutines at once against
+// different vault addresses
 type VaultClientImpl struct {
-	logger     *logrus.Logger
-	httpClient *Client
+	logger *logrus.Logger
 }
 
 func (vaultClient *VaultClientImpl) initialize(logger *logrus.Logger) {
 	vaultClient.logger = logger
-	vaultClient.httpClient = nil
 }
 
-func (vaultClient *VaultClientImpl) SubmitUnsealKey(vaultApiUrl string, unsealKey string) error {
+// SubmitUnsealKey submits one unseal key, migrate is set while vault moves from shamir keys to an auto-unseal seal
+// and accepts the keys of the old seal only when asked to migrate
+func (vaultClient *VaultClientImpl) SubmitUnsealKey(vaultApiUrl string, unsealKey *Secret, migrate bool) error {
 	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
-	vaultClient.httpClient = NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	requestBody, marshalError := marshalSecretField("key", unsealKey)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to encode unseal request: %s", marshalError.Error())
+		return marshalError
+	}
+	defer ZeroBytes(requestBody)
+
+	if migrate {
+		// {"key":<key>} becomes {"key":<key>,"migrate":true}, the key buffer is zeroed above
+		migrateBody := append(append(make([]byte, 0, len(requestBody)+15), requestBody[:len(requestBody)-1]...), `,"migrate":true}`...)
+		defer ZeroBytes(migrateBody)
+		requestBody = migrateBody
+	}
 
 	request, requestCreationError := http.NewRequest(
 		http.MethodPut,
-		fmt.Sprintf("%s/v1/sys/unseal", vaultClient.httpClient.hostURL),
-		bytes.NewBufferString(fmt.Sprintf("{\"key\": \"%s\"}", unsealKey)))
+		fmt.Sprintf("%s/v1/sys/unseal", httpClient.hostURL),
+		bytes.NewReader(requestBody))
 
 	if requestCreationError != nil {
-		vaultClient.logger.Errorf("Failed to create request to unseal vault at %s: %s", vaultClient.httpClient.hostURL, requestCreationError.Error())
+		vaultClient.logger.Errorf("Failed to create request to unseal vault at %s: %s", httpClient.hostURL, requestCreationError.Error())
 		return requestCreationError
 	}
 
-	_, doRequestError := vaultClient.httpClient.doRequest(request, "")
+	_, doRequestError := httpClient.doRequest(request, "application/json")
 
 	if doRequestError != nil {
-		vaultClient.logger.Errorf("Failed to perform request to unseal vault at %s: %s", vaultClient.httpClient.hostURL, doRequestError.Error())
+		vaultClient.logger.Errorf("Failed to perform request to unseal vault at %s: %s", httpClient.hostURL, doRequestError.Error())
 		return doRequestError
 	}
 
@@ -51,21 +90,21 @@ func (vaultClient *VaultClientImpl) SubmitUnsealKey(vaultApiUrl string, unsealKe
 
 func (vaultClient *VaultClientImpl) GetVaultStatus(vaultApiUrl string) (*VaultStatusResponse, error) {
 	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
-	vaultClient.httpClient = NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
 	request, requestCreationError := http.NewRequest(
 		http.MethodGet,
-		fmt.Sprintf("%s/v1/sys/seal-status", vaultClient.httpClient.hostURL),
+		fmt.Sprintf("%s/v1/sys/seal-status", httpClient.hostURL),
 		nil)
 
 	if requestCreationError != nil {
-		vaultClient.logger.Errorf("Failed to create request to get vault status at %s: %s", vaultClient.httpClient.hostURL, requestCreationError.Error())
+		vaultClient.logger.Errorf("Failed to create request to get vault status at %s: %s", httpClient.hostURL, requestCreationError.Error())
 		return nil, requestCreationError
 	}
 
-	response, doRequestError := vaultClient.httpClient.doRequest(request, "")
+	response, doRequestError := httpClient.doRequest(request, "")
 
 	if doRequestError != nil {
-		vaultClient.logger.Errorf("Failed to perform request to check vault status at %s: %s", vaultClient.httpClient.hostURL, doRequestError.Error())
+		vaultClient.logger.Errorf("Failed to perform request to check vault status at %s: %s", httpClient.hostURL, doRequestError.Error())
 		return nil, doRequestError
 	}
 
@@ -81,6 +120,680 @@ func (vaultClient *VaultClientImpl) GetVaultStatus(vaultApiUrl string) (*VaultSt
 	return &vaultStatus, nil
 }
 
+func (vaultClient *VaultClientImpl) GetLeader(vaultApiUrl string) (*VaultLeaderResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/leader", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to get vault leader at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to perform request to get vault leader at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+
+	var leaderResponse VaultLeaderResponse
+
+	unmarshalError := json.Unmarshal(response, &leaderResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal vault leader response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &leaderResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) JoinRaftCluster(vaultApiUrl string, joinRequest RaftJoinRequest) (*RaftJoinResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	requestBody, marshalError := json.Marshal(joinRequest)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal raft join request: %s", marshalError.Error())
+		return nil, marshalError
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/sys/storage/raft/join", httpClient.hostURL),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to join raft cluster at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	response, doRequestError := httpClient.doRequest(request, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to perform request to join raft cluster led by %s: %s", joinRequest.LeaderApiAddr, doRequestError.Error())
+		return nil, doRequestError
+	}
+
+	var joinResponse RaftJoinResponse
+
+	unmarshalError := json.Unmarshal(response, &joinResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal raft join response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &joinResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) GetRaftConfiguration(vaultApiUrl string, token *Secret) (*RaftConfigurationResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/storage/raft/configuration", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to get raft configuration at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to perform request to get raft configuration at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+
+	var configurationResponse RaftConfigurationResponse
+
+	unmarshalError := json.Unmarshal(response, &configurationResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal raft configuration response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &configurationResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) LoginAppRole(vaultApiUrl string, mountPath string, roleId string, secretId *Secret) (*VaultAuthResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	roleIdBytes, marshalError := json.Marshal(roleId)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal approle login request: %s", marshalError.Error())
+		return nil, marshalError
+	}
+
+	secretIdBody, marshalError := marshalSecretField("secret_id", secretId)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal approle login request: %s", marshalError.Error())
+		return nil, marshalError
+	}
+	defer ZeroBytes(secretIdBody)
+
+	// {"role_id":<role>,"secret_id":<secret>} built around the secret field so every copy of it can be zeroed
+	requestBody := append(append([]byte(`{"role_id":`), roleIdBytes...), ',')
+	requestBody = append(requestBody, secretIdBody[1:]...)
+	defer ZeroBytes(requestBody)
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/auth/%s/login", httpClient.hostURL, mountPath),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create approle login request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	response, doRequestError := httpClient.doRequest(request, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to perform approle login at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+	defer ZeroBytes(response)
+
+	var authResponse VaultAuthResponse
+
+	unmarshalError := json.Unmarshal(response, &authResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal approle login response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &authResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) LoginCert(vaultApiUrl string, mountPath string, name string, clientCertificate tls.Certificate) (*VaultAuthResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClientWithTlsConfig(vaultApiUrl, &tls.Config{Certificates: []tls.Certificate{clientCertificate}}, vaultClient.logger)
+
+	requestBody, marshalError := json.Marshal(map[string]string{
+		"name": name,
+	})
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal cert login request: %s", marshalError.Error())
+		return nil, marshalError
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/auth/%s/login", httpClient.hostURL, mountPath),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create cert login request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	response, doRequestError := httpClient.doRequest(request, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to perform cert login at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+	defer ZeroBytes(response)
+
+	var authResponse VaultAuthResponse
+
+	unmarshalError := json.Unmarshal(response, &authResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal cert login response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &authResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) IssueCertificate(vaultApiUrl string, token *Secret, mountPath string, role string, issueRequest PkiIssueRequest) (*PkiIssueResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	requestBody, marshalError := json.Marshal(issueRequest)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal certificate issue request: %s", marshalError.Error())
+		return nil, marshalError
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/%s/issue/%s", httpClient.hostURL, mountPath, role),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create certificate issue request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to issue certificate from %s/issue/%s: %s", mountPath, role, doRequestError.Error())
+		return nil, doRequestError
+	}
+	defer ZeroBytes(response)
+
+	var issueResponse PkiIssueResponse
+
+	unmarshalError := json.Unmarshal(response, &issueResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal certificate issue response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &issueResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) LookupSelfToken(vaultApiUrl string, token *Secret) (*TokenLookupResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/auth/token/lookup-self", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create token lookup request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to look up token at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+	defer ZeroBytes(response)
+
+	var lookupResponse TokenLookupResponse
+
+	unmarshalError := json.Unmarshal(response, &lookupResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal token lookup response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &lookupResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) RenewSelfToken(vaultApiUrl string, token *Secret) (*VaultAuthResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/auth/token/renew-self", httpClient.hostURL),
+		bytes.NewBufferString("{}"))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create token renewal request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to renew token at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+	defer ZeroBytes(response)
+
+	var authResponse VaultAuthResponse
+
+	unmarshalError := json.Unmarshal(response, &authResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal token renewal response into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &authResponse, nil
+}
+
+// ReadKvSecret reads a KV v2 secret, secretPath is the full api path including the data segment e.g. secret/data/k8s/cluster
+func (vaultClient *VaultClientImpl) ReadKvSecret(vaultApiUrl string, token *Secret, secretPath string) (*KvSecretResponse, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/%s", httpClient.hostURL, secretPath),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create secret read request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to read secret %s at %s: %s", secretPath, httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+	defer ZeroBytes(response)
+
+	var secretResponse KvSecretResponse
+
+	unmarshalError := json.Unmarshal(response, &secretResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal secret %s into a known response: %s", secretPath, unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return &secretResponse, nil
+}
+
+func (vaultClient *VaultClientImpl) DownloadRaftSnapshot(vaultApiUrl string, token *Secret, writer io.Writer) (int64, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	httpClient.httpClient.Timeout = snapshotTimeout
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/storage/raft/snapshot", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create raft snapshot request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return 0, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	bytesWritten, doRequestError := httpClient.doStreamingRequest(request, writer)
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to download raft snapshot from %s: %s", httpClient.hostURL, doRequestError.Error())
+		return bytesWritten, doRequestError
+	}
+
+	return bytesWritten, nil
+}
+
+func (vaultClient *VaultClientImpl) RestoreRaftSnapshot(vaultApiUrl string, token *Secret, snapshot io.Reader, force bool) error {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	httpClient.httpClient.Timeout = snapshotTimeout
+
+	endpoint := "snapshot"
+	if force {
+		endpoint = "snapshot-force"
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/sys/storage/raft/%s", httpClient.hostURL, endpoint),
+		snapshot)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create raft snapshot restore request at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	_, doRequestError := httpClient.doRequestWithResponseStatus(request, http.StatusNoContent, "application/octet-stream")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to restore raft snapshot to %s: %s", httpClient.hostURL, doRequestError.Error())
+		return doRequestError
+	}
+
+	return nil
+}
+
+func (vaultClient *VaultClientImpl) ListAuditDevices(vaultApiUrl string, token *Secret) (map[string]VaultAuditDevice, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/audit", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to list audit devices at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to list audit devices at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+
+	var listResponse VaultAuditListResponse
+
+	unmarshalError := json.Unmarshal(response, &listResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal audit devices into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return listResponse.Data, nil
+}
+
+func (vaultClient *VaultClientImpl) EnableAuditDevice(vaultApiUrl string, token *Secret, path string, auditDevice VaultAuditDevice) error {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	requestBody, marshalError := json.Marshal(auditDevice)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal request to enable audit device %s: %s", path, marshalError.Error())
+		return marshalError
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPut,
+		fmt.Sprintf("%s/v1/sys/audit/%s", httpClient.hostURL, path),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to enable audit device %s at %s: %s", path, httpClient.hostURL, requestCreationError.Error())
+		return requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	_, doRequestError := httpClient.doRequestWithResponseStatus(request, http.StatusNoContent, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to enable audit device %s at %s: %s", path, httpClient.hostURL, doRequestError.Error())
+		return doRequestError
+	}
+
+	return nil
+}
+
+func (vaultClient *VaultClientImpl) ListAuthMethods(vaultApiUrl string, token *Secret) (map[string]VaultAuthMount, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/auth", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to list auth methods at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to list auth methods at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+
+	var listResponse VaultAuthListResponse
+
+	unmarshalError := json.Unmarshal(response, &listResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal auth methods into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return listResponse.Data, nil
+}
+
+func (vaultClient *VaultClientImpl) EnableAuthMethod(vaultApiUrl string, token *Secret, path string, authMount VaultAuthMount) error {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	requestBody, marshalError := json.Marshal(authMount)
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal request to enable auth method %s: %s", path, marshalError.Error())
+		return marshalError
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/sys/auth/%s", httpClient.hostURL, path),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to enable auth method %s at %s: %s", path, httpClient.hostURL, requestCreationError.Error())
+		return requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	_, doRequestError := httpClient.doRequestWithResponseStatus(request, http.StatusNoContent, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to enable auth method %s at %s: %s", path, httpClient.hostURL, doRequestError.Error())
+		return doRequestError
+	}
+
+	return nil
+}
+
+func (vaultClient *VaultClientImpl) ListAclPolicies(vaultApiUrl string, token *Secret) ([]string, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/policies/acl?list=true", httpClient.hostURL),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to list acl policies at %s: %s", httpClient.hostURL, requestCreationError.Error())
+		return nil, requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to list acl policies at %s: %s", httpClient.hostURL, doRequestError.Error())
+		return nil, doRequestError
+	}
+
+	var listResponse VaultPolicyListResponse
+
+	unmarshalError := json.Unmarshal(response, &listResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal acl policies into a known response: %s", unmarshalError)
+		return nil, unmarshalError
+	}
+
+	return listResponse.Data.Keys, nil
+}
+
+func (vaultClient *VaultClientImpl) ReadAclPolicy(vaultApiUrl string, token *Secret, name string) (string, error) {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+	request, requestCreationError := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/sys/policies/acl/%s", httpClient.hostURL, name),
+		nil)
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to read acl policy %s at %s: %s", name, httpClient.hostURL, requestCreationError.Error())
+		return "", requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	response, doRequestError := httpClient.doRequest(request, "")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to read acl policy %s at %s: %s", name, httpClient.hostURL, doRequestError.Error())
+		return "", doRequestError
+	}
+
+	var policyResponse VaultPolicyResponse
+
+	unmarshalError := json.Unmarshal(response, &policyResponse)
+
+	if unmarshalError != nil {
+		vaultClient.logger.Errorf("Failed to unmarshal acl policy %s into a known response: %s", name, unmarshalError)
+		return "", unmarshalError
+	}
+
+	return policyResponse.Data.Policy, nil
+}
+
+func (vaultClient *VaultClientImpl) WriteAclPolicy(vaultApiUrl string, token *Secret, name string, policy string) error {
+	vaultClient.logger.Debugf("Vault URL is %s", vaultApiUrl)
+	httpClient := NewClient(vaultApiUrl, "", "", true, vaultClient.logger)
+
+	requestBody, marshalError := json.Marshal(map[string]string{"policy": policy})
+
+	if marshalError != nil {
+		vaultClient.logger.Errorf("Failed to marshal request to write acl policy %s: %s", name, marshalError.Error())
+		return marshalError
+	}
+
+	request, requestCreationError := http.NewRequest(
+		http.MethodPut,
+		fmt.Sprintf("%s/v1/sys/policies/acl/%s", httpClient.hostURL, name),
+		bytes.NewBuffer(requestBody))
+
+	if requestCreationError != nil {
+		vaultClient.logger.Errorf("Failed to create request to write acl policy %s at %s: %s", name, httpClient.hostURL, requestCreationError.Error())
+		return requestCreationError
+	}
+
+	request.Header.Set("X-Vault-Token", token.Reveal())
+
+	_, doRequestError := httpClient.doRequestWithResponseStatus(request, http.StatusNoContent, "application/json")
+
+	if doRequestError != nil {
+		vaultClient.logger.Errorf("Failed to write acl policy %s at %s: %s", name, httpClient.hostURL, doRequestError.Error())
+		return doRequestError
+	}
+
+	return nil
+}
+
+// marshalSecretField encodes {"<field>": "<secret>"} into a buffer the caller can zero, escaping the secret the way
+// encoding/json would without going through an intermediate string
+func marshalSecretField(field string, secret *Secret) ([]byte, error) {
+	fieldBytes, marshalError := json.Marshal(field)
+
+	if marshalError != nil {
+		return nil, marshalError
+	}
+
+	var buffer bytes.Buffer
+	buffer.Grow(len(fieldBytes) + len(secret.Bytes())*6 + 4)
+	buffer.WriteByte('{')
+	buffer.Write(fieldBytes)
+	buffer.WriteString(":\"")
+	for _, character := range secret.Bytes() {
+		switch {
+		case character == '"' || character == '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteByte(character)
+		case character < 0x20:
+			fmt.Fprintf(&buffer, "\\u%04x", character)
+		default:
+			buffer.WriteByte(character)
+		}
+	}
+	buffer.WriteString("\"}")
+	return buffer.Bytes(), nil
+}
+
 type VaultStatusResponse struct {
 	Type         string    `json:"type"`
 	Initialized  bool      `json:"initialized"`
@@ -95,3 +808,122 @@ type VaultStatusResponse struct {
 	RecoverySeal bool      `json:"recovery_seal"`
 	StorageType  string    `json:"storage_type"`
 }
+
+type VaultLeaderResponse struct {
+	HaEnabled            bool   `json:"ha_enabled"`
+	IsSelf               bool   `json:"is_self"`
+	LeaderAddress        string `json:"leader_address"`
+	LeaderClusterAddress string `json:"leader_cluster_address"`
+	RaftCommittedIndex   int    `json:"raft_committed_index"`
+	RaftAppliedIndex     int    `json:"raft_applied_index"`
+}
+
+type RaftJoinRequest struct {
+	LeaderApiAddr    string `json:"leader_api_addr"`
+	LeaderCaCert     string `json:"leader_ca_cert,omitempty"`
+	LeaderClientCert string `json:"leader_client_cert,omitempty"`
+	LeaderClientKey  string `json:"leader_client_key,omitempty"`
+	Retry            bool   `json:"retry"`
+}
+
+type RaftJoinResponse struct {
+	Joined bool `json:"joined"`
+}
+
+type RaftConfigurationResponse struct {
+	Data struct {
+		Config struct {
+			Index   int          `json:"index"`
+			Servers []RaftServer `json:"servers"`
+		} `json:"config"`
+	} `json:"data"`
+}
+
+type RaftServer struct {
+	Address         string `json:"address"`
+	Leader          bool   `json:"leader"`
+	NodeId          string `json:"node_id"`
+	ProtocolVersion string `json:"protocol_version"`
+	Voter           bool   `json:"voter"`
+}
+
+type VaultAuthResponse struct {
+	Auth struct {
+		ClientToken   *Secret  `json:"client_token"`
+		Accessor      string   `json:"accessor"`
+		Policies      []string `json:"policies"`
+		LeaseDuration int      `json:"lease_duration"`
+		Renewable     bool     `json:"renewable"`
+	} `json:"auth"`
+}
+
+type PkiIssueRequest struct {
+	CommonName string `json:"common_name"`
+	AltNames   string `json:"alt_names,omitempty"`
+	IpSans     string `json:"ip_sans,omitempty"`
+	Ttl        string `json:"ttl,omitempty"`
+}
+
+type PkiIssueResponse struct {
+	Data struct {
+		Certificate    string   `json:"certificate"`
+		IssuingCa      string   `json:"issuing_ca"`
+		CaChain        []string `json:"ca_chain"`
+		PrivateKey     *Secret  `json:"private_key"`
+		PrivateKeyType string   `json:"private_key_type"`
+		SerialNumber   string   `json:"serial_number"`
+		Expiration     int64    `json:"expiration"`
+	} `json:"data"`
+}
+
+type TokenLookupResponse struct {
+	Data struct {
+		Accessor  string   `json:"accessor"`
+		Policies  []string `json:"policies"`
+		Ttl       int      `json:"ttl"`
+		Renewable bool     `json:"renewable"`
+	} `json:"data"`
+}
+
+type KvSecretResponse struct {
+	LeaseDuration int `json:"lease_duration"`
+	Data          struct {
+		Data     map[string]interface{} `json:"data"`
+		Metadata struct {
+			CreatedTime string `json:"created_time"`
+			Version     int    `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+}
+
+type VaultAuditDevice struct {
+	Type        string            `json:"type"`
+	Description string            `json:"description"`
+	Options     map[string]string `json:"options"`
+}
+
+type VaultAuditListResponse struct {
+	Data map[string]VaultAuditDevice `json:"data"`
+}
+
+type VaultAuthMount struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+type VaultAuthListResponse struct {
+	Data map[string]VaultAuthMount `json:"data"`
+}
+
+type VaultPolicyListResponse struct {
+	Data struct {
+		Keys []string `json:"keys"`
+	} `json:"data"`
+}
+
+type VaultPolicyResponse struct {
+	Data struct {
+		Name   string `json:"name"`
+		Policy string `json:"policy"`
+	} `json:"data"`
+}
@@ -11,17 +11,25 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// orders of the zone and keepalived config drive disks in the VM definition
+const zoneDiskOrder = 1
+const keepalivedDiskOrder = 2
+
+// config volumes are found by label wherever they are attached
+var zoneVolume = services.ConfigVolumeQuery{Label: "ZS-DNS-ZONES"}
+var keepalivedVolume = services.ConfigVolumeQuery{Label: "ZS-DNS-KEEPALIVED"}
+
 func SetupBind9(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
 
 	filesystemService := services.GetFileSystemService()
 
-	copyFilesError := copyDnsFiles(logger, filesystemService)
+	copyFilesError := copyDnsFiles(logger, filesystemService, vmDetails)
 
 	if copyFilesError != nil {
 		return copyFilesError
 	}
 
-	copyFilesError = copyKeepalivedFiles(logger, filesystemService)
+	copyFilesError = copyKeepalivedFiles(logger, filesystemService, vmDetails)
 
 	if copyFilesError != nil {
 		return copyFilesError
@@ -38,7 +46,7 @@ func SetupBind9(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
 	return nil
 }
 
-func copyDnsFiles(logger *logrus.Logger, filesystemService services.FileSystemService) error {
+func copyDnsFiles(logger *logrus.Logger, filesystemService services.FileSystemService, vmDetails clients.ProxmoxVm) error {
 	// create folders
 	createFilesystemFolderError := filesystemService.CreateRootFsDirectory("/etc/named/zones", true, 0750)
 	if createFilesystemFolderError != nil {
@@ -46,7 +54,7 @@ func copyDnsFiles(logger *logrus.Logger, filesystemService services.FileSystemSe
 		return createFilesystemFolderError
 	}
 
-	fs, getFileSystemError := filesystemService.GetBlockFilesystem("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi1")
+	fs, getFileSystemError := filesystemService.OpenConfigVolume(vmDetails, zoneVolume, zoneDiskOrder)
 
 	if getFileSystemError != nil {
 		return getFileSystemError
@@ -62,25 +70,19 @@ func copyDnsFiles(logger *logrus.Logger, filesystemService services.FileSystemSe
 	for _, info := range fileInfos {
 		fileName := info.Name()
 
-		if fileName == "." || fileName == ".." || fileName == "lost+found" {
+		if fileName == "." || fileName == ".." || fileName == "lost+found" || fileName == services.CertificateConfigFile {
 			continue
 		}
 
 		var copyError error = nil
-		var setOwnerError error = nil
-		var setPermissionsError error = nil
 		logger.Debugf("Copying file %s", fileName)
 
 		if fileName == "named.conf" {
-			copyError = filesystemService.CopySingleFileToRootFs(fs, fileName, "/etc/named.conf")
-			setOwnerError = filesystemService.SetRootFsOwner("/etc/named.conf", "named", false)
-			setPermissionsError = filesystemService.SetRootFsPermissions("/etc/named.conf", 0640, false)
+			_, copyError = filesystemService.CopyFileToRootFs(fs, fmt.Sprintf("/%s", fileName), "/etc/named.conf", services.FileAttributes{Owner: "named", Mode: 0640})
 		} else if strings.Contains(fileName, "named.conf.") {
-			copyError = filesystemService.CopySingleFileToRootFs(fs, fmt.Sprintf("/%s", fileName), fmt.Sprintf("/etc/named/%s", fileName))
-			setPermissionsError = filesystemService.SetRootFsPermissions("/etc/named.conf", 0640, false)
+			_, copyError = filesystemService.CopyFileToRootFs(fs, fmt.Sprintf("/%s", fileName), fmt.Sprintf("/etc/named/%s", fileName), services.FileAttributes{Mode: 0640})
 		} else if fileName != "vm-config.json" {
-			copyError = filesystemService.CopySingleFileToRootFs(fs, fmt.Sprintf("/%s", fileName), fmt.Sprintf("/etc/named/zones/%s", fileName))
-			setPermissionsError = filesystemService.SetRootFsPermissions(fmt.Sprintf("/etc/named/zones/%s", fileName), 0640, false)
+			_, copyError = filesystemService.CopyFileToRootFs(fs, fmt.Sprintf("/%s", fileName), fmt.Sprintf("/etc/named/zones/%s", fileName), services.FileAttributes{Mode: 0640})
 		}
 
 		if copyError != nil {
@@ -88,17 +90,15 @@ func copyDnsFiles(logger *logrus.Logger, filesystemService services.FileSystemSe
 			return copyError
 		}
 
-		if setOwnerError != nil {
-			return setOwnerError
-		}
+	}
 
-		if setPermissionsError != nil {
-			return setPermissionsError
-		}
+	_, configureCertificatesError := services.GetCertificateService().ConfigureCertificates(fs, vmDetails)
 
+	if configureCertificatesError != nil {
+		return configureCertificatesError
 	}
 
-	setOwnerError := filesystemService.SetRootFsOwner("/etc/named/", "named", true)
+	_, setOwnerError := filesystemService.SetRootFsOwner("/etc/named/", "named", true)
 
 	if setOwnerError != nil {
 		return setOwnerError
@@ -139,26 +139,26 @@ func startServices(logger *logrus.Logger, systemdService services.SystemdService
 	return nil
 }
 
-func copyKeepalivedFiles(logger *logrus.Logger, filesystemService services.FileSystemService) error {
+func copyKeepalivedFiles(logger *logrus.Logger, filesystemService services.FileSystemService, vmDetails clients.ProxmoxVm) error {
 	createFilesystemFolderError := filesystemService.CreateRootFsDirectory("/etc/keepalived/", true, 0750)
 	if createFilesystemFolderError != nil {
 		logger.Errorf("Failed to create keepalived folder: %s", createFilesystemFolderError.Error())
 		return createFilesystemFolderError
 	}
-	fs, getFileSystemError := filesystemService.GetBlockFilesystem("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi2")
+	fs, getFileSystemError := filesystemService.OpenConfigVolume(vmDetails, keepalivedVolume, keepalivedDiskOrder)
 
 	if getFileSystemError != nil {
 		return getFileSystemError
 	}
 
-	copyError := filesystemService.CopySingleFileToRootFs(fs, "/keepalived.conf", "/etc/keepalived/keepalived.conf")
+	_, copyError := filesystemService.CopySingleFileToRootFs(fs, "/keepalived.conf", "/etc/keepalived/keepalived.conf")
 
 	if copyError != nil {
 		logger.Errorf("Failed to copy file %s to root filesystem: %s", "keepalived.conf", copyError)
 		return copyError
 	}
 
-	setOwnerError := filesystemService.SetRootFsOwner("/etc/named.conf", "named", false)
+	_, setOwnerError := filesystemService.SetRootFsOwner("/etc/named.conf", "named", false)
 
 	if setOwnerError != nil {
 		return setOwnerError
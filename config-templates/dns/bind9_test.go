@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newConfigDrive attaches a config drive labelled label holding files to host as /dev/<name>
+func newConfigDrive(t *testing.T, host *clients.MemoryOsClient, name string, label string, files map[string]string) {
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), name+".img"), name, label, files))
+}
+
+// useMemoryHost runs the services against an in-memory host on which named is uid and gid 25
+func useMemoryHost(t *testing.T, ctrl *gomock.Controller) *clients.MemoryOsClient {
+	host := clients.NewMemoryOsClient()
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("named").Return(&user.User{Uid: "25", Gid: "25"}, nil).AnyTimes()
+
+	previousOsClient, previousUserClient := clients.GetOsClient(), clients.GetUserClient()
+	clients.SetOsClient(host)
+	clients.SetUserClient(mockUserClient)
+	t.Cleanup(func() {
+		clients.SetOsClient(previousOsClient)
+		clients.SetUserClient(previousUserClient)
+		services.Initialize(&logrus.Logger{})
+	})
+	services.Initialize(&logrus.Logger{})
+	return host
+}
+
+func TestCopyDnsFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	newConfigDrive(t, host, "vdb", zoneVolume.Label, map[string]string{
+		"named.conf":         "options {};\n",
+		"named.conf.options": "listen-on { any; };\n",
+		"db.example":         "$ORIGIN example.\n",
+		"vm-config.json":     "{}\n",
+	})
+
+	copyError := copyDnsFiles(&logrus.Logger{}, services.GetFileSystemService(), clients.ProxmoxVm{})
+
+	assert.Nil(t, copyError)
+
+	namedConf, _ := host.Node("/etc/named.conf")
+	assert.Equal(t, "options {};\n", string(namedConf.Contents))
+	assert.Equal(t, os.FileMode(0640), namedConf.Mode.Perm())
+	assert.Equal(t, 25, namedConf.Uid)
+
+	zone, found := host.Node("/etc/named/zones/db.example")
+	assert.True(t, found)
+	assert.Equal(t, "$ORIGIN example.\n", string(zone.Contents))
+	assert.Equal(t, 25, zone.Uid)
+
+	options, found := host.Node("/etc/named/named.conf.options")
+	assert.True(t, found)
+	assert.Equal(t, os.FileMode(0640), options.Mode.Perm())
+
+	namedDirectory, _ := host.Node("/etc/named")
+	assert.Equal(t, os.FileMode(0750), namedDirectory.Mode.Perm())
+	assert.Equal(t, 25, namedDirectory.Uid)
+
+	_, found = host.Node("/etc/named/zones/vm-config.json")
+	assert.False(t, found)
+}
+
+func TestCopyDnsFiles_noConfigDrive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	newConfigDrive(t, host, "vdb", "SOMETHING-ELSE", map[string]string{"named.conf": "options {};\n"})
+
+	copyError := copyDnsFiles(&logrus.Logger{}, services.GetFileSystemService(), clients.ProxmoxVm{})
+
+	assert.NotNil(t, copyError)
+	_, found := host.Node("/etc/named.conf")
+	assert.False(t, found)
+}
+
+func TestCopyDnsFiles_hostRoot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	host.AddFile("/mnt/image/etc/passwd", []byte("named:x:40:40::/var/named:/sbin/nologin\n"), 0644)
+	host.AddDirectory("/mnt/image/etc/named", 0755)
+	newConfigDrive(t, host, "vdb", zoneVolume.Label, map[string]string{
+		"named.conf": "options {};\n",
+		"db.example": "$ORIGIN example.\n",
+	})
+	clients.SetHostRoot("/mnt/image")
+	t.Cleanup(func() { clients.SetHostRoot("/") })
+	services.Initialize(&logrus.Logger{})
+
+	copyError := copyDnsFiles(&logrus.Logger{}, services.GetFileSystemService(), clients.ProxmoxVm{})
+
+	// the config drive is a device of the running system while the files and the named user belong to the image
+	assert.Nil(t, copyError)
+	namedConf, found := host.Node("/mnt/image/etc/named.conf")
+	assert.True(t, found)
+	assert.Equal(t, 40, namedConf.Uid)
+	zone, found := host.Node("/mnt/image/etc/named/zones/db.example")
+	assert.True(t, found)
+	assert.Equal(t, "$ORIGIN example.\n", string(zone.Contents))
+	_, found = host.Node("/etc/named.conf")
+	assert.False(t, found)
+}
@@ -13,19 +13,20 @@ import (
 )
 
 func ControllerSetup(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
-	setupError := Setup(logger, vmDetails)
+	kubeConfig, loadConfigError := loadConfig(logger, vmDetails)
+
+	if loadConfigError != nil {
+		return loadConfigError
+	}
+	defer kubeConfig.destroySecrets()
+
+	setupError := Setup(logger, vmDetails, kubeConfig)
 	if setupError != nil {
 		return setupError
 	}
 
 	logger.Debug("Setup Successful")
 
-	kubeConfig, loadConfigError := loadConfig(logger)
-
-	if loadConfigError != nil {
-		return loadConfigError
-	}
-
 	certLoadError := loadCertificates(logger, kubeConfig)
 
 	if certLoadError != nil {
@@ -57,7 +58,7 @@ func ControllerSetup(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
 
 func loadCertificates(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 	filesystemService := services.GetFileSystemService()
-	_, statFileError := os.Stat("/etc/kubernetes/pki/ca.crt")
+	_, statFileError := clients.GetOsClient().StatFile("/etc/kubernetes/pki/ca.crt")
 	if statFileError != nil && !strings.Contains(statFileError.Error(), "no such file or directory") {
 		logger.Errorf("Failed to stat k8s ca cert: %s", statFileError.Error())
 		return statFileError
@@ -76,7 +77,7 @@ func loadCertificates(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 	if certWrtiteError != nil {
 		return certWrtiteError
 	}
-	privateKeyWriteError := filesystemService.WriteFileContents("/etc/kubernetes/pki/ca.key", []byte(kubeConfig.K8sCaInitPrivateKey), 0651)
+	privateKeyWriteError := filesystemService.WriteFileContents("/etc/kubernetes/pki/ca.key", kubeConfig.K8sCaInitPrivateKey.Bytes(), 0651)
 
 	if privateKeyWriteError != nil {
 		return privateKeyWriteError
@@ -91,7 +92,7 @@ func loadCertificates(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 }
 
 func k8sInit(logger *logrus.Logger, kubeConfig *k8sConfig) error {
-	_, statFileError := os.Stat("/etc/kubernetes/kubelet.conf")
+	_, statFileError := clients.GetOsClient().StatFile("/etc/kubernetes/kubelet.conf")
 	if !errors.Is(statFileError, os.ErrNotExist) {
 		logger.Info("Kubernetes config already exists, skipping...")
 		return nil
@@ -108,13 +109,13 @@ func k8sInit(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 		fmt.Sprintf("--pod-network-cidr=%s", kubeConfig.PodNetworkCidr),
 		fmt.Sprintf("--service-cidr=%s", kubeConfig.ServiceNetworkCidr),
 		"--token",
-		kubeConfig.K8sInitToken,
+		string(kubeConfig.K8sInitToken.Bytes()),
 	}
 	logger.Info("Initializing Kubernetes Cluster, this may take awhile...")
-	logger.Debugf("/usr/bin/kubeadm %s", strings.Replace(strings.Join(kubeInitArgs, " "), kubeConfig.K8sInitToken, "XXXXXXX", 1))
+	logger.Debug(kubeadmCommandLine(kubeInitArgs))
 	command := exec.Command("/usr/bin/kubeadm", kubeInitArgs...)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(clients.GetOsClient(), command)
 
 	logger.Info(string(outputText))
 
@@ -127,7 +128,7 @@ func k8sInit(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 }
 
 func k8sControllerJoin(logger *logrus.Logger, kubeConfig *k8sConfig) error {
-	_, statFileError := os.Stat("/etc/kubernetes/kubelet.conf")
+	_, statFileError := clients.GetOsClient().StatFile("/etc/kubernetes/kubelet.conf")
 	if !errors.Is(statFileError, os.ErrNotExist) {
 		logger.Info("Kubernetes config already exists, skipping...")
 		return nil
@@ -148,12 +149,12 @@ func k8sControllerJoin(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 		"--discovery-token-ca-cert-hash",
 		fmt.Sprintf("sha256:%s", *hash),
 		"--token",
-		kubeConfig.K8sInitToken,
+		string(kubeConfig.K8sInitToken.Bytes()),
 	}
-	logger.Debugf("/usr/bin/kubeadm %s", strings.Replace(strings.Join(kubeInitArgs, " "), kubeConfig.K8sInitToken, "XXXXXXX", 1))
+	logger.Debug(kubeadmCommandLine(kubeInitArgs))
 	command := exec.Command("/usr/bin/kubeadm", kubeInitArgs...)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(clients.GetOsClient(), command)
 
 	logger.Info(string(outputText))
 
@@ -5,49 +5,59 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
 	"zs-vm-agent/clients"
 
 	"github.com/sirupsen/logrus"
 )
 
 func WorkerSetup(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
-	setupError := Setup(logger, vmDetails)
+	kubeConfig, loadConfigError := loadConfig(logger, vmDetails)
+
+	if loadConfigError != nil {
+		return loadConfigError
+	}
+	defer kubeConfig.destroySecrets()
+
+	setupError := Setup(logger, vmDetails, kubeConfig)
 	if setupError != nil {
 		return setupError
 	}
 
 	logger.Debug("Setup Successful")
 
-	kubeConfig, loadConfigError := loadConfig(logger)
-
-	if loadConfigError != nil {
-		return loadConfigError
-	}
-
 	certLoadError := loadCertificates(logger, kubeConfig)
 
 	if certLoadError != nil {
 		return certLoadError
 	}
 
-	driveMappings = make(map[string]string)
-
+	var drives []AdditionalVolume
+	var logicalVolumes []AdditionalVolume
 	for _, volume := range kubeConfig.AdditionalVolumes {
-		driveMappings[fmt.Sprintf("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi%d", volume.Order)] = volume.StorageLocation
+		if volume.LogicalVolume != "" {
+			logicalVolumes = append(logicalVolumes, volume)
+			continue
+		}
+		drives = append(drives, volume)
 	}
 
-	additionalVolumesMountError := mountDrives(logger)
+	additionalVolumesMountError := mountDrives(logger, vmDetails, drives)
 
 	if additionalVolumesMountError != nil {
 		return additionalVolumesMountError
 	}
 
+	logicalVolumesMountError := mountLogicalVolumes(logger, logicalVolumes)
+
+	if logicalVolumesMountError != nil {
+		return logicalVolumesMountError
+	}
+
 	return k8sWorkerJoin(logger, kubeConfig)
 }
 
 func k8sWorkerJoin(logger *logrus.Logger, kubeConfig *k8sConfig) error {
-	_, statFileError := os.Stat("/etc/kubernetes/kubelet.conf")
+	_, statFileError := clients.GetOsClient().StatFile("/etc/kubernetes/kubelet.conf")
 	if !errors.Is(statFileError, os.ErrNotExist) {
 		logger.Info("Kubernetes config already exists, skipping...")
 		return nil
@@ -60,8 +70,8 @@ func k8sWorkerJoin(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 	}
 
 	// if these fail the files likely don't exist or other errors that will cause subsequent failures
-	_ = os.Remove("/etc/kubernetes/pki/ca.crt")
-	_ = os.Remove("/etc/kubernetes/pki/ca.key")
+	_ = clients.GetOsClient().Remove("/etc/kubernetes/pki/ca.crt")
+	_ = clients.GetOsClient().Remove("/etc/kubernetes/pki/ca.key")
 
 	logger.Debugf("Retrieved ca hash is %s", *hash)
 
@@ -71,12 +81,12 @@ func k8sWorkerJoin(logger *logrus.Logger, kubeConfig *k8sConfig) error {
 		"--discovery-token-ca-cert-hash",
 		fmt.Sprintf("sha256:%s", *hash),
 		"--token",
-		kubeConfig.K8sInitToken,
+		string(kubeConfig.K8sInitToken.Bytes()),
 	}
-	logger.Infof("/usr/bin/kubeadm %s", strings.Replace(strings.Join(kubeInitArgs, " "), kubeConfig.K8sInitToken, "XXXXXXX", 1))
+	logger.Info(kubeadmCommandLine(kubeInitArgs))
 	command := exec.Command("/usr/bin/kubeadm", kubeInitArgs...)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(clients.GetOsClient(), command)
 
 	logger.Info(string(outputText))
 
@@ -3,39 +3,94 @@ package k8s
 import (
 	"crypto/sha256"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"maps"
 	"os/exec"
 	"strings"
-	"time"
 	"zs-vm-agent/clients"
 	"zs-vm-agent/services"
 
 	"github.com/sirupsen/logrus"
 )
 
+// AdditionalVolume is a worker data disk, the first partition of Layout (a single partition by default) is formatted
+// as Filesystem (xfs by default) and mounted at StorageLocation, growing with the disk when it spans all of it. Wipe
+// allows repartitioning a disk whose contents do not match Layout and Encryption puts the partition in a LUKS container.
+// A volume with a LogicalVolume ("vg/lv") is backed by that logical volume of VolumeGroups instead of the disk at Order
 type AdditionalVolume struct {
-	StorageLocation string `json:"storageLocation"`
-	Order           int    `json:"order"`
+	StorageLocation string                   `json:"storageLocation"`
+	Order           int                      `json:"order"`
+	LogicalVolume   string                   `json:"logicalVolume"`
+	Layout          *services.DiskLayout     `json:"layout"`
+	Wipe            bool                     `json:"wipe"`
+	Filesystem      services.FilesystemSpec  `json:"filesystem"`
+	Encryption      *services.EncryptionSpec `json:"encryption"`
 }
 
 type k8sConfig struct {
 	ControlPlaneEndpoint  string             `json:"controlPlaneEndpoint"`
 	ControllerIpAddresses []string           `json:"controllerIpAddresses"`
-	K8sInitToken          string             `json:"k8sInitToken"`
-	K8sCaInitPrivateKey   string             `json:"k8sCaInitPrivateKey"`
+	K8sInitToken          *clients.Secret    `json:"k8sInitToken"`
+	K8sCaInitPrivateKey   *clients.Secret    `json:"k8sCaInitPrivateKey"`
 	K8sCaInitPublicCert   string             `json:"k8sCaInitPublicCert"`
 	PodNetworkCidr        string             `json:"podNetworkCidr"`
 	ServiceNetworkCidr    string             `json:"serviceNetworkCidr"`
 	WorkerIpAddresses     []string           `json:"workerIpAddresses"`
 	AdditionalVolumes     []AdditionalVolume `json:"additionalVolumes"`
+	VolumeGroups          []VolumeGroup      `json:"volumeGroups"`
+	// EtcdLogicalVolume ("vg/lv") replaces the etcd drive, EtcdEncryption puts etcd's storage in a LUKS container
+	EtcdLogicalVolume string                   `json:"etcdLogicalVolume"`
+	EtcdEncryption    *services.EncryptionSpec `json:"etcdEncryption"`
 }
 
-var driveMappings = map[string]string{
-	"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi1": "/etc/kubernetes/",
-	"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi2": "/var/lib/kubelet/",
-	"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi3": "/var/lib/etcd/",
+// destroySecrets zeroes the token and keys once the node has joined or failed to
+func (kubeConfig *k8sConfig) destroySecrets() {
+	kubeConfig.K8sInitToken.Destroy()
+	kubeConfig.K8sCaInitPrivateKey.Destroy()
+	if kubeConfig.EtcdEncryption != nil {
+		kubeConfig.EtcdEncryption.Key.Destroy()
+	}
+	for _, volume := range kubeConfig.AdditionalVolumes {
+		if volume.Encryption != nil {
+			volume.Encryption.Key.Destroy()
+		}
+	}
+}
+
+// kubeadmCommandLine renders kubeadm arguments for the log with the bootstrap token left out
+func kubeadmCommandLine(arguments []string) string {
+	logged := make([]string, len(arguments))
+	copy(logged, arguments)
+	for index := range logged {
+		if logged[index] == "--token" && index+1 < len(logged) {
+			logged[index+1] = "<token>"
+		}
+	}
+	return "/usr/bin/kubeadm " + strings.Join(logged, " ")
+}
+
+// VolumeGroup is an LVM volume group spanning the attached disks with the given orders
+type VolumeGroup struct {
+	Name           string                       `json:"name"`
+	Disks          []int                        `json:"disks"`
+	LogicalVolumes []services.LogicalVolumeSpec `json:"logicalVolumes"`
+}
+
+// orders of the k8s disks in the VM definition
+const etcdDiskOrder = 3
+const configDiskOrder = 4
+
+var configVolume = services.ConfigVolumeQuery{Label: "ZS-K8S-CONFIG"}
+
+// k8sDrives returns the drives every node mounts, the etcd drive is left out when etcd lives on a logical volume
+func k8sDrives(kubeConfig *k8sConfig) []AdditionalVolume {
+	drives := []AdditionalVolume{
+		{Order: 1, StorageLocation: "/etc/kubernetes/"},
+		{Order: 2, StorageLocation: "/var/lib/kubelet/"},
+	}
+	if kubeConfig.EtcdLogicalVolume == "" {
+		drives = append(drives, AdditionalVolume{Order: etcdDiskOrder, StorageLocation: "/var/lib/etcd/", Encryption: kubeConfig.EtcdEncryption})
+	}
+	return drives
 }
 
 var requiredServices = []string{
@@ -43,14 +98,50 @@ var requiredServices = []string{
 	"containerd",
 }
 
-func Setup(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
+// Setup mounts the k8s drives and starts the services every node needs. kubeadm joins the system it runs on to the
+// cluster, so the role is refused under a host root
+func Setup(logger *logrus.Logger, vmDetails clients.ProxmoxVm, kubeConfig *k8sConfig) error {
+	if clients.GetHostRoot() != "/" {
+		logger.Errorf("The k8s roles join the running system to the cluster and cannot be applied under host root %s", clients.GetHostRoot())
+		return fmt.Errorf("the k8s roles cannot be applied under host root %s: %w", clients.GetHostRoot(), clients.ErrHostRoot)
+	}
+
+	applyVolumeGroupsError := applyVolumeGroups(logger, vmDetails, kubeConfig.VolumeGroups)
+
+	if applyVolumeGroupsError != nil {
+		return applyVolumeGroupsError
+	}
+
+	var logicalVolumes []AdditionalVolume
+	if kubeConfig.EtcdLogicalVolume != "" {
+		logicalVolumes = append(logicalVolumes, AdditionalVolume{StorageLocation: "/var/lib/etcd/", LogicalVolume: kubeConfig.EtcdLogicalVolume, Encryption: kubeConfig.EtcdEncryption})
+	}
+
 	//mount k8s config drives
-	mountDrivesError := mountDrives(logger)
+	mountDrivesError := mountDrives(logger, vmDetails, k8sDrives(kubeConfig))
 
 	if mountDrivesError != nil {
 		return mountDrivesError
 	}
 
+	mountLogicalVolumesError := mountLogicalVolumes(logger, logicalVolumes)
+
+	if mountLogicalVolumesError != nil {
+		return mountLogicalVolumesError
+	}
+
+	configDrive, openConfigDriveError := services.GetFileSystemService().OpenConfigVolume(vmDetails, configVolume, configDiskOrder)
+
+	if openConfigDriveError != nil {
+		return openConfigDriveError
+	}
+
+	_, configureCertificatesError := services.GetCertificateService().ConfigureCertificates(configDrive, vmDetails)
+
+	if configureCertificatesError != nil {
+		return configureCertificatesError
+	}
+
 	systemdService := services.GetSystemdService()
 
 	// turn on kubelet systemd service
@@ -65,92 +156,181 @@ func Setup(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
 	return nil
 }
 
-func mountDrives(logger *logrus.Logger) error {
+// mountDrives partitions, formats and mounts each drive at its storage location, drives without a declared layout get
+// a single xfs partition that is grown to fill the disk
+func mountDrives(logger *logrus.Logger, vmDetails clients.ProxmoxVm, drives []AdditionalVolume) error {
 	filesystemService := services.GetFileSystemService()
 	diskService := services.GetDiskService()
-	for diskPath := range maps.Keys(driveMappings) {
-		logger.Debugf("Creating Directory %s", driveMappings[diskPath])
-		createDirectoryError := filesystemService.CreateRootFsDirectory(driveMappings[diskPath], false, 0640)
+
+	for _, drive := range drives {
+		logger.Debugf("Creating Directory %s", drive.StorageLocation)
+		createDirectoryError := filesystemService.CreateRootFsDirectory(drive.StorageLocation, false, 0640)
 
 		if createDirectoryError != nil {
 			return createDirectoryError
 		}
 
-		dataDrive, getDiskError := diskService.GetDisk(diskPath)
-		if getDiskError != nil && strings.Contains(getDiskError.Error(), "device or resource busy") {
-			logger.Infof("Disk %s is busy, skipping...", diskPath)
-			continue
+		diskPath, resolveDiskError := diskService.ResolveDisk(vmDetails, drive.Order)
 
-		} else if getDiskError != nil {
-			return getDiskError
+		if resolveDiskError != nil {
+			return resolveDiskError
 		}
 
-		partTable, getPartTableError := dataDrive.GetPartitionTable()
+		encryption := driveEncryption(drive, diskPath)
+		partitionPath := diskService.PartitionDevicePath(diskPath, 1)
 
-		if (getPartTableError != nil && strings.Contains(getPartTableError.Error(), "unknown disk partition type")) || len(partTable.GetPartitions()) == 0 {
-			logger.Debugf("No Partitions found for %s, creating...", diskPath)
-			createDiskPartitionError := diskService.CreatePartition(diskPath)
+		mountedDevice := partitionPath
+		if encryption != nil {
+			mountedDevice = encryption.MappedDevicePath()
+		}
 
-			if createDiskPartitionError != nil {
-				logger.Errorf("Failed to create partition for disk %s: %s", diskPath, createDiskPartitionError.Error())
-				return createDiskPartitionError
-			}
-			time.Sleep(5 * time.Second)
-			logger.Debugf("Getting updated partition table for disk %s", diskPath)
-			partTable, getPartTableError = dataDrive.GetPartitionTable()
-			if getPartTableError != nil {
-				logger.Errorf("Failed to get Partition Table from disk after creation %s: %s", diskPath, getPartTableError.Error())
-				return getPartTableError
-			}
-			if len(partTable.GetPartitions()) == 0 {
-				logger.Error("No partitions found after creating a new partition")
-				return errors.New("no partitions found after creating new partition")
-			}
-		} else if getPartTableError != nil {
-			logger.Errorf("Failed to get Partition Table from disk %s: %s", diskPath, getPartTableError.Error())
-			return getPartTableError
+		partitionError := filesystemService.PartitionDisk(diskPath, drive.Layout, drive.Wipe, mountedDevice, drive.StorageLocation)
+
+		if partitionError != nil {
+			return partitionError
 		}
 
-		closeDiskError := dataDrive.Close()
+		mountError := mountVolume(logger, partitionPath, drive.StorageLocation, drive.Filesystem, encryption)
 
-		if closeDiskError != nil {
-			logger.Errorf("Failed to close disk %s: %s", diskPath, closeDiskError.Error())
-			return closeDiskError
+		if mountError != nil {
+			return mountError
 		}
 
-		createFilesystemError := filesystemService.CreateXfsFileSystem(fmt.Sprintf("%s-part1", diskPath))
+		if drive.Layout == nil || (len(drive.Layout.Partitions) == 1 && drive.Layout.Partitions[0].Size == "") {
+			growError := services.GetMountService().GrowMount(diskPath, 1, drive.StorageLocation, drive.Filesystem, encryption)
 
-		if createFilesystemError != nil {
-			errorMessage := createFilesystemError.Error()
-			if !strings.Contains(errorMessage, "appears to contain an existing filesystem") {
-				logger.Debug("Actual Error create filesystem, returning error")
-				return createFilesystemError
+			if growError != nil {
+				logger.Warnf("Continuing without growing %s: %s", drive.StorageLocation, growError.Error())
 			}
 		}
 
-		logger.Debugf("Mounting filesystemd for partition on %s-part1 to %s", diskPath, driveMappings[diskPath])
+		//setFolderOwnerError := filesystemService.SetRootFsOwner("/opt/vault", "vault", true)
+		//if setFolderOwnerError != nil {
+		//	return setFolderOwnerError
+		//}
+	}
+
+	return nil
+}
+
+// mountLogicalVolumes mounts volumes backed by logical volumes and grows their filesystems, which does nothing when
+// they already fill the logical volume
+func mountLogicalVolumes(logger *logrus.Logger, volumes []AdditionalVolume) error {
+	for _, volume := range volumes {
+		volumeGroup, logicalVolume, validName := strings.Cut(volume.LogicalVolume, "/")
+
+		if !validName {
+			logger.Errorf("Logical volume %s is not named as vg/lv", volume.LogicalVolume)
+			return fmt.Errorf("logical volume %s is not named as vg/lv", volume.LogicalVolume)
+		}
+
+		createDirectoryError := services.GetFileSystemService().CreateRootFsDirectory(volume.StorageLocation, false, 0640)
+
+		if createDirectoryError != nil {
+			return createDirectoryError
+		}
+
+		encryption := volume.Encryption
+		if encryption != nil && encryption.Name == "" {
+			named := *encryption
+			named.Name = fmt.Sprintf("k8s-%s-%s", volumeGroup, logicalVolume)
+			encryption = &named
+		}
 
-		mountError := filesystemService.MountFilesystem(fmt.Sprintf("%s-part1", diskPath), driveMappings[diskPath])
+		devicePath := services.GetLvmService().LogicalVolumePath(volumeGroup, logicalVolume)
+		mountError := mountVolume(logger, devicePath, volume.StorageLocation, volume.Filesystem, encryption)
 
 		if mountError != nil {
 			return mountError
 		}
 
-		//setFolderOwnerError := filesystemService.SetRootFsOwner("/opt/vault", "vault", true)
-		//if setFolderOwnerError != nil {
-		//	return setFolderOwnerError
-		//}
+		growError := services.GetMountService().GrowMountedFilesystem(devicePath, volume.StorageLocation, volume.Filesystem, encryption)
+
+		if growError != nil {
+			logger.Warnf("Continuing without growing %s: %s", volume.StorageLocation, growError.Error())
+		}
+	}
+
+	return nil
+}
+
+// mountVolume opens the LUKS container on devicePath when encrypted, formats it when blank and mounts it persistently
+// ahead of kubelet
+func mountVolume(logger *logrus.Logger, devicePath string, mountPath string, filesystem services.FilesystemSpec, encryption *services.EncryptionSpec) error {
+	filesystemService := services.GetFileSystemService()
+
+	if encryption != nil {
+		var openError error
+		devicePath, openError = services.GetEncryptionService().OpenEncryptedDevice(devicePath, *encryption)
+
+		if openError != nil {
+			return openError
+		}
+	}
+
+	createFilesystemError := filesystemService.CreateFileSystem(devicePath, filesystem)
+
+	if createFilesystemError != nil {
+		return createFilesystemError
+	}
+
+	logger.Debugf("Mounting filesystem on %s to %s", devicePath, mountPath)
+
+	return services.GetMountService().PersistMount(devicePath, mountPath, filesystem, encryption, []string{"kubelet.service"})
+}
+
+// applyVolumeGroups creates and extends the declared volume groups
+func applyVolumeGroups(logger *logrus.Logger, vmDetails clients.ProxmoxVm, volumeGroups []VolumeGroup) error {
+	for _, volumeGroup := range volumeGroups {
+		spec := services.VolumeGroupSpec{Name: volumeGroup.Name, LogicalVolumes: volumeGroup.LogicalVolumes}
+		for _, order := range volumeGroup.Disks {
+			diskPath, resolveDiskError := services.GetDiskService().ResolveDisk(vmDetails, order)
+
+			if resolveDiskError != nil {
+				return resolveDiskError
+			}
+			spec.Devices = append(spec.Devices, diskPath)
+		}
+
+		grown, applyError := services.GetLvmService().ApplyVolumeGroup(spec)
+
+		if applyError != nil {
+			return applyError
+		}
+
+		for _, logicalVolume := range grown {
+			logger.Infof("Logical volume %s/%s grew", volumeGroup.Name, logicalVolume)
+		}
 	}
 
 	return nil
 }
 
-func loadConfig(logger *logrus.Logger) (*k8sConfig, error) {
+// driveEncryption returns the declared encryption of a drive, its LUKS container is named after the drive unless the
+// config names it
+func driveEncryption(drive AdditionalVolume, diskPath string) *services.EncryptionSpec {
+	encryption := drive.Encryption
+
+	if encryption == nil || encryption.Name != "" {
+		return encryption
+	}
+
+	driveName := fmt.Sprintf("disk%d", drive.Order)
+	if _, scsiDrive, isScsi := strings.Cut(diskPath, "drive-"); isScsi {
+		driveName = scsiDrive
+	}
+
+	named := *encryption
+	named.Name = fmt.Sprintf("k8s-%s", driveName)
+	return &named
+}
+
+func loadConfig(logger *logrus.Logger, vmDetails clients.ProxmoxVm) (*k8sConfig, error) {
 	filesystemService := services.GetFileSystemService()
 
 	logger.Debug("Loading config filesystem")
 	////Get filesystem containing k8s config
-	configDrive, getFileSystemError := filesystemService.GetBlockFilesystem("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi4")
+	configDrive, getFileSystemError := services.GetFileSystemService().OpenConfigVolume(vmDetails, configVolume, configDiskOrder)
 
 	if getFileSystemError != nil {
 		return nil, getFileSystemError
@@ -164,6 +344,13 @@ func loadConfig(logger *logrus.Logger) (*k8sConfig, error) {
 		return nil, readConfigFileError
 	}
 
+	logger.Debug("Resolving secrets")
+	k8sConfigBytes, readConfigFileError = services.GetSecretService().ResolveSecrets(configDrive, k8sConfigBytes)
+
+	if readConfigFileError != nil {
+		return nil, readConfigFileError
+	}
+
 	var parsedConfig k8sConfig
 
 	logger.Debug("Reading Json")
@@ -172,6 +359,7 @@ func loadConfig(logger *logrus.Logger) (*k8sConfig, error) {
 	if jsonProcessingError != nil {
 		return nil, jsonProcessingError
 	}
+	clients.ZeroBytes(k8sConfigBytes)
 
 	//return config object
 
@@ -210,7 +398,7 @@ func loadPublicKey(logger *logrus.Logger) error {
 	logger.Debugf("/bin/openssl %s", strings.Join(hashArgs, " "))
 	command := exec.Command("/bin/openssl", hashArgs...)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(clients.GetOsClient(), command)
 
 	for _, line := range strings.Split(string(outputText), "\n") {
 		logger.Info(line)
@@ -236,7 +424,7 @@ func convertPenToDer(logger *logrus.Logger) ([]byte, error) {
 	logger.Debugf("/bin/openssl %s", strings.Join(hashArgs, " "))
 	command := exec.Command("/bin/openssl", hashArgs...)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(clients.GetOsClient(), command)
 
 	for _, line := range strings.Split(string(outputText), "\n") {
 		logger.Info(line)
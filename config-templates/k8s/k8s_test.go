@@ -0,0 +1,74 @@
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// useMemoryHost runs the services against an in-memory host
+func useMemoryHost(t *testing.T) *clients.MemoryOsClient {
+	host := clients.NewMemoryOsClient()
+
+	previousOsClient := clients.GetOsClient()
+	clients.SetOsClient(host)
+	t.Cleanup(func() {
+		clients.SetOsClient(previousOsClient)
+		services.Initialize(&logrus.Logger{})
+	})
+	services.Initialize(&logrus.Logger{})
+	return host
+}
+
+func TestLoadConfig(t *testing.T) {
+	host := useMemoryHost(t)
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), "vdb.img"), "vdb", configVolume.Label, map[string]string{
+		"k8s-config.json": `{"controlPlaneEndpoint":"k8s.example:6443","k8sInitToken":"abcdef.0123456789abcdef","controllerIpAddresses":["10.0.0.10"]}`,
+	}))
+
+	kubeConfig, loadError := loadConfig(&logrus.Logger{}, clients.ProxmoxVm{})
+
+	assert.Nil(t, loadError)
+	assert.Equal(t, "k8s.example:6443", kubeConfig.ControlPlaneEndpoint)
+	assert.Equal(t, []string{"10.0.0.10"}, kubeConfig.ControllerIpAddresses)
+	assert.Equal(t, "abcdef.0123456789abcdef", kubeConfig.K8sInitToken.Reveal())
+}
+
+func TestLoadCertificates(t *testing.T) {
+	host := useMemoryHost(t)
+	host.AddDirectory("/etc/kubernetes", 0755)
+	kubeConfig := &k8sConfig{
+		K8sCaInitPublicCert: "certificate\n",
+		K8sCaInitPrivateKey: clients.NewSecret([]byte("private key\n")),
+	}
+
+	loadError := loadCertificates(&logrus.Logger{}, kubeConfig)
+
+	assert.Nil(t, loadError)
+
+	pki, _ := host.Node("/etc/kubernetes/pki")
+	assert.Equal(t, os.FileMode(0751), pki.Mode.Perm())
+	certificate, _ := host.Node("/etc/kubernetes/pki/ca.crt")
+	assert.Equal(t, os.FileMode(0644), certificate.Mode.Perm())
+	assert.Equal(t, "certificate\n", string(certificate.Contents))
+	privateKey, _ := host.Node("/etc/kubernetes/pki/ca.key")
+	assert.Equal(t, os.FileMode(0600), privateKey.Mode.Perm())
+	assert.Equal(t, "private key", string(privateKey.Contents))
+}
+
+func TestLoadCertificates_existing(t *testing.T) {
+	host := useMemoryHost(t)
+	host.AddFile("/etc/kubernetes/pki/ca.crt", []byte("existing\n"), 0644)
+
+	loadError := loadCertificates(&logrus.Logger{}, &k8sConfig{K8sCaInitPublicCert: "certificate\n"})
+
+	assert.Nil(t, loadError)
+
+	certificate, _ := host.ReadFile("/etc/kubernetes/pki/ca.crt")
+	assert.Equal(t, "existing\n", string(certificate))
+}
@@ -3,6 +3,8 @@ package loadbalancer
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"zs-vm-agent/clients"
 	"zs-vm-agent/services"
 
@@ -14,17 +16,32 @@ var systemServices = [...]string{
 	"haproxy",
 }
 
+// orders of the config and keepalived config drive disks in the VM definition
+const configDiskOrder = 1
+const keepalivedDiskOrder = 2
+
+// config volumes are found by label wherever they are attached
+var configVolume = services.ConfigVolumeQuery{Label: "ZS-LB-CONFIG"}
+var keepalivedVolume = services.ConfigVolumeQuery{Label: "ZS-LB-KEEPALIVED"}
+
+// SELinux labels of the copied configs, set as each file is written so none is ever readable with a wrong label
+const haproxyConfigLabel = "system_u:object_r:etc_t:s0"
+const keepalivedConfigLabel = "system_u:object_r:keepalived_var_run_t:s0"
+
+// fileMapping copies a file with permissions, or a directory whose files get directoryFilesPermissions
 type fileMapping struct {
 	path                      string
 	permissions               int
 	directoryFilesPermissions int
+	mirror                    bool
+	seLinuxLabel              string
 }
 
 func SetupLoadBalancer(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
 	logger.Info("Setting up as load balancer")
 	var fileSystemService = services.GetFileSystemService()
 
-	filePermissionError := initializeFileSystem(logger, fileSystemService)
+	filePermissionError := initializeFileSystem(logger, fileSystemService, vmDetails)
 
 	if filePermissionError != nil {
 		return filePermissionError
@@ -52,8 +69,8 @@ func SetupLoadBalancer(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error
 	return nil
 }
 
-func initializeFileSystem(logger *logrus.Logger, filesystemService services.FileSystemService) error {
-	fs, getFileSystemError := filesystemService.GetBlockFilesystem("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi1")
+func initializeFileSystem(logger *logrus.Logger, filesystemService services.FileSystemService, vmDetails clients.ProxmoxVm) error {
+	fs, getFileSystemError := filesystemService.OpenConfigVolume(vmDetails, configVolume, configDiskOrder)
 
 	logger.Info("Creating directories")
 
@@ -75,7 +92,7 @@ func initializeFileSystem(logger *logrus.Logger, filesystemService services.File
 			return directoryCreationError
 		}
 		logger.Debugf("Setting root fs owner for %s to haproxy", directory)
-		setOwnerError := filesystemService.SetRootFsOwner(directory, "haproxy", false)
+		_, setOwnerError := filesystemService.SetRootFsOwner(directory, "haproxy", false)
 
 		if setOwnerError != nil {
 			return setOwnerError
@@ -86,18 +103,22 @@ func initializeFileSystem(logger *logrus.Logger, filesystemService services.File
 
 	copyFilesError := copyFiles(fs, map[string]fileMapping{
 		"haproxy.cfg": {
-			path:        "/etc/haproxy/haproxy.cfg",
-			permissions: 0755,
+			path:         "/etc/haproxy/haproxy.cfg",
+			permissions:  0755,
+			seLinuxLabel: haproxyConfigLabel,
 		},
 		"certs": {
 			path:                      "/etc/haproxy/certs",
-			permissions:               0600,
+			permissions:               0700,
 			directoryFilesPermissions: 0600,
+			seLinuxLabel:              haproxyConfigLabel,
 		},
 		"conf.d": {
 			path:                      "/etc/haproxy/conf.d/",
 			permissions:               0755,
 			directoryFilesPermissions: 0644,
+			mirror:                    true,
+			seLinuxLabel:              haproxyConfigLabel,
 		},
 		"vm-config.json": {
 			path:        "/tmp/vm-config.json",
@@ -109,7 +130,13 @@ func initializeFileSystem(logger *logrus.Logger, filesystemService services.File
 		return copyFilesError
 	}
 
-	fs, getFileSystemError = filesystemService.GetBlockFilesystem("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi2")
+	_, configureCertificatesError := services.GetCertificateService().ConfigureCertificates(fs, vmDetails)
+
+	if configureCertificatesError != nil {
+		return configureCertificatesError
+	}
+
+	fs, getFileSystemError = filesystemService.OpenConfigVolume(vmDetails, keepalivedVolume, keepalivedDiskOrder)
 
 	if getFileSystemError != nil {
 		return getFileSystemError
@@ -117,8 +144,9 @@ func initializeFileSystem(logger *logrus.Logger, filesystemService services.File
 
 	copyFilesError = copyFiles(fs, map[string]fileMapping{
 		"keepalived.conf": {
-			path:        "/etc/keepalived/keepalived.conf",
-			permissions: 0600,
+			path:         "/etc/keepalived/keepalived.conf",
+			permissions:  0600,
+			seLinuxLabel: keepalivedConfigLabel,
 		},
 	}, logger)
 
@@ -126,20 +154,6 @@ func initializeFileSystem(logger *logrus.Logger, filesystemService services.File
 		return copyFilesError
 	}
 
-	selinuxService := services.GetSeLinuxService()
-
-	changeContextError := selinuxService.ChangeContext("/etc/haproxy", "system_u", "object_r", "etc_t", true)
-
-	if changeContextError != nil {
-		return changeContextError
-	}
-
-	changeContextError = selinuxService.ChangeContext("/etc/keepalived", "system_u", "object_r", "keepalived_var_run_t", true)
-
-	if changeContextError != nil {
-		return changeContextError
-	}
-
 	return nil
 }
 
@@ -147,17 +161,30 @@ func copyFiles(sourceFs clients.FileSystemWrapper, sources map[string]fileMappin
 	filesystemService := services.GetFileSystemService()
 	for sourceFile, destFile := range sources {
 		logger.Debugf("Triggering copy for %s to %s", sourceFile, destFile.path)
-		copyError := filesystemService.CopyFilesToRootFs(sourceFs, sourceFile, destFile.path, true)
+		// config drive filesystems only take paths from their root
+		sourcePath := fmt.Sprintf("/%s", sourceFile)
+		var copyError error
+		if destFile.directoryFilesPermissions != 0 {
+			_, copyError = filesystemService.CopyTreeToRootFs(sourceFs, sourcePath, destFile.path, services.TreeCopyOptions{
+				Recursive:     true,
+				DirectoryMode: os.FileMode(destFile.permissions),
+				FileAttributes: services.FileAttributes{
+					Mode:         os.FileMode(destFile.directoryFilesPermissions),
+					SeLinuxLabel: destFile.seLinuxLabel,
+				},
+				Exclude: []string{"lost+found"},
+				// backends removed from the config drive must not linger in haproxy's config
+				MirrorDeletes: destFile.mirror,
+			})
+		} else {
+			_, copyError = filesystemService.CopyFileToRootFs(sourceFs, sourcePath, destFile.path, services.FileAttributes{
+				Mode:         os.FileMode(destFile.permissions),
+				SeLinuxLabel: destFile.seLinuxLabel,
+			})
+		}
 		if copyError != nil {
 			return copyError
 		}
-		logger.Debugf("Setting permissions for %s", sourceFile)
-		setPermissionsError := filesystemService.SetRootFsPermissions(destFile.path, destFile.directoryFilesPermissions, true)
-
-		if setPermissionsError != nil {
-			logger.Error(setPermissionsError.Error())
-			return setPermissionsError
-		}
 		logger.Debugf("Finished copy for %s", sourceFile)
 	}
 	return nil
@@ -2,8 +2,16 @@ package loadbalancer
 
 import (
 	"encoding/json"
-	"github.com/stretchr/testify/assert"
+	"os"
+	"os/user"
+	"path/filepath"
 	"testing"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestJsonMarshalTest(t *testing.T) {
@@ -18,3 +26,105 @@ func TestJsonMarshalTest(t *testing.T) {
 
 	assert.NotEqual(t, 0, len(configObject.Ports))
 }
+
+// useMemoryHost runs the services against an in-memory host on which haproxy is uid and gid 188
+func useMemoryHost(t *testing.T, ctrl *gomock.Controller) *clients.MemoryOsClient {
+	host := clients.NewMemoryOsClient()
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("haproxy").Return(&user.User{Uid: "188", Gid: "188"}, nil).AnyTimes()
+
+	previousOsClient, previousUserClient := clients.GetOsClient(), clients.GetUserClient()
+	clients.SetOsClient(host)
+	clients.SetUserClient(mockUserClient)
+	t.Cleanup(func() {
+		clients.SetOsClient(previousOsClient)
+		clients.SetUserClient(previousUserClient)
+		services.Initialize(&logrus.Logger{})
+	})
+	services.Initialize(&logrus.Logger{})
+	return host
+}
+
+func TestInitializeFileSystem(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	host.AddDirectory("/etc/keepalived", 0755)
+	host.AddDirectory("/tmp", 0777)
+	host.AddFile("/etc/haproxy/conf.d/removed.cfg", []byte("backend removed\n"), 0644)
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), "vdb.img"), "vdb", configVolume.Label, map[string]string{
+		"haproxy.cfg":        "global\n",
+		"certs/site.pem":     "certificate and key\n",
+		"conf.d/backend.cfg": "backend web\n",
+		"vm-config.json":     "{}\n",
+	}))
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), "vdc.img"), "vdc", keepalivedVolume.Label, map[string]string{
+		"keepalived.conf": "vrrp_instance VI_1 {}\n",
+	}))
+
+	initializeError := initializeFileSystem(&logrus.Logger{}, services.GetFileSystemService(), clients.ProxmoxVm{})
+
+	assert.Nil(t, initializeError)
+
+	certs, _ := host.Node("/etc/haproxy/certs")
+	assert.Equal(t, os.FileMode(0700), certs.Mode.Perm())
+	assert.Equal(t, 188, certs.Uid)
+
+	// the certificate is never readable with the wrong mode or label
+	certificate, found := host.Node("/etc/haproxy/certs/site.pem")
+	assert.True(t, found)
+	assert.Equal(t, os.FileMode(0600), certificate.Mode.Perm())
+	assert.Equal(t, []byte(haproxyConfigLabel), certificate.Xattrs["security.selinux"])
+
+	haproxyCfg, _ := host.Node("/etc/haproxy/haproxy.cfg")
+	assert.Equal(t, "global\n", string(haproxyCfg.Contents))
+	assert.Equal(t, []byte(haproxyConfigLabel), haproxyCfg.Xattrs["security.selinux"])
+
+	backend, found := host.Node("/etc/haproxy/conf.d/backend.cfg")
+	assert.True(t, found)
+	assert.Equal(t, os.FileMode(0644), backend.Mode.Perm())
+	_, found = host.Node("/etc/haproxy/conf.d/removed.cfg")
+	assert.False(t, found)
+
+	keepalivedConf, _ := host.Node("/etc/keepalived/keepalived.conf")
+	assert.Equal(t, os.FileMode(0600), keepalivedConf.Mode.Perm())
+	assert.Equal(t, []byte(keepalivedConfigLabel), keepalivedConf.Xattrs["security.selinux"])
+}
+
+func TestSetupLoadBalancer_hostRoot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	host.AddFile("/mnt/image/etc/passwd", []byte("haproxy:x:188:188::/var/lib/haproxy:/sbin/nologin\n"), 0644)
+	host.AddDirectory("/mnt/image/etc/keepalived", 0755)
+	host.AddDirectory("/mnt/image/etc/systemd/system", 0755)
+	host.AddDirectory("/mnt/image/tmp", 0777)
+	for _, service := range systemServices {
+		host.AddFile("/mnt/image/usr/lib/systemd/system/"+service+".service", []byte("[Install]\nWantedBy=multi-user.target\n"), 0644)
+	}
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), "vdb.img"), "vdb", configVolume.Label, map[string]string{
+		"haproxy.cfg":        "global\n",
+		"certs/site.pem":     "certificate and key\n",
+		"conf.d/backend.cfg": "backend web\n",
+		"vm-config.json":     `{"ports":[{"port":8443,"protocol":"tcp"}]}`,
+	}))
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), "vdc.img"), "vdc", keepalivedVolume.Label, map[string]string{
+		"keepalived.conf": "vrrp_instance VI_1 {}\n",
+	}))
+	clients.SetHostRoot("/mnt/image")
+	t.Cleanup(func() { clients.SetHostRoot("/") })
+	services.Initialize(&logrus.Logger{})
+
+	setupError := SetupLoadBalancer(&logrus.Logger{}, clients.ProxmoxVm{})
+
+	// the image is configured and its services enabled without a command run on the system building it
+	assert.Nil(t, setupError)
+	assert.Empty(t, host.Commands())
+	certs, found := host.Node("/mnt/image/etc/haproxy/certs")
+	assert.True(t, found)
+	assert.Equal(t, 188, certs.Uid)
+	for _, service := range systemServices {
+		_, found = host.Node("/mnt/image/etc/systemd/system/multi-user.target.wants/" + service + ".service")
+		assert.True(t, found, service)
+	}
+}
@@ -0,0 +1,166 @@
+package vault
+
+import (
+	"bytes"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/sirupsen/logrus"
+)
+
+const auditLogrotatePath = "/etc/logrotate.d/vault-audit"
+const defaultAuditLogRotate = 30
+
+const auditLogrotateTemplate = `{{ range .Paths }}{{ . }} {{ end }}{
+    daily
+    rotate {{ .Rotate }}
+    compress
+    delaycompress
+    missingok
+    notifempty
+    create 0600 vault vault
+    postrotate
+        /bin/systemctl reload vault > /dev/null 2>&1 || true
+    endscript
+}
+`
+
+// bootstrapConfig declares the audit devices and auth methods that should exist once vault is unsealed, keyed by
+// mount path. ACL policies are read from the *.hcl files in PolicyDirectory on the config drive and named after them
+type bootstrapConfig struct {
+	Enabled         bool                                `json:"enabled"`
+	Audit           map[string]clients.VaultAuditDevice `json:"audit"`
+	Auth            map[string]clients.VaultAuthMount   `json:"auth"`
+	PolicyDirectory string                              `json:"policyDirectory"`
+	AuditLogRotate  int                                 `json:"auditLogRotate"`
+}
+
+// bootstrapVault brings audit devices, auth methods and policies in line with the config drive, every step only
+// changes what differs so it is safe to run on each boot and on every node of a cluster
+func bootstrapVault(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, config *vaultConfig, vaultApiUrl string) error {
+	session, connectError := connectVault(configs, config, vaultApiUrl)
+
+	if connectError != nil {
+		return connectError
+	}
+
+	vaultService := services.GetVaultService()
+
+	prepareAuditLogsError := prepareAuditLogs(logger, filesystemService, config.Bootstrap)
+
+	if prepareAuditLogsError != nil {
+		return prepareAuditLogsError
+	}
+
+	applyAuditError := vaultService.ApplyAuditDevices(session, config.Bootstrap.Audit)
+
+	if applyAuditError != nil {
+		return applyAuditError
+	}
+
+	applyAuthError := vaultService.ApplyAuthMethods(session, config.Bootstrap.Auth)
+
+	if applyAuthError != nil {
+		return applyAuthError
+	}
+
+	policies, readPoliciesError := readPolicies(logger, filesystemService, configs, config.Bootstrap.PolicyDirectory)
+
+	if readPoliciesError != nil {
+		return readPoliciesError
+	}
+
+	applyPoliciesError := vaultService.ApplyAclPolicies(session, policies)
+
+	if applyPoliciesError != nil {
+		return applyPoliciesError
+	}
+
+	services.GetStatusService().RecordEvent("vault", "bootstrap applied")
+	return nil
+}
+
+// prepareAuditLogs creates the directories of file audit devices for the vault user and rotates their logs, vault
+// reopens audit files when it is reloaded
+func prepareAuditLogs(logger *logrus.Logger, filesystemService services.FileSystemService, config bootstrapConfig) error {
+	var auditLogPaths []string
+	for _, auditDevice := range config.Audit {
+		if auditDevice.Type == "file" && strings.HasPrefix(auditDevice.Options["file_path"], "/") {
+			auditLogPaths = append(auditLogPaths, auditDevice.Options["file_path"])
+		}
+	}
+
+	if len(auditLogPaths) == 0 {
+		return nil
+	}
+	sort.Strings(auditLogPaths)
+
+	for _, auditLogPath := range auditLogPaths {
+		auditLogDirectory := filepath.Dir(auditLogPath)
+		createDirectoryError := filesystemService.CreateRootFsDirectory(auditLogDirectory, true, 0750)
+
+		if createDirectoryError != nil {
+			return createDirectoryError
+		}
+
+		_, setOwnerError := filesystemService.SetRootFsOwner(auditLogDirectory, "vault", false)
+
+		if setOwnerError != nil {
+			return setOwnerError
+		}
+	}
+
+	rotate := config.AuditLogRotate
+	if rotate <= 0 {
+		rotate = defaultAuditLogRotate
+	}
+
+	var renderedLogrotate bytes.Buffer
+	renderError := template.Must(template.New("logrotate").Parse(auditLogrotateTemplate)).Execute(&renderedLogrotate, struct {
+		Paths  []string
+		Rotate int
+	}{auditLogPaths, rotate})
+
+	if renderError != nil {
+		logger.Errorf("Failed to render audit logrotate config: %s", renderError.Error())
+		return renderError
+	}
+
+	return filesystemService.WriteFileContents(auditLogrotatePath, renderedLogrotate.Bytes(), 0644)
+}
+
+func readPolicies(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, policyDirectory string) (map[string]string, error) {
+	policies := make(map[string]string)
+
+	if policyDirectory == "" {
+		return policies, nil
+	}
+
+	policyDirectory = path.Join("/", policyDirectory)
+	fileInfos, readDirError := configs.ReadDir(policyDirectory)
+
+	if readDirError != nil {
+		logger.Errorf("Failed to read policy directory %s: %s", policyDirectory, readDirError.Error())
+		return nil, readDirError
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || !strings.HasSuffix(fileInfo.Name(), ".hcl") {
+			continue
+		}
+
+		policyBytes, readPolicyError := filesystemService.ReadFileContentsFromFilesystem(configs, path.Join(policyDirectory, fileInfo.Name()))
+
+		if readPolicyError != nil {
+			return nil, readPolicyError
+		}
+		policies[strings.TrimSuffix(fileInfo.Name(), ".hcl")] = string(policyBytes)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,400 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultSnapshotDirectory = "/var/lib/vault-snapshots"
+const defaultSnapshotInterval = 24 * time.Hour
+const defaultSnapshotRetention = 7
+const snapshotIndexFile = "index.json"
+const snapshotComponent = "vault-snapshots"
+
+// snapshotConfig enables scheduled raft snapshots, Disk is the order of an optional dedicated disk that is formatted
+// and mounted at Directory the same way the data store is. Device is the resolved disk, or a path given directly
+type snapshotConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Interval  string `json:"interval"`
+	Retain    int    `json:"retain"`
+	Directory string `json:"directory"`
+	Disk      int    `json:"disk"`
+	Device    string `json:"device"`
+	// Filesystem formats Device, xfs when unset, and Encryption optionally puts it in a LUKS container
+	Filesystem services.FilesystemSpec  `json:"filesystem"`
+	Encryption *services.EncryptionSpec `json:"encryption"`
+}
+
+type snapshotMetadata struct {
+	File    string    `json:"file"`
+	Sha256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type snapshotter struct {
+	logger    *logrus.Logger
+	session   *services.VaultSession
+	directory string
+	retain    int
+}
+
+func scheduleSnapshots(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, config *vaultConfig, vaultApiUrl string) error {
+	interval := defaultSnapshotInterval
+	if config.Snapshots.Interval != "" {
+		var parseIntervalError error
+		interval, parseIntervalError = time.ParseDuration(config.Snapshots.Interval)
+
+		if parseIntervalError != nil {
+			logger.Errorf("Invalid snapshot interval %s: %s", config.Snapshots.Interval, parseIntervalError.Error())
+			return parseIntervalError
+		}
+
+		if interval <= 0 {
+			logger.Errorf("Invalid snapshot interval %s: must be positive", config.Snapshots.Interval)
+			return fmt.Errorf("snapshot interval %s must be positive", config.Snapshots.Interval)
+		}
+	}
+
+	snapshots, prepareError := newSnapshotter(logger, filesystemService, configs, config, vaultApiUrl, true)
+
+	if prepareError != nil {
+		return prepareError
+	}
+
+	return services.GetSchedulerService().Schedule("vault raft snapshot", interval, func() error {
+		_, snapshotError := snapshots.takeSnapshot()
+
+		if snapshotError != nil {
+			services.GetStatusService().SetComponentStatus(snapshotComponent, services.StateFailed, snapshotError.Error())
+			return snapshotError
+		}
+		services.GetStatusService().SetComponentStatus(snapshotComponent, services.StateOk, "last snapshot succeeded")
+		return nil
+	})
+}
+
+// newSnapshotter prepares the snapshot directory, when a dedicated disk is configured it is initialized for scheduled
+// snapshots, a restore only opens and mounts it so an unformatted disk is never formatted in its place
+func newSnapshotter(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, config *vaultConfig, vaultApiUrl string, initialize bool) (*snapshotter, error) {
+	directory := config.Snapshots.Directory
+	if directory == "" {
+		directory = defaultSnapshotDirectory
+	}
+
+	retain := config.Snapshots.Retain
+	if retain <= 0 {
+		retain = defaultSnapshotRetention
+	}
+
+	createDirectoryError := filesystemService.CreateRootFsDirectory(directory, true, 0750)
+
+	if createDirectoryError != nil {
+		return nil, createDirectoryError
+	}
+
+	if config.Snapshots.Device != "" && initialize {
+		initializeError := initializeDisk(logger, filesystemService, config.Snapshots.Device, directory, config.Snapshots.Filesystem, withDefaultName(config.Snapshots.Encryption, "vault-snapshots"), nil)
+
+		if initializeError != nil {
+			return nil, initializeError
+		}
+	} else if config.Snapshots.Device != "" {
+		mountError := mountSnapshotDisk(logger, filesystemService, config.Snapshots, directory)
+
+		if mountError != nil {
+			return nil, mountError
+		}
+	}
+
+	session, connectError := connectVault(configs, config, vaultApiUrl)
+
+	if connectError != nil {
+		return nil, connectError
+	}
+
+	return &snapshotter{logger: logger, session: session, directory: directory, retain: retain}, nil
+}
+
+// mountSnapshotDisk opens and mounts an existing snapshot disk at directory, a disk without a filesystem holds no
+// snapshots and is refused rather than formatted
+func mountSnapshotDisk(logger *logrus.Logger, filesystemService services.FileSystemService, config snapshotConfig, directory string) error {
+	devicePath := services.GetDiskService().PartitionDevicePath(config.Device, 1)
+	existingType, probeError := filesystemService.ProbeFileSystem(devicePath)
+
+	if probeError != nil {
+		return probeError
+	}
+
+	if existingType == "" {
+		logger.Errorf("Snapshot disk %s holds no filesystem", devicePath)
+		return fmt.Errorf("snapshot disk %s holds no filesystem, there are no snapshots on it", devicePath)
+	}
+
+	encryption := withDefaultName(config.Encryption, "vault-snapshots")
+	if encryption != nil {
+		defer encryption.Key.Destroy()
+
+		var openError error
+		devicePath, openError = services.GetEncryptionService().OpenEncryptedDevice(devicePath, *encryption)
+
+		if openError != nil {
+			return openError
+		}
+	}
+
+	return filesystemService.MountFilesystem(devicePath, directory, config.Filesystem.Type)
+}
+
+// takeSnapshot streams a raft snapshot into a temporary file, checksumming it on the way, renames it into place
+// once flushed and records it in the index before pruning snapshots beyond the retention count
+func (snapshots *snapshotter) takeSnapshot() (*snapshotMetadata, error) {
+	osClient := clients.GetOsClient()
+	created := time.Now().UTC()
+	fileName := fmt.Sprintf("vault-raft-%s.snap", created.Format("20060102T150405Z"))
+	snapshotPath := filepath.Join(snapshots.directory, fileName)
+	partialPath := snapshotPath + ".partial"
+
+	snapshotFile, createFileError := osClient.CreateFile(partialPath, 0600)
+
+	if createFileError != nil {
+		snapshots.logger.Errorf("Failed to create snapshot file %s: %s", partialPath, createFileError.Error())
+		return nil, createFileError
+	}
+
+	hasher := sha256.New()
+	size, downloadError := services.GetVaultService().DownloadRaftSnapshot(snapshots.session, io.MultiWriter(snapshotFile, hasher))
+
+	if syncer, isSyncable := snapshotFile.(interface{ Sync() error }); isSyncable && downloadError == nil {
+		downloadError = syncer.Sync()
+	}
+	closeError := snapshotFile.Close()
+
+	if downloadError != nil || closeError != nil {
+		_ = osClient.Remove(partialPath)
+		return nil, errors.Join(downloadError, closeError)
+	}
+
+	renameError := osClient.Rename(partialPath, snapshotPath)
+
+	if renameError != nil {
+		snapshots.logger.Errorf("Failed to move snapshot %s into place: %s", snapshotPath, renameError.Error())
+		return nil, renameError
+	}
+
+	metadata := snapshotMetadata{File: fileName, Sha256: hex.EncodeToString(hasher.Sum(nil)), Size: size, Created: created}
+	snapshots.logger.Infof("Wrote vault snapshot %s (%d bytes, sha256 %s)", fileName, size, metadata.Sha256)
+
+	index, readIndexError := readSnapshotIndex(snapshots.directory)
+
+	if readIndexError != nil {
+		return nil, readIndexError
+	}
+
+	index = append(index, metadata)
+	index, pruneError := snapshots.prune(index)
+
+	if pruneError != nil {
+		return nil, pruneError
+	}
+
+	return &metadata, writeSnapshotIndex(snapshots.directory, index)
+}
+
+func (snapshots *snapshotter) prune(index []snapshotMetadata) ([]snapshotMetadata, error) {
+	sort.Slice(index, func(i, j int) bool { return index[i].Created.Before(index[j].Created) })
+
+	for len(index) > snapshots.retain {
+		snapshots.logger.Infof("Pruning vault snapshot %s", index[0].File)
+		removeError := clients.GetOsClient().Remove(filepath.Join(snapshots.directory, index[0].File))
+
+		if removeError != nil && !errors.Is(removeError, os.ErrNotExist) {
+			snapshots.logger.Errorf("Failed to prune snapshot %s: %s", index[0].File, removeError.Error())
+			return nil, removeError
+		}
+		index = index[1:]
+	}
+	return index, nil
+}
+
+func readSnapshotIndex(directory string) ([]snapshotMetadata, error) {
+	indexPath := filepath.Join(directory, snapshotIndexFile)
+	_, statFileError := clients.GetOsClient().StatFile(indexPath)
+
+	if errors.Is(statFileError, os.ErrNotExist) {
+		return nil, nil
+	} else if statFileError != nil {
+		return nil, statFileError
+	}
+
+	indexBytes, readIndexError := services.GetFileSystemService().ReadFileContents(indexPath)
+
+	if readIndexError != nil {
+		return nil, readIndexError
+	}
+
+	var index []snapshotMetadata
+	jsonProcessingError := json.Unmarshal(indexBytes, &index)
+
+	if jsonProcessingError != nil {
+		return nil, fmt.Errorf("failed to parse snapshot index %s: %w", indexPath, jsonProcessingError)
+	}
+	return index, nil
+}
+
+func writeSnapshotIndex(directory string, index []snapshotMetadata) error {
+	indexBytes, marshalError := json.MarshalIndent(index, "", "  ")
+
+	if marshalError != nil {
+		return marshalError
+	}
+
+	return services.GetFileSystemService().WriteFileContents(filepath.Join(directory, snapshotIndexFile), indexBytes, 0640)
+}
+
+// Restore implements `zs-vm-agent vault restore <snapshot> [--force]`, the snapshot is either a file name from the
+// snapshot index or a path. Indexed snapshots are verified against their recorded checksum before upload, snapshots
+// missing from the index are refused unless forced
+func Restore(logger *logrus.Logger, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: zs-vm-agent vault restore <snapshot> [--force]")
+	}
+	snapshotName := args[0]
+	force := len(args) > 1 && args[1] == "--force"
+
+	runningSystemError := requireRunningSystem(logger)
+
+	if runningSystemError != nil {
+		return runningSystemError
+	}
+
+	filesystemService := services.GetFileSystemService()
+	diskService := services.GetDiskService()
+	vmDetails, getVmDetailsError := clients.GetInfraConfigMapperClient().GetVmDetailsByHostname()
+
+	if getVmDetailsError != nil {
+		return getVmDetailsError
+	}
+
+	configDrive, openConfigDriveError := filesystemService.OpenConfigVolume(*vmDetails, configVolume, configDiskOrder)
+
+	if openConfigDriveError != nil {
+		return openConfigDriveError
+	}
+
+	config, loadConfigError := loadConfig(logger, filesystemService, configDrive)
+
+	if loadConfigError != nil {
+		return loadConfigError
+	}
+
+	if config.Snapshots.Disk != 0 {
+		var resolveSnapshotDiskError error
+		config.Snapshots.Device, resolveSnapshotDiskError = diskService.ResolveDisk(*vmDetails, config.Snapshots.Disk)
+
+		if resolveSnapshotDiskError != nil {
+			return resolveSnapshotDiskError
+		}
+	}
+
+	vaultApiUrl, readApiUrlError := readVaultApiUrl(filesystemService, configDrive)
+
+	if readApiUrlError != nil {
+		return readApiUrlError
+	}
+
+	snapshots, prepareError := newSnapshotter(logger, filesystemService, configDrive, config, vaultApiUrl, false)
+
+	if prepareError != nil {
+		return prepareError
+	}
+
+	snapshotPath := snapshotName
+	if !strings.Contains(snapshotName, "/") {
+		snapshotPath = filepath.Join(snapshots.directory, snapshotName)
+	}
+
+	verifyError := snapshots.verify(snapshotPath, force)
+
+	if verifyError != nil {
+		return verifyError
+	}
+
+	snapshotFile, openFileError := clients.GetOsClient().OpenFile(snapshotPath)
+
+	if openFileError != nil {
+		logger.Errorf("Failed to open snapshot %s: %s", snapshotPath, openFileError.Error())
+		return openFileError
+	}
+	defer snapshotFile.Close()
+
+	restoreError := services.GetVaultService().RestoreRaftSnapshot(snapshots.session, snapshotFile, force)
+
+	if restoreError != nil {
+		return restoreError
+	}
+
+	logger.Infof("Restored vault from snapshot %s", snapshotPath)
+	return nil
+}
+
+// verify checks an indexed snapshot against its recorded checksum, a snapshot missing from the index cannot be
+// verified and is only restored when forced
+func (snapshots *snapshotter) verify(snapshotPath string, force bool) error {
+	index, readIndexError := readSnapshotIndex(snapshots.directory)
+
+	if readIndexError != nil {
+		return readIndexError
+	}
+
+	var expected *snapshotMetadata
+	for i := range index {
+		if filepath.Join(snapshots.directory, index[i].File) == filepath.Clean(snapshotPath) {
+			expected = &index[i]
+		}
+	}
+
+	if expected == nil && !force {
+		snapshots.logger.Errorf("Snapshot %s is not in the snapshot index, pass --force to restore it unverified", snapshotPath)
+		return fmt.Errorf("snapshot %s is not in the snapshot index", snapshotPath)
+	} else if expected == nil {
+		snapshots.logger.Warnf("Snapshot %s is not in the snapshot index, restoring without checksum verification", snapshotPath)
+		return nil
+	}
+
+	snapshotFile, openFileError := clients.GetOsClient().OpenFile(snapshotPath)
+
+	if openFileError != nil {
+		return openFileError
+	}
+	defer snapshotFile.Close()
+
+	hasher := sha256.New()
+	_, hashError := io.Copy(hasher, snapshotFile)
+
+	if hashError != nil {
+		return hashError
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != expected.Sha256 {
+		snapshots.logger.Errorf("Snapshot %s checksum %s does not match indexed checksum %s", snapshotPath, actual, expected.Sha256)
+		return fmt.Errorf("snapshot %s failed checksum verification", snapshotPath)
+	}
+
+	snapshots.logger.Infof("Snapshot %s matches its indexed checksum", snapshotPath)
+	return nil
+}
@@ -0,0 +1,50 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotter_prune(t *testing.T) {
+	directory := t.TempDir()
+	now := time.Now()
+
+	index := []snapshotMetadata{
+		{File: "newest.snap", Created: now},
+		{File: "oldest.snap", Created: now.Add(-2 * time.Hour)},
+		{File: "middle.snap", Created: now.Add(-time.Hour)},
+	}
+	for _, metadata := range index {
+		assert.Nil(t, os.WriteFile(filepath.Join(directory, metadata.File), []byte("snapshot"), 0600))
+	}
+
+	snapshots := snapshotter{logger: &logrus.Logger{}, directory: directory, retain: 2}
+	pruned, pruneError := snapshots.prune(index)
+
+	assert.Nil(t, pruneError)
+	assert.Equal(t, []string{"middle.snap", "newest.snap"}, []string{pruned[0].File, pruned[1].File})
+	_, statError := os.Stat(filepath.Join(directory, "oldest.snap"))
+	assert.True(t, os.IsNotExist(statError))
+}
+
+func TestSnapshotter_verify_unindexed(t *testing.T) {
+	directory := t.TempDir()
+	snapshotPath := filepath.Join(directory, "copied-in.snap")
+	assert.Nil(t, os.WriteFile(snapshotPath, []byte("snapshot"), 0600))
+
+	snapshots := snapshotter{logger: &logrus.Logger{}, directory: directory, retain: 2}
+
+	assert.NotNil(t, snapshots.verify(snapshotPath, false))
+	assert.Nil(t, snapshots.verify(snapshotPath, true))
+}
+
+func TestScheduleSnapshots_nonPositiveInterval(t *testing.T) {
+	config := &vaultConfig{Snapshots: snapshotConfig{Enabled: true, Interval: "0s"}}
+
+	assert.NotNil(t, scheduleSnapshots(&logrus.Logger{}, nil, nil, config, ""))
+}
@@ -0,0 +1,310 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/sirupsen/logrus"
+)
+
+const vaultHclPath = "/etc/vault.d/vault.hcl"
+const transitCaCertPath = "/etc/vault.d/transit-ca.pem"
+
+// the transit token reaches vault through the environment so it is never written into vault.hcl
+const transitTokenEnvPath = "/etc/vault.d/transit-seal.env"
+const transitTokenDropInPath = "/etc/systemd/system/vault.service.d/transit-seal.conf"
+const transitTokenDropIn = "[Service]\nEnvironmentFile=" + transitTokenEnvPath + "\n"
+
+// a transit vault that is slow to answer delays the first unseal well past a normal start, after each timeout vault is
+// restarted so it retries the seal
+const defaultTransitUnsealTimeout = 5 * time.Minute
+const transitUnsealAttempts = 3
+
+type transitSealConfig struct {
+	Address       string         `json:"address"`
+	MountPath     string         `json:"mountPath"`
+	KeyName       string         `json:"keyName"`
+	TokenFile     string         `json:"tokenFile"`
+	AppRole       *appRoleConfig `json:"appRole"`
+	CaCertFile    string         `json:"caCertFile"`
+	TlsServerName string         `json:"tlsServerName"`
+	UnsealTimeout string         `json:"unsealTimeout"`
+}
+
+type appRoleConfig struct {
+	MountPath    string `json:"mountPath"`
+	RoleIdFile   string `json:"roleIdFile"`
+	SecretIdFile string `json:"secretIdFile"`
+}
+
+type transitSealTemplateData struct {
+	Address       string
+	MountPath     string
+	KeyName       string
+	TlsCaCert     string
+	TlsServerName string
+}
+
+var transitSealTemplate = template.Must(template.New("transitSeal").Funcs(template.FuncMap{"hcl": hclString}).Parse(`
+seal "transit" {
+  address         = {{ hcl .Address }}
+  disable_renewal = "false"
+  key_name        = {{ hcl .KeyName }}
+  mount_path      = {{ hcl (printf "%s/" .MountPath) }}
+{{- if .TlsCaCert }}
+  tls_ca_cert     = {{ hcl .TlsCaCert }}
+{{- end }}
+{{- if .TlsServerName }}
+  tls_server_name = {{ hcl .TlsServerName }}
+{{- end }}
+}
+`))
+
+// hclString quotes value as an HCL string, escaping quotes, backslashes, control characters and the ${ and %{
+// sequences HCL would otherwise expand
+func hclString(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for index, character := range value {
+		switch {
+		case character == '"' || character == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(character)
+		case character == '\n':
+			quoted.WriteString("\\n")
+		case character == '\r':
+			quoted.WriteString("\\r")
+		case character == '\t':
+			quoted.WriteString("\\t")
+		case character < 0x20 || character == 0x7f:
+			quoted.WriteString(fmt.Sprintf("\\u%04x", character))
+		case (character == '$' || character == '%') && strings.HasPrefix(value[index+1:], "{"):
+			quoted.WriteRune(character)
+			quoted.WriteRune(character)
+		default:
+			quoted.WriteRune(character)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// configureTransitSeal appends a transit seal stanza to the vault.hcl copied from the config drive, the token for
+// the unsealing vault is either read directly from the config drive or obtained through an approle login and handed to
+// vault as VAULT_TRANSIT_SEAL_TOKEN. It reports whether the running vault is still sealed with shamir keys and has to
+// be restarted to migrate to the transit seal
+func configureTransitSeal(logger *logrus.Logger, filesystemService services.FileSystemService, systemdService services.SystemdService, configs clients.FileSystemWrapper, config *transitSealConfig, vaultApiUrl string) (bool, error) {
+	if config.Address == "" || config.KeyName == "" {
+		logger.Error("Transit seal requires both an address and a key name")
+		return false, errors.New("transit seal requires both an address and a key name")
+	}
+
+	migrate, checkSealError := checkSealMigration(logger, configs, vaultApiUrl)
+
+	if checkSealError != nil {
+		return false, checkSealError
+	}
+
+	vaultHcl, readVaultHclError := filesystemService.ReadFileContents(vaultHclPath)
+
+	if readVaultHclError != nil {
+		return false, readVaultHclError
+	}
+
+	if strings.Contains(string(vaultHcl), "seal \"") {
+		logger.Errorf("%s already declares a seal stanza, refusing to add a transit seal", vaultHclPath)
+		return false, errors.New("vault.hcl already declares a seal stanza")
+	}
+
+	token, getTokenError := getTransitToken(logger, filesystemService, configs, config)
+
+	if getTokenError != nil {
+		return false, getTokenError
+	}
+	defer token.Destroy()
+
+	writeTokenError := writeTransitToken(logger, filesystemService, systemdService, token)
+
+	if writeTokenError != nil {
+		return false, writeTokenError
+	}
+
+	templateData := transitSealTemplateData{
+		Address:       config.Address,
+		MountPath:     strings.Trim(config.MountPath, "/"),
+		KeyName:       config.KeyName,
+		TlsServerName: config.TlsServerName,
+	}
+
+	if templateData.MountPath == "" {
+		templateData.MountPath = "transit"
+	}
+
+	if config.CaCertFile != "" {
+		_, copyCaError := filesystemService.CopySingleFileToRootFs(configs, config.CaCertFile, transitCaCertPath)
+
+		if copyCaError != nil {
+			return false, copyCaError
+		}
+		templateData.TlsCaCert = transitCaCertPath
+	}
+
+	var renderedSeal bytes.Buffer
+	renderError := transitSealTemplate.Execute(&renderedSeal, templateData)
+
+	if renderError != nil {
+		logger.Errorf("Failed to render transit seal stanza: %s", renderError.Error())
+		return false, renderError
+	}
+
+	logger.Infof("Configuring transit auto-unseal against %s", config.Address)
+
+	vaultHcl = append(vaultHcl, renderedSeal.Bytes()...)
+	return migrate, filesystemService.WriteFileContents(vaultHclPath, vaultHcl, 0640)
+}
+
+// checkSealMigration asks a running vault for its seal type before vault.hcl is changed. A vault initialized with
+// shamir keys only moves to the transit seal through a migrate unseal with those keys, without them on the config
+// drive it is refused here rather than left unable to unseal. A vault that is not running yet reports a migration
+// once it starts, which the unseal step handles
+func checkSealMigration(logger *logrus.Logger, configs clients.FileSystemWrapper, vaultApiUrl string) (bool, error) {
+	vaultStatus, getVaultStatusError := services.GetVaultService().GetSealStatus(vaultApiUrl)
+
+	if getVaultStatusError != nil {
+		logger.Debugf("Vault is not running at %s, its seal is checked once it starts: %s", vaultApiUrl, getVaultStatusError.Error())
+		return false, nil
+	}
+
+	if !vaultStatus.Initialized || vaultStatus.Type != "shamir" {
+		return false, nil
+	}
+
+	for _, keyFile := range unsealKeyFiles {
+		keyExists, checkKeyError := configFileExists(configs, keyFile)
+
+		if checkKeyError != nil {
+			return false, checkKeyError
+		}
+
+		if !keyExists {
+			logger.Errorf("Vault at %s is sealed with shamir keys and %s is missing from the config drive, refusing to switch it to the transit seal", vaultApiUrl, keyFile)
+			return false, fmt.Errorf("vault is sealed with shamir keys, migrating it to the transit seal needs %s on the config drive", strings.Join(unsealKeyFiles, ", "))
+		}
+	}
+
+	logger.Infof("Vault at %s is sealed with shamir keys, it will be migrated to the transit seal", vaultApiUrl)
+	return true, nil
+}
+
+// writeTransitToken writes the token to an environment file only root can read and points vault.service at it, systemd
+// reads the file before dropping privileges
+func writeTransitToken(logger *logrus.Logger, filesystemService services.FileSystemService, systemdService services.SystemdService, token *clients.Secret) error {
+	if bytes.ContainsAny(token.Bytes(), " \t\r\n\"'\\") {
+		logger.Error("The transit seal token contains characters an environment file cannot hold")
+		return errors.New("the transit seal token contains whitespace, quotes or backslashes")
+	}
+
+	environment := append([]byte("VAULT_TRANSIT_SEAL_TOKEN="), token.Bytes()...)
+	environment = append(environment, '\n')
+	_, writeEnvironmentError := filesystemService.WriteFileToRootFs(transitTokenEnvPath, environment, services.FileAttributes{Mode: 0600, Owner: "0", Group: "0"})
+	clients.ZeroBytes(environment)
+
+	if writeEnvironmentError != nil {
+		return writeEnvironmentError
+	}
+
+	createDirectoryError := filesystemService.CreateRootFsDirectory(path.Dir(transitTokenDropInPath), true, 0755)
+
+	if createDirectoryError != nil {
+		return createDirectoryError
+	}
+
+	dropInChanged, writeDropInError := filesystemService.WriteFileToRootFs(transitTokenDropInPath, []byte(transitTokenDropIn), services.FileAttributes{Mode: 0644})
+
+	if writeDropInError != nil {
+		return writeDropInError
+	}
+
+	if dropInChanged {
+		return systemdService.DaemonReload()
+	}
+	return nil
+}
+
+// waitForAutoUnseal waits for vault to unseal through the transit vault, restarting it after each timeout so it
+// retries the seal
+func waitForAutoUnseal(logger *logrus.Logger, systemdService services.SystemdService, config *transitSealConfig, vaultApiUrl string) error {
+	timeout := defaultTransitUnsealTimeout
+	if config.UnsealTimeout != "" {
+		var parseTimeoutError error
+		timeout, parseTimeoutError = time.ParseDuration(config.UnsealTimeout)
+
+		if parseTimeoutError != nil {
+			logger.Errorf("Invalid transit unseal timeout %s: %s", config.UnsealTimeout, parseTimeoutError.Error())
+			return parseTimeoutError
+		}
+	}
+
+	var waitError error
+	for attempt := 1; attempt <= transitUnsealAttempts; attempt++ {
+		waitError = services.GetVaultService().WaitForUnseal(vaultApiUrl, timeout)
+
+		if waitError == nil {
+			return nil
+		}
+
+		if attempt < transitUnsealAttempts {
+			logger.Warnf("Vault did not auto-unseal within %s, restarting it to retry the transit seal (%d/%d)", timeout, attempt, transitUnsealAttempts)
+			restartError := systemdService.RestartService("vault")
+
+			if restartError != nil {
+				return restartError
+			}
+		}
+	}
+	return waitError
+}
+
+func getTransitToken(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, config *transitSealConfig) (*clients.Secret, error) {
+	if config.TokenFile != "" {
+		tokenBytes, readTokenError := filesystemService.ReadFileContentsFromFilesystem(configs, config.TokenFile)
+
+		if readTokenError != nil {
+			return nil, readTokenError
+		}
+		return clients.NewSecret(tokenBytes), nil
+	}
+
+	if config.AppRole == nil {
+		logger.Error("Transit seal requires either a token file or an approle to authenticate to the unsealing vault")
+		return nil, errors.New("transit seal requires either a token file or an approle")
+	}
+
+	roleIdBytes, readRoleIdError := filesystemService.ReadFileContentsFromFilesystem(configs, config.AppRole.RoleIdFile)
+
+	if readRoleIdError != nil {
+		return nil, readRoleIdError
+	}
+
+	secretIdBytes, readSecretIdError := filesystemService.ReadFileContentsFromFilesystem(configs, config.AppRole.SecretIdFile)
+
+	if readSecretIdError != nil {
+		return nil, readSecretIdError
+	}
+
+	secretId := clients.NewSecret(secretIdBytes)
+	defer secretId.Destroy()
+
+	return services.GetVaultService().LoginAppRole(
+		config.Address,
+		config.AppRole.MountPath,
+		strings.TrimSpace(string(roleIdBytes)),
+		secretId)
+}
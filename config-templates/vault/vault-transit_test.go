@@ -0,0 +1,28 @@
+package vault
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHclString(t *testing.T) {
+	assert.Equal(t, `"https://transit:8200"`, hclString("https://transit:8200"))
+	assert.Equal(t, `"a\"b\\c\nd"`, hclString("a\"b\\c\nd"))
+	assert.Equal(t, `"$${HOME} %%{if} $5"`, hclString("${HOME} %{if} $5"))
+}
+
+func TestTransitSealTemplate(t *testing.T) {
+	var renderedSeal bytes.Buffer
+	renderError := transitSealTemplate.Execute(&renderedSeal, transitSealTemplateData{
+		Address:   "https://transit:8200",
+		MountPath: "transit",
+		KeyName:   `unseal" token = "injected`,
+	})
+
+	assert.Nil(t, renderError)
+	assert.Contains(t, renderedSeal.String(), `key_name        = "unseal\" token = \"injected"`)
+	assert.Contains(t, renderedSeal.String(), `mount_path      = "transit/"`)
+	assert.NotContains(t, renderedSeal.String(), "tls_ca_cert")
+}
@@ -0,0 +1,141 @@
+package vault
+
+import (
+	"fmt"
+	"time"
+	"zs-vm-agent/services"
+
+	"github.com/sirupsen/logrus"
+)
+
+const sealStatusComponent = "vault-seal"
+const defaultWatchdogInterval = 30 * time.Second
+const defaultUnsealAttemptWindow = 15 * time.Minute
+const defaultMaxUnsealAttempts = 3
+
+type watchdogConfig struct {
+	Disabled          bool   `json:"disabled"`
+	Interval          string `json:"interval"`
+	MaxUnsealAttempts int    `json:"maxUnsealAttempts"`
+	AttemptWindow     string `json:"attemptWindow"`
+}
+
+// sealWatchdog re-runs the unseal flow whenever vault reports itself sealed, which happens after the vault unit
+// restarts or the process crashes. Attempts are limited to maxAttempts per window so a vault that immediately
+// seals again is reported as failed rather than hammered with unseal requests
+type sealWatchdog struct {
+	logger      *logrus.Logger
+	vaultApiUrl string
+	unseal      func() error
+	maxAttempts int
+	window      time.Duration
+	attempts    []time.Time
+}
+
+func scheduleSealWatchdog(logger *logrus.Logger, config watchdogConfig, vaultApiUrl string, unseal func() error) error {
+	statusService := services.GetStatusService()
+
+	if config.Disabled {
+		logger.Info("Vault seal watchdog is disabled")
+		return nil
+	}
+
+	interval, window, parseError := parseWatchdogConfig(config)
+
+	if parseError != nil {
+		logger.Errorf("Invalid vault watchdog configuration: %s", parseError.Error())
+		return parseError
+	}
+
+	watchdog := &sealWatchdog{
+		logger:      logger,
+		vaultApiUrl: vaultApiUrl,
+		unseal:      unseal,
+		maxAttempts: config.MaxUnsealAttempts,
+		window:      window,
+	}
+
+	if watchdog.maxAttempts <= 0 {
+		watchdog.maxAttempts = defaultMaxUnsealAttempts
+	}
+
+	statusService.SetComponentStatus(sealStatusComponent, services.StateOk, "unsealed")
+	return services.GetSchedulerService().Schedule("vault seal watchdog", interval, watchdog.check)
+}
+
+func parseWatchdogConfig(config watchdogConfig) (time.Duration, time.Duration, error) {
+	interval := defaultWatchdogInterval
+	window := defaultUnsealAttemptWindow
+	var parseError error
+
+	if config.Interval != "" {
+		interval, parseError = time.ParseDuration(config.Interval)
+		if parseError != nil {
+			return 0, 0, parseError
+		} else if interval <= 0 {
+			return 0, 0, fmt.Errorf("interval %s is not positive", config.Interval)
+		}
+	}
+
+	if config.AttemptWindow != "" {
+		window, parseError = time.ParseDuration(config.AttemptWindow)
+		if parseError != nil {
+			return 0, 0, parseError
+		} else if window <= 0 {
+			return 0, 0, fmt.Errorf("attempt window %s is not positive", config.AttemptWindow)
+		}
+	}
+
+	return interval, window, nil
+}
+
+func (watchdog *sealWatchdog) check() error {
+	statusService := services.GetStatusService()
+
+	vaultStatus, getStatusError := services.GetVaultService().GetSealStatus(watchdog.vaultApiUrl)
+
+	if getStatusError != nil {
+		statusService.SetComponentStatus(sealStatusComponent, services.StateDegraded, fmt.Sprintf("vault unreachable: %s", getStatusError.Error()))
+		return nil
+	}
+
+	if !vaultStatus.Sealed {
+		statusService.SetComponentStatus(sealStatusComponent, services.StateOk, "unsealed")
+		return nil
+	}
+
+	if !watchdog.allowAttempt(time.Now()) {
+		message := fmt.Sprintf("vault is sealed and %d unseal attempts within %s have been used", watchdog.maxAttempts, watchdog.window)
+		statusService.SetComponentStatus(sealStatusComponent, services.StateFailed, message)
+		return fmt.Errorf("%s", message)
+	}
+
+	statusService.RecordEvent(sealStatusComponent, "vault reported sealed, re-running unseal")
+	unsealError := watchdog.unseal()
+
+	if unsealError != nil {
+		statusService.SetComponentStatus(sealStatusComponent, services.StateFailed, fmt.Sprintf("unseal failed: %s", unsealError.Error()))
+		return unsealError
+	}
+
+	statusService.SetComponentStatus(sealStatusComponent, services.StateOk, "unsealed by watchdog")
+	return nil
+}
+
+// allowAttempt records an unseal attempt at now unless the attempt budget for the current window is exhausted
+func (watchdog *sealWatchdog) allowAttempt(now time.Time) bool {
+	var recentAttempts []time.Time
+	for _, attempt := range watchdog.attempts {
+		if now.Sub(attempt) < watchdog.window {
+			recentAttempts = append(recentAttempts, attempt)
+		}
+	}
+	watchdog.attempts = recentAttempts
+
+	if len(watchdog.attempts) >= watchdog.maxAttempts {
+		return false
+	}
+
+	watchdog.attempts = append(watchdog.attempts, now)
+	return true
+}
@@ -0,0 +1,35 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealWatchdog_allowAttempt(t *testing.T) {
+	watchdog := sealWatchdog{maxAttempts: 2, window: 10 * time.Minute}
+	now := time.Now()
+
+	assert.True(t, watchdog.allowAttempt(now))
+	assert.True(t, watchdog.allowAttempt(now.Add(time.Minute)))
+	assert.False(t, watchdog.allowAttempt(now.Add(2*time.Minute)))
+	assert.True(t, watchdog.allowAttempt(now.Add(11*time.Minute)))
+}
+
+func TestParseWatchdogConfig(t *testing.T) {
+	interval, window, parseError := parseWatchdogConfig(watchdogConfig{Interval: "1m"})
+
+	assert.Nil(t, parseError)
+	assert.Equal(t, time.Minute, interval)
+	assert.Equal(t, defaultUnsealAttemptWindow, window)
+
+	_, _, parseError = parseWatchdogConfig(watchdogConfig{AttemptWindow: "soon"})
+	assert.NotNil(t, parseError)
+
+	// a ticker cannot run on an interval that is not positive
+	_, _, parseError = parseWatchdogConfig(watchdogConfig{Interval: "0s"})
+	assert.NotNil(t, parseError)
+	_, _, parseError = parseWatchdogConfig(watchdogConfig{AttemptWindow: "-5m"})
+	assert.NotNil(t, parseError)
+}
@@ -1,8 +1,14 @@
 package vault
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 	"zs-vm-agent/clients"
@@ -11,117 +17,576 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const vaultConfigFile = "vault-config.json"
+const defaultVaultApiPort = 8200
+const vaultStartAttempts = 30
+
+// a raft peer is named by a "vault-peer-<ip>" tag on the VM, every node of the cluster carries the tags of all peers
+const raftPeerTagPrefix = "vault-peer-"
+
+// orders of the data store and config drive disks in the VM definition
+const dataDiskOrder = 1
+const configDiskOrder = 2
+
+var configVolume = services.ConfigVolumeQuery{Label: "ZS-VAULT-CONFIG"}
+
+// shamir unseal keys on the config drive, also needed to migrate a shamir sealed vault to the transit seal
+var unsealKeyFiles = []string{"vault-key-1", "vault-key-2", "vault-key-3"}
+
+type vaultConfig struct {
+	Raft      raftConfig                     `json:"raft"`
+	Seal      sealConfig                     `json:"seal"`
+	Watchdog  watchdogConfig                 `json:"watchdog"`
+	Snapshots snapshotConfig                 `json:"snapshots"`
+	Bootstrap bootstrapConfig                `json:"bootstrap"`
+	Vault     services.VaultConnectionConfig `json:"vault"`
+	// Filesystem formats the data store disk, xfs when unset, and Encryption optionally puts it in a LUKS container
+	Filesystem services.FilesystemSpec  `json:"filesystem"`
+	Encryption *services.EncryptionSpec `json:"encryption"`
+}
+
+// sealConfig selects an auto-unseal mechanism, shamir unseal keys from the config drive are used when none is set
+type sealConfig struct {
+	Transit *transitSealConfig `json:"transit"`
+}
+
+// raftConfig joins the node to the raft cluster of the peers tagged on the VM, see raftPeers
+type raftConfig struct {
+	Enabled          bool   `json:"enabled"`
+	NodeId           string `json:"nodeId"`
+	ApiPort          int    `json:"apiPort"`
+	LeaderCaCert     string `json:"leaderCaCert"`
+	LeaderClientCert string `json:"leaderClientCert"`
+	LeaderClientKey  string `json:"leaderClientKey"`
+	TokenFile        string `json:"tokenFile"`
+}
+
 func Setup(logger *logrus.Logger, vmDetails clients.ProxmoxVm) error {
+	runningSystemError := requireRunningSystem(logger)
+
+	if runningSystemError != nil {
+		return runningSystemError
+	}
+
 	filesystemService := services.GetFileSystemService()
 	diskService := services.GetDiskService()
 	systemdService := services.GetSystemdService()
 
-	// scsi-0QEMU_QEMU_HARDDISK_drive-scsi2
-	configDrive, getFileSystemError := filesystemService.GetBlockFilesystem("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi2")
+	configDrive, openConfigDriveError := filesystemService.OpenConfigVolume(vmDetails, configVolume, configDiskOrder)
 
-	if getFileSystemError != nil {
-		return getFileSystemError
+	if openConfigDriveError != nil {
+		return openConfigDriveError
 	}
-	initError := initializeDataStore(logger, diskService, filesystemService)
+	config, loadConfigError := loadConfig(logger, filesystemService, configDrive)
+
+	if loadConfigError != nil {
+		return loadConfigError
+	}
+
+	dataDiskPath, resolveDataDiskError := diskService.ResolveDisk(vmDetails, dataDiskOrder)
+
+	if resolveDataDiskError != nil {
+		return resolveDataDiskError
+	}
+
+	if config.Snapshots.Disk != 0 {
+		var resolveSnapshotDiskError error
+		config.Snapshots.Device, resolveSnapshotDiskError = diskService.ResolveDisk(vmDetails, config.Snapshots.Disk)
+
+		if resolveSnapshotDiskError != nil {
+			return resolveSnapshotDiskError
+		}
+	}
+
+	initError := initializeDataStore(logger, filesystemService, dataDiskPath, config.Filesystem, config.Encryption)
 
 	if initError != nil {
 		return initError
 	}
 
+	certificatesManaged, configureCertificatesError := services.GetCertificateService().ConfigureCertificates(configDrive, vmDetails)
+
+	if configureCertificatesError != nil {
+		return configureCertificatesError
+	}
+
 	logger.Info("Copying Vault Configurations.")
 
-	copyFilesError := copyFiles(logger, filesystemService, configDrive)
+	copyFilesError := copyFiles(logger, filesystemService, configDrive, !certificatesManaged)
 
 	if copyFilesError != nil {
 		return copyFilesError
 	}
 
+	vaultApiUrl, readApiUrlError := readVaultApiUrl(filesystemService, configDrive)
+
+	if readApiUrlError != nil {
+		return readApiUrlError
+	}
+
+	migratingSeal := false
+	if config.Seal.Transit != nil {
+		var configureSealError error
+		migratingSeal, configureSealError = configureTransitSeal(logger, filesystemService, systemdService, configDrive, config.Seal.Transit, vaultApiUrl)
+
+		if configureSealError != nil {
+			return configureSealError
+		}
+	}
+
 	logger.Info("Starting Vault Service")
 
-	startServiceError := systemdService.StartService("vault")
+	startService := systemdService.StartService
+	if migratingSeal {
+		// the running vault only reads the new seal stanza once restarted
+		startService = systemdService.RestartService
+	}
+	startServiceError := startService("vault")
 
 	if startServiceError != nil {
 		return startServiceError
 	}
 
-	logger.Info("Unsealing Vault")
+	var leaderApiUrl *string
+	if config.Raft.Enabled {
+		var joinError error
+		leaderApiUrl, joinError = joinRaftCluster(logger, filesystemService, configDrive, vmDetails, config, vaultApiUrl)
+
+		if joinError != nil {
+			return joinError
+		}
+	}
+
+	unseal := func() error {
+		logger.Info("Unsealing Vault")
+		return unsealVault(logger, filesystemService, configDrive, vaultApiUrl)
+	}
+	if config.Seal.Transit != nil {
+		unseal = func() error {
+			vaultStatus, getVaultStatusError := waitForVault(logger, vaultApiUrl)
+
+			if getVaultStatusError != nil {
+				return getVaultStatusError
+			}
+
+			if vaultStatus.Migration {
+				logger.Info("Migrating Vault from shamir unseal keys to the transit seal")
+				return unsealVault(logger, filesystemService, configDrive, vaultApiUrl)
+			}
 
-	vaultUnsealError := unsealVault(logger, filesystemService, configDrive)
+			logger.Info("Waiting for Vault to auto-unseal")
+			return waitForAutoUnseal(logger, systemdService, config.Seal.Transit, vaultApiUrl)
+		}
+	}
+
+	vaultUnsealError := unseal()
 
 	if vaultUnsealError != nil {
-		return nil
+		return vaultUnsealError
+	}
+
+	if leaderApiUrl != nil {
+		verifyMembershipError := verifyRaftMembership(logger, filesystemService, configDrive, vmDetails, config, vaultApiUrl, *leaderApiUrl)
+
+		if verifyMembershipError != nil {
+			return verifyMembershipError
+		}
+	}
+
+	if config.Bootstrap.Enabled {
+		bootstrapError := bootstrapVault(logger, filesystemService, configDrive, config, vaultApiUrl)
+
+		if bootstrapError != nil {
+			return bootstrapError
+		}
+	}
+
+	if config.Seal.Transit != nil {
+		// auto-unseal only fails to recover on its own when the transit vault was unavailable, restarting
+		// vault makes it retry the seal
+		unseal = func() error {
+			restartError := systemdService.RestartService("vault")
+
+			if restartError != nil {
+				return restartError
+			}
+			return waitForAutoUnseal(logger, systemdService, config.Seal.Transit, vaultApiUrl)
+		}
+	}
+
+	scheduleWatchdogError := scheduleSealWatchdog(logger, config.Watchdog, vaultApiUrl, unseal)
+
+	if scheduleWatchdogError != nil {
+		return scheduleWatchdogError
+	}
+
+	if config.Snapshots.Enabled {
+		return scheduleSnapshots(logger, filesystemService, configDrive, config, vaultApiUrl)
 	}
 
 	return nil
 }
 
-func initializeDataStore(logger *logrus.Logger, diskService services.DiskService, filesystemService services.FileSystemService) error {
-	diskPath := "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi1"
-	logger.Debug("Initializing Data Store")
-	_, statFileError := clients.GetOsClient().StatFile(fmt.Sprintf("%s-part1", diskPath))
-	logger.Debugf("Stat file attempt made on %s-part1", diskPath)
-	if statFileError != nil && !strings.Contains(statFileError.Error(), fmt.Sprintf("stat %s-part1: no such file or directory", diskPath)) {
-		errorMessage := statFileError.Error()
-		logger.Debug(errorMessage)
-		return statFileError
+// requireRunningSystem refuses to apply the role under a host root, vault is unsealed, joined and snapshotted through
+// the api of the vault running on this system
+func requireRunningSystem(logger *logrus.Logger) error {
+	if clients.GetHostRoot() == "/" {
+		return nil
 	}
 
-	logger.Debugf("Successfully located %s", fmt.Sprintf("%s-part1", diskPath))
+	logger.Errorf("The vault role needs a running vault and cannot be applied under host root %s", clients.GetHostRoot())
+	return fmt.Errorf("the vault role cannot be applied under host root %s: %w", clients.GetHostRoot(), clients.ErrHostRoot)
+}
+
+func loadConfig(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper) (*vaultConfig, error) {
+	var parsedConfig vaultConfig
+
+	configExists, checkConfigError := configFileExists(configs, vaultConfigFile)
 
-	dataDrive, getDiskError := diskService.GetDisk(diskPath)
-	if getDiskError != nil {
-		return getDiskError
+	if checkConfigError != nil {
+		return nil, checkConfigError
 	}
 
-	partTable, getPartTableError := dataDrive.GetPartitionTable()
+	if !configExists {
+		logger.Debugf("No %s found, running as a single node", vaultConfigFile)
+		return &parsedConfig, nil
+	}
+
+	configBytes, readConfigError := filesystemService.ReadFileContentsFromFilesystem(configs, vaultConfigFile)
 
-	if (getPartTableError != nil && strings.Contains(getPartTableError.Error(), "unknown disk partition type")) || len(partTable.GetPartitions()) == 0 {
-		createDiskPartitionError := diskService.CreatePartition(diskPath)
+	if readConfigError != nil {
+		return nil, readConfigError
+	}
+
+	configBytes, readConfigError = services.GetSecretService().ResolveSecrets(configs, configBytes)
+
+	if readConfigError != nil {
+		return nil, readConfigError
+	}
+
+	jsonProcessingError := json.Unmarshal(configBytes, &parsedConfig)
+
+	if jsonProcessingError != nil {
+		logger.Errorf("Failed to parse %s: %s", vaultConfigFile, jsonProcessingError.Error())
+		return nil, jsonProcessingError
+	}
 
-		if createDiskPartitionError != nil {
-			logger.Errorf("Failed to create partition for disk %s: %s", diskPath, createDiskPartitionError.Error())
-			return createDiskPartitionError
+	if parsedConfig.Raft.ApiPort == 0 {
+		parsedConfig.Raft.ApiPort = defaultVaultApiPort
+	}
+
+	return &parsedConfig, nil
+}
+
+// connectVault logs into the local vault with the credentials from the "vault" section of the config
+func connectVault(configs clients.FileSystemWrapper, config *vaultConfig, vaultApiUrl string) (*services.VaultSession, error) {
+	connection := config.Vault
+	if connection.Address == "" {
+		connection.Address = vaultApiUrl
+	}
+
+	return services.GetSecretService().Connect(configs, connection)
+}
+
+func configFileExists(configs clients.FileSystemWrapper, fileName string) (bool, error) {
+	fileInfos, readDirError := configs.ReadDir("/")
+
+	if readDirError != nil {
+		return false, readDirError
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Name() == fileName {
+			return true, nil
 		}
-		time.Sleep(5 * time.Second)
-	} else if getPartTableError != nil {
-		logger.Errorf("Failed to get Partition Table from disk %s: %s", diskPath, getPartTableError.Error())
-		return getPartTableError
+	}
+	return false, nil
+}
+
+func readVaultApiUrl(filesystemService services.FileSystemService, configs clients.FileSystemWrapper) (string, error) {
+	vaultApiBytes, readApiError := filesystemService.ReadFileContentsFromFilesystem(configs, "vault-api-url")
+	if readApiError != nil {
+		return "", readApiError
 	}
 
-	partTable, getPartTableError = dataDrive.GetPartitionTable()
+	return strings.TrimSpace(string(vaultApiBytes)), nil
+}
 
-	if getPartTableError != nil {
-		logger.Errorf("Failed to get Partition Table from disk after creation %s: %s", diskPath, getPartTableError.Error())
-		return getPartTableError
+// joinRaftCluster joins the local node to an existing raft cluster, nil is returned for the leader when the node
+// already holds raft state or is the first peer and bootstraps the cluster once it is initialized. Peers keep
+// waiting for a leader, so nodes can be added before the first peer is up
+func joinRaftCluster(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, vmDetails clients.ProxmoxVm, config *vaultConfig, vaultApiUrl string) (*string, error) {
+	vaultService := services.GetVaultService()
+
+	vaultStatus, getVaultStatusError := waitForVault(logger, vaultApiUrl)
+
+	if getVaultStatusError != nil {
+		return nil, getVaultStatusError
 	}
-	if len(partTable.GetPartitions()) == 0 {
-		logger.Error("No partitions found after creating a new partition")
-		return errors.New("no partitions found after creating new partition")
+
+	if vaultStatus.Initialized {
+		logger.Info("Vault already holds raft state, skipping join")
+		return nil, nil
 	}
 
-	closeDiskError := dataDrive.Close()
+	if len(vmDetails.IpConfig) == 0 {
+		logger.Errorf("VM %s has no ip configuration to tell it apart from its raft peers", vmDetails.Name)
+		return nil, errors.New("vm has no ip configuration")
+	}
+
+	myIp, parseIpError := netip.ParseAddr(stripCidr(vmDetails.IpConfig[0].IpAddress))
 
-	if closeDiskError != nil {
-		logger.Errorf("Failed to close disk %s: %s", diskPath, closeDiskError.Error())
-		return closeDiskError
+	if parseIpError != nil {
+		logger.Errorf("VM %s has an invalid ip address %s: %s", vmDetails.Name, vmDetails.IpConfig[0].IpAddress, parseIpError.Error())
+		return nil, parseIpError
 	}
 
-	createFilesystemError := filesystemService.CreateXfsFileSystem(fmt.Sprintf("%s-part1", diskPath))
+	peers, readPeersError := raftPeers(vmDetails)
 
-	if createFilesystemError != nil {
-		errorMessage := createFilesystemError.Error()
-		if !strings.Contains(errorMessage, "appears to contain an existing filesystem") {
-			return createFilesystemError
+	if readPeersError != nil {
+		logger.Errorf("Failed to read the raft peers of VM %s: %s", vmDetails.Name, readPeersError.Error())
+		return nil, readPeersError
+	}
+
+	var peerApiUrls []string
+	for _, peer := range peers {
+		if peer == myIp {
+			continue
 		}
+		peerApiUrls = append(peerApiUrls, fmt.Sprintf("https://%s", net.JoinHostPort(peer.String(), strconv.Itoa(config.Raft.ApiPort))))
 	}
 
-	mountError := filesystemService.MountFilesystem(fmt.Sprintf("%s-part1", diskPath), "/opt/vault")
+	isFirstPeer := len(peers) == 0 || peers[0] == myIp
+	var leaderApiUrl *string
+	for leaderApiUrl == nil {
+		var findLeaderError error
+		leaderApiUrl, findLeaderError = vaultService.FindRaftLeader(peerApiUrls)
+
+		if findLeaderError != nil {
+			return nil, findLeaderError
+		}
+
+		if leaderApiUrl == nil && isFirstPeer {
+			logger.Info("No raft leader found and this node is the first peer, bootstrapping as leader")
+			return nil, waitForInitialization(logger, vaultApiUrl)
+		}
+
+		if leaderApiUrl == nil {
+			logger.Infof("Waiting for a raft leader among peers %s...", strings.Join(peerApiUrls, ", "))
+			time.Sleep(10 * time.Second)
+		}
+	}
+
+	tlsMaterial, readTlsMaterialError := readRaftTlsMaterial(filesystemService, configs, config.Raft)
+
+	if readTlsMaterialError != nil {
+		return nil, readTlsMaterialError
+	}
+
+	joinError := vaultService.JoinRaftCluster(vaultApiUrl, *leaderApiUrl, *tlsMaterial)
+	tlsMaterial.LeaderClientKey.Destroy()
+
+	if joinError != nil {
+		return nil, joinError
+	}
+
+	return leaderApiUrl, nil
+}
+
+// raftPeers reads the peers of the raft cluster from the "vault-peer-<ip>" tags of the VM. They are sorted so every
+// node agrees on the first peer, the one that bootstraps the cluster
+func raftPeers(vmDetails clients.ProxmoxVm) ([]netip.Addr, error) {
+	var peers []netip.Addr
+	for _, tag := range vmDetails.Tags {
+		peerIp, isPeerTag := strings.CutPrefix(tag, raftPeerTagPrefix)
+
+		if !isPeerTag {
+			continue
+		}
+
+		peer, parseIpError := netip.ParseAddr(peerIp)
+
+		if parseIpError != nil {
+			return nil, fmt.Errorf("tag %s does not name a peer ip address: %w", tag, parseIpError)
+		}
+		peers = append(peers, peer)
+	}
+
+	slices.SortFunc(peers, netip.Addr.Compare)
+	return slices.Compact(peers), nil
+}
+
+// waitForInitialization waits for the first peer to be initialized through sys/init. Whoever initializes it holds
+// the unseal keys the config drive hands to the agent, so vault is never initialized by the agent itself
+func waitForInitialization(logger *logrus.Logger, vaultApiUrl string) error {
+	for {
+		vaultStatus, getVaultStatusError := waitForVault(logger, vaultApiUrl)
+
+		if getVaultStatusError != nil {
+			return getVaultStatusError
+		}
+
+		if vaultStatus.Initialized {
+			return nil
+		}
+		logger.Infof("Waiting for Vault at %s to be initialized...", vaultApiUrl)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func waitForVault(logger *logrus.Logger, vaultApiUrl string) (*clients.VaultStatusResponse, error) {
+	var vaultStatus *clients.VaultStatusResponse
+	var getVaultStatusError error
+	for attempt := 0; attempt < vaultStartAttempts; attempt++ {
+		vaultStatus, getVaultStatusError = clients.GetVaultClient().GetVaultStatus(vaultApiUrl)
+
+		if getVaultStatusError == nil {
+			return vaultStatus, nil
+		}
+		logger.Debugf("Vault is not yet responding at %s, waiting...", vaultApiUrl)
+		time.Sleep(2 * time.Second)
+	}
+	return nil, getVaultStatusError
+}
+
+func readRaftTlsMaterial(filesystemService services.FileSystemService, configs clients.FileSystemWrapper, config raftConfig) (*services.RaftTlsMaterial, error) {
+	var tlsMaterial services.RaftTlsMaterial
+
+	for _, certificate := range []struct {
+		fileName    string
+		destination *string
+	}{
+		{fileName: config.LeaderCaCert, destination: &tlsMaterial.LeaderCaCert},
+		{fileName: config.LeaderClientCert, destination: &tlsMaterial.LeaderClientCert},
+	} {
+		if certificate.fileName == "" {
+			continue
+		}
+		fileBytes, readFileError := filesystemService.ReadFileContentsFromFilesystem(configs, certificate.fileName)
+
+		if readFileError != nil {
+			return nil, readFileError
+		}
+		*certificate.destination = string(fileBytes)
+	}
+
+	if config.LeaderClientKey != "" {
+		keyBytes, readFileError := filesystemService.ReadFileContentsFromFilesystem(configs, config.LeaderClientKey)
+
+		if readFileError != nil {
+			return nil, readFileError
+		}
+		// registered so the key is redacted from the join request should it ever be logged
+		tlsMaterial.LeaderClientKey = clients.NewSecret(keyBytes)
+	}
+
+	return &tlsMaterial, nil
+}
+
+func verifyRaftMembership(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, vmDetails clients.ProxmoxVm, config *vaultConfig, vaultApiUrl string, leaderApiUrl string) error {
+	vaultService := services.GetVaultService()
+
+	if config.Raft.TokenFile == "" {
+		logger.Warn("No raft token file configured, verifying membership through the local leader status instead")
+		return vaultService.WaitForRaftLeader(vaultApiUrl, leaderApiUrl)
+	}
+
+	tokenBytes, readTokenError := filesystemService.ReadFileContentsFromFilesystem(configs, config.Raft.TokenFile)
+
+	if readTokenError != nil {
+		return readTokenError
+	}
+
+	// the secret takes ownership of the buffer read, destroying it zeroes the token
+	token := clients.NewSecret(tokenBytes)
+	defer token.Destroy()
+
+	nodeId := config.Raft.NodeId
+	if nodeId == "" {
+		nodeId = vmDetails.Name
+	}
+
+	return vaultService.VerifyRaftMembership(leaderApiUrl, nodeId, token)
+}
+
+func stripCidr(ipAddress string) string {
+	address, _, _ := strings.Cut(ipAddress, "/")
+	return address
+}
+
+func initializeDataStore(logger *logrus.Logger, filesystemService services.FileSystemService, diskPath string, filesystem services.FilesystemSpec, encryption *services.EncryptionSpec) error {
+	logger.Debug("Initializing Data Store")
+	return initializeDisk(logger, filesystemService, diskPath, "/opt/vault", filesystem, withDefaultName(encryption, "vault-data"), []string{"vault.service"})
+}
+
+// withDefaultName names the LUKS container of a disk when the config does not
+func withDefaultName(encryption *services.EncryptionSpec, name string) *services.EncryptionSpec {
+	if encryption == nil || encryption.Name != "" {
+		return encryption
+	}
+
+	named := *encryption
+	named.Name = name
+	return &named
+}
+
+// initializeDisk partitions, encrypts and formats the disk when needed, then mounts it persistently ahead of the
+// requiredBy services and hands it to the vault user
+func initializeDisk(logger *logrus.Logger, filesystemService services.FileSystemService, diskPath string, mountPath string, filesystem services.FilesystemSpec, encryption *services.EncryptionSpec, requiredBy []string) error {
+	// by-id links take a -part1 suffix, a disk given directly as /dev/vdb has /dev/vdb1
+	devicePath := services.GetDiskService().PartitionDevicePath(diskPath, 1)
+
+	_, statFileError := clients.GetOsClient().StatFile(devicePath)
+	logger.Debugf("Stat file attempt made on %s", devicePath)
+	if statFileError != nil && !errors.Is(statFileError, os.ErrNotExist) {
+		errorMessage := statFileError.Error()
+		logger.Debug(errorMessage)
+		return statFileError
+	}
+
+	logger.Debugf("Successfully located %s", devicePath)
+
+	mountedDevice := devicePath
+	if encryption != nil {
+		mountedDevice = encryption.MappedDevicePath()
+		// the key is only needed until the container is open and grown
+		defer encryption.Key.Destroy()
+	}
+
+	partitionError := filesystemService.PartitionDisk(diskPath, nil, false, mountedDevice, mountPath)
+
+	if partitionError != nil {
+		return partitionError
+	}
+
+	if encryption != nil {
+		var openError error
+		devicePath, openError = services.GetEncryptionService().OpenEncryptedDevice(devicePath, *encryption)
+
+		if openError != nil {
+			return openError
+		}
+	}
+
+	createFilesystemError := filesystemService.CreateFileSystem(devicePath, filesystem)
+
+	if createFilesystemError != nil {
+		return createFilesystemError
+	}
+
+	mountError := services.GetMountService().PersistMount(devicePath, mountPath, filesystem, encryption, requiredBy)
 
 	if mountError != nil {
 		return mountError
 	}
 
-	setFolderOwnerError := filesystemService.SetRootFsOwner("/opt/vault", "vault", true)
+	growError := services.GetMountService().GrowMount(diskPath, 1, mountPath, filesystem, encryption)
+
+	if growError != nil {
+		logger.Warnf("Continuing without growing %s: %s", mountPath, growError.Error())
+	}
+
+	_, setFolderOwnerError := filesystemService.SetRootFsOwner(mountPath, "vault", true)
 	if setFolderOwnerError != nil {
 		return setFolderOwnerError
 	}
@@ -129,58 +594,51 @@ func initializeDataStore(logger *logrus.Logger, diskService services.DiskService
 	return nil
 }
 
-func copyFiles(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper) error {
+func copyFiles(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, copyCertificates bool) error {
 
 	logger.Debug("Copying vault.hcl")
-	copyFileError := filesystemService.CopyFilesToRootFs(configs, "vault.hcl", "/etc/vault.d/vault.hcl", false)
+	_, copyFileError := filesystemService.CopyFilesToRootFs(configs, "vault.hcl", "/etc/vault.d/vault.hcl", false)
 
 	if copyFileError != nil {
 		return copyFileError
 	}
 
+	if !copyCertificates {
+		logger.Debug("Certificates are issued by vault, skipping certificate copy")
+		return nil
+	}
+
 	logger.Debug("Copying public cert")
-	copyFileError = filesystemService.CopyFilesToRootFs(configs, "vault-public.pem", "/etc/vault.d/tls.crt", false)
+	_, copyFileError = filesystemService.CopyFilesToRootFs(configs, "vault-public.pem", "/etc/vault.d/tls.crt", false)
 
 	if copyFileError != nil {
 		return copyFileError
 	}
 
 	logger.Debug("Copying private key")
-	copyFileError = filesystemService.CopyFilesToRootFs(configs, "vault-private.pem", "/etc/vault.d/tls.pem", false)
+	_, copyFileError = filesystemService.CopyFilesToRootFs(configs, "vault-private.pem", "/etc/vault.d/tls.pem", false)
 
 	return copyFileError
 }
 
-func unsealVault(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper) error {
-	vaultkeyBytes, readKeyError := filesystemService.ReadFileContentsFromFilesystem(configs, "vault-key-1")
-
-	if readKeyError != nil {
-		return readKeyError
-	}
-
-	vaultKey1 := string(vaultkeyBytes)
-
-	vaultkeyBytes, readKeyError = filesystemService.ReadFileContentsFromFilesystem(configs, "vault-key-2")
-	if readKeyError != nil {
-		return readKeyError
-	}
-
-	vaultKey2 := string(vaultkeyBytes)
-	vaultkeyBytes, readKeyError = filesystemService.ReadFileContentsFromFilesystem(configs, "vault-key-3")
-	if readKeyError != nil {
-		return readKeyError
-	}
+func unsealVault(logger *logrus.Logger, filesystemService services.FileSystemService, configs clients.FileSystemWrapper, vaultApiUrl string) error {
+	var unsealKeys []*clients.Secret
+	defer func() {
+		for _, unsealKey := range unsealKeys {
+			unsealKey.Destroy()
+		}
+	}()
 
-	vaultKey3 := string(vaultkeyBytes)
+	for _, keyFile := range unsealKeyFiles {
+		vaultKeyBytes, readKeyError := filesystemService.ReadFileContentsFromFilesystem(configs, keyFile)
 
-	vaultApiBytes, readApiError := filesystemService.ReadFileContentsFromFilesystem(configs, "vault-api-url")
-	if readApiError != nil {
-		return readKeyError
+		if readKeyError != nil {
+			return readKeyError
+		}
+		unsealKeys = append(unsealKeys, clients.NewSecret(vaultKeyBytes))
 	}
 
-	vaultApiUrl := string(vaultApiBytes)
-
-	unsealError := services.GetVaultService().UnsealVault(vaultApiUrl, []string{vaultKey1, vaultKey2, vaultKey3})
+	unsealError := services.GetVaultService().UnsealVault(vaultApiUrl, unsealKeys)
 
 	if unsealError != nil {
 		return unsealError
@@ -0,0 +1,168 @@
+package vault
+
+import (
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+	"zs-vm-agent/services"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// useMemoryHost runs the services against an in-memory host on which vault is uid and gid 990
+func useMemoryHost(t *testing.T, ctrl *gomock.Controller) *clients.MemoryOsClient {
+	host := clients.NewMemoryOsClient()
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("vault").Return(&user.User{Uid: "990", Gid: "990"}, nil).AnyTimes()
+
+	previousOsClient, previousUserClient := clients.GetOsClient(), clients.GetUserClient()
+	clients.SetOsClient(host)
+	clients.SetUserClient(mockUserClient)
+	t.Cleanup(func() {
+		clients.SetOsClient(previousOsClient)
+		clients.SetUserClient(previousUserClient)
+		services.Initialize(&logrus.Logger{})
+	})
+	t.Setenv("INFRA_CONFIG_MAPPER_URL", "http://127.0.0.1:1")
+	clients.Initialize(&logrus.Logger{}, "")
+	services.Initialize(&logrus.Logger{})
+	return host
+}
+
+// openConfigDrive adds a vault config drive holding files to host and opens it
+func openConfigDrive(t *testing.T, host *clients.MemoryOsClient, files map[string]string) clients.FileSystemWrapper {
+	assert.Nil(t, host.AddConfigDrive(filepath.Join(t.TempDir(), "vdb.img"), "vdb", configVolume.Label, files))
+
+	configDrive, openError := services.GetFileSystemService().OpenConfigVolume(clients.ProxmoxVm{}, configVolume, configDiskOrder)
+
+	assert.Nil(t, openError)
+	return configDrive
+}
+
+// reloadRecorder counts daemon reloads, any other systemd call fails the test with a nil pointer
+type reloadRecorder struct {
+	services.SystemdService
+	reloads int
+}
+
+func (recorder *reloadRecorder) DaemonReload() error {
+	recorder.reloads++
+	return nil
+}
+
+func TestCopyFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	host.AddDirectory("/etc/vault.d", 0755)
+	configDrive := openConfigDrive(t, host, map[string]string{
+		"vault.hcl":         "storage \"raft\" {}\n",
+		"vault-public.pem":  "certificate\n",
+		"vault-private.pem": "private key\n",
+	})
+
+	copyError := copyFiles(&logrus.Logger{}, services.GetFileSystemService(), configDrive, true)
+
+	assert.Nil(t, copyError)
+
+	vaultHcl, readError := host.ReadFile("/etc/vault.d/vault.hcl")
+	assert.Nil(t, readError)
+	assert.Equal(t, "storage \"raft\" {}\n", string(vaultHcl))
+	certificate, _ := host.ReadFile("/etc/vault.d/tls.crt")
+	assert.Equal(t, "certificate\n", string(certificate))
+	privateKey, _ := host.ReadFile("/etc/vault.d/tls.pem")
+	assert.Equal(t, "private key\n", string(privateKey))
+}
+
+func TestCopyFiles_issuedCertificates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	host.AddDirectory("/etc/vault.d", 0755)
+	configDrive := openConfigDrive(t, host, map[string]string{
+		"vault.hcl": "storage \"raft\" {}\n",
+	})
+
+	copyError := copyFiles(&logrus.Logger{}, services.GetFileSystemService(), configDrive, false)
+
+	assert.Nil(t, copyError)
+
+	_, found := host.Node("/etc/vault.d/tls.pem")
+	assert.False(t, found)
+}
+
+func TestConfigureTransitSeal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	host.AddFile(vaultHclPath, []byte("storage \"raft\" {}\n"), 0640)
+	host.AddDirectory("/etc/systemd/system", 0755)
+	configDrive := openConfigDrive(t, host, map[string]string{
+		"transit-token": "hvs.transit\n",
+	})
+	systemd := &reloadRecorder{}
+
+	// nothing listens on the api url, so the seal migration check finds no running vault
+	migrate, configureError := configureTransitSeal(&logrus.Logger{}, services.GetFileSystemService(), systemd, configDrive, &transitSealConfig{
+		Address:   "https://transit:8200",
+		KeyName:   "unseal",
+		TokenFile: "transit-token",
+	}, "https://127.0.0.1:1")
+
+	assert.Nil(t, configureError)
+	assert.False(t, migrate)
+	assert.Equal(t, 1, systemd.reloads)
+
+	vaultHcl, _ := host.ReadFile(vaultHclPath)
+	assert.Contains(t, string(vaultHcl), `seal "transit"`)
+	assert.NotContains(t, string(vaultHcl), "hvs.transit")
+
+	environment, found := host.Node(transitTokenEnvPath)
+	assert.True(t, found)
+	assert.Equal(t, os.FileMode(0600), environment.Mode.Perm())
+	assert.Equal(t, "VAULT_TRANSIT_SEAL_TOKEN=hvs.transit\n", string(environment.Contents))
+
+	dropIn, _ := host.ReadFile(transitTokenDropInPath)
+	assert.Equal(t, transitTokenDropIn, string(dropIn))
+}
+
+func TestRaftPeers(t *testing.T) {
+	peers, readPeersError := raftPeers(clients.ProxmoxVm{Tags: []string{
+		"vault",
+		"vault-peer-10.0.0.12",
+		"vault-peer-10.0.0.9",
+		"vault-peer-10.0.0.12",
+	}})
+
+	assert.Nil(t, readPeersError)
+	// sorted by address rather than as text, so 10.0.0.9 bootstraps the cluster
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.9"), netip.MustParseAddr("10.0.0.12")}, peers)
+}
+
+func TestRaftPeers_invalidTag(t *testing.T) {
+	_, readPeersError := raftPeers(clients.ProxmoxVm{Tags: []string{"vault-peer-leader"}})
+
+	assert.NotNil(t, readPeersError)
+}
+
+func TestSetup_hostRoot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := useMemoryHost(t, ctrl)
+	clients.SetHostRoot("/mnt/image")
+	t.Cleanup(func() { clients.SetHostRoot("/") })
+	services.Initialize(&logrus.Logger{})
+
+	setupError := Setup(&logrus.Logger{}, clients.ProxmoxVm{})
+
+	// vault is only reachable on the running system, so nothing of the role is applied to the image
+	assert.ErrorIs(t, setupError, clients.ErrHostRoot)
+	assert.Empty(t, host.Commands())
+	_, found := host.Node("/mnt/image")
+	assert.False(t, found)
+}
@@ -34,4 +34,9 @@ sed -i 's~clients "zs-vm-agent/clients"~~g' clients/diskWrapper_mock.go
 mockgen -source=clients/userClient.go -destination=clients/userClient_mock.go
 sed -i 's/package mock_clients/package clients/g' clients/userClient_mock.go
 sed -i 's/clients\.//g' clients/userClient_mock.go
-sed -i 's~clients "zs-vm-agent/clients"~~g' clients/userClient_mock.go
\ No newline at end of file
+sed -i 's~clients "zs-vm-agent/clients"~~g' clients/userClient_mock.go
+
+mockgen -source=clients/vaultClient.go -destination=clients/vaultClient_mock.go
+sed -i 's/package mock_clients/package clients/g' clients/vaultClient_mock.go
+sed -i 's/clients\.//g' clients/vaultClient_mock.go
+sed -i 's~clients "zs-vm-agent/clients"~~g' clients/vaultClient_mock.go
@@ -12,7 +12,6 @@ import (
 	"zs-vm-agent/config-templates/vault"
 	"zs-vm-agent/services"
 
-	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,9 +23,22 @@ var templateMap = map[string]func(logger *logrus.Logger, vmDetails clients.Proxm
 	"k8s-worker":     k8s.WorkerSetup,
 }
 
+var commandMap = map[string]map[string]func(logger *logrus.Logger, args []string) error{
+	"vault": {
+		"restore": vault.Restore,
+	},
+}
+
 func main() {
 	logger := initLogging()
 
+	// roles can be applied to a mounted image or chroot, whose /etc/hostname then names the vm
+	hostRoot := os.Getenv("HOST_ROOT")
+	if hostRoot != "" {
+		logger.Infof("Applying roles to %s", hostRoot)
+		clients.SetHostRoot(hostRoot)
+	}
+
 	hostname, getHostnameError := loadHostname(logger)
 
 	if getHostnameError != nil {
@@ -38,6 +50,23 @@ func main() {
 	clients.Initialize(logger, *hostname)
 	logger.Info("Initializing Services")
 	services.Initialize(logger)
+	// strict manifests refuse config drives without a SHA256SUMS or with files it does not list
+	services.GetManifestService().SetStrict(strings.EqualFold(os.Getenv("CONFIG_MANIFEST_STRICT"), "true"))
+
+	trustedKeysDirectory := os.Getenv("CONFIG_TRUSTED_KEYS")
+	if trustedKeysDirectory == "" {
+		trustedKeysDirectory = services.DefaultTrustedKeysDirectory
+	}
+	loadTrustedKeysError := services.GetManifestService().LoadTrustedKeys(trustedKeysDirectory)
+
+	if loadTrustedKeysError != nil {
+		logger.Errorf("Failed to load trusted config drive keys: %s", loadTrustedKeysError.Error())
+		os.Exit(-1)
+	}
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(logger, os.Args[1:]))
+	}
 
 	vmDetails, getVmDetailsError := clients.GetInfraConfigMapperClient().GetVmDetailsByHostname()
 
@@ -52,17 +81,59 @@ func main() {
 	}
 	logger.Debugf("Retrieved vm details for vm %s", vmDetails.VmId)
 
+	statusService := services.GetStatusService()
+	statusListenAddress := os.Getenv("STATUS_LISTEN_ADDRESS")
+	if statusListenAddress != "" {
+		statusService.Serve(statusListenAddress)
+	}
+
 	for _, tag := range vmDetails.Tags {
 		logger.Debugf("Parsing tag %s", tag)
 		val, okay := templateMap[tag]
 		if okay {
 			err := val(logger, *vmDetails)
 			if err != nil {
+				statusService.SetComponentStatus(tag, services.StateFailed, err.Error())
 				os.Exit(-1)
 			}
+			statusService.SetComponentStatus(tag, services.StateOk, "setup complete")
 			break
 		}
 	}
+
+	// the agent exits once roles are applied unless it is asked to stay resident for maintenance tasks
+	schedulerService := services.GetSchedulerService()
+	if schedulerService.HasTasks() && strings.EqualFold(os.Getenv("RUN_SCHEDULER"), "true") {
+		logger.Info("Running scheduled maintenance tasks")
+		runError := schedulerService.Run()
+
+		if runError != nil {
+			os.Exit(-1)
+		}
+	} else if schedulerService.HasTasks() {
+		logger.Info("Maintenance tasks were scheduled but RUN_SCHEDULER is not true, exiting")
+	}
+}
+
+// runCommand dispatches `zs-vm-agent <role> <command> [args...]` to the matching role command
+func runCommand(logger *logrus.Logger, args []string) int {
+	if len(args) < 2 {
+		logger.Errorf("usage: zs-vm-agent <role> <command> [args...]")
+		return -1
+	}
+
+	command, okay := commandMap[args[0]][args[1]]
+	if !okay {
+		logger.Errorf("Unknown command %s %s", args[0], args[1])
+		return -1
+	}
+
+	commandError := command(logger, args[2:])
+	if commandError != nil {
+		logger.Errorf("%s %s failed: %s", args[0], args[1], commandError.Error())
+		return -1
+	}
+	return 0
 }
 
 func initLogging() *logrus.Logger {
@@ -81,14 +152,16 @@ func initLogging() *logrus.Logger {
 
 	log.SetLevel(logLevelCode)
 	log.SetFormatter(customFormatter)
+	log.AddHook(clients.NewRedactionHook())
 	return log
 }
 
 func retrieveHostname() (*string, error) {
-	hostnameFile, openFileError := file.OpenFromPath("/etc/hostname", true)
+	hostnameFile, openFileError := clients.GetOsClient().OpenFile("/etc/hostname")
 	if openFileError != nil {
 		return nil, openFileError
 	}
+	defer hostnameFile.Close()
 
 	readBuffer := make([]byte, 4096)
 	bytesRead, readError := hostnameFile.Read(readBuffer)
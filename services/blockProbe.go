@@ -0,0 +1,150 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// blockProbeSize covers every superblock offset probed below, the btrfs superblock at 64KiB is the furthest
+const blockProbeSize = 0x10000 + 0x1000
+
+// blockSignature is a magic value identifying what a block device holds, named the way blkid reports it
+type blockSignature struct {
+	name   string
+	offset int
+	magic  []byte
+}
+
+var blockSignatures = []blockSignature{
+	{"gpt", 512, []byte("EFI PART")},
+	{"gpt", 4096, []byte("EFI PART")},
+	{"crypto_LUKS", 0, []byte("LUKS\xba\xbe")},
+	{"LVM2_member", 512 + 24, []byte("LVM2 001")},
+	{"LVM2_member", 24, []byte("LVM2 001")},
+	{"xfs", 0, []byte("XFSB")},
+	{"btrfs", 0x10040, []byte("_BHRfS_M")},
+	// the ext2, ext3 and ext4 superblocks share a magic, they only differ in feature flags
+	{"ext4", 1024 + 0x38, []byte{0x53, 0xef}},
+	{"swap", 4096 - 10, []byte("SWAPSPACE2")},
+	{"swap", 4096 - 10, []byte("SWAP-SPACE")},
+	{"iso9660", 0x8001, []byte("CD001")},
+	// FAT boot sectors end in the same 0x55aa as an MBR so they have to be probed first
+	{"vfat", 0x52, []byte("FAT32   ")},
+	{"vfat", 0x36, []byte("FAT16   ")},
+	{"vfat", 0x36, []byte("FAT12   ")},
+	{"dos", 510, []byte{0x55, 0xaa}},
+}
+
+// probeBlockSignature reports the first known partition table, filesystem or volume signature on device, an empty
+// name means the device looks unused
+func probeBlockSignature(device io.ReaderAt) (string, error) {
+	probeBuffer := make([]byte, blockProbeSize)
+	bytesRead, readError := device.ReadAt(probeBuffer, 0)
+
+	if readError != nil && !errors.Is(readError, io.EOF) {
+		return "", readError
+	}
+	probeBuffer = probeBuffer[:bytesRead]
+
+	for _, signature := range blockSignatures {
+		end := signature.offset + len(signature.magic)
+		if end <= len(probeBuffer) && bytes.Equal(probeBuffer[signature.offset:end], signature.magic) {
+			return signature.name, nil
+		}
+	}
+	return "", nil
+}
+
+// filesystemUuidOffsets locates the 16 byte filesystem uuid in each superblock, for btrfs this is the fsid
+var filesystemUuidOffsets = map[string]int{
+	"xfs":   32,
+	"ext4":  1024 + 0x68,
+	"btrfs": 0x10000 + 0x20,
+	"swap":  1024 + 12,
+}
+
+// probeFilesystemUuid reads the uuid of a filesystem of the given type, formatted the way /dev/disk/by-uuid names it
+func probeFilesystemUuid(device io.ReaderAt, filesystemType string) (string, error) {
+	switch filesystemType {
+	case "vfat":
+		return probeFatSerial(device)
+	case "iso9660":
+		return probeIsoUuid(device)
+	}
+
+	offset, known := filesystemUuidOffsets[filesystemType]
+
+	if !known {
+		return "", fmt.Errorf("cannot read the uuid of a %s filesystem", filesystemType)
+	}
+
+	uuid := make([]byte, 16)
+	_, readError := device.ReadAt(uuid, int64(offset))
+
+	if readError != nil {
+		return "", readError
+	}
+
+	if bytes.Equal(uuid, make([]byte, 16)) {
+		return "", fmt.Errorf("%s filesystem has no uuid", filesystemType)
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// probeFatSerial reads the volume serial FAT uses as its uuid, which sits after the FAT32 or the FAT12/16 extended BPB
+func probeFatSerial(device io.ReaderAt) (string, error) {
+	bootSector := make([]byte, 0x5a)
+	_, readError := device.ReadAt(bootSector, 0)
+
+	if readError != nil {
+		return "", readError
+	}
+
+	serial := bootSector[0x27:0x2b]
+	if bytes.Equal(bootSector[0x52:0x57], []byte("FAT32")) {
+		serial = bootSector[0x43:0x47]
+	}
+	return fmt.Sprintf("%02X%02X-%02X%02X", serial[3], serial[2], serial[1], serial[0]), nil
+}
+
+// isoCreationDateOffset locates the volume creation date in the primary volume descriptor, blkid reports it as the uuid
+const isoCreationDateOffset = 0x8000 + 813
+
+func probeIsoUuid(device io.ReaderAt) (string, error) {
+	creationDate := make([]byte, 16)
+	_, readError := device.ReadAt(creationDate, isoCreationDateOffset)
+
+	if readError != nil {
+		return "", readError
+	}
+
+	if bytes.Equal(creationDate, bytes.Repeat([]byte("0"), 16)) || bytes.Equal(creationDate, make([]byte, 16)) {
+		return "", errors.New("iso9660 filesystem has no creation date")
+	}
+
+	date := string(creationDate)
+	return fmt.Sprintf("%s-%s-%s-%s-%s-%s-%s", date[0:4], date[4:6], date[6:8], date[8:10], date[10:12], date[12:14], date[14:16]), nil
+}
+
+// luksUuidOffset is where LUKS1 and LUKS2 headers keep the container uuid as a NUL terminated string
+const luksUuidOffset = 168
+
+// probeLuksUuid reads the uuid of a LUKS container, which crypttab and /dev/disk/by-uuid refer to it by
+func probeLuksUuid(device io.ReaderAt) (string, error) {
+	uuid := make([]byte, 40)
+	_, readError := device.ReadAt(uuid, luksUuidOffset)
+
+	if readError != nil {
+		return "", readError
+	}
+
+	uuid, _, _ = bytes.Cut(uuid, []byte{0})
+
+	if len(uuid) == 0 {
+		return "", errors.New("LUKS header has no uuid")
+	}
+	return string(uuid), nil
+}
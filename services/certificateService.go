@@ -0,0 +1,382 @@
+package services
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+const CertificateConfigFile = "certificates.json"
+const defaultCertificateCheckInterval = time.Hour
+const defaultCertificateRenewBefore = 7 * 24 * time.Hour
+
+type CertificateService interface {
+	initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService, vaultService VaultService, secretService SecretService, systemdService SystemdService, schedulerService SchedulerService)
+	ConfigureCertificates(configs clients.FileSystemWrapper, vmDetails clients.ProxmoxVm) (bool, error)
+	EnsureCertificate(session *VaultSession, spec CertificateSpec, vmDetails clients.ProxmoxVm) (bool, error)
+}
+
+// CertificateConfig is read from certificates.json on a role's config drive, auth files are paths on the same drive
+type CertificateConfig struct {
+	VaultAddress  string            `json:"vaultAddress"`
+	Auth          VaultAuthConfig   `json:"auth"`
+	CheckInterval string            `json:"checkInterval"`
+	Certificates  []CertificateSpec `json:"certificates"`
+}
+
+// CertificateSpec describes a single certificate issued from a pki mount. Modes are octal strings such as "0640",
+// BundlePath writes the certificate, chain and key to one file for consumers like haproxy
+type CertificateSpec struct {
+	MountPath     string   `json:"mountPath"`
+	Role          string   `json:"role"`
+	CommonName    string   `json:"commonName"`
+	AltNames      []string `json:"altNames"`
+	IpSans        []string `json:"ipSans"`
+	Ttl           string   `json:"ttl"`
+	RenewBefore   string   `json:"renewBefore"`
+	CertPath      string   `json:"certPath"`
+	KeyPath       string   `json:"keyPath"`
+	CaPath        string   `json:"caPath"`
+	BundlePath    string   `json:"bundlePath"`
+	Owner         string   `json:"owner"`
+	Mode          string   `json:"mode"`
+	KeyMode       string   `json:"keyMode"`
+	SeLinuxType   string   `json:"seLinuxType"`
+	ReloadService string   `json:"reloadService"`
+}
+
+type CertificateServiceImpl struct {
+	logger            *logrus.Logger
+	osClient          clients.OsClient
+	filesystemService FileSystemService
+	vaultService      VaultService
+	secretService     SecretService
+	systemdService    SystemdService
+	schedulerService  SchedulerService
+}
+
+func (certificateService *CertificateServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService, vaultService VaultService, secretService SecretService, systemdService SystemdService, schedulerService SchedulerService) {
+	certificateService.logger = logger
+	certificateService.osClient = osClient
+	certificateService.filesystemService = filesystemService
+	certificateService.vaultService = vaultService
+	certificateService.secretService = secretService
+	certificateService.systemdService = systemdService
+	certificateService.schedulerService = schedulerService
+}
+
+// ConfigureCertificates issues every certificate declared in the config drive's certificates.json and schedules
+// their renewal, false is returned when the drive does not declare any certificates
+func (certificateService *CertificateServiceImpl) ConfigureCertificates(configs clients.FileSystemWrapper, vmDetails clients.ProxmoxVm) (bool, error) {
+	fileInfos, readDirError := configs.ReadDir("/")
+
+	if readDirError != nil {
+		certificateService.logger.Errorf("Failed to read config drive while looking for %s: %s", CertificateConfigFile, readDirError.Error())
+		return false, readDirError
+	}
+
+	configFound := false
+	for _, fileInfo := range fileInfos {
+		configFound = configFound || fileInfo.Name() == CertificateConfigFile
+	}
+
+	if !configFound {
+		certificateService.logger.Debugf("No %s found on %s, skipping certificate management", CertificateConfigFile, configs.GetFilesystemLabel())
+		return false, nil
+	}
+
+	configBytes, readConfigError := certificateService.filesystemService.ReadFileContentsFromFilesystem(configs, CertificateConfigFile)
+
+	if readConfigError != nil {
+		return false, readConfigError
+	}
+
+	var config CertificateConfig
+	jsonProcessingError := json.Unmarshal(configBytes, &config)
+
+	if jsonProcessingError != nil {
+		certificateService.logger.Errorf("Failed to parse %s: %s", CertificateConfigFile, jsonProcessingError.Error())
+		return false, jsonProcessingError
+	}
+
+	session, connectError := certificateService.secretService.Connect(configs, VaultConnectionConfig{Address: config.VaultAddress, Auth: config.Auth})
+
+	if connectError != nil {
+		return false, connectError
+	}
+
+	checkInterval, parseIntervalError := parseDurationOrDefault(config.CheckInterval, defaultCertificateCheckInterval)
+
+	if parseIntervalError != nil {
+		certificateService.logger.Errorf("Invalid certificate check interval %s: %s", config.CheckInterval, parseIntervalError.Error())
+		return false, parseIntervalError
+	}
+
+	if checkInterval <= 0 {
+		certificateService.logger.Errorf("Invalid certificate check interval %s: must be positive", config.CheckInterval)
+		return false, fmt.Errorf("certificate check interval %s must be positive", config.CheckInterval)
+	}
+
+	for _, spec := range config.Certificates {
+		_, ensureError := certificateService.EnsureCertificate(session, spec, vmDetails)
+
+		if ensureError != nil {
+			return false, ensureError
+		}
+
+		scheduleError := certificateService.scheduleRenewal(session, spec, vmDetails, checkInterval)
+
+		if scheduleError != nil {
+			return false, scheduleError
+		}
+	}
+
+	return true, nil
+}
+
+func (certificateService *CertificateServiceImpl) scheduleRenewal(session *VaultSession, spec CertificateSpec, vmDetails clients.ProxmoxVm, checkInterval time.Duration) error {
+	return certificateService.schedulerService.Schedule(fmt.Sprintf("renew certificate %s", spec.CertPath), checkInterval, func() error {
+		renewed, ensureError := certificateService.EnsureCertificate(session, spec, vmDetails)
+
+		if ensureError != nil || !renewed || spec.ReloadService == "" {
+			return ensureError
+		}
+
+		certificateService.logger.Infof("Reloading %s after certificate %s was renewed", spec.ReloadService, spec.CertPath)
+		return certificateService.systemdService.ReloadOrRestartService(spec.ReloadService)
+	})
+}
+
+// EnsureCertificate issues a new certificate when the current one is missing or within its renewal window,
+// true is returned when new certificate material was written
+func (certificateService *CertificateServiceImpl) EnsureCertificate(session *VaultSession, spec CertificateSpec, vmDetails clients.ProxmoxVm) (bool, error) {
+	renewBefore, parseRenewBeforeError := parseDurationOrDefault(spec.RenewBefore, defaultCertificateRenewBefore)
+
+	if parseRenewBeforeError != nil {
+		certificateService.logger.Errorf("Invalid renewal window %s for %s: %s", spec.RenewBefore, spec.CertPath, parseRenewBeforeError.Error())
+		return false, parseRenewBeforeError
+	}
+
+	renewalRequired, checkExpiryError := certificateService.renewalRequired(spec.CertPath, renewBefore)
+
+	if checkExpiryError != nil {
+		return false, checkExpiryError
+	}
+
+	if !renewalRequired {
+		certificateService.logger.Debugf("Certificate %s is still valid, skipping...", spec.CertPath)
+		return false, nil
+	}
+
+	token, getTokenError := certificateService.vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return false, getTokenError
+	}
+	defer token.Destroy()
+
+	issueRequest := buildIssueRequest(spec, vmDetails)
+	certificateService.logger.Infof("Issuing certificate for %s (dns: %s, ip: %s) from %s/issue/%s", issueRequest.CommonName, issueRequest.AltNames, issueRequest.IpSans, spec.MountPath, spec.Role)
+
+	issueResponse, issueError := certificateService.vaultService.IssueCertificate(session.Address, token, spec.MountPath, spec.Role, issueRequest)
+
+	if issueError != nil {
+		return false, issueError
+	}
+
+	writeError := certificateService.writeCertificate(spec, issueResponse)
+
+	if writeError != nil {
+		return false, writeError
+	}
+
+	return true, nil
+}
+
+func (certificateService *CertificateServiceImpl) renewalRequired(certPath string, renewBefore time.Duration) (bool, error) {
+	_, statFileError := certificateService.osClient.StatFile(certPath)
+
+	if errors.Is(statFileError, os.ErrNotExist) {
+		return true, nil
+	} else if statFileError != nil {
+		certificateService.logger.Errorf("Failed to stat certificate %s: %s", certPath, statFileError.Error())
+		return false, statFileError
+	}
+
+	certBytes, readCertError := certificateService.filesystemService.ReadFileContents(certPath)
+
+	if readCertError != nil {
+		return false, readCertError
+	}
+
+	certBlock, _ := pem.Decode(certBytes)
+
+	if certBlock == nil {
+		certificateService.logger.Warnf("Certificate %s does not contain PEM data, reissuing", certPath)
+		return true, nil
+	}
+
+	certificate, parseCertError := x509.ParseCertificate(certBlock.Bytes)
+
+	if parseCertError != nil {
+		certificateService.logger.Warnf("Certificate %s could not be parsed, reissuing: %s", certPath, parseCertError.Error())
+		return true, nil
+	}
+
+	certificateService.logger.Debugf("Certificate %s expires at %s", certPath, certificate.NotAfter)
+	return time.Now().Add(renewBefore).After(certificate.NotAfter), nil
+}
+
+func (certificateService *CertificateServiceImpl) writeCertificate(spec CertificateSpec, issueResponse *clients.PkiIssueResponse) error {
+	mode, parseModeError := parseModeOrDefault(spec.Mode, 0644)
+
+	if parseModeError != nil {
+		return parseModeError
+	}
+
+	keyMode, parseKeyModeError := parseModeOrDefault(spec.KeyMode, 0600)
+
+	if parseKeyModeError != nil {
+		return parseKeyModeError
+	}
+
+	// the key was registered for redaction as it was decoded, it is destroyed once written and every buffer holding a
+	// copy of it is zeroed below
+	privateKey := issueResponse.Data.PrivateKey
+	defer privateKey.Destroy()
+
+	chain := issueResponse.Data.CaChain
+	if len(chain) == 0 && issueResponse.Data.IssuingCa != "" {
+		chain = []string{issueResponse.Data.IssuingCa}
+	}
+
+	chainParts := make([][]byte, 0, len(chain))
+	for _, pem := range chain {
+		chainParts = append(chainParts, []byte(pem))
+	}
+	certificate := []byte(issueResponse.Data.Certificate)
+
+	files := []struct {
+		path        string
+		contents    []byte
+		permissions int
+	}{
+		{spec.KeyPath, pemFile(privateKey.Bytes()), keyMode},
+		{spec.BundlePath, pemFile(append(append([][]byte{certificate}, chainParts...), privateKey.Bytes())...), keyMode},
+		{spec.CaPath, pemFile(chainParts...), mode},
+		{spec.CertPath, pemFile(certificate), mode},
+	}
+	defer func() {
+		for _, file := range files {
+			clients.ZeroBytes(file.contents)
+		}
+	}()
+
+	// each file is written through a temporary file renamed into place so none is ever half written. The renames
+	// are separate, the key and bundle go first and the certificate last so a service that reloads when the
+	// certificate changes finds its new key already in place
+	attributes := FileAttributes{}
+	if spec.Owner != "" {
+		ownership, resolveOwnerError := certificateService.filesystemService.ResolveOwnership(spec.Owner)
+
+		if resolveOwnerError != nil {
+			return resolveOwnerError
+		}
+		if ownership.Uid != -1 {
+			attributes.Owner = strconv.Itoa(ownership.Uid)
+		}
+		if ownership.Gid != -1 {
+			attributes.Group = strconv.Itoa(ownership.Gid)
+		}
+	}
+	if spec.SeLinuxType != "" {
+		attributes.SeLinuxLabel = fmt.Sprintf("system_u:object_r:%s:%s", spec.SeLinuxType, defaultSeLinuxLevel)
+	}
+
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+
+		fileAttributes := attributes
+		fileAttributes.Mode = os.FileMode(file.permissions)
+		_, writeError := certificateService.filesystemService.WriteFileToRootFs(file.path, file.contents, fileAttributes)
+
+		if writeError != nil {
+			return writeError
+		}
+	}
+
+	certificateService.logger.Infof("Wrote certificate %s with serial %s", spec.CertPath, issueResponse.Data.SerialNumber)
+	return nil
+}
+
+// pemFile joins PEM blocks into the contents of a file in a single allocation, a buffer holding a key leaves no
+// copies behind when it is zeroed
+func pemFile(blocks ...[]byte) []byte {
+	size := 1
+	for _, block := range blocks {
+		size += len(block) + 1
+	}
+
+	contents := make([]byte, 0, size)
+	for index, block := range blocks {
+		if index > 0 {
+			contents = append(contents, '\n')
+		}
+		contents = append(contents, block...)
+	}
+	return append(contents, '\n')
+}
+
+func buildIssueRequest(spec CertificateSpec, vmDetails clients.ProxmoxVm) clients.PkiIssueRequest {
+	commonName := spec.CommonName
+	if commonName == "" {
+		commonName = vmDetails.Name
+	}
+
+	altNames := append([]string{vmDetails.Name}, spec.AltNames...)
+
+	var ipSans []string
+	for _, ipConfig := range vmDetails.IpConfig {
+		ipAddress, _, _ := strings.Cut(ipConfig.IpAddress, "/")
+		if ipAddress != "" && ipAddress != "dhcp" {
+			ipSans = append(ipSans, ipAddress)
+		}
+	}
+	ipSans = append(ipSans, spec.IpSans...)
+
+	return clients.PkiIssueRequest{
+		CommonName: commonName,
+		AltNames:   strings.Join(altNames, ","),
+		IpSans:     strings.Join(ipSans, ","),
+		Ttl:        spec.Ttl,
+	}
+}
+
+func parseDurationOrDefault(duration string, defaultDuration time.Duration) (time.Duration, error) {
+	if duration == "" {
+		return defaultDuration, nil
+	}
+	return time.ParseDuration(duration)
+}
+
+func parseModeOrDefault(mode string, defaultMode int) (int, error) {
+	if mode == "" {
+		return defaultMode, nil
+	}
+	parsedMode, parseError := strconv.ParseUint(mode, 8, 32)
+	if parseError != nil {
+		return 0, fmt.Errorf("invalid file mode %s: %w", mode, parseError)
+	}
+	return int(parsedMode), nil
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"os"
+	"testing"
+	"time"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildIssueRequest(t *testing.T) {
+	vmDetails := clients.ProxmoxVm{Name: "vault-01"}
+	vmDetails.IpConfig = append(vmDetails.IpConfig, struct {
+		Gateway   string `json:"gateway"`
+		IpAddress string `json:"ip_address"`
+		Order     int    `json:"order"`
+	}{IpAddress: "10.1.0.14/24"})
+
+	issueRequest := buildIssueRequest(CertificateSpec{AltNames: []string{"vault.internal"}, IpSans: []string{"127.0.0.1"}, Ttl: "720h"}, vmDetails)
+
+	assert.Equal(t, "vault-01", issueRequest.CommonName)
+	assert.Equal(t, "vault-01,vault.internal", issueRequest.AltNames)
+	assert.Equal(t, "10.1.0.14,127.0.0.1", issueRequest.IpSans)
+	assert.Equal(t, "720h", issueRequest.Ttl)
+}
+
+func TestParseModeOrDefault(t *testing.T) {
+	mode, parseError := parseModeOrDefault("0640", 0600)
+	assert.Nil(t, parseError)
+	assert.Equal(t, 0640, mode)
+
+	mode, parseError = parseModeOrDefault("", 0600)
+	assert.Nil(t, parseError)
+	assert.Equal(t, 0600, mode)
+
+	_, parseError = parseModeOrDefault("0990", 0600)
+	assert.NotNil(t, parseError)
+}
+
+func TestCertificateServiceImpl_renewalRequired_missingCertificate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile("/etc/vault.d/tls.crt").Return(nil, os.ErrNotExist)
+
+	testCertificateService := CertificateServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	renewalRequired, checkError := testCertificateService.renewalRequired("/etc/vault.d/tls.crt", time.Hour)
+
+	assert.Nil(t, checkError)
+	assert.True(t, renewalRequired)
+}
+
+func TestCertificateServiceImpl_writeCertificate(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddDirectory("/etc/haproxy/certs", 0750)
+	host.AddFile("/etc/haproxy/certs/haproxy.key", []byte("old key\n"), 0600)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: host}
+	testCertificateService := CertificateServiceImpl{logger: &logrus.Logger{}, filesystemService: &testFilesystemService}
+	issueResponse := &clients.PkiIssueResponse{}
+	issueResponse.Data.Certificate = "cert"
+	issueResponse.Data.PrivateKey = clients.NewSecret([]byte("key"))
+
+	writeError := testCertificateService.writeCertificate(CertificateSpec{
+		CertPath:    "/etc/haproxy/certs/haproxy.crt",
+		KeyPath:     "/etc/haproxy/certs/haproxy.key",
+		Owner:       "0:0",
+		SeLinuxType: "cert_t",
+	}, issueResponse)
+
+	assert.Nil(t, writeError)
+	key, _ := host.Node("/etc/haproxy/certs/haproxy.key")
+	assert.Equal(t, "key\n", string(key.Contents))
+	assert.Equal(t, os.FileMode(0600), key.Mode.Perm())
+	assert.Equal(t, []byte("system_u:object_r:cert_t:s0"), key.Xattrs[seLinuxXattr])
+	certificate, _ := host.Node("/etc/haproxy/certs/haproxy.crt")
+	assert.Equal(t, os.FileMode(0644), certificate.Mode.Perm())
+
+	// only the renamed files are left behind
+	entries, _ := host.ReadDir("/etc/haproxy/certs")
+	assert.Equal(t, 2, len(entries))
+}
+
+// renameRecorder records the paths files are renamed to so the order they are replaced in can be checked
+type renameRecorder struct {
+	*clients.MemoryOsClient
+	renamed []string
+}
+
+func (recorder *renameRecorder) Rename(oldPath string, newPath string) error {
+	recorder.renamed = append(recorder.renamed, newPath)
+	return recorder.MemoryOsClient.Rename(oldPath, newPath)
+}
+
+func TestCertificateServiceImpl_writeCertificate_keyBeforeCertificate(t *testing.T) {
+	host := &renameRecorder{MemoryOsClient: clients.NewMemoryOsClient()}
+	host.AddDirectory("/etc/vault.d", 0755)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: host}
+	testCertificateService := CertificateServiceImpl{logger: &logrus.Logger{}, filesystemService: &testFilesystemService}
+	issueResponse := &clients.PkiIssueResponse{}
+	issueResponse.Data.Certificate = "cert"
+	issueResponse.Data.PrivateKey = clients.NewSecret([]byte("key"))
+	issueResponse.Data.IssuingCa = "ca"
+
+	writeError := testCertificateService.writeCertificate(CertificateSpec{
+		CertPath:   "/etc/vault.d/tls.crt",
+		KeyPath:    "/etc/vault.d/tls.pem",
+		CaPath:     "/etc/vault.d/ca.crt",
+		BundlePath: "/etc/vault.d/bundle.pem",
+	}, issueResponse)
+
+	assert.Nil(t, writeError)
+	assert.Equal(t, []string{"/etc/vault.d/tls.pem", "/etc/vault.d/bundle.pem", "/etc/vault.d/ca.crt", "/etc/vault.d/tls.crt"}, host.renamed)
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"zs-vm-agent/clients"
+)
+
+const blockDeviceDirectory = "/sys/class/block"
+
+// ErrConfigVolumeNotFound is returned when no block device holds the requested config volume
+var ErrConfigVolumeNotFound = errors.New("config volume not found")
+
+// fatLabelLength is all a FAT volume label holds, mkfs.vfat truncates longer labels
+const fatLabelLength = 11
+
+// configVolumeTypes are the filesystems config volumes are built with, anything else is never opened
+var configVolumeTypes = map[string]bool{"vfat": true, "iso9660": true, "ext4": true}
+
+// ConfigVolumeQuery identifies a config volume, every field that is set has to match. Labels and uuids are compared
+// ignoring case as FAT stores labels in upper case, MarkerFile is a path on the volume that has to exist
+type ConfigVolumeQuery struct {
+	Label      string `json:"label"`
+	Uuid       string `json:"uuid"`
+	MarkerFile string `json:"markerFile"`
+}
+
+func (query ConfigVolumeQuery) String() string {
+	var criteria []string
+	if query.Label != "" {
+		criteria = append(criteria, "label "+query.Label)
+	}
+	if query.Uuid != "" {
+		criteria = append(criteria, "uuid "+query.Uuid)
+	}
+	if query.MarkerFile != "" {
+		criteria = append(criteria, "marker "+query.MarkerFile)
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// FindConfigFilesystem probes every block device, whole disks and partitions alike, for a FAT, ISO9660 or ext4
+// filesystem matching query. Finding more than one is an error so a stray disk can never stand in for the real one
+func (filesystemService *FileSystemServiceImpl) FindConfigFilesystem(query ConfigVolumeQuery) (clients.FileSystemWrapper, error) {
+	if query.Label == "" && query.Uuid == "" && query.MarkerFile == "" {
+		return nil, errors.New("a config volume needs a label, uuid or marker file to be found by")
+	}
+
+	blockDevices, listDevicesError := filesystemService.osClient.ReadDir(blockDeviceDirectory)
+
+	if listDevicesError != nil {
+		filesystemService.logger.Errorf("Failed to list block devices: %s", listDevicesError.Error())
+		return nil, listDevicesError
+	}
+
+	var matchedDevices []string
+	var matchedDisks []clients.DiskWrapper
+	var matchedFilesystem clients.FileSystemWrapper
+	for _, blockDevice := range blockDevices {
+		name := blockDevice.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") {
+			continue
+		}
+
+		devicePath := filepath.Join("/dev", name)
+		configDisk, configFilesystem := filesystemService.probeConfigVolume(devicePath, query)
+
+		if configFilesystem != nil {
+			matchedDevices = append(matchedDevices, devicePath)
+			matchedDisks = append(matchedDisks, configDisk)
+			matchedFilesystem = configFilesystem
+		}
+	}
+
+	switch len(matchedDevices) {
+	case 0:
+		filesystemService.logger.Debugf("No block device holds a config volume with %s", query)
+		return nil, fmt.Errorf("%w: no block device holds %s", ErrConfigVolumeNotFound, query)
+	case 1:
+		// the disk stays open for as long as its filesystem is read, as it does for GetBlockFilesystem
+		filesystemService.logger.Infof("Found config volume with %s on %s", query, matchedDevices[0])
+		return matchedFilesystem, nil
+	}
+
+	for _, matchedDisk := range matchedDisks {
+		_ = matchedDisk.Close()
+	}
+	sort.Strings(matchedDevices)
+	filesystemService.logger.Errorf("Config volume with %s found on %s, refusing to pick one", query, strings.Join(matchedDevices, ", "))
+	return nil, fmt.Errorf("config volume with %s found on %d devices: %s", query, len(matchedDevices), strings.Join(matchedDevices, ", "))
+}
+
+// probeConfigVolume returns the opened disk and its filesystem when devicePath matches query, a disk that does not
+// match is closed again. The signature and uuid are read from the raw device first so only candidates are opened
+func (filesystemService *FileSystemServiceImpl) probeConfigVolume(devicePath string, query ConfigVolumeQuery) (clients.DiskWrapper, clients.FileSystemWrapper) {
+	device, openDeviceError := filesystemService.osClient.OpenFile(devicePath)
+
+	if openDeviceError != nil {
+		filesystemService.logger.Debugf("Skipping %s, it cannot be opened: %s", devicePath, openDeviceError.Error())
+		return nil, nil
+	}
+
+	signature, probeError := probeBlockSignature(device)
+	uuid := ""
+	if probeError == nil && configVolumeTypes[signature] {
+		uuid, _ = probeFilesystemUuid(device, signature)
+	}
+	_ = device.Close()
+
+	if probeError != nil || !configVolumeTypes[signature] {
+		return nil, nil
+	}
+
+	if query.Uuid != "" && !strings.EqualFold(uuid, query.Uuid) {
+		return nil, nil
+	}
+
+	disk, openDiskError := filesystemService.osClient.OpenDiskReadOnly(devicePath)
+
+	if openDiskError != nil {
+		filesystemService.logger.Debugf("Skipping %s, it cannot be opened: %s", devicePath, openDiskError.Error())
+		return nil, nil
+	}
+
+	configFilesystem, getFilesystemError := disk.GetFileSystem(0)
+
+	if getFilesystemError != nil {
+		filesystemService.logger.Debugf("Skipping %s, its %s filesystem cannot be read: %s", devicePath, signature, getFilesystemError.Error())
+		_ = disk.Close()
+		return nil, nil
+	}
+
+	if (query.Label != "" && !labelMatches(signature, configFilesystem.GetFilesystemLabel(), query.Label)) ||
+		(query.MarkerFile != "" && filesystemService.statSourceFile(configFilesystem, query.MarkerFile) == nil) {
+		_ = disk.Close()
+		return nil, nil
+	}
+
+	filesystemService.logger.Debugf("%s holds a %s config volume labelled %q with uuid %s", devicePath, signature, configFilesystem.GetFilesystemLabel(), uuid)
+	return disk, configFilesystem
+}
+
+// OpenConfigVolume opens the config volume matching query, or the VM disk with the given order when no volume matches
+// since drives built before config volumes were labelled are only found by their order. The volume is verified against
+// its manifest and every file read from it is checked again as it is read
+func (filesystemService *FileSystemServiceImpl) OpenConfigVolume(vmDetails clients.ProxmoxVm, query ConfigVolumeQuery, order int) (clients.FileSystemWrapper, error) {
+	configs, findVolumeError := filesystemService.FindConfigFilesystem(query)
+
+	if errors.Is(findVolumeError, ErrConfigVolumeNotFound) {
+		diskPath, resolveDiskError := filesystemService.diskService.ResolveDisk(vmDetails, order)
+
+		if resolveDiskError != nil {
+			return nil, resolveDiskError
+		}
+
+		configs, findVolumeError = filesystemService.GetBlockFilesystem(diskPath)
+	}
+
+	if findVolumeError != nil {
+		return nil, findVolumeError
+	}
+
+	manifest, verifyManifestError := filesystemService.manifestService.VerifyFilesystem(configs)
+
+	if verifyManifestError != nil {
+		return nil, verifyManifestError
+	}
+	return filesystemService.manifestService.VerifiedFilesystem(configs, manifest), nil
+}
+
+// labelMatches compares a volume label with the label queried for, on FAT a label cut to the length FAT holds matches
+func labelMatches(signature string, label string, queryLabel string) bool {
+	label = strings.TrimSpace(label)
+	if signature == "vfat" && len(queryLabel) > fatLabelLength && strings.EqualFold(label, queryLabel[:fatLabelLength]) {
+		return true
+	}
+	return strings.EqualFold(label, queryLabel)
+}
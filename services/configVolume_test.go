@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFatDevice(serial []byte) []byte {
+	device := make([]byte, blockProbeSize)
+	copy(device[0x52:], "FAT32   ")
+	copy(device[0x43:], serial)
+	device[510], device[511] = 0x55, 0xaa
+	return device
+}
+
+func testIsoDevice(creationDate string) []byte {
+	device := make([]byte, blockProbeSize)
+	copy(device[0x8001:], "CD001")
+	copy(device[isoCreationDateOffset:], creationDate)
+	return device
+}
+
+func TestProbeFilesystemUuid_configVolumes(t *testing.T) {
+	fatDevice := testFatDevice([]byte{0x78, 0x56, 0x34, 0x12})
+	signature, _ := probeBlockSignature(bytes.NewReader(fatDevice))
+	assert.Equal(t, "vfat", signature)
+	uuid, probeError := probeFilesystemUuid(bytes.NewReader(fatDevice), "vfat")
+	assert.Nil(t, probeError)
+	assert.Equal(t, "1234-5678", uuid)
+
+	isoDevice := testIsoDevice("2024050112000000")
+	signature, _ = probeBlockSignature(bytes.NewReader(isoDevice))
+	assert.Equal(t, "iso9660", signature)
+	uuid, probeError = probeFilesystemUuid(bytes.NewReader(isoDevice), "iso9660")
+	assert.Nil(t, probeError)
+	assert.Equal(t, "2024-05-01-12-00-00-00", uuid)
+}
+
+// newBlockDeviceOsClient lists devices as the block devices of the system, each backed by a file holding its bytes.
+// The disks opened for filesystems are recorded as they are closed
+func newBlockDeviceOsClient(t *testing.T, ctrl *gomock.Controller, devices map[string][]byte, filesystems map[string]clients.FileSystemWrapper) (*clients.MockOsClient, map[string]bool) {
+	sysDirectory, deviceDirectory := t.TempDir(), t.TempDir()
+	for name, contents := range devices {
+		assert.Nil(t, os.WriteFile(filepath.Join(sysDirectory, name), nil, 0644))
+		assert.Nil(t, os.WriteFile(filepath.Join(deviceDirectory, name), contents, 0644))
+	}
+
+	closedDisks := map[string]bool{}
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().ReadDir(blockDeviceDirectory).DoAndReturn(func(string) ([]os.DirEntry, error) { return os.ReadDir(sysDirectory) })
+	mockOsClient.EXPECT().OpenFile(gomock.Any()).DoAndReturn(func(devicePath string) (*os.File, error) {
+		return os.Open(filepath.Join(deviceDirectory, filepath.Base(devicePath)))
+	}).AnyTimes()
+	mockOsClient.EXPECT().OpenDiskReadOnly(gomock.Any()).DoAndReturn(func(devicePath string) (clients.DiskWrapper, error) {
+		configFilesystem, known := filesystems[filepath.Base(devicePath)]
+		if !known {
+			return nil, errors.New("not a disk")
+		}
+		mockDiskWrapper := clients.NewMockDiskWrapper(ctrl)
+		mockDiskWrapper.EXPECT().GetFileSystem(0).Return(configFilesystem, nil)
+		mockDiskWrapper.EXPECT().Close().DoAndReturn(func() error {
+			closedDisks[filepath.Base(devicePath)] = true
+			return nil
+		}).AnyTimes()
+		return mockDiskWrapper, nil
+	}).AnyTimes()
+	return mockOsClient, closedDisks
+}
+
+func TestFileSystemServiceImpl_FindConfigFilesystem(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	vaultVolume := newTestConfigDrive(t, ctrl, "ZS-VAULT-CFG", map[string]string{"vault-config.json": ""})
+	k8sVolume := newTestConfigDrive(t, ctrl, "ZS-K8S-CONFIG", map[string]string{"k8s-config.json": ""})
+	mockOsClient, closedDisks := newBlockDeviceOsClient(t, ctrl, map[string][]byte{
+		"sda":   make([]byte, blockProbeSize),
+		"sdb":   testFatDevice([]byte{0x78, 0x56, 0x34, 0x12}),
+		"sr0":   testIsoDevice("2024050112000000"),
+		"loop0": testIsoDevice("2024050112000000"),
+	}, map[string]clients.FileSystemWrapper{"sdb": vaultVolume, "sr0": k8sVolume})
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	found, findError := testFilesystemService.FindConfigFilesystem(ConfigVolumeQuery{Label: "zs-k8s-config"})
+	assert.Nil(t, findError)
+	assert.Equal(t, k8sVolume, found)
+	assert.Equal(t, map[string]bool{"sdb": true}, closedDisks)
+}
+
+func TestFileSystemServiceImpl_FindConfigFilesystem_byUuidAndMarker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	vaultVolume := newTestConfigDrive(t, ctrl, "", map[string]string{"vault-config.json": ""})
+	mockOsClient, _ := newBlockDeviceOsClient(t, ctrl, map[string][]byte{
+		"sdb": testFatDevice([]byte{0x78, 0x56, 0x34, 0x12}),
+		"sdc": testFatDevice([]byte{0x21, 0x43, 0x65, 0x87}),
+	}, map[string]clients.FileSystemWrapper{"sdb": vaultVolume, "sdc": vaultVolume})
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	found, findError := testFilesystemService.FindConfigFilesystem(ConfigVolumeQuery{Uuid: "1234-5678", MarkerFile: "vault-config.json"})
+	assert.Nil(t, findError)
+	assert.Equal(t, vaultVolume, found)
+}
+
+func TestFileSystemServiceImpl_FindConfigFilesystem_notFoundOrAmbiguous(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	volume := newTestConfigDrive(t, ctrl, "ZS-LB-CONFIG", map[string]string{})
+	newService := func() (FileSystemServiceImpl, map[string]bool) {
+		mockOsClient, closedDisks := newBlockDeviceOsClient(t, ctrl, map[string][]byte{
+			"sdb": testFatDevice([]byte{1, 2, 3, 4}),
+			"sdc": testFatDevice([]byte{5, 6, 7, 8}),
+		}, map[string]clients.FileSystemWrapper{"sdb": volume, "sdc": volume})
+		return FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}, closedDisks
+	}
+
+	testFilesystemService, closedDisks := newService()
+	_, findError := testFilesystemService.FindConfigFilesystem(ConfigVolumeQuery{Label: "ZS-DNS-ZONES"})
+	assert.ErrorIs(t, findError, ErrConfigVolumeNotFound)
+	assert.Equal(t, map[string]bool{"sdb": true, "sdc": true}, closedDisks)
+
+	// neither disk is handed out so both are closed again
+	testFilesystemService, closedDisks = newService()
+	_, findError = testFilesystemService.FindConfigFilesystem(ConfigVolumeQuery{Label: "ZS-LB-CONFIG"})
+	assert.ErrorContains(t, findError, "/dev/sdb, /dev/sdc")
+	assert.NotErrorIs(t, findError, ErrConfigVolumeNotFound)
+	assert.Equal(t, map[string]bool{"sdb": true, "sdc": true}, closedDisks)
+
+	_, findError = testFilesystemService.FindConfigFilesystem(ConfigVolumeQuery{})
+	assert.NotNil(t, findError)
+}
+
+func TestFileSystemServiceImpl_OpenConfigVolume(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	volume := newTestConfigDrive(t, ctrl, "ZS-LB-CONFIG", map[string]string{})
+	newService := func(manifestService ManifestService) FileSystemServiceImpl {
+		mockOsClient, _ := newBlockDeviceOsClient(t, ctrl, map[string][]byte{
+			"sdb": testFatDevice([]byte{1, 2, 3, 4}),
+		}, map[string]clients.FileSystemWrapper{"sdb": volume})
+		testDiskService := DiskServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+		return FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient, diskService: &testDiskService, manifestService: manifestService}
+	}
+	vmDetails := clients.ProxmoxVm{Name: "lb-01"}
+
+	testFilesystemService := newService(&ManifestServiceImpl{logger: &logrus.Logger{}})
+	opened, openError := testFilesystemService.OpenConfigVolume(vmDetails, ConfigVolumeQuery{Label: "ZS-LB-CONFIG"}, 4)
+	assert.Nil(t, openError)
+	assert.Equal(t, volume, opened)
+
+	// a volume without a manifest is refused once the manifest service is strict
+	testFilesystemService = newService(&ManifestServiceImpl{logger: &logrus.Logger{}, strict: true})
+	_, openError = testFilesystemService.OpenConfigVolume(vmDetails, ConfigVolumeQuery{Label: "ZS-LB-CONFIG"}, 4)
+	assert.ErrorContains(t, openError, "has no SHA256SUMS")
+
+	// without a matching volume the disk is looked up by its order
+	testFilesystemService = newService(&ManifestServiceImpl{logger: &logrus.Logger{}})
+	_, openError = testFilesystemService.OpenConfigVolume(vmDetails, ConfigVolumeQuery{Label: "ZS-DNS-ZONES"}, 4)
+	assert.ErrorContains(t, openError, "has no disk with order 4")
+}
+
+func TestLabelMatches(t *testing.T) {
+	assert.True(t, labelMatches("vfat", "ZS-DNS-ZONE", "ZS-DNS-ZONES"))
+	assert.True(t, labelMatches("vfat", "zs-lb-confi", "ZS-LB-CONFIG"))
+	assert.True(t, labelMatches("iso9660", "ZS-DNS-ZONES   ", "zs-dns-zones"))
+	// only FAT truncates labels
+	assert.False(t, labelMatches("iso9660", "ZS-DNS-ZONE", "ZS-DNS-ZONES"))
+	assert.False(t, labelMatches("vfat", "ZS-DNS-KEEP", "ZS-DNS-ZONES"))
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"zs-vm-agent/clients"
+)
+
+// virtioPciSlots are the slots Proxmox places virtio0 to virtio5 in on the root bus
+var virtioPciSlots = []int{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+
+// ResolveDisk finds the local device of the VM disk with the given order and verifies its size matches the one
+// Proxmox reports, so a re-ordered or missing disk is never mistaken for another
+func (diskService *DiskServiceImpl) ResolveDisk(vmDetails clients.ProxmoxVm, order int) (string, error) {
+	for _, vmDisk := range vmDetails.Disk {
+		if vmDisk.Order != order {
+			continue
+		}
+
+		candidates, candidatesError := diskDeviceCandidates(vmDisk)
+
+		if candidatesError != nil {
+			diskService.logger.Errorf("Cannot resolve disk %d: %s", order, candidatesError.Error())
+			return "", candidatesError
+		}
+
+		for _, candidate := range candidates {
+			_, statCandidateError := diskService.osClient.StatFile(candidate)
+
+			if statCandidateError != nil {
+				continue
+			}
+
+			verifyError := diskService.verifyDiskSize(candidate, vmDisk.Size)
+
+			if verifyError != nil {
+				diskService.logger.Errorf("Disk %d at %s does not match %s%d: %s", order, candidate, vmDisk.BusType, vmDisk.Id, verifyError.Error())
+				return "", verifyError
+			}
+
+			diskService.logger.Debugf("Resolved disk %d (%s%d) to %s", order, vmDisk.BusType, vmDisk.Id, candidate)
+			return candidate, nil
+		}
+
+		diskService.logger.Errorf("No device found for disk %d (%s%d), tried %s", order, vmDisk.BusType, vmDisk.Id, strings.Join(candidates, ", "))
+		return "", fmt.Errorf("no device found for disk %d (%s%d)", order, vmDisk.BusType, vmDisk.Id)
+	}
+
+	diskService.logger.Errorf("VM %s has no disk with order %d", vmDetails.Name, order)
+	return "", fmt.Errorf("vm %s has no disk with order %d", vmDetails.Name, order)
+}
+
+// storage backends round volumes up to their allocation unit, LVM's 4MiB extents being the coarsest of the usual ones
+const diskSizeTolerance = 4 << 20
+
+// verifyDiskSize compares the size of the device with the Proxmox size, which is skipped when Proxmox reports none. A
+// device smaller than reported is rescanned first since a disk resized underneath the VM shows its old size until then
+func (diskService *DiskServiceImpl) verifyDiskSize(devicePath string, size string) error {
+	if size == "" {
+		return nil
+	}
+
+	expectedBytes, parseSizeError := parsePartitionSize(size, 0)
+
+	if parseSizeError != nil {
+		return parseSizeError
+	}
+
+	deviceBytes, measureError := diskService.deviceSize(devicePath)
+
+	if measureError != nil {
+		return measureError
+	}
+
+	if deviceBytes < expectedBytes {
+		diskService.rescanDisk(devicePath)
+		deviceBytes, measureError = diskService.deviceSize(devicePath)
+
+		if measureError != nil {
+			return measureError
+		}
+	}
+
+	if deviceBytes < expectedBytes || deviceBytes-expectedBytes > diskSizeTolerance {
+		return fmt.Errorf("device has %d bytes, expected %s (%d bytes)", deviceBytes, size, expectedBytes)
+	}
+	return nil
+}
+
+func (diskService *DiskServiceImpl) deviceSize(devicePath string) (uint64, error) {
+	device, openDeviceError := diskService.osClient.OpenFile(devicePath)
+
+	if openDeviceError != nil {
+		return 0, openDeviceError
+	}
+	defer device.Close()
+
+	deviceBytes, seekError := device.Seek(0, io.SeekEnd)
+
+	if seekError != nil {
+		return 0, seekError
+	}
+	return uint64(deviceBytes), nil
+}
+
+// diskDeviceCandidates lists the stable links a disk may appear under, most specific first. scsi disks carry their
+// drive id as serial, the other buses are found by their fixed position on the Proxmox machine's PCI bus
+func diskDeviceCandidates(vmDisk clients.ProxmoxDisk) ([]string, error) {
+	switch strings.ToLower(vmDisk.BusType) {
+	case "scsi":
+		return []string{
+			fmt.Sprintf("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi%d", vmDisk.Id),
+			fmt.Sprintf("/dev/disk/by-id/scsi-SQEMU_QEMU_HARDDISK_drive-scsi%d", vmDisk.Id),
+		}, nil
+	case "virtio":
+		if vmDisk.Id < 0 || vmDisk.Id >= len(virtioPciSlots) {
+			return nil, fmt.Errorf("virtio%d has no known PCI slot", vmDisk.Id)
+		}
+		pciAddress := fmt.Sprintf("pci-0000:00:%02x.0", virtioPciSlots[vmDisk.Id])
+		return []string{
+			fmt.Sprintf("/dev/disk/by-id/virtio-drive-virtio%d", vmDisk.Id),
+			fmt.Sprintf("/dev/disk/by-path/virtio-%s", pciAddress),
+			fmt.Sprintf("/dev/disk/by-path/%s", pciAddress),
+		}, nil
+	case "sata":
+		if vmDisk.Id < 0 || vmDisk.Id > 5 {
+			return nil, fmt.Errorf("sata%d is not a valid sata port", vmDisk.Id)
+		}
+		return []string{
+			fmt.Sprintf("/dev/disk/by-path/pci-0000:00:07.0-ata-%d.0", vmDisk.Id+1),
+			fmt.Sprintf("/dev/disk/by-path/pci-0000:00:07.0-ata-%d", vmDisk.Id+1),
+		}, nil
+	case "ide":
+		if vmDisk.Id < 0 || vmDisk.Id > 3 {
+			return nil, fmt.Errorf("ide%d is not a valid ide position", vmDisk.Id)
+		}
+		channel, unit := vmDisk.Id/2+1, vmDisk.Id%2
+		candidates := []string{fmt.Sprintf("/dev/disk/by-path/pci-0000:00:01.1-ata-%d.%d", channel, unit)}
+		if unit == 0 {
+			candidates = append(candidates, fmt.Sprintf("/dev/disk/by-path/pci-0000:00:01.1-ata-%d", channel))
+		}
+		return candidates, nil
+	}
+	return nil, fmt.Errorf("unsupported bus type %q", vmDisk.BusType)
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"os"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskDeviceCandidates(t *testing.T) {
+	candidates, candidatesError := diskDeviceCandidates(clients.ProxmoxDisk{BusType: "scsi", Id: 3})
+	assert.Nil(t, candidatesError)
+	assert.Equal(t, "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi3", candidates[0])
+
+	candidates, _ = diskDeviceCandidates(clients.ProxmoxDisk{BusType: "virtio", Id: 1})
+	assert.Contains(t, candidates, "/dev/disk/by-path/virtio-pci-0000:00:0b.0")
+
+	candidates, _ = diskDeviceCandidates(clients.ProxmoxDisk{BusType: "sata", Id: 0})
+	assert.Contains(t, candidates, "/dev/disk/by-path/pci-0000:00:07.0-ata-1.0")
+
+	candidates, _ = diskDeviceCandidates(clients.ProxmoxDisk{BusType: "ide", Id: 1})
+	assert.Equal(t, []string{"/dev/disk/by-path/pci-0000:00:01.1-ata-1.1"}, candidates)
+
+	for _, vmDisk := range []clients.ProxmoxDisk{{BusType: "virtio", Id: 6}, {BusType: "sata", Id: 6}, {BusType: "nvme"}} {
+		_, candidatesError = diskDeviceCandidates(vmDisk)
+		assert.NotNil(t, candidatesError)
+	}
+}
+
+func TestDiskServiceImpl_ResolveDisk(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	imagePath := createTestDiskImage(t)
+	devicePath := "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi1"
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile(devicePath).Return(nil, nil).AnyTimes()
+	mockOsClient.EXPECT().StatFile(gomock.Any()).Return(nil, os.ErrNotExist).AnyTimes()
+	mockOsClient.EXPECT().OpenFile(devicePath).DoAndReturn(func(string) (*os.File, error) { return os.Open(imagePath) }).AnyTimes()
+	mockOsClient.EXPECT().EvalSymlinks(devicePath).Return("", os.ErrNotExist).AnyTimes()
+	testDiskService := DiskServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	vmDetails := clients.ProxmoxVm{Name: "k8s-01", Disk: []clients.ProxmoxDisk{
+		{BusType: "scsi", Id: 0, Order: 0, Size: "32G"},
+		{BusType: "scsi", Id: 1, Order: 1, Size: "64M"},
+		{BusType: "scsi", Id: 2, Order: 2, Size: "64M"},
+	}}
+
+	resolvedPath, resolveError := testDiskService.ResolveDisk(vmDetails, 1)
+	assert.Nil(t, resolveError)
+	assert.Equal(t, devicePath, resolvedPath)
+
+	// a device of another size is not the disk Proxmox describes
+	vmDetails.Disk[1].Size = "128M"
+	_, resolveError = testDiskService.ResolveDisk(vmDetails, 1)
+	assert.NotNil(t, resolveError)
+
+	vmDetails.Disk[1].Size = "32M"
+	_, resolveError = testDiskService.ResolveDisk(vmDetails, 1)
+	assert.NotNil(t, resolveError)
+
+	// a volume rounded up to the backend's allocation unit still matches
+	vmDetails.Disk[1].Size = "62M"
+	resolvedPath, resolveError = testDiskService.ResolveDisk(vmDetails, 1)
+	assert.Nil(t, resolveError)
+	assert.Equal(t, devicePath, resolvedPath)
+
+	_, resolveError = testDiskService.ResolveDisk(vmDetails, 2)
+	assert.NotNil(t, resolveError)
+
+	_, resolveError = testDiskService.ResolveDisk(vmDetails, 5)
+	assert.NotNil(t, resolveError)
+}
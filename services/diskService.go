@@ -1,27 +1,79 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+	"zs-vm-agent/clients"
 
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
+const partitionAlignment = 1024 * 1024
+const gptPartitionArrayBytes = 128 * 128
+const partitionDeviceWaitAttempts = 20
+const partitionDeviceWaitInterval = 500 * time.Millisecond
+
 type DiskService interface {
-	initialize(logger *logrus.Logger)
+	initialize(logger *logrus.Logger, osClient clients.OsClient)
 	GetDisk(path string) (*disk.Disk, error)
 	CreatePartition(diskPath string) error
+	ApplyLayout(diskPath string, layout DiskLayout, wipe bool) error
+	PartitionDevicePath(diskPath string, partitionNumber int) string
+	GrowPartition(diskPath string, partitionNumber int) (uint64, uint64, error)
+	ResolveDisk(vmDetails clients.ProxmoxVm, order int) (string, error)
+}
+
+// DiskLayout declares the GPT partitions of a disk, they are created in order and aligned to 1MiB
+type DiskLayout struct {
+	Partitions []PartitionSpec `json:"partitions"`
+}
+
+// PartitionSpec sizes are either absolute ("512M", "20G") or a percentage of the disk ("25%"), an empty size takes
+// the remaining space and is only allowed on the last partition. Type is a GPT type GUID or one of partitionTypes,
+// Name becomes the GPT partition name and so the /dev/disk/by-partlabel link
+type PartitionSpec struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+	Type string `json:"type"`
+	Guid string `json:"guid"`
+}
+
+var partitionTypes = map[string]gpt.Type{
+	"":      gpt.LinuxFilesystem,
+	"linux": gpt.LinuxFilesystem,
+	"swap":  gpt.LinuxSwap,
+	"lvm":   gpt.LinuxLVM,
+	"luks":  gpt.LinuxLUKS,
+	"efi":   gpt.EFISystemPartition,
+}
+
+var partitionSizePattern = regexp.MustCompile(`^(\d+)\s*([KMGT]?)(I?B)?$`)
+var partitionTypeGuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$`)
+
+// DefaultLayout is a single linux partition spanning the disk
+func DefaultLayout() DiskLayout {
+	return DiskLayout{Partitions: []PartitionSpec{{Type: "linux"}}}
 }
 
 type DiskServiceImpl struct {
-	logger *logrus.Logger
+	logger   *logrus.Logger
+	osClient clients.OsClient
 }
 
-func (diskService *DiskServiceImpl) initialize(logger *logrus.Logger) {
+func (diskService *DiskServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient) {
 	diskService.logger = logger
+	diskService.osClient = osClient
 }
 
 func (diskService *DiskServiceImpl) GetDisk(devicePath string) (*disk.Disk, error) {
@@ -36,35 +88,431 @@ func (diskService *DiskServiceImpl) GetDisk(devicePath string) (*disk.Disk, erro
 }
 
 func (diskService *DiskServiceImpl) CreatePartition(diskPath string) error {
-	writeLayoutError := os.WriteFile("/tmp/layout", []byte("start=        2048"), 0600)
+	return diskService.ApplyLayout(diskPath, DefaultLayout(), false)
+}
+
+// ApplyLayout writes layout to the disk as a GPT and has the kernel re-read it. A disk already partitioned as
+// declared is left alone, any other partition table or a filesystem or volume signature is only overwritten
+// when wipe is set
+func (diskService *DiskServiceImpl) ApplyLayout(diskPath string, layout DiskLayout, wipe bool) error {
+	openedDisk, getDiskError := diskService.GetDisk(diskPath)
+
+	if getDiskError != nil {
+		return getDiskError
+	}
+	defer openedDisk.Close()
+
+	planned, planError := planPartitions(layout, openedDisk.Size, openedDisk.LogicalBlocksize)
+
+	if planError != nil {
+		diskService.logger.Errorf("Layout for %s is invalid: %s", diskPath, planError.Error())
+		return planError
+	}
+
+	existingTable, getPartTableError := openedDisk.GetPartitionTable()
+
+	if getPartTableError == nil && len(existingTable.GetPartitions()) == 0 {
+		diskService.logger.Debugf("Disk %s has an empty %s partition table", diskPath, existingTable.Type())
+	} else if getPartTableError == nil {
+		if gptTable, isGpt := existingTable.(*gpt.Table); isGpt && layoutMatches(layout, gptTable.Partitions, planned) {
+			diskService.logger.Infof("Disk %s is already partitioned as declared", diskPath)
+			return nil
+		}
+
+		if !wipe {
+			diskService.logger.Errorf("Disk %s has a partition table that differs from the declared layout, refusing to repartition it without wipe", diskPath)
+			return fmt.Errorf("disk %s has a partition table that differs from the declared layout", diskPath)
+		}
+	} else {
+		signature, probeError := probeBlockSignature(openedDisk.Backend)
+
+		if probeError != nil {
+			diskService.logger.Errorf("Failed to probe %s for existing data: %s", diskPath, probeError.Error())
+			return probeError
+		}
+
+		if signature != "" && !wipe {
+			diskService.logger.Errorf("Disk %s holds a %s signature, refusing to partition it without wipe", diskPath, signature)
+			return fmt.Errorf("disk %s holds a %s signature", diskPath, signature)
+		}
+	}
+
+	if wipe {
+		diskService.logger.Warnf("Wiping signatures on %s before partitioning", diskPath)
+		wipeError := wipeSignatures(openedDisk, planned)
+
+		if wipeError != nil {
+			diskService.logger.Errorf("Failed to wipe signatures on %s: %s", diskPath, wipeError.Error())
+			return wipeError
+		}
+	}
+
+	table := &gpt.Table{
+		LogicalSectorSize:  int(openedDisk.LogicalBlocksize),
+		PhysicalSectorSize: int(openedDisk.PhysicalBlocksize),
+		ProtectiveMBR:      true,
+		Partitions:         planned,
+	}
+
+	diskService.logger.Infof("Writing %d partition(s) to %s", len(planned), diskPath)
+	partitionError := openedDisk.Partition(table)
+
+	if partitionError != nil {
+		diskService.logger.Errorf("Failed to partition %s: %s", diskPath, partitionError.Error())
+		return partitionError
+	}
+
+	return diskService.waitForPartitionDevices(diskPath, len(planned))
+}
+
+// GrowPartition extends a partition that ends the GPT to the end of a disk that has grown. The kernel is told about
+// the new size in place, so a mounted partition keeps working. It returns the partition size before and after in bytes
+func (diskService *DiskServiceImpl) GrowPartition(diskPath string, partitionNumber int) (uint64, uint64, error) {
+	diskService.rescanDisk(diskPath)
+
+	// partitions of the disk may be mounted, which rules out an exclusive open
+	openedDisk, openDiskError := diskfs.Open(diskPath, diskfs.WithOpenMode(diskfs.ReadWrite))
+
+	if openDiskError != nil {
+		diskService.logger.Errorf("Failed to open disk at %s: %s", diskPath, openDiskError.Error())
+		return 0, 0, openDiskError
+	}
+	defer openedDisk.Close()
+
+	existingTable, getPartTableError := openedDisk.GetPartitionTable()
+
+	if getPartTableError != nil {
+		diskService.logger.Errorf("Failed to get Partition Table from disk %s: %s", diskPath, getPartTableError.Error())
+		return 0, 0, getPartTableError
+	}
+
+	gptTable, isGpt := existingTable.(*gpt.Table)
+
+	if !isGpt || partitionNumber < 1 || partitionNumber > len(gptTable.Partitions) {
+		diskService.logger.Errorf("Disk %s has no GPT partition %d to grow", diskPath, partitionNumber)
+		return 0, 0, fmt.Errorf("disk %s has no GPT partition %d to grow", diskPath, partitionNumber)
+	}
+
+	sectorSize := uint64(openedDisk.LogicalBlocksize)
+	target := gptTable.Partitions[partitionNumber-1]
+	oldSize := (target.End - target.Start + 1) * sectorSize
+
+	for _, partition := range gptTable.Partitions {
+		if partition.Start > target.End {
+			diskService.logger.Debugf("Partition %d of %s is followed by another partition, not growing it", partitionNumber, diskPath)
+			return oldSize, oldSize, nil
+		}
+	}
+
+	diskSize, diskSizeError := backendSize(clients.NewDiskWrapper(openedDisk), openedDisk.Size)
+
+	if diskSizeError != nil {
+		diskService.logger.Errorf("Failed to stat the backing device of %s: %s", diskPath, diskSizeError.Error())
+		return 0, 0, diskSizeError
+	}
+
+	newEnd := lastAlignedSector(diskSize, openedDisk.LogicalBlocksize)
+
+	if newEnd <= target.End {
+		return oldSize, oldSize, nil
+	}
+
+	table := &gpt.Table{
+		LogicalSectorSize:  int(openedDisk.LogicalBlocksize),
+		PhysicalSectorSize: int(openedDisk.PhysicalBlocksize),
+		GUID:               gptTable.GUID,
+		ProtectiveMBR:      true,
+	}
+	for _, partition := range gptTable.Partitions {
+		grown := &gpt.Partition{
+			Start:      partition.Start,
+			End:        partition.End,
+			Type:       partition.Type,
+			Name:       partition.Name,
+			GUID:       partition.GUID,
+			Attributes: partition.Attributes,
+		}
+		if partition == target {
+			grown.End = newEnd
+		}
+		grown.Size = (grown.End - grown.Start + 1) * sectorSize
+		table.Partitions = append(table.Partitions, grown)
+	}
+	newSize := (newEnd - target.Start + 1) * sectorSize
+
+	writableBackend, writableError := openedDisk.Backend.Writable()
+
+	if writableError != nil {
+		diskService.logger.Errorf("Failed to open %s for writing: %s", diskPath, writableError.Error())
+		return 0, 0, writableError
+	}
+
+	// the table is written directly as re-reading the whole table fails while a partition is in use
+	writeTableError := table.Write(writableBackend, diskSize)
+
+	if writeTableError != nil {
+		diskService.logger.Errorf("Failed to write grown partition table to %s: %s", diskPath, writeTableError.Error())
+		return 0, 0, writeTableError
+	}
+
+	resizeError := resizeKernelPartition(openedDisk, partitionNumber, target.Start*sectorSize, newSize)
+
+	if resizeError != nil {
+		diskService.logger.Errorf("Failed to update the kernel's size of partition %d on %s: %s", partitionNumber, diskPath, resizeError.Error())
+		return 0, 0, resizeError
+	}
+
+	diskService.logger.Infof("Grew partition %d of %s from %d to %d bytes", partitionNumber, diskPath, oldSize, newSize)
+	return oldSize, newSize, nil
+}
+
+// backendSize is the size of the file or device backing a disk. A block device stats with a size of zero, its capacity
+// is the one measured when the disk was opened after the rescan
+func backendSize(diskWrapper clients.DiskWrapper, deviceCapacity int64) (int64, error) {
+	backendInfo, statError := diskWrapper.StatBackend()
+
+	if statError != nil {
+		return 0, statError
+	}
+
+	if backendInfo.Mode().IsRegular() {
+		return backendInfo.Size(), nil
+	}
+	return deviceCapacity, nil
+}
+
+// rescanDisk asks the scsi layer to re-read the capacity of a disk that was resized underneath the running VM
+func (diskService *DiskServiceImpl) rescanDisk(diskPath string) {
+	devicePath, resolveError := diskService.osClient.EvalSymlinks(diskPath)
+
+	if resolveError != nil {
+		return
+	}
+
+	rescanPath := fmt.Sprintf("/sys/class/block/%s/device/rescan", filepath.Base(devicePath))
+	_, statRescanError := diskService.osClient.StatFile(rescanPath)
+
+	if statRescanError != nil {
+		return
+	}
+
+	rescanError := diskService.osClient.WriteFile(rescanPath, []byte("1"), 0200)
 
-	if writeLayoutError != nil {
-		diskService.logger.Errorf("Failed to write layout config to disk: %s", writeLayoutError.Error())
-		return writeLayoutError
+	if rescanError != nil {
+		diskService.logger.Warnf("Failed to rescan %s for a new capacity: %s", diskPath, rescanError.Error())
 	}
+}
 
-	command := exec.Command("bash", "-c", fmt.Sprintf("echo 'start=2048' | sfdisk --label gpt --force --wipe always %s && partprobe", diskPath))
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
+// resizeKernelPartition updates the kernel's view of one partition with BLKPG, disk images need no update
+func resizeKernelPartition(openedDisk *disk.Disk, partitionNumber int, startBytes uint64, lengthBytes uint64) error {
+	backendInfo, statError := openedDisk.Backend.Stat()
 
-	//reader, writer := io.Pipe()
+	if statError != nil {
+		return statError
+	}
 
-	commandExecutionError := command.Start()
+	if backendInfo.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
 
-	if commandExecutionError != nil {
-		diskService.logger.Errorf("Failed to create partition at %s: %s", diskPath, commandExecutionError.Error())
-		return commandExecutionError
+	backendFile, getFileError := openedDisk.Backend.Sys()
+
+	if getFileError != nil {
+		return getFileError
+	}
+
+	partition := unix.BlkpgPartition{Start: int64(startBytes), Length: int64(lengthBytes), Pno: int32(partitionNumber)}
+	argument := unix.BlkpgIoctlArg{
+		Op:      unix.BLKPG_RESIZE_PARTITION,
+		Datalen: int32(unsafe.Sizeof(partition)),
+		Data:    (*byte)(unsafe.Pointer(&partition)),
 	}
 
-	commandWaitError := command.Wait()
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, backendFile.Fd(), unix.BLKPG, uintptr(unsafe.Pointer(&argument)))
+
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// PartitionDevicePath returns the device node of a partition, /dev/disk/by-* links use a -partN suffix while
+// kernel names append the number, separated by a p when the disk name ends in a digit
+func (diskService *DiskServiceImpl) PartitionDevicePath(diskPath string, partitionNumber int) string {
+	if strings.HasPrefix(diskPath, "/dev/disk/") {
+		return fmt.Sprintf("%s-part%d", diskPath, partitionNumber)
+	}
+	if last := diskPath[len(diskPath)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", diskPath, partitionNumber)
+	}
+	return fmt.Sprintf("%s%d", diskPath, partitionNumber)
+}
+
+// waitForPartitionDevices waits for udev to create the partition device nodes after the kernel re-read the table
+func (diskService *DiskServiceImpl) waitForPartitionDevices(diskPath string, partitionCount int) error {
+	for partitionNumber := 1; partitionNumber <= partitionCount; partitionNumber++ {
+		devicePath := diskService.PartitionDevicePath(diskPath, partitionNumber)
+
+		var statFileError error
+		for attempt := 0; attempt < partitionDeviceWaitAttempts; attempt++ {
+			_, statFileError = diskService.osClient.StatFile(devicePath)
+			if !errors.Is(statFileError, os.ErrNotExist) {
+				break
+			}
+			time.Sleep(partitionDeviceWaitInterval)
+		}
+
+		if statFileError != nil {
+			diskService.logger.Errorf("Partition device %s did not appear: %s", devicePath, statFileError.Error())
+			return statFileError
+		}
+	}
+	return nil
+}
+
+// planPartitions turns the layout into GPT entries for a disk of diskSize bytes
+func planPartitions(layout DiskLayout, diskSize int64, sectorSize int64) ([]*gpt.Partition, error) {
+	if len(layout.Partitions) == 0 {
+		return nil, errors.New("layout declares no partitions")
+	}
+
+	if diskSize < 2*partitionAlignment {
+		return nil, fmt.Errorf("a %d byte disk is too small to partition", diskSize)
+	}
+
+	alignment := uint64(partitionAlignment / sectorSize)
+	lastUsable := lastUsableSector(diskSize, sectorSize)
+	usableBytes := (lastUsable + 1 - alignment) * uint64(sectorSize)
+
+	var partitions []*gpt.Partition
+	nextStart := alignment
+	for index, spec := range layout.Partitions {
+		partitionType, knownType := partitionTypes[strings.ToLower(spec.Type)]
+		if !knownType {
+			if !partitionTypeGuidPattern.MatchString(spec.Type) {
+				return nil, fmt.Errorf("partition %d has unknown type %q", index+1, spec.Type)
+			}
+			partitionType = gpt.Type(strings.ToUpper(spec.Type))
+		}
+
+		var end uint64
+		if spec.Size == "" {
+			if index != len(layout.Partitions)-1 {
+				return nil, fmt.Errorf("only the last partition may omit its size")
+			}
+			end = lastAlignedSector(diskSize, sectorSize)
+		} else {
+			sizeBytes, parseSizeError := parsePartitionSize(spec.Size, usableBytes)
+
+			if parseSizeError != nil {
+				return nil, fmt.Errorf("partition %d: %w", index+1, parseSizeError)
+			}
+			sizeSectors := (sizeBytes + uint64(sectorSize) - 1) / uint64(sectorSize)
+			end = nextStart + sizeSectors - 1
+		}
+
+		if end > lastUsable || end < nextStart {
+			return nil, fmt.Errorf("partition %d does not fit on a %d byte disk", index+1, diskSize)
+		}
+
+		partitions = append(partitions, &gpt.Partition{
+			Start: nextStart,
+			End:   end,
+			Type:  partitionType,
+			Name:  spec.Name,
+			GUID:  spec.Guid,
+		})
+		nextStart = (end + alignment) / alignment * alignment
+	}
+	return partitions, nil
+}
+
+// lastUsableSector is the last sector before the backup partition array and header at the end of the disk
+func lastUsableSector(diskSize int64, sectorSize int64) uint64 {
+	return uint64(diskSize/sectorSize) - 2 - uint64(gptPartitionArrayBytes/sectorSize)
+}
+
+// lastAlignedSector is where a partition taking the remaining space of the disk ends
+func lastAlignedSector(diskSize int64, sectorSize int64) uint64 {
+	alignment := uint64(partitionAlignment / sectorSize)
+	return (lastUsableSector(diskSize, sectorSize)+1)/alignment*alignment - 1
+}
+
+func parsePartitionSize(size string, usableBytes uint64) (uint64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+
+	if percent, isPercentage := strings.CutSuffix(size, "%"); isPercentage {
+		percentage, parseError := strconv.ParseUint(strings.TrimSpace(percent), 10, 64)
+
+		if parseError != nil || percentage == 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid percentage %q", size)
+		}
+		return usableBytes * percentage / 100, nil
+	}
+
+	matches := partitionSizePattern.FindStringSubmatch(size)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	value, _ := strconv.ParseUint(matches[1], 10, 64)
+	shift := map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}[matches[2]]
+	if value == 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return value << shift, nil
+}
+
+// layoutMatches compares the partitions on disk with the planned ones, the last partition may end before the planned
+// end when it takes the remaining space of a disk that has since grown
+func layoutMatches(layout DiskLayout, existing []*gpt.Partition, planned []*gpt.Partition) bool {
+	if len(existing) != len(planned) {
+		return false
+	}
+
+	for index, partition := range planned {
+		current := existing[index]
+		sameEnd := current.End == partition.End ||
+			(index == len(planned)-1 && layout.Partitions[index].Size == "" && current.End <= partition.End)
+
+		if !strings.EqualFold(string(current.Type), string(partition.Type)) || current.Name != partition.Name ||
+			current.Start != partition.Start || !sameEnd {
+			return false
+		}
+	}
+	return true
+}
+
+// wipeSignatures zeroes the first MiB of the disk and of every planned partition along with the last MiB of the disk,
+// which covers old partition tables and every superblock probeBlockSignature knows about
+func wipeSignatures(openedDisk *disk.Disk, planned []*gpt.Partition) error {
+	writableBackend, writableError := openedDisk.Backend.Writable()
+
+	if writableError != nil {
+		return writableError
+	}
+
+	zeroes := make([]byte, partitionAlignment)
+	offsets := []int64{0, openedDisk.Size - partitionAlignment}
+	for _, partition := range planned {
+		offsets = append(offsets, int64(partition.Start)*openedDisk.LogicalBlocksize)
+	}
+
+	for _, offset := range offsets {
+		if offset < 0 {
+			continue
+		}
+
+		length := int64(len(zeroes))
+		if offset+length > openedDisk.Size {
+			length = openedDisk.Size - offset
+		}
 
-	//for _, line := range strings.Split(string(outputText), "\n") {
-	//	diskService.logger.Info(line)
-	//}
+		_, writeError := writableBackend.WriteAt(zeroes[:length], offset)
 
-	if commandWaitError != nil {
-		diskService.logger.Errorf("Failed to create partition at %s: %s", diskPath, commandWaitError.Error())
-		return commandWaitError
+		if writeError != nil {
+			return writeError
+		}
 	}
 	return nil
 }
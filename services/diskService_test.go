@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDiskSize = 64 * 1024 * 1024
+
+func createTestDiskImage(t *testing.T) string {
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	image, createError := os.Create(imagePath)
+	assert.Nil(t, createError)
+	assert.Nil(t, image.Truncate(testDiskSize))
+	assert.Nil(t, image.Close())
+	return imagePath
+}
+
+func TestPlanPartitions(t *testing.T) {
+	layout := DiskLayout{Partitions: []PartitionSpec{
+		{Name: "swap", Size: "8M", Type: "swap"},
+		{Name: "data", Size: "50%"},
+		{Name: "rest", Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+	}}
+
+	partitions, planError := planPartitions(layout, testDiskSize, 512)
+
+	assert.Nil(t, planError)
+	assert.Equal(t, 3, len(partitions))
+	assert.Equal(t, uint64(2048), partitions[0].Start)
+	assert.Equal(t, uint64(2048+16384-1), partitions[0].End)
+	assert.Equal(t, gpt.LinuxSwap, partitions[0].Type)
+	assert.Equal(t, uint64(2048+16384), partitions[1].Start)
+	assert.Equal(t, uint64(0), partitions[2].Start%2048)
+	assert.Equal(t, uint64(0), (partitions[2].End+1)%2048)
+	assert.Equal(t, "data", partitions[1].Name)
+}
+
+func TestPlanPartitions_invalid(t *testing.T) {
+	for _, layout := range []DiskLayout{
+		{},
+		{Partitions: []PartitionSpec{{Size: ""}, {Size: "1M"}}},
+		{Partitions: []PartitionSpec{{Size: "1T"}}},
+		{Partitions: []PartitionSpec{{Size: "ten"}}},
+		{Partitions: []PartitionSpec{{Type: "zfs"}}},
+	} {
+		_, planError := planPartitions(layout, testDiskSize, 512)
+		assert.NotNil(t, planError)
+	}
+}
+
+func TestParsePartitionSize(t *testing.T) {
+	for size, expected := range map[string]uint64{"512": 512, "4K": 4096, "10M": 10 << 20, "2GiB": 2 << 30, "1gb": 1 << 30, "25%": 250} {
+		parsed, parseError := parsePartitionSize(size, 1000)
+		assert.Nil(t, parseError)
+		assert.Equal(t, expected, parsed, size)
+	}
+
+	_, parseError := parsePartitionSize("101%", 1000)
+	assert.NotNil(t, parseError)
+}
+
+func TestProbeBlockSignature(t *testing.T) {
+	device := make([]byte, blockProbeSize)
+	signature, probeError := probeBlockSignature(bytes.NewReader(device))
+	assert.Nil(t, probeError)
+	assert.Equal(t, "", signature)
+
+	copy(device, "XFSB")
+	signature, _ = probeBlockSignature(bytes.NewReader(device))
+	assert.Equal(t, "xfs", signature)
+
+	signature, _ = probeBlockSignature(bytes.NewReader([]byte("LUKS\xba\xbe")))
+	assert.Equal(t, "crypto_LUKS", signature)
+}
+
+func TestDiskServiceImpl_PartitionDevicePath(t *testing.T) {
+	testDiskService := DiskServiceImpl{}
+
+	assert.Equal(t, "/dev/disk/by-id/scsi-drive-scsi1-part2", testDiskService.PartitionDevicePath("/dev/disk/by-id/scsi-drive-scsi1", 2))
+	assert.Equal(t, "/dev/sdb1", testDiskService.PartitionDevicePath("/dev/sdb", 1))
+	assert.Equal(t, "/dev/nvme0n1p1", testDiskService.PartitionDevicePath("/dev/nvme0n1", 1))
+}
+
+func TestDiskServiceImpl_ApplyLayout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	imagePath := createTestDiskImage(t)
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile(gomock.Any()).Return(nil, nil).AnyTimes()
+	testDiskService := DiskServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+	layout := DiskLayout{Partitions: []PartitionSpec{{Name: "data", Size: "16M"}, {Name: "logs"}}}
+
+	assert.Nil(t, testDiskService.ApplyLayout(imagePath, layout, false))
+
+	openedDisk, getDiskError := testDiskService.GetDisk(imagePath)
+	assert.Nil(t, getDiskError)
+	table, getTableError := openedDisk.GetPartitionTable()
+	assert.Nil(t, getTableError)
+	assert.Equal(t, 2, len(table.GetPartitions()))
+	assert.Equal(t, "logs", table.(*gpt.Table).Partitions[1].Name)
+	assert.Nil(t, openedDisk.Close())
+
+	// reapplying is a no-op while a different layout needs wipe
+	assert.Nil(t, testDiskService.ApplyLayout(imagePath, layout, false))
+	assert.NotNil(t, testDiskService.ApplyLayout(imagePath, DefaultLayout(), false))
+	assert.Nil(t, testDiskService.ApplyLayout(imagePath, DefaultLayout(), true))
+}
+
+func TestDiskServiceImpl_ApplyLayout_refusesExistingData(t *testing.T) {
+	imagePath := createTestDiskImage(t)
+	image, openError := os.OpenFile(imagePath, os.O_RDWR, 0)
+	assert.Nil(t, openError)
+	_, writeError := image.WriteAt([]byte("XFSB"), 0)
+	assert.Nil(t, writeError)
+	assert.Nil(t, image.Close())
+
+	testDiskService := DiskServiceImpl{logger: &logrus.Logger{}}
+
+	assert.NotNil(t, testDiskService.CreatePartition(imagePath))
+}
+
+func TestDiskServiceImpl_GrowPartition(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	imagePath := createTestDiskImage(t)
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile(gomock.Any()).Return(nil, nil).AnyTimes()
+	mockOsClient.EXPECT().EvalSymlinks(gomock.Any()).DoAndReturn(filepath.EvalSymlinks).AnyTimes()
+	// the disk is rescanned for its new capacity before the partition grows
+	mockOsClient.EXPECT().WriteFile(filepath.Join("/sys/class/block", filepath.Base(imagePath), "device/rescan"), []byte("1"), 0200).Return(nil).MinTimes(1)
+	testDiskService := DiskServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+	assert.Nil(t, testDiskService.ApplyLayout(imagePath, DiskLayout{Partitions: []PartitionSpec{{Name: "data", Size: "8M"}, {Name: "logs"}}}, false))
+	assert.Nil(t, os.Truncate(imagePath, 2*testDiskSize))
+
+	oldSize, newSize, growError := testDiskService.GrowPartition(imagePath, 1)
+
+	assert.Nil(t, growError)
+	assert.Equal(t, oldSize, newSize)
+
+	oldSize, newSize, growError = testDiskService.GrowPartition(imagePath, 2)
+
+	assert.Nil(t, growError)
+	assert.Equal(t, uint64(testDiskSize-10*partitionAlignment), oldSize)
+	assert.Equal(t, uint64(2*testDiskSize-10*partitionAlignment), newSize)
+
+	openedDisk, getDiskError := testDiskService.GetDisk(imagePath)
+	assert.Nil(t, getDiskError)
+	table, getTableError := openedDisk.GetPartitionTable()
+	assert.Nil(t, getTableError)
+	assert.Equal(t, "logs", table.(*gpt.Table).Partitions[1].Name)
+	assert.Equal(t, int64(newSize), table.GetPartitions()[1].GetSize())
+	assert.Nil(t, openedDisk.Close())
+
+	oldSize, newSize, growError = testDiskService.GrowPartition(imagePath, 2)
+
+	assert.Nil(t, growError)
+	assert.Equal(t, oldSize, newSize)
+}
+
+func TestBackendSize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDisk := clients.NewMockDiskWrapper(ctrl)
+	mockFileInfo := NewMockFileInfo(ctrl)
+	mockDisk.EXPECT().StatBackend().Return(mockFileInfo, nil).AnyTimes()
+
+	mockFileInfo.EXPECT().Mode().Return(os.FileMode(0644)).Times(1)
+	mockFileInfo.EXPECT().Size().Return(int64(2 * testDiskSize)).Times(1)
+	size, sizeError := backendSize(mockDisk, testDiskSize)
+	assert.Nil(t, sizeError)
+	assert.Equal(t, int64(2*testDiskSize), size)
+
+	// block devices stat with no size and keep the capacity measured on open
+	mockFileInfo.EXPECT().Mode().Return(os.ModeDevice | 0660).Times(1)
+	size, sizeError = backendSize(mockDisk, testDiskSize)
+	assert.Nil(t, sizeError)
+	assert.Equal(t, int64(testDiskSize), size)
+}
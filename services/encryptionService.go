@@ -0,0 +1,232 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+const crypttabPath = "/etc/crypttab"
+const cryptsetupPath = "/usr/sbin/cryptsetup"
+
+var mappedDeviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// EncryptionSpec puts a LUKS2 container between a partition and its filesystem. The passphrase is either Key, usually
+// a vaultSecret reference resolved along with the rest of the config, or the file at KeyFile on the VM. Containers
+// keyed from a file are opened by systemd at boot, the others are opened by the agent once it has the key. Options
+// are passed to luksFormat as is
+type EncryptionSpec struct {
+	Name    string          `json:"name"`
+	Key     *clients.Secret `json:"key"`
+	KeyFile string          `json:"keyFile"`
+	Options []string        `json:"options"`
+}
+
+type EncryptionService interface {
+	initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService, systemdService SystemdService)
+	OpenEncryptedDevice(devicePath string, spec EncryptionSpec) (string, error)
+	ResizeEncryptedDevice(spec EncryptionSpec) error
+}
+
+type EncryptionServiceImpl struct {
+	logger            *logrus.Logger
+	osClient          clients.OsClient
+	filesystemService FileSystemService
+	systemdService    SystemdService
+}
+
+func (encryptionService *EncryptionServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService, systemdService SystemdService) {
+	encryptionService.logger = logger
+	encryptionService.osClient = osClient
+	encryptionService.filesystemService = filesystemService
+	encryptionService.systemdService = systemdService
+}
+
+// MappedDevicePath is where the opened container of spec appears
+func (spec EncryptionSpec) MappedDevicePath() string {
+	return fmt.Sprintf("/dev/mapper/%s", spec.Name)
+}
+
+// OpenedAtBoot is true for containers systemd opens from crypttab, the agent opens the others once it has the key
+func (spec EncryptionSpec) OpenedAtBoot() bool {
+	return spec.KeyFile != ""
+}
+
+// OpenEncryptedDevice formats devicePath as a LUKS container if it is blank, opens it unless it is already open and
+// records it in crypttab. It returns the mapped device the filesystem goes on
+func (encryptionService *EncryptionServiceImpl) OpenEncryptedDevice(devicePath string, spec EncryptionSpec) (string, error) {
+	validateError := validateEncryptionSpec(spec)
+
+	if validateError != nil {
+		encryptionService.logger.Errorf("Invalid encryption for %s: %s", devicePath, validateError.Error())
+		return "", validateError
+	}
+
+	existingType, probeError := encryptionService.filesystemService.ProbeFileSystem(devicePath)
+
+	if probeError != nil {
+		return "", probeError
+	}
+
+	if existingType == "" {
+		encryptionService.logger.Infof("Formatting %s as a LUKS container", devicePath)
+		formatArgs := append([]string{"luksFormat", "--batch-mode", "--type", "luks2"}, spec.Options...)
+		formatError := encryptionService.runCryptsetup(spec, append(formatArgs, devicePath)...)
+
+		if formatError != nil {
+			return "", formatError
+		}
+	} else if existingType != "crypto_LUKS" {
+		encryptionService.logger.Errorf("Device %s contains %s, refusing to encrypt it", devicePath, existingType)
+		return "", fmt.Errorf("device %s contains %s, refusing to encrypt it", devicePath, existingType)
+	}
+
+	mappedPath := spec.MappedDevicePath()
+	_, statMappedError := encryptionService.osClient.StatFile(mappedPath)
+
+	if statMappedError == nil {
+		encryptionService.logger.Debugf("LUKS container %s is already open", spec.Name)
+	} else {
+		openError := encryptionService.runCryptsetup(spec, "open", "--type", "luks", devicePath, spec.Name)
+
+		if openError != nil {
+			return "", openError
+		}
+	}
+
+	recordError := encryptionService.recordCrypttabEntry(devicePath, spec)
+
+	if recordError != nil {
+		return "", recordError
+	}
+
+	return mappedPath, nil
+}
+
+// ResizeEncryptedDevice grows an open container to fill its partition after the partition has grown
+func (encryptionService *EncryptionServiceImpl) ResizeEncryptedDevice(spec EncryptionSpec) error {
+	return encryptionService.runCryptsetup(spec, "resize", spec.Name)
+}
+
+func (encryptionService *EncryptionServiceImpl) recordCrypttabEntry(devicePath string, spec EncryptionSpec) error {
+	device, openDeviceError := encryptionService.osClient.OpenFile(devicePath)
+
+	if openDeviceError != nil {
+		encryptionService.logger.Errorf("Failed to open %s to read its LUKS uuid: %s", devicePath, openDeviceError.Error())
+		return openDeviceError
+	}
+	luksUuid, probeUuidError := probeLuksUuid(device)
+	_ = device.Close()
+
+	if probeUuidError != nil {
+		encryptionService.logger.Errorf("Failed to read the LUKS uuid of %s: %s", devicePath, probeUuidError.Error())
+		return probeUuidError
+	}
+
+	var existingCrypttab []byte
+	_, statCrypttabError := encryptionService.osClient.StatFile(crypttabPath)
+
+	if statCrypttabError == nil {
+		var readCrypttabError error
+		existingCrypttab, readCrypttabError = encryptionService.filesystemService.ReadFileContents(crypttabPath)
+
+		if readCrypttabError != nil {
+			return readCrypttabError
+		}
+	}
+
+	updatedCrypttab := updateCrypttab(existingCrypttab, spec.Name, crypttabEntry(luksUuid, spec))
+
+	if bytes.Equal(existingCrypttab, updatedCrypttab) {
+		return nil
+	}
+
+	encryptionService.logger.Infof("Recording LUKS container %s in %s", spec.Name, crypttabPath)
+	writeCrypttabError := encryptionService.filesystemService.WriteFileContents(crypttabPath, updatedCrypttab, 0600)
+
+	if writeCrypttabError != nil {
+		return writeCrypttabError
+	}
+
+	// systemd-cryptsetup units are generated from crypttab
+	return encryptionService.systemdService.DaemonReload()
+}
+
+// runCryptsetup passes the key on stdin, or points cryptsetup at the key file so its exact bytes are used
+func (encryptionService *EncryptionServiceImpl) runCryptsetup(spec EncryptionSpec, args ...string) error {
+	command := exec.Command(cryptsetupPath, args...)
+
+	if spec.KeyFile != "" {
+		command.Args = append(command.Args, "--key-file", spec.KeyFile)
+	} else {
+		command.Args = append(command.Args, "--key-file", "-")
+		command.Stdin = bytes.NewReader(spec.Key.Bytes())
+	}
+
+	outputText, commandExecutionError := clients.CombinedOutput(encryptionService.osClient, command)
+
+	for _, line := range strings.Split(string(outputText), "\n") {
+		encryptionService.logger.Info(line)
+	}
+
+	if commandExecutionError != nil {
+		encryptionService.logger.Errorf("Failed to run cryptsetup %s for %s: %s", args[0], spec.Name, commandExecutionError.Error())
+		commandExecutionError = fmt.Errorf("%w %s", commandExecutionError, outputText)
+		return commandExecutionError
+	}
+
+	return nil
+}
+
+func validateEncryptionSpec(spec EncryptionSpec) error {
+	if !mappedDeviceNamePattern.MatchString(spec.Name) {
+		return fmt.Errorf("invalid mapped device name %q", spec.Name)
+	}
+
+	if spec.Key.IsEmpty() == (spec.KeyFile == "") {
+		return errors.New("exactly one of key and keyFile must be set")
+	}
+	return nil
+}
+
+// crypttabEntry opens file keyed containers at boot, containers keyed from vault are noauto as only the agent can
+// fetch their key
+func crypttabEntry(luksUuid string, spec EncryptionSpec) string {
+	if spec.OpenedAtBoot() {
+		return fmt.Sprintf("%s UUID=%s %s luks,nofail", spec.Name, luksUuid, spec.KeyFile)
+	}
+	return fmt.Sprintf("%s UUID=%s none luks,noauto,nofail", spec.Name, luksUuid)
+}
+
+// updateCrypttab replaces the entry for name in crypttab or appends it, other entries are kept as they are
+func updateCrypttab(crypttab []byte, name string, entry string) []byte {
+	var lines []string
+	replaced := false
+
+	for _, line := range strings.Split(strings.TrimRight(string(crypttab), "\n"), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) > 0 && fields[0] == name {
+			if !replaced {
+				lines = append(lines, entry)
+				replaced = true
+			}
+			continue
+		}
+
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	if !replaced {
+		lines = append(lines, entry)
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
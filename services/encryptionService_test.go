@@ -0,0 +1,70 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateCrypttab(t *testing.T) {
+	crypttab := []byte("# <name> <device> <key> <options>\nswap /dev/sdb2 /dev/urandom swap\nvault-data UUID=old none luks\n")
+
+	updated := updateCrypttab(crypttab, "vault-data", "vault-data UUID=new none luks,noauto,nofail")
+
+	assert.Equal(t, "# <name> <device> <key> <options>\nswap /dev/sdb2 /dev/urandom swap\nvault-data UUID=new none luks,noauto,nofail\n", string(updated))
+	assert.Equal(t, updated, updateCrypttab(updated, "vault-data", "vault-data UUID=new none luks,noauto,nofail"))
+	assert.Equal(t, "etcd UUID=abc /etc/keys/etcd luks,nofail\n", string(updateCrypttab(nil, "etcd", "etcd UUID=abc /etc/keys/etcd luks,nofail")))
+}
+
+func TestCrypttabEntry(t *testing.T) {
+	assert.Equal(t, "etcd UUID=abc /etc/keys/etcd luks,nofail", crypttabEntry("abc", EncryptionSpec{Name: "etcd", KeyFile: "/etc/keys/etcd"}))
+	assert.Equal(t, "etcd UUID=abc none luks,noauto,nofail", crypttabEntry("abc", EncryptionSpec{Name: "etcd", Key: clients.NewSecret([]byte("passphrase"))}))
+}
+
+func TestValidateEncryptionSpec(t *testing.T) {
+	assert.Nil(t, validateEncryptionSpec(EncryptionSpec{Name: "vault-data", Key: clients.NewSecret([]byte("passphrase"))}))
+	assert.NotNil(t, validateEncryptionSpec(EncryptionSpec{Name: "vault data", Key: clients.NewSecret([]byte("passphrase"))}))
+	assert.NotNil(t, validateEncryptionSpec(EncryptionSpec{Name: "vault-data"}))
+	assert.NotNil(t, validateEncryptionSpec(EncryptionSpec{Name: "vault-data", Key: clients.NewSecret([]byte("passphrase")), KeyFile: "/etc/keys/vault"}))
+}
+
+func TestProbeLuksUuid(t *testing.T) {
+	header := make([]byte, 512)
+	copy(header, "LUKS\xba\xbe")
+	copy(header[luksUuidOffset:], "0b5f6c5e-3f7a-4b43-9c4e-8d1e2f3a4b5c")
+
+	uuid, probeError := probeLuksUuid(bytes.NewReader(header))
+
+	assert.Nil(t, probeError)
+	assert.Equal(t, "0b5f6c5e-3f7a-4b43-9c4e-8d1e2f3a4b5c", uuid)
+}
+
+func TestEncryptionServiceImpl_OpenEncryptedDevice_refusesExistingFilesystem(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	devicePath := fmt.Sprintf("%s/device", t.TempDir())
+	device := make([]byte, blockProbeSize)
+	copy(device, "XFSB")
+	assert.Nil(t, os.WriteFile(devicePath, device, 0600))
+
+	testFilesystemService := &FileSystemServiceImpl{}
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil, nil, nil)
+	testEncryptionService := &EncryptionServiceImpl{}
+	testEncryptionService.initialize(&logrus.Logger{}, mockOsClient, testFilesystemService, nil)
+	mockOsClient.
+		EXPECT().
+		OpenFile(gomock.Eq(devicePath)).
+		Times(1).
+		DoAndReturn(os.Open)
+
+	_, openError := testEncryptionService.OpenEncryptedDevice(devicePath, EncryptionSpec{Name: "data", Key: clients.NewSecret([]byte("passphrase"))})
+
+	assert.NotNil(t, openError)
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"zs-vm-agent/clients"
+)
+
+const seLinuxXattr = "security.selinux"
+const defaultFileMode = 0644
+
+// FileAttributes are applied to a copied file before it is moved into place. Unset attributes are kept from the file
+// being replaced, a new file takes the source's mode (0644 when the source has none) and the agent's owner. Acl holds
+// entries in setfacl's text form, such as "user:prometheus:r--", and Xattrs other extended attributes to set
+type FileAttributes struct {
+	Mode         os.FileMode       `json:"mode"`
+	Owner        string            `json:"owner"`
+	Group        string            `json:"group"`
+	SeLinuxLabel string            `json:"seLinuxLabel"`
+	Acl          []AclEntry        `json:"acl"`
+	Xattrs       map[string]string `json:"xattrs"`
+}
+
+// CopySingleFileToRootFs copies a file keeping the attributes of the file it replaces, it reports whether the
+// contents changed
+func (filesystemService *FileSystemServiceImpl) CopySingleFileToRootFs(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, destPath string) (bool, error) {
+	return filesystemService.CopyFileToRootFs(sourceFilesystem, sourceFilePath, destPath, FileAttributes{})
+}
+
+// CopyFileToRootFs streams a file into a temporary file next to destPath, flushes it, applies attributes and renames
+// it over destPath so readers only ever see the old or the new file. A destPath that is a directory receives the file
+// under its source name. It reports whether the contents changed, an identical file only has its attributes updated
+func (filesystemService *FileSystemServiceImpl) CopyFileToRootFs(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, destPath string, attributes FileAttributes) (bool, error) {
+	sourceInfo := filesystemService.statSourceFile(sourceFilesystem, sourceFilePath)
+	return filesystemService.copyFile(sourceFilesystem, sourceFilePath, sourceInfo, destPath, attributes)
+}
+
+// copyFile copies a file whose directory entry, if known, is sourceInfo
+func (filesystemService *FileSystemServiceImpl) copyFile(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, sourceInfo os.FileInfo, destPath string, attributes FileAttributes) (bool, error) {
+	sourceFile, openSourceError := sourceFilesystem.OpenFile(sourceFilePath, 0)
+
+	if openSourceError != nil {
+		filesystemService.logger.Errorf("Failed to open file %s: %s", sourceFilePath, openSourceError.Error())
+		return false, openSourceError
+	}
+	defer sourceFile.Close()
+
+	return filesystemService.replaceFile(sourceFile, sourceFilePath, sourceInfo, destPath, attributes)
+}
+
+// WriteFileToRootFs writes data to destPath the way CopyFileToRootFs copies a file, through a private temporary file
+// renamed into place once its attributes are applied. It reports whether the contents changed
+func (filesystemService *FileSystemServiceImpl) WriteFileToRootFs(destPath string, data []byte, attributes FileAttributes) (bool, error) {
+	return filesystemService.replaceFile(bytes.NewReader(data), filepath.Base(destPath), nil, destPath, attributes)
+}
+
+// replaceFile streams source, named sourceFilePath, over destPath
+func (filesystemService *FileSystemServiceImpl) replaceFile(source io.Reader, sourceFilePath string, sourceInfo os.FileInfo, destPath string, attributes FileAttributes) (bool, error) {
+	existingInfo, statDestError := filesystemService.osClient.StatFile(destPath)
+
+	if statDestError == nil && existingInfo.IsDir() {
+		destPath = filepath.Join(destPath, path.Base(sourceFilePath))
+		existingInfo, statDestError = filesystemService.osClient.StatFile(destPath)
+	}
+
+	if statDestError != nil {
+		existingInfo = nil
+	}
+
+	tempPath := filepath.Join(filepath.Dir(destPath), fmt.Sprintf(".%s.%d.tmp", filepath.Base(destPath), os.Getpid()))
+	// only the agent can read the copy until its attributes are applied, sources include private keys and tokens
+	tempFile, createTempError := filesystemService.osClient.CreateFile(tempPath, 0600)
+
+	if createTempError != nil {
+		filesystemService.logger.Errorf("Failed to create file to copy source to %s: %s", destPath, createTempError.Error())
+		return false, createTempError
+	}
+
+	if tempFile == nil {
+		filesystemService.logger.Errorf("Failed to retrieve file to copy source %s to: %s, file was nil", sourceFilePath, destPath)
+		return false, fmt.Errorf("failed to retrieve file to copy source %s to: %s, file was nil", sourceFilePath, destPath)
+	}
+
+	// a temporary file left behind by an earlier run keeps its mode when truncated
+	restrictError := filesystemService.osClient.SetPermissions(tempPath, 0600)
+
+	if restrictError != nil {
+		_ = tempFile.Close()
+		_ = filesystemService.osClient.Remove(tempPath)
+		filesystemService.logger.Errorf("Failed to restrict permissions of %s: %s", tempPath, restrictError.Error())
+		return false, restrictError
+	}
+
+	hasher := sha256.New()
+	_, copyError := io.Copy(io.MultiWriter(tempFile, hasher), source)
+
+	if syncer, isSyncable := tempFile.(interface{ Sync() error }); isSyncable && copyError == nil {
+		copyError = syncer.Sync()
+	}
+	closeError := tempFile.Close()
+
+	if copyError != nil || closeError != nil {
+		_ = filesystemService.osClient.Remove(tempPath)
+		filesystemService.logger.Errorf("Failed to copy %s to %s: %s", sourceFilePath, destPath, errors.Join(copyError, closeError).Error())
+		return false, errors.Join(copyError, closeError)
+	}
+
+	changed := true
+	if existingInfo != nil {
+		existingDigest, digestError := filesystemService.fileDigest(destPath)
+		changed = digestError != nil || !bytes.Equal(existingDigest, hasher.Sum(nil))
+	}
+
+	targetPath := destPath
+	if changed {
+		targetPath = tempPath
+	} else {
+		_ = filesystemService.osClient.Remove(tempPath)
+	}
+
+	applyError := filesystemService.applyFileAttributes(targetPath, destPath, sourceInfo, existingInfo, attributes)
+
+	if applyError != nil {
+		if changed {
+			_ = filesystemService.osClient.Remove(tempPath)
+		}
+		return false, applyError
+	}
+
+	if !changed {
+		filesystemService.logger.Debugf("%s is unchanged", destPath)
+		return false, nil
+	}
+
+	renameError := filesystemService.osClient.Rename(tempPath, destPath)
+
+	if renameError != nil {
+		_ = filesystemService.osClient.Remove(tempPath)
+		filesystemService.logger.Errorf("Failed to move %s into place: %s", destPath, renameError.Error())
+		return false, renameError
+	}
+
+	syncDirectoryError := filesystemService.syncDirectory(filepath.Dir(destPath))
+
+	if syncDirectoryError != nil {
+		filesystemService.logger.Errorf("Failed to flush the rename of %s: %s", destPath, syncDirectoryError.Error())
+		return true, syncDirectoryError
+	}
+
+	filesystemService.logger.Debugf("Copied %s to %s", sourceFilePath, destPath)
+	return true, nil
+}
+
+// syncDirectory flushes the entries of a directory, a rename into it is only durable once its directory is synced
+func (filesystemService *FileSystemServiceImpl) syncDirectory(directory string) error {
+	openedDirectory, openDirectoryError := filesystemService.osClient.OpenFile(directory)
+
+	if openDirectoryError != nil {
+		return openDirectoryError
+	}
+	defer openedDirectory.Close()
+
+	if syncer, isSyncable := openedDirectory.(interface{ Sync() error }); isSyncable {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// applyFileAttributes sets the mode, owner, ACL, extended attributes, SELinux label and modification time of
+// targetPath, which replaces destPath
+func (filesystemService *FileSystemServiceImpl) applyFileAttributes(targetPath string, destPath string, sourceInfo os.FileInfo, existingInfo os.FileInfo, attributes FileAttributes) error {
+	mode := attributes.Mode.Perm()
+	if mode == 0 && existingInfo != nil {
+		mode = existingInfo.Mode().Perm()
+	} else if mode == 0 && sourceInfo != nil {
+		mode = sourceInfo.Mode().Perm()
+	}
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+
+	setPermissionsError := filesystemService.osClient.SetPermissions(targetPath, int(mode))
+
+	if setPermissionsError != nil {
+		filesystemService.logger.Errorf("Failed to set permissions of %s: %s", destPath, setPermissionsError.Error())
+		return setPermissionsError
+	}
+
+	uid, gid, resolveOwnerError := filesystemService.resolveOwner(attributes, existingInfo)
+
+	if resolveOwnerError != nil {
+		return resolveOwnerError
+	}
+
+	if uid != -1 || gid != -1 {
+		setOwnerError := filesystemService.osClient.SetOwner(targetPath, uid, gid)
+
+		if setOwnerError != nil {
+			filesystemService.logger.Errorf("Failed to set owner of %s: %s", destPath, setOwnerError.Error())
+			return setOwnerError
+		}
+	}
+
+	applyAclError := filesystemService.applyCopiedAcl(targetPath, destPath, existingInfo, attributes.Acl, mode)
+
+	if applyAclError != nil {
+		return applyAclError
+	}
+
+	xattrNames := make([]string, 0, len(attributes.Xattrs))
+	for name := range attributes.Xattrs {
+		xattrNames = append(xattrNames, name)
+	}
+	sort.Strings(xattrNames)
+
+	for _, name := range xattrNames {
+		setXattrError := filesystemService.osClient.SetXattr(targetPath, name, []byte(attributes.Xattrs[name]))
+
+		if setXattrError != nil {
+			filesystemService.logger.Errorf("Failed to set xattr %s of %s: %s", name, destPath, setXattrError.Error())
+			return setXattrError
+		}
+	}
+
+	label := []byte(attributes.SeLinuxLabel)
+	if len(label) == 0 && existingInfo != nil && targetPath != destPath {
+		// a new file gets the default label of its directory, keep the label of the file it replaces instead
+		label, _ = filesystemService.osClient.GetXattr(destPath, seLinuxXattr)
+	}
+
+	if len(label) > 0 {
+		setLabelError := filesystemService.osClient.SetXattr(targetPath, seLinuxXattr, label)
+
+		if setLabelError != nil {
+			filesystemService.logger.Errorf("Failed to set the SELinux label of %s: %s", destPath, setLabelError.Error())
+			return setLabelError
+		}
+	}
+
+	if sourceInfo != nil && !sourceInfo.ModTime().IsZero() {
+		setModTimeError := filesystemService.osClient.SetModTime(targetPath, sourceInfo.ModTime())
+
+		if setModTimeError != nil {
+			filesystemService.logger.Errorf("Failed to set the modification time of %s: %s", destPath, setModTimeError.Error())
+			return setModTimeError
+		}
+	}
+
+	return nil
+}
+
+// applyCopiedAcl sets acl on targetPath. Without one a new file would only get the default ACL of its directory, so
+// the ACL of the file it replaces is kept instead
+func (filesystemService *FileSystemServiceImpl) applyCopiedAcl(targetPath string, destPath string, existingInfo os.FileInfo, acl []AclEntry, mode os.FileMode) error {
+	if len(acl) > 0 {
+		return filesystemService.applyAcl(targetPath, acl, mode, false)
+	}
+
+	if existingInfo == nil || targetPath == destPath {
+		return nil
+	}
+
+	existingAcl, getAclError := filesystemService.osClient.GetXattr(destPath, aclAccessXattr)
+
+	if getAclError != nil || len(existingAcl) == 0 {
+		return nil
+	}
+
+	setAclError := filesystemService.osClient.SetXattr(targetPath, aclAccessXattr, existingAcl)
+
+	if setAclError != nil {
+		filesystemService.logger.Errorf("Failed to keep the ACL of %s: %s", destPath, setAclError.Error())
+		return setAclError
+	}
+	return nil
+}
+
+// resolveOwner returns the uid and gid to give a file, -1 leaves the id as the file was created
+func (filesystemService *FileSystemServiceImpl) resolveOwner(attributes FileAttributes, existingInfo os.FileInfo) (int, int, error) {
+	uid, gid := -1, -1
+
+	if existingInfo != nil {
+		if existingStat, isStat := existingInfo.Sys().(*syscall.Stat_t); isStat {
+			uid, gid = int(existingStat.Uid), int(existingStat.Gid)
+		}
+	}
+
+	if attributes.Owner != "" {
+		var lookupUserError error
+		uid, _, lookupUserError = filesystemService.lookupUser(attributes.Owner)
+
+		if lookupUserError != nil {
+			return 0, 0, lookupUserError
+		}
+	}
+
+	if attributes.Group != "" {
+		var lookupGroupError error
+		gid, lookupGroupError = filesystemService.lookupGroup(attributes.Group)
+
+		if lookupGroupError != nil {
+			return 0, 0, lookupGroupError
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// statSourceFile looks a file up in its directory listing, config drive filesystems have no stat. A file that cannot
+// be found gets default attributes
+func (filesystemService *FileSystemServiceImpl) statSourceFile(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string) os.FileInfo {
+	cleanPath := path.Clean("/" + sourceFilePath)
+	fileInfos, readDirectoryError := sourceFilesystem.ReadDir(path.Dir(cleanPath))
+
+	if readDirectoryError != nil {
+		filesystemService.logger.Debugf("Failed to read the attributes of %s: %s", sourceFilePath, readDirectoryError.Error())
+		return nil
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Name() == path.Base(cleanPath) {
+			return fileInfo
+		}
+	}
+	return nil
+}
+
+func (filesystemService *FileSystemServiceImpl) fileDigest(path string) ([]byte, error) {
+	file, openFileError := filesystemService.osClient.OpenFile(path)
+
+	if openFileError != nil {
+		return nil, openFileError
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, hashError := io.Copy(hasher, file)
+
+	if hashError != nil {
+		return nil, hashError
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := filepath.Join(t.TempDir(), "config.yaml")
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+
+	changed, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", destPath)
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+	copied, readError := os.ReadFile(destPath)
+	assert.Nil(t, readError)
+	assert.Equal(t, "a: b\n", string(copied))
+
+	destInfo, _ := os.Stat(destPath)
+	assert.Equal(t, os.FileMode(0600), destInfo.Mode().Perm())
+	assert.True(t, testSourceModTime.Equal(destInfo.ModTime()))
+
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(destPath), ".*.tmp"))
+	assert.Empty(t, leftovers)
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_unchanged(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(destPath, []byte("a: b\n"), 0640))
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+	existingInfo, _ := os.Stat(destPath)
+
+	changed, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", destPath)
+
+	assert.Nil(t, copyError)
+	assert.False(t, changed)
+
+	// the file is left in place with the mode it already had
+	destInfo, _ := os.Stat(destPath)
+	assert.True(t, os.SameFile(existingInfo, destInfo))
+	assert.Equal(t, os.FileMode(0640), destInfo.Mode().Perm())
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_replacesExisting(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(destPath, []byte("a: old\n"), 0640))
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+	existingInfo, _ := os.Stat(destPath)
+
+	changed, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: new\n"}), "config.yaml", destPath)
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+	copied, _ := os.ReadFile(destPath)
+	assert.Equal(t, "a: new\n", string(copied))
+
+	// the file is replaced rather than rewritten, keeping the mode of the one it replaces
+	destInfo, _ := os.Stat(destPath)
+	assert.False(t, os.SameFile(existingInfo, destInfo))
+	assert.Equal(t, os.FileMode(0640), destInfo.Mode().Perm())
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_isDirectory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destDirectory := t.TempDir()
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+
+	changed, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", destDirectory)
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+	copied, readError := os.ReadFile(filepath.Join(destDirectory, "config.yaml"))
+	assert.Nil(t, readError)
+	assert.Equal(t, "a: b\n", string(copied))
+}
+
+func TestFileSystemServiceImpl_CopyFileToRootFs_attributes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := filepath.Join(t.TempDir(), "named.conf")
+	currentUser, _ := user.Current()
+	currentGroup, _ := user.LookupGroupId(currentUser.Gid)
+
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("named").Return(currentUser, nil)
+	mockUserClient.EXPECT().GetGroupByName("named").Return(currentGroup, nil)
+	mockOsClient := newTestOsClient(ctrl)
+	mockOsClient.EXPECT().SetXattr(gomock.Any(), seLinuxXattr, []byte("system_u:object_r:named_conf_t:s0")).Return(nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient, userClient: mockUserClient}
+
+	changed, copyError := testFilesystemService.CopyFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "options {};\n"}), "config.yaml", destPath, FileAttributes{
+		Mode:         0640,
+		Owner:        "named",
+		Group:        "named",
+		SeLinuxLabel: "system_u:object_r:named_conf_t:s0",
+	})
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+	destInfo, _ := os.Stat(destPath)
+	assert.Equal(t, os.FileMode(0640), destInfo.Mode().Perm())
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_createPermissionDenied(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile("imATestFile").Return(nil, os.ErrNotExist)
+	mockOsClient.EXPECT().CreateFile(gomock.Any(), gomock.Any()).Return(nil, os.ErrPermission)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	_, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", "imATestFile")
+
+	assert.ErrorIs(t, copyError, os.ErrPermission)
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_nilFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile("imATestFile").Return(nil, os.ErrNotExist)
+	mockOsClient.EXPECT().CreateFile(gomock.Any(), gomock.Any()).Return(nil, nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	_, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", "imATestFile")
+
+	assert.EqualError(t, copyError, "failed to retrieve file to copy source config.yaml to: imATestFile, file was nil")
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_writeFileError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFileWrapper := clients.NewMockFileWrapper(ctrl)
+	mockFileWrapper.EXPECT().Close().Return(nil)
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile("imATestFile").Return(nil, os.ErrNotExist)
+	// the temporary file is private before anything is written to it
+	gomock.InOrder(
+		mockOsClient.EXPECT().CreateFile(gomock.Not("imATestFile"), 0600).Return(mockFileWrapper, nil),
+		mockOsClient.EXPECT().SetPermissions(gomock.Not("imATestFile"), 0600).Return(nil),
+		mockFileWrapper.EXPECT().Write(gomock.Any()).Return(0, errors.New("disk full")),
+	)
+	// the partial file is removed and the destination is never touched
+	mockOsClient.EXPECT().Remove(gomock.Not("imATestFile")).Return(nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	changed, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", "imATestFile")
+
+	assert.False(t, changed)
+	assert.EqualError(t, copyError, "disk full")
+}
+
+func TestFileSystemServiceImpl_CopySingleFileToRootFs_bytesWrittenDoesntMatchFileSize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFileWrapper := clients.NewMockFileWrapper(ctrl)
+	mockFileWrapper.EXPECT().Write(gomock.Any()).Return(2, nil)
+	mockFileWrapper.EXPECT().Close().Return(nil)
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile("imATestFile").Return(nil, os.ErrNotExist)
+	mockOsClient.EXPECT().CreateFile(gomock.Not("imATestFile"), 0600).Return(mockFileWrapper, nil)
+	mockOsClient.EXPECT().SetPermissions(gomock.Not("imATestFile"), 0600).Return(nil)
+	mockOsClient.EXPECT().Remove(gomock.Not("imATestFile")).Return(nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	changed, copyError := testFilesystemService.CopySingleFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "a: b\n"}), "config.yaml", "imATestFile")
+
+	assert.False(t, changed)
+	assert.ErrorIs(t, copyError, io.ErrShortWrite)
+}
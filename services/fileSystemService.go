@@ -4,43 +4,67 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
-	"strconv"
+	"path"
 	"strings"
-	"syscall"
 	"zs-vm-agent/clients"
 
-	"github.com/moby/sys/mount"
 	"github.com/sirupsen/logrus"
 )
 
 type FileSystemService interface {
-	initialize(logger *logrus.Logger, osClient clients.OsClient, userClient clients.UserClient)
+	initialize(logger *logrus.Logger, osClient clients.OsClient, userClient clients.UserClient, diskService DiskService, manifestService ManifestService)
 	CreateRootFsDirectory(path string, recursive bool, permissions int) error
-	SetRootFsOwner(path string, owner string, recursive bool) error
+	SetRootFsOwner(path string, owner string, recursive bool) (int, error)
+	ResolveOwnership(spec string) (Ownership, error)
 	SetRootFsPermissions(path string, permissions int, recursive bool) error
+	GetRootFsXattr(path string, name string) ([]byte, error)
+	SetRootFsXattr(path string, name string, value []byte) error
+	ListRootFsXattrs(path string) ([]string, error)
+	RemoveRootFsXattr(path string, name string) error
+	GetRootFsAcl(path string) ([]AclEntry, error)
+	SetRootFsAcl(path string, acl []AclEntry) error
+	GetSeLinuxLabel(path string) (string, error)
+	SetSeLinuxLabel(path string, label string, recursive bool) error
+	ChangeSeLinuxContext(path string, seUser string, seRole string, seType string, recursive bool) error
 	GetFilesystem(diskWrapper clients.DiskWrapper, partition int) (clients.FileSystemWrapper, error)
 	GetBlockFilesystem(devicePath string) (clients.FileSystemWrapper, error)
-	CopyFilesToRootFs(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, recursive bool) error
-	CopySingleFileToRootFs(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, destPath string) error
+	FindConfigFilesystem(query ConfigVolumeQuery) (clients.FileSystemWrapper, error)
+	OpenConfigVolume(vmDetails clients.ProxmoxVm, query ConfigVolumeQuery, order int) (clients.FileSystemWrapper, error)
+	CopyFilesToRootFs(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, recursive bool) (bool, error)
+	CopySingleFileToRootFs(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, destPath string) (bool, error)
+	CopyFileToRootFs(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, destPath string, attributes FileAttributes) (bool, error)
+	WriteFileToRootFs(destPath string, data []byte, attributes FileAttributes) (bool, error)
+	CopyTreeToRootFs(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, options TreeCopyOptions) (bool, error)
 	ReadFileContents(path string) ([]byte, error)
 	ReadFileContentsFromFilesystem(fs clients.FileSystemWrapper, path string) ([]byte, error)
 	WriteFileContents(path string, data []byte, permissions uint16) error
-	MountFilesystem(deviceLocation string, mountLocation string) error
-	CreateXfsFileSystem(partitionPath string) error
+	MountFilesystem(deviceLocation string, mountLocation string, filesystemType string) error
+	ProbeFileSystem(devicePath string) (string, error)
+	CreateFileSystem(devicePath string, spec FilesystemSpec) error
+	GrowFileSystem(devicePath string, mountPath string, filesystemType string) error
+	GetMounts() ([]MountEntry, error)
+	DeviceMounts(devicePath string) ([]MountEntry, error)
+	IsMounted(devicePath string, mountPath string) (bool, error)
+	PartitionDisk(diskPath string, layout *DiskLayout, wipe bool, mountedDevice string, mountPath string) error
 }
 
 type FileSystemServiceImpl struct {
-	logger     *logrus.Logger
-	osClient   clients.OsClient
-	userClient clients.UserClient
+	logger          *logrus.Logger
+	osClient        clients.OsClient
+	userClient      clients.UserClient
+	diskService     DiskService
+	manifestService ManifestService
 }
 
-func (filesystemService *FileSystemServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, userClient clients.UserClient) {
+func (filesystemService *FileSystemServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, userClient clients.UserClient, diskService DiskService, manifestService ManifestService) {
 	filesystemService.logger = logger
 	filesystemService.osClient = osClient
 	filesystemService.userClient = userClient
+	filesystemService.diskService = diskService
+	filesystemService.manifestService = manifestService
 }
 
 func (filesystemService *FileSystemServiceImpl) CreateRootFsDirectory(path string, recursive bool, permissions int) error {
@@ -50,12 +74,20 @@ func (filesystemService *FileSystemServiceImpl) CreateRootFsDirectory(path strin
 		currentPath = strings.ReplaceAll(fmt.Sprintf("%s%s/", currentPath, pathPart), "//", "/")
 		_, readDirectoryError := filesystemService.osClient.StatFile(currentPath)
 
-		if readDirectoryError != nil && readDirectoryError.Error() == fmt.Sprintf("stat %s: no such file or directory", currentPath) && (recursive || strings.Contains(currentPath, path)) {
+		if errors.Is(readDirectoryError, fs.ErrNotExist) && (recursive || strings.Contains(currentPath, path)) {
 			createDirectoryError := filesystemService.osClient.Mkdir(currentPath, permissions)
 			if createDirectoryError != nil {
 				filesystemService.logger.Errorf("Failed to create directory %s: %s", currentPath, createDirectoryError.Error())
 				return createDirectoryError
 			}
+
+			// the umask applies to mkdir, the requested mode is set explicitly
+			setPermissionsError := filesystemService.osClient.SetPermissions(currentPath, permissions)
+			if setPermissionsError != nil {
+				filesystemService.logger.Errorf("Failed to set permissions on directory %s: %s", currentPath, setPermissionsError.Error())
+				return setPermissionsError
+			}
+			continue
 		} else if readDirectoryError != nil {
 			readDirectoryErrorString := readDirectoryError.Error()
 			filesystemService.logger.Errorf("Failed to read directory %s: %s", currentPath, readDirectoryErrorString)
@@ -139,59 +171,36 @@ func (filesystemService *FileSystemServiceImpl) GetBlockFilesystem(devicePath st
 	return blockFilesystem, nil
 }
 
-func (filesystemService *FileSystemServiceImpl) CopyFilesToRootFs(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, recursive bool) error {
+// CopyFilesToRootFs copies a file, or a directory into destPath keeping the relative paths of its files and skipping
+// lost+found. Subdirectories are only copied when recursive, it reports whether any contents changed
+func (filesystemService *FileSystemServiceImpl) CopyFilesToRootFs(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, recursive bool) (bool, error) {
 	filesystemService.logger.Infof("Copying %s to %s", sourcePath, destPath)
 	fileInfos, readSourceError := filesystemService.attemptReadDir(sourceFilesystem, sourcePath)
-	isSourceADir := true
 	if readSourceError != nil && readSourceError.Error() != fmt.Sprintf("error reading directory %s: cannot create directory at %s since it is a file", sourcePath, sourcePath) {
 		filesystemService.logger.Debugf("Failed to read source file at %s, cannot continue copy operation", sourcePath)
-		return readSourceError
+		return false, readSourceError
 	}
 
-	if fileInfos == nil {
-		isSourceADir = false
-		fileInfo, _, getFileInfoError := filesystemService.getSingleFileInfo(sourceFilesystem, sourcePath, destPath)
-		if getFileInfoError != nil {
-			return getFileInfoError
-		}
-		fileInfos = []os.FileInfo{fileInfo}
-	}
-	for _, fileInfo := range fileInfos {
-		fileName := fileInfo.Name()
-		filesystemService.logger.Debugf("Processing %s", fileName)
-		filesystemService.logger.Debugf("Is Directory? %v", fileInfo.IsDir())
-		//filesystemService.logger.Debugf("Processing %s", fileName)
-		//filesystemService.logger.Debugf("Processing %s", fileName)
-
-		if fileInfo.IsDir() && fileName != "." && fileName != ".." {
-			filesystemService.logger.Debugf("Starting copy for directory %s", fileName)
-			copyError := filesystemService.CopyFilesToRootFs(sourceFilesystem, fmt.Sprintf("%s/%s", sourcePath, fileName), destPath, recursive)
-			if copyError != nil {
-				return copyError
-			}
-
-		} else if fileName != "." && fileName != ".." {
-			filesystemService.logger.Debugf("Starting copy for file %s", fileName)
-			filePath := sourcePath
-			if isSourceADir {
-				filePath = sourcePath + "/" + fileName
-			}
-			filesystemService.logger.Debugf("Copying filepath %s", filePath)
-			copyFileError := filesystemService.CopySingleFileToRootFs(sourceFilesystem, filePath, destPath)
-			if copyFileError != nil {
-				return copyFileError
-			}
-		}
-		filesystemService.logger.Debugf("Copied %s to %s", sourcePath, destPath)
+	if fileInfos != nil {
+		return filesystemService.copyTree(sourceFilesystem, sourcePath, destPath, "", fileInfos, TreeCopyOptions{
+			Recursive: recursive,
+			Exclude:   []string{"lost+found"},
+		})
 	}
 
-	return nil
+	fileInfo, _, getFileInfoError := filesystemService.getSingleFileInfo(sourceFilesystem, sourcePath, destPath)
+	if getFileInfoError != nil {
+		return false, getFileInfoError
+	}
+	filesystemService.logger.Debugf("Copying filepath %s", sourcePath)
+	return filesystemService.copyFile(sourceFilesystem, sourcePath, fileInfo, destPath, FileAttributes{})
 }
 
 func (filesystemService *FileSystemServiceImpl) attemptReadDir(sourceFilesystem clients.FileSystemWrapper, sourcePath string) ([]os.FileInfo, error) {
 	fileInfos, readSourceError := sourceFilesystem.ReadDir(sourcePath)
-	expectedErrorMessage := fmt.Sprintf("error reading directory %s: cannot create directory at /%s since it is a file", sourcePath, sourcePath)
-	if readSourceError != nil && readSourceError.Error() == expectedErrorMessage {
+	// config drives report the file from their root, whether or not sourcePath was given from it
+	fileErrorMessage := fmt.Sprintf("cannot create directory at %s since it is a file", path.Join("/", sourcePath))
+	if readSourceError != nil && strings.HasSuffix(readSourceError.Error(), fileErrorMessage) {
 		return nil, nil
 	} else if readSourceError != nil {
 		return nil, readSourceError
@@ -200,58 +209,6 @@ func (filesystemService *FileSystemServiceImpl) attemptReadDir(sourceFilesystem
 	return fileInfos, nil
 }
 
-func (filesystemService *FileSystemServiceImpl) CopySingleFileToRootFs(sourceFilesystem clients.FileSystemWrapper, sourceFilePath string, destPath string) error {
-	sourceFile, readSourceError := sourceFilesystem.OpenFile(sourceFilePath, 0)
-	if readSourceError != nil {
-		filesystemService.logger.Errorf("Failed to open file %s: %s", sourceFilePath, readSourceError.Error())
-		return readSourceError
-	}
-	filesystemService.logger.Debugf("File %s opened", sourceFilePath)
-	var fileBytes = make([]byte, 4096)
-	var fileBuffer = bytes.Buffer{}
-	bytesRead, readBytesError := sourceFile.Read(fileBytes)
-	for bytesRead > 0 {
-		if readBytesError != nil && readBytesError.Error() != "EOF" {
-			filesystemService.logger.Errorf("Failed to read bytes from source file -> %s: %s", destPath, readBytesError.Error())
-			return readBytesError
-		}
-		for i := range bytesRead {
-			fileBuffer.WriteByte(fileBytes[i])
-		}
-		fileBytes = make([]byte, 4096)
-		bytesRead, readBytesError = sourceFile.Read(fileBytes)
-	}
-
-	osFile, createFileError := filesystemService.osClient.CreateFile(destPath)
-	if createFileError != nil && strings.Contains(createFileError.Error(), "is a directory") {
-		filePathParts := strings.Split(sourceFilePath, "/")
-		osFile, createFileError = filesystemService.osClient.CreateFile(fmt.Sprintf("%s/%s", destPath, filePathParts[len(filePathParts)-1]))
-	}
-	if createFileError != nil {
-		filesystemService.logger.Errorf("Failed to create file to copy source to %s: %s", destPath, createFileError.Error())
-		return createFileError
-	}
-
-	if osFile == nil {
-		filesystemService.logger.Errorf("Failed to retrieve file to copy source %s to: %s, file was nil", sourceFilePath, destPath)
-		return fmt.Errorf("failed to retrieve file to copy source %s to: %s, file was nil", sourceFilePath, destPath)
-	}
-
-	bytesWritten, writeFileError := osFile.Write(fileBuffer.Bytes())
-
-	if writeFileError != nil {
-		filesystemService.logger.Errorf("Failed to write source file to destination %s: %s", destPath, writeFileError.Error())
-		return writeFileError
-	}
-
-	if bytesWritten != fileBuffer.Len() {
-		filesystemService.logger.Errorf("Bytes written %d to %s does not match the number of bytes read %d from the source file", bytesWritten, destPath, fileBuffer.Len())
-		return fmt.Errorf("bytes written %d to %s does not match the number of bytes read %d from the source file", bytesWritten, destPath, fileBuffer.Len())
-	}
-
-	return nil
-}
-
 func (filesystemService *FileSystemServiceImpl) getSingleFileInfo(system clients.FileSystemWrapper, sourcePath string, destPath string) (os.FileInfo, *string, error) {
 	filesystemService.logger.Debugf("Getting file info for %s", sourcePath)
 	sourceParts := strings.Split(sourcePath, "/")
@@ -287,50 +244,21 @@ func (filesystemService *FileSystemServiceImpl) getSingleFileInfo(system clients
 	return sourceFile, &sourceDir, nil
 }
 
-func (filesystemService *FileSystemServiceImpl) SetRootFsOwner(path string, owner string, recursive bool) error {
-	directoryInfo, getDirectoryInfoError := filesystemService.osClient.StatFile(path)
-
-	if getDirectoryInfoError != nil {
-		filesystemService.logger.Errorf("Failed to retrieve directory %s before updating ownership: %s", path, getDirectoryInfoError.Error())
-		return getDirectoryInfoError
-	}
-
-	if directoryInfo.IsDir() && recursive {
-		directoryEntries, readDirectoryError := filesystemService.osClient.ReadDir(path)
-		if readDirectoryError != nil {
-			filesystemService.logger.Errorf("Failed to read directory for recursive ownership change %s: %s", path, readDirectoryError)
-			return readDirectoryError
-		}
-		for _, entry := range directoryEntries {
-			setOwnerError := filesystemService.SetRootFsOwner(strings.ReplaceAll(fmt.Sprintf("%s/%s", path, entry.Name()), "//", "/"), owner, recursive)
-			if setOwnerError != nil {
-				return setOwnerError
-			}
-		}
-	}
-
-	fileSys := directoryInfo.Sys().(*syscall.Stat_t)
-
-	ownerUser, getUserUidError := filesystemService.userClient.GetUserByName(owner)
+// SetRootFsOwner gives path, and everything beneath it when recursive, to an owner spec such as "user", "user:group",
+// ":group" or "1000:1000". Symlinks are changed rather than followed, it returns how many paths changed
+func (filesystemService *FileSystemServiceImpl) SetRootFsOwner(path string, owner string, recursive bool) (int, error) {
+	ownership, resolveOwnerError := filesystemService.ResolveOwnership(owner)
 
-	if getUserUidError != nil {
-		filesystemService.logger.Errorf("Failed to retrieve UID for user %s: %s", owner, getUserUidError.Error())
-		return getUserUidError
+	if resolveOwnerError != nil {
+		return 0, resolveOwnerError
 	}
 
-	uid, uidConversionError := strconv.Atoi(ownerUser.Uid)
+	changed, setOwnerError := filesystemService.setOwnership(path, ownership, recursive)
 
-	if uidConversionError != nil {
-		filesystemService.logger.Errorf("Failed to convert uid string %s to integer: %s", ownerUser.Uid, uidConversionError)
-		return uidConversionError
+	if changed > 0 {
+		filesystemService.logger.Debugf("Changed the owner of %d paths under %s to %s", changed, path, owner)
 	}
-
-	setOwnerError := filesystemService.osClient.SetOwner(path, uid, int(fileSys.Gid))
-	if setOwnerError != nil {
-		logrus.Errorf("Failed to set owner for %s: %s", path, setOwnerError)
-		return setOwnerError
-	}
-	return nil
+	return changed, setOwnerError
 }
 
 func (filesystemService *FileSystemServiceImpl) ReadFileContents(path string) ([]byte, error) {
@@ -391,7 +319,7 @@ func (filesystemService *FileSystemServiceImpl) ReadFileContentsFromFilesystem(f
 func (filesystemService *FileSystemServiceImpl) WriteFileContents(path string, data []byte, permissions uint16) error {
 	filesystemService.logger.Debugf("Reading File at %s", path)
 
-	writeError := os.WriteFile(path, data, os.FileMode(permissions))
+	writeError := filesystemService.osClient.WriteFile(path, data, int(permissions))
 
 	if writeError != nil {
 		filesystemService.logger.Errorf("Failed to write provided data to file: %s", writeError.Error())
@@ -401,8 +329,35 @@ func (filesystemService *FileSystemServiceImpl) WriteFileContents(path string, d
 	return nil
 }
 
-func (filesystemService *FileSystemServiceImpl) MountFilesystem(deviceLocation string, mountLocation string) error {
-	mountError := mount.Mount(deviceLocation, mountLocation, "xfs", "")
+func (filesystemService *FileSystemServiceImpl) MountFilesystem(deviceLocation string, mountLocation string, filesystemType string) error {
+	filesystemType = normalizeFilesystemType(filesystemType)
+
+	if filesystemType == "swap" {
+		active, checkSwapError := filesystemService.isSwapActive(deviceLocation)
+
+		if checkSwapError != nil {
+			return checkSwapError
+		}
+
+		if active {
+			filesystemService.logger.Debugf("Swap on %s is already active", deviceLocation)
+			return nil
+		}
+		return filesystemService.runFilesystemCommand("/usr/sbin/swapon", deviceLocation)
+	}
+
+	mounted, checkMountError := filesystemService.IsMounted(deviceLocation, mountLocation)
+
+	if checkMountError != nil {
+		return checkMountError
+	}
+
+	if mounted {
+		filesystemService.logger.Debugf("%s is already mounted at %s", deviceLocation, mountLocation)
+		return nil
+	}
+
+	mountError := filesystemService.osClient.Mount(deviceLocation, mountLocation, filesystemType, "")
 	if mountError != nil {
 		filesystemService.logger.Errorf("Failed to mount device %s at %s: %s", deviceLocation, mountLocation, mountError.Error())
 		return mountError
@@ -410,18 +365,86 @@ func (filesystemService *FileSystemServiceImpl) MountFilesystem(deviceLocation s
 	return nil
 }
 
-func (filesystemService *FileSystemServiceImpl) CreateXfsFileSystem(partitionPath string) error {
-	command := exec.Command("/usr/sbin/mkfs.xfs", partitionPath)
+// ProbeFileSystem reports the filesystem, volume or partition table signature found on a device, an empty type means
+// the device holds nothing recognisable
+func (filesystemService *FileSystemServiceImpl) ProbeFileSystem(devicePath string) (string, error) {
+	device, openDeviceError := filesystemService.osClient.OpenFile(devicePath)
+
+	if openDeviceError != nil {
+		filesystemService.logger.Errorf("Failed to open device %s for probing: %s", devicePath, openDeviceError.Error())
+		return "", openDeviceError
+	}
+	defer device.Close()
+
+	signature, probeError := probeBlockSignature(device)
+
+	if probeError != nil {
+		filesystemService.logger.Errorf("Failed to probe device %s: %s", devicePath, probeError.Error())
+		return "", probeError
+	}
+
+	return signature, nil
+}
+
+// CreateFileSystem formats a device as described by spec. A device already holding a filesystem of the requested
+// type is left untouched and a device holding anything else is refused, so existing data is never reformatted
+func (filesystemService *FileSystemServiceImpl) CreateFileSystem(devicePath string, spec FilesystemSpec) error {
+	commandPath, commandArgs, buildCommandError := mkfsCommand(devicePath, spec)
+
+	if buildCommandError != nil {
+		filesystemService.logger.Errorf("Invalid filesystem for %s: %s", devicePath, buildCommandError.Error())
+		return buildCommandError
+	}
+
+	existingType, probeError := filesystemService.ProbeFileSystem(devicePath)
+
+	if probeError != nil {
+		return probeError
+	}
+
+	filesystemType := normalizeFilesystemType(spec.Type)
+
+	if existingType == filesystemType {
+		filesystemService.logger.Infof("Device %s already contains a %s filesystem, skipping format", devicePath, filesystemType)
+		return nil
+	} else if existingType != "" {
+		filesystemService.logger.Errorf("Device %s contains %s, refusing to format it as %s", devicePath, existingType, filesystemType)
+		return fmt.Errorf("device %s contains %s, refusing to format it as %s", devicePath, existingType, filesystemType)
+	}
+
+	return filesystemService.runFilesystemCommand(commandPath, commandArgs...)
+}
+
+// GrowFileSystem grows a mounted filesystem online to fill its device
+func (filesystemService *FileSystemServiceImpl) GrowFileSystem(devicePath string, mountPath string, filesystemType string) error {
+	switch normalizeFilesystemType(filesystemType) {
+	case "xfs":
+		return filesystemService.runFilesystemCommand("/usr/sbin/xfs_growfs", mountPath)
+	case "ext4":
+		return filesystemService.runFilesystemCommand("/usr/sbin/resize2fs", devicePath)
+	case "btrfs":
+		return filesystemService.runFilesystemCommand("/usr/sbin/btrfs", "filesystem", "resize", "max", mountPath)
+	case "swap":
+		filesystemService.logger.Warnf("Swap on %s cannot grow while in use, recreate it to use the new space", devicePath)
+		return nil
+	}
+
+	filesystemService.logger.Errorf("Cannot grow unsupported filesystem type %s on %s", filesystemType, devicePath)
+	return fmt.Errorf("cannot grow unsupported filesystem type %s", filesystemType)
+}
+
+func (filesystemService *FileSystemServiceImpl) runFilesystemCommand(commandPath string, args ...string) error {
+	command := exec.Command(commandPath, args...)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(filesystemService.osClient, command)
 
 	for _, line := range strings.Split(string(outputText), "\n") {
 		filesystemService.logger.Info(line)
 	}
 
 	if commandExecutionError != nil {
-		filesystemService.logger.Errorf("Failed to create filesystem at %s: %s", partitionPath, commandExecutionError.Error())
-		commandExecutionError = errors.New(commandExecutionError.Error() + " " + string(outputText))
+		filesystemService.logger.Errorf("Failed to run %s on %s: %s", commandPath, args[len(args)-1], commandExecutionError.Error())
+		commandExecutionError = fmt.Errorf("%w %s", commandExecutionError, outputText)
 		return commandExecutionError
 	}
 
@@ -3,10 +3,13 @@ package services
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
+	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 	"zs-vm-agent/clients"
 
 	"github.com/golang/mock/gomock"
@@ -22,7 +25,7 @@ func TestFileSystemServiceImpl_CreateRootFsDirectory_alreadyExists(t *testing.T)
 	testPath := "testPath"
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 	mockOsClient.
 		EXPECT().
 		StatFile(gomock.Eq(testPath+"/")).
@@ -42,7 +45,7 @@ func TestFileSystemServiceImpl_CreateRootFsDirectory_readFailed(t *testing.T) {
 	testPath := "testPath"
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 
 	testError := errors.New("failed to read directory")
 
@@ -67,12 +70,12 @@ func TestFileSystemServiceImpl_CreateRootFsDirectory_doesntExist(t *testing.T) {
 	testPath := "testPath"
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 	mockOsClient.
 		EXPECT().
 		StatFile(gomock.Eq(testPath+"/")).
 		Times(1).
-		Return(nil, fmt.Errorf("stat %s/: no such file or directory", testPath))
+		Return(nil, &os.PathError{Op: "stat", Path: testPath + "/", Err: syscall.ENOENT})
 
 	mockOsClient.
 		EXPECT().
@@ -80,11 +83,46 @@ func TestFileSystemServiceImpl_CreateRootFsDirectory_doesntExist(t *testing.T) {
 		Times(1).
 		Return(nil)
 
+	mockOsClient.
+		EXPECT().
+		SetPermissions(gomock.Eq(fmt.Sprintf("%s/", testPath)), gomock.Eq(0700)).
+		Times(1).
+		Return(nil)
+
 	createRootFsDirError := testFilesystemService.CreateRootFsDirectory(testPath, false, 0700)
 
 	assert.Nil(t, createRootFsDirError)
 }
 
+func TestFileSystemServiceImpl_CreateRootFsDirectory_mode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	directory := filepath.Join(t.TempDir(), "parent", "child")
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+
+	createRootFsDirError := testFilesystemService.CreateRootFsDirectory(directory, true, 0770)
+
+	assert.Nil(t, createRootFsDirError)
+	// group write survives the umask
+	for _, path := range []string{filepath.Dir(directory), directory} {
+		fileInfo, statError := os.Stat(path)
+		assert.Nil(t, statError)
+		assert.Equal(t, os.FileMode(0770), fileInfo.Mode().Perm())
+	}
+}
+
+func TestFileSystemServiceImpl_CreateFileSystem_hostRoot(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/dev/vdb", make([]byte, 1024*1024), 0660)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: clients.NewRootedOsClient("/mnt/image", host)}
+
+	createError := testFilesystemService.CreateFileSystem("/dev/vdb", FilesystemSpec{Type: "xfs"})
+
+	// the blank device belongs to the running system, so it is refused rather than formatted
+	assert.ErrorIs(t, createError, clients.ErrHostRoot)
+	assert.Empty(t, host.Commands())
+}
+
 func TestFileSystemServiceImpl_CreateRootFsDirectory_doesntExist_createFailed(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -95,12 +133,12 @@ func TestFileSystemServiceImpl_CreateRootFsDirectory_doesntExist_createFailed(t
 	testPath := "testPath"
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 	mockOsClient.
 		EXPECT().
 		StatFile(gomock.Eq(testPath+"/")).
 		Times(1).
-		Return(nil, fmt.Errorf("stat %s/: no such file or directory", testPath))
+		Return(nil, &os.PathError{Op: "stat", Path: testPath + "/", Err: syscall.ENOENT})
 
 	testError := errors.New("i failed")
 
@@ -131,7 +169,7 @@ func TestFileSystemServiceImpl_GetFilesystem(t *testing.T) {
 	mockDiskWrapper.EXPECT().GetFileSystem(gomock.Eq(testPartitionNumber)).Return(mockFileSystemWrapper, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, nil, nil)
+	testFilesystemService.initialize(&logrus.Logger{}, nil, nil, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetFilesystem(mockDiskWrapper, testPartitionNumber)
 
@@ -156,7 +194,7 @@ func TestFileSystemServiceImpl_GetFilesystem_UnableToRead(t *testing.T) {
 	mockDiskWrapper.EXPECT().GetFileSystem(gomock.Eq(testPartitionNumber)).Return(mockFileSystemWrapper, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, nil, nil)
+	testFilesystemService.initialize(&logrus.Logger{}, nil, nil, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetFilesystem(mockDiskWrapper, testPartitionNumber)
 
@@ -186,7 +224,7 @@ func TestFileSystemServiceImpl_GetFilesystem_FailedToGetFileSystem(t *testing.T)
 	mockDiskWrapper.EXPECT().GetFileSystem(gomock.Eq(testPartitionNumber)).Return(nil, getFileSystemTestError)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, nil, nil)
+	testFilesystemService.initialize(&logrus.Logger{}, nil, nil, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetFilesystem(mockDiskWrapper, testPartitionNumber)
 
@@ -212,7 +250,7 @@ func TestFileSystemServiceImpl_GetFilesystem_NilDisk(t *testing.T) {
 	mockFileSystem.EXPECT().ReadDir(gomock.Eq("/")).Times(0)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, nil, nil)
+	testFilesystemService.initialize(&logrus.Logger{}, nil, nil, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetFilesystem(nil, testPartitionNumber)
 
@@ -236,7 +274,7 @@ func TestFileSystemServiceImpl_GetBlockFilesystem(t *testing.T) {
 	mockOsClient.EXPECT().OpenDisk(gomock.Eq(testPath)).Times(1).Return(mockDiskWrapper, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetBlockFilesystem(testPath)
 
@@ -261,7 +299,7 @@ func TestFileSystemServiceImpl_GetBlockFilesystem_FailedGetFilesystem(t *testing
 	mockOsClient.EXPECT().OpenDisk(gomock.Eq(testPath)).Times(1).Return(mockDiskWrapper, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetBlockFilesystem(testPath)
 
@@ -286,7 +324,7 @@ func TestFileSystemServiceImpl_GetBlockFilesystem_FailedGetDisk(t *testing.T) {
 	mockOsClient.EXPECT().OpenDisk(gomock.Eq(testPath)).Times(1).Return(mockDiskWrapper, testError)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
 
 	retrievedFilesystem, getFilesystemError := testFilesystemService.GetBlockFilesystem(testPath)
 
@@ -304,21 +342,38 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory(t *testing.
 	testFile := "testFile.txt"
 
 	testBytes := []byte("testBytes")
+	destFilePath := filepath.Join("destPath", testFile)
+	tempPath := fmt.Sprintf("destPath/.%s.%d.tmp", testFile, os.Getpid())
 
 	mockDestFile := clients.NewMockFileWrapper(ctrl)
 	mockDestFile.EXPECT().Write(gomock.Eq(testBytes)).Times(1).Return(len(testBytes), nil)
+	mockDestFile.EXPECT().Close().Return(nil)
+
+	mockDestInfo := NewMockFileInfo(ctrl)
+	mockDestInfo.EXPECT().IsDir().Return(true)
 
 	osClient := clients.NewMockOsClient(ctrl)
-	osClient.EXPECT().CreateFile("destPath").Times(1).Return(mockDestFile, nil)
+	osClient.EXPECT().StatFile("destPath").Return(mockDestInfo, nil)
+	osClient.EXPECT().StatFile(destFilePath).Return(nil, os.ErrNotExist)
+	// the copy is written to a private temporary file and renamed over the destination
+	osClient.EXPECT().CreateFile(tempPath, 0600).Times(1).Return(mockDestFile, nil)
+	osClient.EXPECT().SetPermissions(tempPath, 0600).Return(nil)
+	osClient.EXPECT().SetPermissions(tempPath, 0644).Return(nil)
+	osClient.EXPECT().SetModTime(tempPath, gomock.Any()).Return(nil)
+	osClient.EXPECT().Rename(tempPath, destFilePath).Return(nil)
+	// the rename is flushed by syncing the directory it happened in
+	osClient.EXPECT().OpenFile("destPath").DoAndReturn(openTestDirectory(t))
 	mockUserClient := clients.NewMockUserClient(ctrl)
 
 	mockFileInfo := NewMockFileInfo(ctrl)
 	mockFileInfo.EXPECT().IsDir().Times(2).Return(false)
 	mockFileInfo.EXPECT().Name().Times(1).Return(testFile)
+	mockFileInfo.EXPECT().Mode().Return(os.FileMode(0)).AnyTimes()
+	mockFileInfo.EXPECT().ModTime().Return(time.Unix(1700000000, 0)).AnyTimes()
 
 	mockSourceFile := clients.NewMockFileWrapper(ctrl)
 	i := 0
-	mockSourceFile.EXPECT().Read(gomock.AssignableToTypeOf([]uint8{})).Times(2).Return(len(testBytes), nil).DoAndReturn(func(fileBytes []uint8) (int, error) {
+	mockSourceFile.EXPECT().Read(gomock.AssignableToTypeOf([]uint8{})).Times(2).DoAndReturn(func(fileBytes []uint8) (int, error) {
 		if i == 0 {
 			i = 1
 			for index := range len(testBytes) {
@@ -326,20 +381,21 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory(t *testing.
 			}
 			return len(testBytes), nil
 		}
-		return 0, nil
+		return 0, io.EOF
 	})
+	mockSourceFile.EXPECT().Close().Return(nil)
 
 	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
 	mockFileSystem.EXPECT().ReadDir(gomock.Eq(testPath)).Times(1).Return([]os.FileInfo{mockFileInfo}, nil)
 	mockFileSystem.EXPECT().OpenFile(gomock.Eq(fmt.Sprintf("%s/%s", testPath, testFile)), gomock.Eq(0)).Return(mockSourceFile, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient, nil, nil)
 
-	getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
+	changed, getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
 
 	assert.Nil(t, getFilesystemError)
-
+	assert.True(t, changed)
 }
 
 func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorCopyingFile(t *testing.T) {
@@ -350,29 +406,36 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorCopyin
 	testFile := "testFile.txt"
 
 	testBytes := []byte("testBytes")
+	tempPath := fmt.Sprintf("destPath/.%s.%d.tmp", testFile, os.Getpid())
 
 	mockDestFile := clients.NewMockFileWrapper(ctrl)
 	mockDestFile.EXPECT().Write(gomock.Eq(testBytes)).Times(1).Return(len(testBytes)-5, nil)
+	mockDestFile.EXPECT().Close().Return(nil)
+
+	mockDestInfo := NewMockFileInfo(ctrl)
+	mockDestInfo.EXPECT().IsDir().Return(true)
 
 	osClient := clients.NewMockOsClient(ctrl)
-	osClient.EXPECT().CreateFile("destPath").Times(1).Return(mockDestFile, nil)
+	osClient.EXPECT().StatFile("destPath").Return(mockDestInfo, nil)
+	osClient.EXPECT().StatFile(filepath.Join("destPath", testFile)).Return(nil, os.ErrNotExist)
+	osClient.EXPECT().CreateFile(tempPath, 0600).Times(1).Return(mockDestFile, nil)
+	osClient.EXPECT().SetPermissions(tempPath, 0600).Return(nil)
+	// the partial copy is removed and the destination is never replaced
+	osClient.EXPECT().Remove(tempPath).Return(nil)
+	osClient.EXPECT().Rename(gomock.Any(), gomock.Any()).Times(0)
 
 	mockFileInfo := NewMockFileInfo(ctrl)
 	mockFileInfo.EXPECT().IsDir().Times(2).Return(false)
 	mockFileInfo.EXPECT().Name().Times(1).Return(testFile)
 
 	mockSourceFile := clients.NewMockFileWrapper(ctrl)
-	i := 0
-	mockSourceFile.EXPECT().Read(gomock.AssignableToTypeOf([]uint8{})).Times(2).Return(len(testBytes), nil).DoAndReturn(func(fileBytes []uint8) (int, error) {
-		if i == 0 {
-			i = 1
-			for index := range len(testBytes) {
-				fileBytes[index] = testBytes[index]
-			}
-			return len(testBytes), nil
+	mockSourceFile.EXPECT().Read(gomock.AssignableToTypeOf([]uint8{})).Times(1).DoAndReturn(func(fileBytes []uint8) (int, error) {
+		for index := range len(testBytes) {
+			fileBytes[index] = testBytes[index]
 		}
-		return 0, nil
+		return len(testBytes), nil
 	})
+	mockSourceFile.EXPECT().Close().Return(nil)
 	mockUserClient := clients.NewMockUserClient(ctrl)
 
 	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
@@ -380,13 +443,12 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorCopyin
 	mockFileSystem.EXPECT().OpenFile(gomock.Eq(fmt.Sprintf("%s/%s", testPath, testFile)), gomock.Eq(0)).Return(mockSourceFile, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient, nil, nil)
 
-	getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
-
-	assert.NotNil(t, getFilesystemError)
-	assert.ErrorContainsf(t, getFilesystemError, "does not match the number of bytes read", "Filesystem error should mention incorrect number of bytes being read & written")
+	changed, getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
 
+	assert.False(t, changed)
+	assert.ErrorIs(t, getFilesystemError, io.ErrShortWrite)
 }
 
 func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorOpeningFile(t *testing.T) {
@@ -403,8 +465,12 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorOpenin
 
 	mockUserClient := clients.NewMockUserClient(ctrl)
 
+	mockDestInfo := NewMockFileInfo(ctrl)
+	mockDestInfo.EXPECT().IsDir().Return(true)
+
 	osClient := clients.NewMockOsClient(ctrl)
-	osClient.EXPECT().CreateFile("destPath").Times(0)
+	osClient.EXPECT().StatFile("destPath").Return(mockDestInfo, nil)
+	osClient.EXPECT().CreateFile("destPath", gomock.Any()).Times(0)
 
 	mockFileInfo := NewMockFileInfo(ctrl)
 	mockFileInfo.EXPECT().IsDir().Times(2).Return(false)
@@ -418,9 +484,9 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorOpenin
 	mockFileSystem.EXPECT().OpenFile(gomock.Eq(fmt.Sprintf("%s/%s", testPath, testFile)), gomock.Eq(0)).Return(nil, errors.New("i failed to open the file"))
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient, nil, nil)
 
-	getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
+	_, getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
 
 	assert.NotNil(t, getFilesystemError)
 	assert.ErrorContainsf(t, getFilesystemError, "i failed to open the file", "test error message about opening a file is not correct")
@@ -440,7 +506,7 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorReadin
 	mockDestFile.EXPECT().Write(gomock.Eq(testBytes)).Times(0)
 
 	osClient := clients.NewMockOsClient(ctrl)
-	osClient.EXPECT().CreateFile("destPath").Times(0)
+	osClient.EXPECT().CreateFile("destPath", gomock.Any()).Times(0)
 
 	mockFileInfo := NewMockFileInfo(ctrl)
 	mockFileInfo.EXPECT().IsDir().Times(0).Return(false)
@@ -458,9 +524,9 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleDirectory_ErrorReadin
 	mockUserClient := clients.NewMockUserClient(ctrl)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient, nil, nil)
 
-	getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
+	_, getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testPath, "destPath", false)
 
 	assert.NotNil(t, getFilesystemError)
 	assert.ErrorContainsf(t, getFilesystemError, errorMessage, "test error message about reading a directory is not correct")
@@ -474,16 +540,23 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleFile(t *testing.T) {
 	testFile := "testFile.txt"
 
 	testBytes := []byte("testBytes")
+	tempPath := fmt.Sprintf(".destPath.%d.tmp", os.Getpid())
 
 	mockDestFile := clients.NewMockFileWrapper(ctrl)
 	mockDestFile.EXPECT().Write(gomock.Eq(testBytes)).Times(1).Return(len(testBytes), nil)
+	mockDestFile.EXPECT().Close().Return(nil)
 
 	osClient := clients.NewMockOsClient(ctrl)
-	osClient.EXPECT().CreateFile("destPath").Times(1).Return(mockDestFile, nil)
+	osClient.EXPECT().StatFile("destPath").Return(nil, os.ErrNotExist)
+	osClient.EXPECT().CreateFile(tempPath, 0600).Times(1).Return(mockDestFile, nil)
+	osClient.EXPECT().SetPermissions(tempPath, 0600).Return(nil)
+	osClient.EXPECT().SetPermissions(tempPath, 0640).Return(nil)
+	osClient.EXPECT().Rename(tempPath, "destPath").Return(nil)
+	osClient.EXPECT().OpenFile(".").DoAndReturn(openTestDirectory(t))
 
 	mockSourceFile := clients.NewMockFileWrapper(ctrl)
 	i := 0
-	mockSourceFile.EXPECT().Read(gomock.AssignableToTypeOf([]uint8{})).Times(2).Return(len(testBytes), nil).DoAndReturn(func(fileBytes []uint8) (int, error) {
+	mockSourceFile.EXPECT().Read(gomock.AssignableToTypeOf([]uint8{})).Times(2).DoAndReturn(func(fileBytes []uint8) (int, error) {
 		if i == 0 {
 			i = 1
 			for index := range len(testBytes) {
@@ -491,13 +564,14 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleFile(t *testing.T) {
 			}
 			return len(testBytes), nil
 		}
-		return 0, nil
+		return 0, io.EOF
 	})
+	mockSourceFile.EXPECT().Close().Return(nil)
 
 	singleFileInfo := NewMockFileInfo(ctrl)
 	singleFileInfo.EXPECT().Name().Times(2).Return(testFile)
-	singleFileInfo.EXPECT().IsDir().Times(2).Return(false)
-	singleFileInfo.EXPECT().Name().Times(1).Return(testFile)
+	singleFileInfo.EXPECT().Mode().Return(os.FileMode(0640)).AnyTimes()
+	singleFileInfo.EXPECT().ModTime().Return(time.Time{}).AnyTimes()
 	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
 	mockFileSystem.EXPECT().ReadDir(gomock.Any()).Times(2).DoAndReturn(func(sourceDir string) ([]os.FileInfo, error) {
 		if sourceDir == "/" {
@@ -510,12 +584,12 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleFile(t *testing.T) {
 	mockUserClient := clients.NewMockUserClient(ctrl)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient)
+	testFilesystemService.initialize(&logrus.Logger{}, osClient, mockUserClient, nil, nil)
 
-	getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testFile, "destPath", false)
+	changed, getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testFile, "destPath", false)
 
 	assert.Nil(t, getFilesystemError)
-
+	assert.True(t, changed)
 }
 
 func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleFile_NilFileInfo(t *testing.T) {
@@ -533,9 +607,9 @@ func TestFileSystemServiceImpl_CopyFilesToRootFs_CopySingleFile_NilFileInfo(t *t
 	})
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, nil, nil)
+	testFilesystemService.initialize(&logrus.Logger{}, nil, nil, nil, nil)
 
-	getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testFile, "destPath", false)
+	_, getFilesystemError := testFilesystemService.CopyFilesToRootFs(mockFileSystem, testFile, "destPath", false)
 
 	assert.NotNil(t, getFilesystemError)
 	assert.Errorf(t, getFilesystemError, fmt.Sprintf("file %s could not be found", testFile))
@@ -556,8 +630,8 @@ func TestFileSystemService_SetRootFsOwner(t *testing.T) {
 	})
 
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().StatFile(testPath).Times(1).Return(mockFileInfo, nil)
-	mockOsClient.EXPECT().SetOwner(testPath, 9001, 9001).Return(nil)
+	mockOsClient.EXPECT().LstatFile(testPath).Times(1).Return(mockFileInfo, nil)
+	mockOsClient.EXPECT().SetLinkOwner(testPath, 9001, -1).Return(nil)
 
 	testUser := user.User{
 		Uid: "9001",
@@ -567,10 +641,11 @@ func TestFileSystemService_SetRootFsOwner(t *testing.T) {
 	mockUserClient.EXPECT().GetUserByName(testOwner).Times(1).Return(&testUser, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
-	setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	changed, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
 
 	assert.Nil(t, setOwnerError)
+	assert.Equal(t, 1, changed)
 }
 
 func TestFileSystemService_SetRootFsOwner_setOwnerError(t *testing.T) {
@@ -587,8 +662,8 @@ func TestFileSystemService_SetRootFsOwner_setOwnerError(t *testing.T) {
 	})
 
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().StatFile(testPath).Times(1).Return(mockFileInfo, nil)
-	mockOsClient.EXPECT().SetOwner(testPath, 9001, 9001).Return(errors.New("testError"))
+	mockOsClient.EXPECT().LstatFile(testPath).Times(1).Return(mockFileInfo, nil)
+	mockOsClient.EXPECT().SetLinkOwner(testPath, 9001, -1).Return(errors.New("testError"))
 
 	testUser := user.User{
 		Uid: "9001",
@@ -598,8 +673,8 @@ func TestFileSystemService_SetRootFsOwner_setOwnerError(t *testing.T) {
 	mockUserClient.EXPECT().GetUserByName(testOwner).Times(1).Return(&testUser, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
-	setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	_, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
 
 	assert.NotNil(t, setOwnerError)
 	assert.Equal(t, setOwnerError.Error(), "testError")
@@ -612,14 +687,7 @@ func TestFileSystemService_SetRootFsOwner_uidConversionError(t *testing.T) {
 	testPath := "aPath"
 	testOwner := "testOwner"
 
-	mockFileInfo := NewMockFileInfo(ctrl)
-	mockFileInfo.EXPECT().IsDir().Times(1).Return(false)
-	mockFileInfo.EXPECT().Sys().Times(1).Return(&syscall.Stat_t{
-		Gid: 9001,
-	})
-
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().StatFile(testPath).Times(1).Return(mockFileInfo, nil)
 
 	testUser := user.User{
 		Uid: "NAN",
@@ -629,8 +697,8 @@ func TestFileSystemService_SetRootFsOwner_uidConversionError(t *testing.T) {
 	mockUserClient.EXPECT().GetUserByName(testOwner).Times(1).Return(&testUser, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
-	setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	_, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
 
 	assert.NotNil(t, setOwnerError)
 	assert.Equal(t, setOwnerError.Error(), "strconv.Atoi: parsing \"NAN\": invalid syntax")
@@ -643,21 +711,14 @@ func TestFileSystemService_SetRootFsOwner_getUserUidError(t *testing.T) {
 	testPath := "aPath"
 	testOwner := "testOwner"
 
-	mockFileInfo := NewMockFileInfo(ctrl)
-	mockFileInfo.EXPECT().IsDir().Times(1).Return(false)
-	mockFileInfo.EXPECT().Sys().Times(1).Return(&syscall.Stat_t{
-		Gid: 9001,
-	})
-
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().StatFile(testPath).Times(1).Return(mockFileInfo, nil)
 
 	mockUserClient := clients.NewMockUserClient(ctrl)
 	mockUserClient.EXPECT().GetUserByName(testOwner).Times(1).Return(nil, errors.New("testError"))
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
-	setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	_, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
 
 	assert.NotNil(t, setOwnerError)
 	assert.Equal(t, setOwnerError.Error(), "testError")
@@ -674,13 +735,14 @@ func TestFileSystemService_SetRootFsOwner_readDirectoryError(t *testing.T) {
 	mockFileInfo.EXPECT().IsDir().Times(1).Return(true)
 
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().StatFile(testPath).Times(1).Return(mockFileInfo, nil)
+	mockOsClient.EXPECT().LstatFile(testPath).Times(1).Return(mockFileInfo, nil)
 	mockOsClient.EXPECT().ReadDir(testPath).Times(1).Return(nil, errors.New("Failed to read directories"))
 	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName(testOwner).Times(1).Return(&user.User{Uid: "9001"}, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
-	setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, true)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	_, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, true)
 
 	assert.NotNil(t, setOwnerError)
 	assert.Equal(t, setOwnerError.Error(), "Failed to read directories")
@@ -694,145 +756,236 @@ func TestFileSystemService_SetRootFsOwner_getDirectoryInfoError(t *testing.T) {
 	testOwner := "testOwner"
 
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().StatFile(testPath).Times(1).Return(nil, errors.New("testError"))
+	mockOsClient.EXPECT().LstatFile(testPath).Times(1).Return(nil, errors.New("testError"))
 
 	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName(testOwner).Times(1).Return(&user.User{Uid: "9001"}, nil)
 
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient)
-	setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	_, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, testOwner, false)
 
 	assert.NotNil(t, setOwnerError)
 	assert.Equal(t, setOwnerError.Error(), "testError")
 }
 
-func TestFileSystemServiceImpl_CopySingleFileToRootFs(t *testing.T) {
+func TestFileSystemServiceImpl_SetRootFsOwner_unchanged(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	testFileName := "imATestFile"
-	blankByteSlice := make([]byte, 4096)
-
-	testFileWrapper := clients.NewMockFileWrapper(ctrl)
-	testFileWrapper.EXPECT().Write(nil)
+	testPath := "aPath"
 
-	mockSourceFile := NewMockFile(ctrl)
-	mockSourceFile.EXPECT().Read(blankByteSlice).Times(1).Return(0, nil)
-	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
-	mockFileSystem.EXPECT().OpenFile("garbage", 0).Times(1).Return(mockSourceFile, nil)
+	mockFileInfo := NewMockFileInfo(ctrl)
+	mockFileInfo.EXPECT().IsDir().Times(1).Return(false)
+	mockFileInfo.EXPECT().Sys().Times(1).Return(&syscall.Stat_t{
+		Uid: 9001,
+		Gid: 25,
+	})
 
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().CreateFile(testFileName).Times(1).Return(testFileWrapper, nil)
+	mockOsClient.EXPECT().LstatFile(testPath).Times(1).Return(mockFileInfo, nil)
+
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("named").Times(1).Return(&user.User{Uid: "9001"}, nil)
+	mockUserClient.EXPECT().GetGroupByName("named").Times(1).Return(&user.Group{Gid: "25"}, nil)
+
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil)
-	copyError := filesystemService.CopySingleFileToRootFs(mockFileSystem, "garbage", testFileName)
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	changed, setOwnerError := testFilesystemService.SetRootFsOwner(testPath, "named:named", false)
 
-	assert.Nil(t, copyError, "Failed to copy single file, error was not nil")
+	assert.Nil(t, setOwnerError)
+	assert.Equal(t, 0, changed)
 }
 
-func TestFileSystemServiceImpl_CopySingleFileToRootFs_isDirectory(t *testing.T) {
+func TestFileSystemServiceImpl_SetRootFsOwner_recursive(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	testFileName := "imATestFile"
-	blankByteSlice := make([]byte, 4096)
+	rootPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(rootPath, "zones"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(rootPath, "zones", "db.example"), []byte("zone"), 0644))
+	assert.Nil(t, os.Symlink("/etc/passwd", filepath.Join(rootPath, "zones", "link")))
+	currentUid, currentGid := os.Getuid(), os.Getgid()
 
-	testFileWrapper := clients.NewMockFileWrapper(ctrl)
-	testFileWrapper.EXPECT().Write(nil)
-
-	mockSourceFile := NewMockFile(ctrl)
-	mockSourceFile.EXPECT().Read(blankByteSlice).Times(1).Return(0, nil)
-	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
-	mockFileSystem.EXPECT().OpenFile("garbage", 0).Times(1).Return(mockSourceFile, nil)
 	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().CreateFile(testFileName).Times(1).Return(nil, errors.New("test file is a directory"))
-	directoryPath := fmt.Sprintf("%s/%s", testFileName, "garbage")
-	mockOsClient.EXPECT().CreateFile(directoryPath).Times(1).Return(testFileWrapper, nil)
+	mockOsClient.EXPECT().LstatFile(gomock.Any()).DoAndReturn(os.Lstat).AnyTimes()
+	mockOsClient.EXPECT().ReadDir(gomock.Any()).DoAndReturn(os.ReadDir).AnyTimes()
+	// the symlink is changed itself, nothing it points at is touched
+	mockOsClient.EXPECT().SetLinkOwner(filepath.Join(rootPath, "zones", "link"), currentUid, currentGid+1).Return(nil)
+	mockOsClient.EXPECT().SetLinkOwner(filepath.Join(rootPath, "zones", "db.example"), currentUid, currentGid+1).Return(nil)
+	mockOsClient.EXPECT().SetLinkOwner(filepath.Join(rootPath, "zones"), currentUid, currentGid+1).Return(nil)
+	mockOsClient.EXPECT().SetLinkOwner(rootPath, currentUid, currentGid+1).Return(nil)
+
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil)
-	copyError := filesystemService.CopySingleFileToRootFs(mockFileSystem, "garbage", testFileName)
-	assert.Nil(t, copyError, "Failed to copy single file, error was not nil")
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, clients.NewMockUserClient(ctrl), nil, nil)
+	changed, setOwnerError := testFilesystemService.SetRootFsOwner(rootPath, fmt.Sprintf("%d:%d", currentUid, currentGid+1), true)
+
+	assert.Nil(t, setOwnerError)
+	assert.Equal(t, 4, changed)
 }
 
-func TestFileSystemServiceImpl_CopySingleFileToRootFs_createPermissionDenied(t *testing.T) {
+func TestFileSystemServiceImpl_ResolveOwnership(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	testFileName := "imATestFile"
-	blankByteSlice := make([]byte, 4096)
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("vault").Return(&user.User{Uid: "990", Gid: "985"}, nil).AnyTimes()
+	mockUserClient.EXPECT().GetGroupByName("named").Return(&user.Group{Gid: "25"}, nil).AnyTimes()
+	mockUserClient.EXPECT().GetGroupByName("missing").Return(nil, user.UnknownGroupError("missing")).AnyTimes()
 
-	mockSourceFile := NewMockFile(ctrl)
-	mockSourceFile.EXPECT().Read(blankByteSlice).Times(1).Return(0, nil)
-	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
-	mockFileSystem.EXPECT().OpenFile("garbage", 0).Times(1).Return(mockSourceFile, nil)
-	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().CreateFile(testFileName).Times(1).Return(nil, errors.New("permission denied"))
 	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil)
-	copyError := filesystemService.CopySingleFileToRootFs(mockFileSystem, "garbage", testFileName)
-	assert.EqualError(t, copyError, "permission denied")
+	testFilesystemService.initialize(&logrus.Logger{}, nil, mockUserClient, nil, nil)
+
+	for spec, expected := range map[string]Ownership{
+		"vault":       {Uid: 990, Gid: -1},
+		"vault:":      {Uid: 990, Gid: 985},
+		"vault:named": {Uid: 990, Gid: 25},
+		":named":      {Uid: -1, Gid: 25},
+		"1000:1001":   {Uid: 1000, Gid: 1001},
+		"vault:1001":  {Uid: 990, Gid: 1001},
+	} {
+		ownership, resolveError := testFilesystemService.ResolveOwnership(spec)
+		assert.Nil(t, resolveError, spec)
+		assert.Equal(t, expected, ownership, spec)
+	}
+
+	_, resolveError := testFilesystemService.ResolveOwnership(":")
+	assert.NotNil(t, resolveError)
+	_, resolveError = testFilesystemService.ResolveOwnership("1000:")
+	assert.NotNil(t, resolveError)
+	_, resolveError = testFilesystemService.ResolveOwnership("vault:missing")
+	assert.EqualError(t, resolveError, "group: unknown group missing")
 }
 
-func TestFileSystemServiceImpl_CopySingleFileToRootFs_nilFile(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+func TestMkfsCommand(t *testing.T) {
+	command, args, buildError := mkfsCommand("/dev/sdb1", FilesystemSpec{})
+	assert.Nil(t, buildError)
+	assert.Equal(t, "/usr/sbin/mkfs.xfs", command)
+	assert.Equal(t, []string{"/dev/sdb1"}, args)
 
-	testFileName := "imATestFile"
-	blankByteSlice := make([]byte, 4096)
+	command, args, buildError = mkfsCommand("/dev/sdb1", FilesystemSpec{Type: "ext4", Label: "longhorn", Uuid: "6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", Options: []string{"-m", "0"}})
+	assert.Nil(t, buildError)
+	assert.Equal(t, "/usr/sbin/mkfs.ext4", command)
+	assert.Equal(t, []string{"-L", "longhorn", "-U", "6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", "-m", "0", "/dev/sdb1"}, args)
 
-	mockSourceFile := NewMockFile(ctrl)
-	mockSourceFile.EXPECT().Read(blankByteSlice).Times(1).Return(0, nil)
-	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
-	mockFileSystem.EXPECT().OpenFile("garbage", 0).Times(1).Return(mockSourceFile, nil)
-	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().CreateFile(testFileName).Times(1).Return(nil, nil)
-	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil)
-	copyError := filesystemService.CopySingleFileToRootFs(mockFileSystem, "garbage", testFileName)
-	assert.EqualError(t, copyError, "failed to retrieve file to copy source garbage to: imATestFile, file was nil")
+	_, args, _ = mkfsCommand("/dev/sdb1", FilesystemSpec{Type: "XFS", Uuid: "6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f"})
+	assert.Equal(t, []string{"-m", "uuid=6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", "/dev/sdb1"}, args)
+
+	for _, spec := range []FilesystemSpec{{Type: "zfs"}, {Label: "label-too-long"}, {Type: "btrfs", Uuid: "not-a-uuid"}} {
+		_, _, buildError = mkfsCommand("/dev/sdb1", spec)
+		assert.NotNil(t, buildError)
+	}
 }
 
-func TestFileSystemServiceImpl_CopySingleFileToRootFs_writeFileError(t *testing.T) {
+func TestFileSystemServiceImpl_CreateFileSystem_existingFilesystem(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	devicePath := fmt.Sprintf("%s/device", t.TempDir())
+	device := make([]byte, blockProbeSize)
+	device[1080], device[1081] = 0x53, 0xef
+	assert.Nil(t, os.WriteFile(devicePath, device, 0600))
 
-	testFileName := "imATestFile"
-	blankByteSlice := make([]byte, 4096)
+	testFilesystemService := GetFileSystemService()
+	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, mockUserClient, nil, nil)
+	mockOsClient.
+		EXPECT().
+		OpenFile(gomock.Eq(devicePath)).
+		Times(2).
+		DoAndReturn(os.Open)
 
-	testFileWrapper := clients.NewMockFileWrapper(ctrl)
-	testFileWrapper.EXPECT().Write(nil).Return(0, errors.New("failed to write out to file, no space or something"))
+	assert.Nil(t, testFilesystemService.CreateFileSystem(devicePath, FilesystemSpec{Type: "ext4"}))
+	assert.NotNil(t, testFilesystemService.CreateFileSystem(devicePath, FilesystemSpec{}))
+}
 
-	mockSourceFile := NewMockFile(ctrl)
-	mockSourceFile.EXPECT().Read(blankByteSlice).Times(1).Return(0, nil)
-	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
-	mockFileSystem.EXPECT().OpenFile("garbage", 0).Times(1).Return(mockSourceFile, nil)
-	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().CreateFile(testFileName).Times(1).Return(testFileWrapper, nil)
-	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil)
-	copyError := filesystemService.CopySingleFileToRootFs(mockFileSystem, "garbage", testFileName)
-	assert.EqualError(t, copyError, "failed to write out to file, no space or something")
+func TestFileSystemServiceImpl_MountFilesystem_memoryHost(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddDirectory("/var/lib/longhorn", 0755)
+	host.AddFile("/dev/sdb1", nil, 0660)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: host}
+
+	assert.Nil(t, testFilesystemService.MountFilesystem("/dev/sdb1", "/var/lib/longhorn", "xfs"))
+	// the mount is listed in mountinfo so mounting again does nothing
+	assert.Nil(t, testFilesystemService.MountFilesystem("/dev/sdb1", "/var/lib/longhorn/", "xfs"))
+	assert.Equal(t, []clients.MemoryMount{{Device: "/dev/sdb1", Target: "/var/lib/longhorn", FilesystemType: "xfs"}}, host.Mounts())
+
+	mounted, checkMountError := testFilesystemService.IsMounted("/dev/sdb1", "/var/lib/longhorn")
+	assert.Nil(t, checkMountError)
+	assert.True(t, mounted)
+
+	assert.NotNil(t, testFilesystemService.MountFilesystem("/dev/sdc1", "/var/lib/missing", "xfs"))
 }
 
-func TestFileSystemServiceImpl_CopySingleFileToRootFs_bytesWrittenDoesntMatchFileSize(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+func TestFileSystemServiceImpl_MountFilesystem_activeSwap(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/dev/sdb2", nil, 0660)
+	host.AddSymlink("/dev/disk/by-uuid/6f1c2a4e", "/dev/sdb2")
+	host.AddFile("/proc/swaps", []byte("Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n/dev/sdb2                               partition\t1048572\t\t0\t\t-2\n"), 0444)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: host}
 
-	testFileName := "imATestFile"
-	blankByteSlice := make([]byte, 4096)
+	// swapon is not run for swap that is already in use
+	assert.Nil(t, testFilesystemService.MountFilesystem("/dev/disk/by-uuid/6f1c2a4e", "", "swap"))
 
-	testFileWrapper := clients.NewMockFileWrapper(ctrl)
-	testFileWrapper.EXPECT().Write(nil).Times(1).Return(15, nil)
+	active, checkSwapError := testFilesystemService.isSwapActive("/dev/sdc2")
+	assert.Nil(t, checkSwapError)
+	assert.False(t, active)
+	assert.Equal(t, "/swap file", unescapeOctal(`/swap\040file`))
+}
 
-	mockSourceFile := NewMockFile(ctrl)
-	mockSourceFile.EXPECT().Read(blankByteSlice).Times(1).Return(0, nil)
-	mockFileSystem := clients.NewMockFileSystemWrapper(ctrl)
-	mockFileSystem.EXPECT().OpenFile("garbage", 0).Times(1).Return(mockSourceFile, nil)
-	mockOsClient := clients.NewMockOsClient(ctrl)
-	mockOsClient.EXPECT().CreateFile(testFileName).Times(1).Return(testFileWrapper, nil)
-	testFilesystemService := GetFileSystemService()
-	testFilesystemService.initialize(&logrus.Logger{}, mockOsClient, nil)
-	copyError := filesystemService.CopySingleFileToRootFs(mockFileSystem, "garbage", testFileName)
+func TestFileSystemServiceImpl_WriteFileContents_memoryHost(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddDirectory("/etc/vault.d", 0750)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: host}
+
+	assert.Nil(t, testFilesystemService.WriteFileContents("/etc/vault.d/vault.hcl", []byte("ui = true\n"), 0640))
 
-	assert.EqualError(t, copyError, "bytes written 15 to imATestFile does not match the number of bytes read 0 from the source file")
+	written, _ := host.Node("/etc/vault.d/vault.hcl")
+	assert.Equal(t, "ui = true\n", string(written.Contents))
+	assert.Equal(t, os.FileMode(0640), written.Mode.Perm())
+
+	readBack, readError := testFilesystemService.ReadFileContents("/etc/vault.d/vault.hcl")
+	assert.Nil(t, readError)
+	assert.Equal(t, "ui = true\n", string(readBack))
+
+	assert.NotNil(t, testFilesystemService.WriteFileContents("/etc/missing/vault.hcl", []byte("ui = true\n"), 0640))
+}
+
+func TestFileSystemServiceImpl_hostRoot(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/mnt/image/etc/passwd", []byte("root:x:0:0:root:/root:/bin/bash\nnamed:x:25:25:Named:/var/named:/sbin/nologin\n"), 0644)
+	host.AddFile("/mnt/image/etc/group", []byte("root:x:0:\nnamed:x:25:\n"), 0644)
+	host.AddDirectory("/mnt/image/run", 0755)
+	host.AddSymlink("/mnt/image/var/run", "/run")
+	host.AddSymlink("/mnt/image/etc/escape", "../../../../run")
+	host.AddFile("/dev/vdb", nil, 0660)
+	rootedClient := clients.NewRootedOsClient("/mnt/image", host)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: rootedClient, userClient: clients.NewFileUserClient(rootedClient)}
+
+	// absolute and climbing symlinks of the image resolve within it
+	assert.Nil(t, testFilesystemService.WriteFileContents("/var/run/named.pid", []byte("25\n"), 0644))
+	assert.Nil(t, testFilesystemService.WriteFileContents("/etc/escape/rndc.key", []byte("key\n"), 0600))
+	_, found := host.Node("/mnt/image/run/named.pid")
+	assert.True(t, found)
+	_, found = host.Node("/mnt/image/run/rndc.key")
+	assert.True(t, found)
+	_, found = host.Node("/run/named.pid")
+	assert.False(t, found)
+
+	resolvedPath, evalError := rootedClient.EvalSymlinks("/var/run/named.pid")
+	assert.Nil(t, evalError)
+	assert.Equal(t, "/run/named.pid", resolvedPath)
+
+	// users and groups come from the image
+	_, setOwnerError := testFilesystemService.SetRootFsOwner("/var/run/named.pid", "named:named", false)
+	assert.Nil(t, setOwnerError)
+	pidFile, _ := host.Node("/mnt/image/run/named.pid")
+	assert.Equal(t, 25, pidFile.Uid)
+	assert.Equal(t, 25, pidFile.Gid)
+	_, unknownUserError := testFilesystemService.ResolveOwnership("vault")
+	assert.Equal(t, user.UnknownUserError("vault"), unknownUserError)
+
+	// devices are those of the running system
+	_, statError := rootedClient.StatFile("/dev/vdb")
+	assert.Nil(t, statError)
 }
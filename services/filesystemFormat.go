@@ -0,0 +1,86 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const defaultFilesystemType = "xfs"
+
+var filesystemUuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// FilesystemSpec describes how a device is formatted and mounted, Type defaults to xfs, Options are passed to mkfs
+// as is and MountOptions default to "defaults"
+type FilesystemSpec struct {
+	Type         string   `json:"type"`
+	Label        string   `json:"label"`
+	Uuid         string   `json:"uuid"`
+	Options      []string `json:"options"`
+	MountOptions []string `json:"mountOptions"`
+}
+
+type filesystemFormatter struct {
+	command        string
+	maxLabelLength int
+	uuidArgs       func(uuid string) []string
+}
+
+var filesystemFormatters = map[string]filesystemFormatter{
+	"xfs": {
+		command:        "/usr/sbin/mkfs.xfs",
+		maxLabelLength: 12,
+		uuidArgs:       func(uuid string) []string { return []string{"-m", "uuid=" + uuid} },
+	},
+	"ext4": {
+		command:        "/usr/sbin/mkfs.ext4",
+		maxLabelLength: 16,
+		uuidArgs:       func(uuid string) []string { return []string{"-U", uuid} },
+	},
+	"btrfs": {
+		command:        "/usr/sbin/mkfs.btrfs",
+		maxLabelLength: 255,
+		uuidArgs:       func(uuid string) []string { return []string{"-U", uuid} },
+	},
+	"swap": {
+		command:        "/usr/sbin/mkswap",
+		maxLabelLength: 16,
+		uuidArgs:       func(uuid string) []string { return []string{"-U", uuid} },
+	},
+}
+
+func normalizeFilesystemType(filesystemType string) string {
+	if filesystemType == "" {
+		return defaultFilesystemType
+	}
+	return strings.ToLower(filesystemType)
+}
+
+// mkfsCommand builds the command that formats devicePath as described by spec
+func mkfsCommand(devicePath string, spec FilesystemSpec) (string, []string, error) {
+	filesystemType := normalizeFilesystemType(spec.Type)
+	formatter, supported := filesystemFormatters[filesystemType]
+
+	if !supported {
+		return "", nil, fmt.Errorf("unsupported filesystem type %s", spec.Type)
+	}
+
+	var args []string
+
+	if spec.Label != "" {
+		if len(spec.Label) > formatter.maxLabelLength {
+			return "", nil, fmt.Errorf("label %s is longer than the %d characters %s allows", spec.Label, formatter.maxLabelLength, filesystemType)
+		}
+		args = append(args, "-L", spec.Label)
+	}
+
+	if spec.Uuid != "" {
+		if !filesystemUuidPattern.MatchString(spec.Uuid) {
+			return "", nil, fmt.Errorf("invalid filesystem uuid %s", spec.Uuid)
+		}
+		args = append(args, formatter.uuidArgs(spec.Uuid)...)
+	}
+
+	args = append(args, spec.Options...)
+	return formatter.command, append(args, devicePath), nil
+}
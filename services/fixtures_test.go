@@ -0,0 +1,91 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSourceModTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestOsClient backs the os client with the real filesystem so what the services write can be checked on disk
+func newTestOsClient(ctrl *gomock.Controller) *clients.MockOsClient {
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().StatFile(gomock.Any()).DoAndReturn(os.Stat).AnyTimes()
+	mockOsClient.EXPECT().OpenFile(gomock.Any()).DoAndReturn(os.Open).AnyTimes()
+	mockOsClient.EXPECT().Rename(gomock.Any(), gomock.Any()).DoAndReturn(os.Rename).AnyTimes()
+	mockOsClient.EXPECT().Remove(gomock.Any()).DoAndReturn(os.Remove).AnyTimes()
+	mockOsClient.EXPECT().RemoveAll(gomock.Any()).DoAndReturn(os.RemoveAll).AnyTimes()
+	mockOsClient.EXPECT().ReadDir(gomock.Any()).DoAndReturn(os.ReadDir).AnyTimes()
+	mockOsClient.EXPECT().Mkdir(gomock.Any(), gomock.Any()).DoAndReturn(func(path string, permissions int) error {
+		return os.Mkdir(path, os.FileMode(permissions))
+	}).AnyTimes()
+	mockOsClient.EXPECT().SetOwner(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(os.Lchown).AnyTimes()
+	mockOsClient.EXPECT().GetXattr(gomock.Any(), gomock.Any()).Return(nil, syscall.ENODATA).AnyTimes()
+	mockOsClient.EXPECT().SetPermissions(gomock.Any(), gomock.Any()).DoAndReturn(func(path string, permissions int) error {
+		return os.Chmod(path, os.FileMode(permissions))
+	}).AnyTimes()
+	mockOsClient.EXPECT().SetModTime(gomock.Any(), gomock.Any()).DoAndReturn(func(path string, modTime time.Time) error {
+		return os.Chtimes(path, modTime, modTime)
+	}).AnyTimes()
+	mockOsClient.EXPECT().CreateFile(gomock.Any(), gomock.Any()).DoAndReturn(func(path string, permissions int) (clients.FileWrapper, error) {
+		file, createError := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(permissions))
+
+		if createError != nil {
+			return nil, createError
+		}
+		return clients.NewOsFileWrapper(file), nil
+	}).AnyTimes()
+	return mockOsClient
+}
+
+// openTestDirectory opens a scratch directory in place of the directory a mocked rename happened in
+func openTestDirectory(t *testing.T) func(string) (clients.HostFile, error) {
+	return func(string) (clients.HostFile, error) {
+		return os.Open(t.TempDir())
+	}
+}
+
+// newTestConfigDrive serves a config drive labelled label holding files, keyed by their slash separated path. The
+// files are private and last modified at testSourceModTime
+func newTestConfigDrive(t *testing.T, ctrl *gomock.Controller, label string, files map[string]string) *clients.MockFileSystemWrapper {
+	sourceRoot := t.TempDir()
+	for filePath, contents := range files {
+		sourcePath := filepath.Join(sourceRoot, filePath)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(sourcePath), 0755))
+		assert.Nil(t, os.WriteFile(sourcePath, []byte(contents), 0600))
+		assert.Nil(t, os.Chtimes(sourcePath, testSourceModTime, testSourceModTime))
+	}
+
+	mockFileSystemWrapper := clients.NewMockFileSystemWrapper(ctrl)
+	mockFileSystemWrapper.EXPECT().GetFilesystemLabel().Return(label).AnyTimes()
+	mockFileSystemWrapper.EXPECT().ReadDir(gomock.Any()).DoAndReturn(func(directory string) ([]os.FileInfo, error) {
+		entries, readDirectoryError := os.ReadDir(filepath.Join(sourceRoot, directory))
+
+		if readDirectoryError != nil {
+			return nil, readDirectoryError
+		}
+
+		fileInfos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			fileInfo, _ := entry.Info()
+			fileInfos = append(fileInfos, fileInfo)
+		}
+		return fileInfos, nil
+	}).AnyTimes()
+	mockFileSystemWrapper.EXPECT().OpenFile(gomock.Any(), 0).DoAndReturn(func(filePath string, _ int) (clients.FileWrapper, error) {
+		file, openError := os.Open(filepath.Join(sourceRoot, filePath))
+
+		if openError != nil {
+			return nil, openError
+		}
+		return clients.NewOsFileWrapper(file), nil
+	}).AnyTimes()
+	return mockFileSystemWrapper
+}
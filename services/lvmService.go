@@ -0,0 +1,329 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+const lvmPath = "/usr/sbin/lvm"
+
+// VolumeGroupSpec declares an LVM volume group spanning whole disks and the logical volumes carved from it. Sizes are
+// absolute ("20G") or a percentage of the volume group ("25%"), an empty size takes the remaining space and is only
+// allowed on the last volume. Disks are added and volumes extended as the spec grows, nothing is ever shrunk
+type VolumeGroupSpec struct {
+	Name           string              `json:"name"`
+	Devices        []string            `json:"devices"`
+	LogicalVolumes []LogicalVolumeSpec `json:"logicalVolumes"`
+}
+
+type LogicalVolumeSpec struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+type LvmService interface {
+	initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService)
+	ApplyVolumeGroup(spec VolumeGroupSpec) ([]string, error)
+	LogicalVolumePath(volumeGroup string, logicalVolume string) string
+}
+
+type LvmServiceImpl struct {
+	logger            *logrus.Logger
+	osClient          clients.OsClient
+	filesystemService FileSystemService
+}
+
+// logicalVolumeChange is a volume to create or extend to sizeBytes
+type logicalVolumeChange struct {
+	name      string
+	create    bool
+	sizeBytes uint64
+}
+
+type volumeGroupState struct {
+	sizeBytes       uint64
+	freeBytes       uint64
+	extentBytes     uint64
+	logicalVolumes  map[string]uint64
+	physicalVolumes map[string]string
+}
+
+type lvmReport struct {
+	Report []struct {
+		Pv []map[string]string `json:"pv"`
+		Vg []map[string]string `json:"vg"`
+		Lv []map[string]string `json:"lv"`
+	} `json:"report"`
+}
+
+func (lvmService *LvmServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService) {
+	lvmService.logger = logger
+	lvmService.osClient = osClient
+	lvmService.filesystemService = filesystemService
+}
+
+func (lvmService *LvmServiceImpl) LogicalVolumePath(volumeGroup string, logicalVolume string) string {
+	return fmt.Sprintf("/dev/%s/%s", volumeGroup, logicalVolume)
+}
+
+// ApplyVolumeGroup brings the volume group in line with spec. Blank disks become physical volumes, disks missing from
+// the group extend it, resized disks are picked up and logical volumes are created or extended online. It returns the
+// names of the logical volumes that grew, whose filesystems still need growing
+func (lvmService *LvmServiceImpl) ApplyVolumeGroup(spec VolumeGroupSpec) ([]string, error) {
+	if spec.Name == "" || len(spec.Devices) == 0 {
+		lvmService.logger.Error("Volume group needs a name and at least one device")
+		return nil, errors.New("volume group needs a name and at least one device")
+	}
+
+	state, readStateError := lvmService.readVolumeGroup(spec.Name)
+
+	if readStateError != nil {
+		return nil, readStateError
+	}
+
+	var newPhysicalVolumes []string
+	for _, device := range spec.Devices {
+		devicePath, resolveError := lvmService.osClient.EvalSymlinks(device)
+
+		if resolveError != nil {
+			lvmService.logger.Errorf("Failed to resolve volume group device %s: %s", device, resolveError.Error())
+			return nil, resolveError
+		}
+
+		owner, isPhysicalVolume := state.physicalVolumes[devicePath]
+
+		if isPhysicalVolume && owner == spec.Name {
+			// picks up space added by resizing the disk, a no-op otherwise
+			resizeError := lvmService.runLvm("pvresize", devicePath)
+
+			if resizeError != nil {
+				return nil, resizeError
+			}
+			continue
+		} else if isPhysicalVolume && owner != "" {
+			lvmService.logger.Errorf("Device %s already belongs to volume group %s", device, owner)
+			return nil, fmt.Errorf("device %s already belongs to volume group %s", device, owner)
+		}
+
+		if !isPhysicalVolume {
+			createError := lvmService.createPhysicalVolume(devicePath)
+
+			if createError != nil {
+				return nil, createError
+			}
+		}
+		newPhysicalVolumes = append(newPhysicalVolumes, devicePath)
+	}
+
+	if len(newPhysicalVolumes) > 0 {
+		command := "vgextend"
+		if state.extentBytes == 0 {
+			command = "vgcreate"
+		}
+
+		lvmService.logger.Infof("Running %s for volume group %s with %s", command, spec.Name, strings.Join(newPhysicalVolumes, ", "))
+		volumeGroupError := lvmService.runLvm(append([]string{command, spec.Name}, newPhysicalVolumes...)...)
+
+		if volumeGroupError != nil {
+			return nil, volumeGroupError
+		}
+	}
+
+	state, readStateError = lvmService.readVolumeGroup(spec.Name)
+
+	if readStateError != nil {
+		return nil, readStateError
+	}
+
+	changes, planError := planLogicalVolumes(spec.LogicalVolumes, state)
+
+	if planError != nil {
+		lvmService.logger.Errorf("Logical volumes of %s are invalid: %s", spec.Name, planError.Error())
+		return nil, planError
+	}
+
+	var grown []string
+	for _, change := range changes {
+		size := fmt.Sprintf("%db", change.sizeBytes)
+
+		var changeError error
+		if change.create {
+			lvmService.logger.Infof("Creating logical volume %s/%s of %d bytes", spec.Name, change.name, change.sizeBytes)
+			changeError = lvmService.runLvm("lvcreate", "--yes", "--wipesignatures", "y", "--name", change.name, "--size", size, spec.Name)
+		} else {
+			lvmService.logger.Infof("Extending logical volume %s/%s from %d to %d bytes", spec.Name, change.name, state.logicalVolumes[change.name], change.sizeBytes)
+			changeError = lvmService.runLvm("lvextend", "--size", size, fmt.Sprintf("%s/%s", spec.Name, change.name))
+			grown = append(grown, change.name)
+		}
+
+		if changeError != nil {
+			return nil, changeError
+		}
+	}
+
+	return grown, nil
+}
+
+func (lvmService *LvmServiceImpl) createPhysicalVolume(devicePath string) error {
+	existingType, probeError := lvmService.filesystemService.ProbeFileSystem(devicePath)
+
+	if probeError != nil {
+		return probeError
+	}
+
+	if existingType != "" {
+		lvmService.logger.Errorf("Device %s contains %s, refusing to use it as a physical volume", devicePath, existingType)
+		return fmt.Errorf("device %s contains %s, refusing to use it as a physical volume", devicePath, existingType)
+	}
+
+	lvmService.logger.Infof("Creating physical volume on %s", devicePath)
+	return lvmService.runLvm("pvcreate", devicePath)
+}
+
+// readVolumeGroup reports every physical volume along with its group, and the sizes of the named group when it exists
+func (lvmService *LvmServiceImpl) readVolumeGroup(name string) (*volumeGroupState, error) {
+	state := &volumeGroupState{logicalVolumes: map[string]uint64{}, physicalVolumes: map[string]string{}}
+
+	physicalVolumes, reportError := lvmService.report("pvs", "-o", "pv_name,vg_name")
+
+	if reportError != nil {
+		return nil, reportError
+	}
+
+	for _, physicalVolume := range physicalVolumes.Report[0].Pv {
+		state.physicalVolumes[physicalVolume["pv_name"]] = physicalVolume["vg_name"]
+	}
+
+	volumeGroups, reportError := lvmService.report("vgs", "--units", "b", "--nosuffix", "-o", "vg_name,vg_size,vg_free,vg_extent_size")
+
+	if reportError != nil {
+		return nil, reportError
+	}
+
+	for _, volumeGroup := range volumeGroups.Report[0].Vg {
+		if volumeGroup["vg_name"] != name {
+			continue
+		}
+		state.sizeBytes, _ = strconv.ParseUint(volumeGroup["vg_size"], 10, 64)
+		state.freeBytes, _ = strconv.ParseUint(volumeGroup["vg_free"], 10, 64)
+		state.extentBytes, _ = strconv.ParseUint(volumeGroup["vg_extent_size"], 10, 64)
+
+		logicalVolumes, reportError := lvmService.report("lvs", "--units", "b", "--nosuffix", "-o", "lv_name,lv_size", name)
+
+		if reportError != nil {
+			return nil, reportError
+		}
+
+		for _, logicalVolume := range logicalVolumes.Report[0].Lv {
+			state.logicalVolumes[logicalVolume["lv_name"]], _ = strconv.ParseUint(logicalVolume["lv_size"], 10, 64)
+		}
+	}
+
+	return state, nil
+}
+
+func (lvmService *LvmServiceImpl) report(args ...string) (*lvmReport, error) {
+	command := exec.Command(lvmPath, append(args, "--reportformat", "json")...)
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	commandExecutionError := lvmService.osClient.RunCommand(command)
+	outputText := stdout.Bytes()
+
+	if commandExecutionError != nil {
+		lvmService.logger.Errorf("Failed to run lvm %s: %s %s", args[0], commandExecutionError.Error(), stderr.String())
+		return nil, fmt.Errorf("%w %s", commandExecutionError, stderr.String())
+	}
+
+	var parsedReport lvmReport
+	parseError := json.Unmarshal(outputText, &parsedReport)
+
+	if parseError != nil {
+		lvmService.logger.Errorf("Failed to parse lvm %s report: %s", args[0], parseError.Error())
+		return nil, parseError
+	}
+
+	if len(parsedReport.Report) == 0 {
+		return nil, fmt.Errorf("lvm %s returned an empty report", args[0])
+	}
+	return &parsedReport, nil
+}
+
+func (lvmService *LvmServiceImpl) runLvm(args ...string) error {
+	command := exec.Command(lvmPath, args...)
+
+	outputText, commandExecutionError := clients.CombinedOutput(lvmService.osClient, command)
+
+	for _, line := range strings.Split(string(outputText), "\n") {
+		lvmService.logger.Info(line)
+	}
+
+	if commandExecutionError != nil {
+		lvmService.logger.Errorf("Failed to run lvm %s: %s", args[0], commandExecutionError.Error())
+		commandExecutionError = fmt.Errorf("%w %s", commandExecutionError, outputText)
+		return commandExecutionError
+	}
+
+	return nil
+}
+
+// planLogicalVolumes works out which logical volumes to create or extend, sizes are rounded down to whole extents
+// and a volume is only extended by at least one extent
+func planLogicalVolumes(specs []LogicalVolumeSpec, state *volumeGroupState) ([]logicalVolumeChange, error) {
+	if state.extentBytes == 0 {
+		return nil, errors.New("volume group does not exist")
+	}
+
+	var changes []logicalVolumeChange
+	freeBytes := state.freeBytes
+
+	for index, spec := range specs {
+		if !mappedDeviceNamePattern.MatchString(spec.Name) {
+			return nil, fmt.Errorf("invalid logical volume name %q", spec.Name)
+		}
+
+		currentBytes, exists := state.logicalVolumes[spec.Name]
+
+		var targetBytes uint64
+		if spec.Size == "" {
+			if index != len(specs)-1 {
+				return nil, errors.New("only the last logical volume may omit its size")
+			}
+			targetBytes = currentBytes + freeBytes
+		} else {
+			sizeBytes, parseSizeError := parsePartitionSize(spec.Size, state.sizeBytes)
+
+			if parseSizeError != nil {
+				return nil, fmt.Errorf("logical volume %s: %w", spec.Name, parseSizeError)
+			}
+			targetBytes = sizeBytes
+		}
+		targetBytes = targetBytes / state.extentBytes * state.extentBytes
+
+		if exists && targetBytes < currentBytes+state.extentBytes {
+			continue
+		}
+
+		if !exists && targetBytes == 0 {
+			return nil, fmt.Errorf("no space left in the volume group for logical volume %s", spec.Name)
+		}
+
+		if targetBytes-currentBytes > freeBytes {
+			return nil, fmt.Errorf("logical volume %s needs %d bytes but the volume group only has %d free", spec.Name, targetBytes-currentBytes, freeBytes)
+		}
+
+		freeBytes -= targetBytes - currentBytes
+		changes = append(changes, logicalVolumeChange{name: spec.Name, create: !exists, sizeBytes: targetBytes})
+	}
+
+	return changes, nil
+}
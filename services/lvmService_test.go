@@ -0,0 +1,60 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testExtentSize = 4 << 20
+
+func TestPlanLogicalVolumes(t *testing.T) {
+	state := &volumeGroupState{sizeBytes: 100 * testExtentSize, freeBytes: 100 * testExtentSize, extentBytes: testExtentSize, logicalVolumes: map[string]uint64{}}
+
+	changes, planError := planLogicalVolumes([]LogicalVolumeSpec{{Name: "data", Size: "50%"}, {Name: "logs", Size: "10M"}, {Name: "rest"}}, state)
+
+	assert.Nil(t, planError)
+	assert.Equal(t, []logicalVolumeChange{
+		{name: "data", create: true, sizeBytes: 50 * testExtentSize},
+		{name: "logs", create: true, sizeBytes: 2 * testExtentSize},
+		{name: "rest", create: true, sizeBytes: 48 * testExtentSize},
+	}, changes)
+}
+
+func TestPlanLogicalVolumes_extend(t *testing.T) {
+	state := &volumeGroupState{
+		sizeBytes:      200 * testExtentSize,
+		freeBytes:      100 * testExtentSize,
+		extentBytes:    testExtentSize,
+		logicalVolumes: map[string]uint64{"data": 50 * testExtentSize, "rest": 50 * testExtentSize},
+	}
+
+	changes, planError := planLogicalVolumes([]LogicalVolumeSpec{{Name: "data", Size: "25%"}, {Name: "rest"}}, state)
+
+	assert.Nil(t, planError)
+	assert.Equal(t, []logicalVolumeChange{{name: "rest", create: false, sizeBytes: 150 * testExtentSize}}, changes)
+
+	// a volume at its size is left alone
+	state.freeBytes = 0
+	changes, planError = planLogicalVolumes([]LogicalVolumeSpec{{Name: "data", Size: "50"}, {Name: "rest"}}, state)
+
+	assert.Nil(t, planError)
+	assert.Empty(t, changes)
+}
+
+func TestPlanLogicalVolumes_invalid(t *testing.T) {
+	state := &volumeGroupState{sizeBytes: 10 * testExtentSize, freeBytes: 10 * testExtentSize, extentBytes: testExtentSize, logicalVolumes: map[string]uint64{}}
+
+	for _, specs := range [][]LogicalVolumeSpec{
+		{{Name: "data"}, {Name: "logs", Size: "4M"}},
+		{{Name: "data", Size: "1G"}},
+		{{Name: "bad/name", Size: "4M"}},
+		{{Name: "data", Size: "100%"}, {Name: "rest"}},
+	} {
+		_, planError := planLogicalVolumes(specs, state)
+		assert.NotNil(t, planError)
+	}
+
+	_, planError := planLogicalVolumes([]LogicalVolumeSpec{{Name: "data"}}, &volumeGroupState{})
+	assert.NotNil(t, planError)
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+// verifiedFilesystem checks every file read from a config drive against the manifest the drive was verified with, so
+// a drive rewritten after VerifyFilesystem cannot hand out contents that were never verified. Unlisted files are
+// refused when strict and passed through with a warning otherwise
+type verifiedFilesystem struct {
+	logger   *logrus.Logger
+	configs  clients.FileSystemWrapper
+	manifest *ConfigManifest
+	strict   bool
+}
+
+// verifiedFile hashes a listed file as it is streamed and fails the read that reaches its end when the digest does
+// not match the manifest, so a copy of a file changed since verification is abandoned before it is moved into place
+type verifiedFile struct {
+	configs        *verifiedFilesystem
+	file           clients.FileWrapper
+	relativePath   string
+	expectedDigest string
+	hasher         hash.Hash
+}
+
+// VerifiedFilesystem wraps configs so each file is checked against manifest as it is read, a drive without a
+// manifest is returned as it is since VerifyFilesystem only accepts one when not strict
+func (manifestService *ManifestServiceImpl) VerifiedFilesystem(configs clients.FileSystemWrapper, manifest *ConfigManifest) clients.FileSystemWrapper {
+	if manifest == nil {
+		return configs
+	}
+
+	return &verifiedFilesystem{
+		logger:   manifestService.logger,
+		configs:  configs,
+		manifest: manifest,
+		strict:   manifestService.strict || manifest.SignedBy != "",
+	}
+}
+
+func (configs *verifiedFilesystem) OpenFile(filePath string, flag int) (clients.FileWrapper, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, fmt.Errorf("config drive %s is verified and cannot be written to", configs.manifest.Label)
+	}
+
+	relativePath := path.Clean("/" + filePath)[1:]
+	expectedDigest, listed := configs.manifest.Files[relativePath]
+
+	if !listed && relativePath != ManifestFile && relativePath != ManifestSignatureFile {
+		if configs.strict {
+			configs.logger.Errorf("Refusing to read %s from %s, it is not listed in %s", relativePath, configs.manifest.Label, ManifestFile)
+			return nil, fmt.Errorf("%s is not listed in the manifest of config drive %s", relativePath, configs.manifest.Label)
+		}
+		configs.logger.Warnf("Reading %s from %s unverified, it is not listed in %s", relativePath, configs.manifest.Label, ManifestFile)
+		return configs.configs.OpenFile(filePath, flag)
+	} else if !listed {
+		return configs.configs.OpenFile(filePath, flag)
+	}
+
+	file, openFileError := configs.configs.OpenFile(filePath, flag)
+
+	if openFileError != nil {
+		return nil, openFileError
+	}
+	return &verifiedFile{configs: configs, file: file, relativePath: relativePath, expectedDigest: expectedDigest, hasher: sha256.New()}, nil
+}
+
+func (configs *verifiedFilesystem) ReadDir(directory string) ([]os.FileInfo, error) {
+	return configs.configs.ReadDir(directory)
+}
+
+func (configs *verifiedFilesystem) GetFilesystemLabel() string {
+	return configs.configs.GetFilesystemLabel()
+}
+
+func (file *verifiedFile) Read(buffer []byte) (int, error) {
+	readBytes, readError := file.file.Read(buffer)
+	file.hasher.Write(buffer[:readBytes])
+
+	if readError == io.EOF && hex.EncodeToString(file.hasher.Sum(nil)) != file.expectedDigest {
+		configs := file.configs
+		configs.logger.Errorf("%s on %s changed since it was verified against manifest %s", file.relativePath, configs.manifest.Label, configs.manifest.Digest)
+		return readBytes, fmt.Errorf("%s on config drive %s does not match the manifest", file.relativePath, configs.manifest.Label)
+	}
+	return readBytes, readError
+}
+
+func (file *verifiedFile) Write([]byte) (int, error) {
+	return 0, errors.New("verified config files are read only")
+}
+
+// Seek is refused as the digest only covers a file read from start to end
+func (file *verifiedFile) Seek(int64, int) (int64, error) {
+	return 0, errors.New("verified config files can only be read in order")
+}
+
+func (file *verifiedFile) Close() error {
+	return file.file.Close()
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestServiceImpl_VerifiedFilesystem(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	configs := newTestConfigDrive(t, ctrl, "", map[string]string{
+		"haproxy.cfg":  "global",
+		"conf.d/a.cfg": "rewritten after verification",
+		"extra.cfg":    "unlisted",
+	})
+	manifest := &ConfigManifest{Label: "lb-config", Files: map[string]string{
+		"haproxy.cfg":  testDigest("global"),
+		"conf.d/a.cfg": testDigest("backend a"),
+	}}
+	testManifestService, _ := newTestManifestService(false)
+	verified := testManifestService.VerifiedFilesystem(configs, manifest)
+
+	file, openError := verified.OpenFile("/haproxy.cfg", 0)
+	assert.Nil(t, openError)
+	contents, _ := io.ReadAll(file)
+	assert.Equal(t, "global", string(contents))
+
+	// a changed file is streamed and fails once its end is reached
+	file, openError = verified.OpenFile("/conf.d/a.cfg", 0)
+	assert.Nil(t, openError)
+	_, readError := io.ReadAll(file)
+	assert.ErrorContains(t, readError, "does not match the manifest")
+	assert.Nil(t, file.Close())
+
+	_, openError = verified.OpenFile("/haproxy.cfg", os.O_RDWR)
+	assert.NotNil(t, openError)
+
+	// unlisted files are only read when not strict
+	_, openError = verified.OpenFile("/extra.cfg", 0)
+	assert.Nil(t, openError)
+
+	testManifestService.SetStrict(true)
+	verified = testManifestService.VerifiedFilesystem(configs, manifest)
+	_, openError = verified.OpenFile("/extra.cfg", 0)
+	assert.ErrorContains(t, openError, "not listed")
+
+	// drives without a manifest are only accepted when not strict and are read as they are
+	assert.Equal(t, configs, testManifestService.VerifiedFilesystem(configs, nil))
+}
+
+func TestManifestServiceImpl_VerifiedFilesystem_copy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	configs := newTestConfigDrive(t, ctrl, "lb-config", map[string]string{"haproxy.cfg": "rewritten after verification"})
+	manifest := &ConfigManifest{Label: "lb-config", Files: map[string]string{"haproxy.cfg": testDigest("global")}}
+	testManifestService, _ := newTestManifestService(false)
+	destPath := filepath.Join(t.TempDir(), "haproxy.cfg")
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+
+	_, copyError := testFilesystemService.CopySingleFileToRootFs(testManifestService.VerifiedFilesystem(configs, manifest), "haproxy.cfg", destPath)
+
+	// the streamed copy is dropped before it replaces anything
+	assert.ErrorContains(t, copyError, "does not match the manifest")
+	leftovers, _ := os.ReadDir(filepath.Dir(destPath))
+	assert.Empty(t, leftovers)
+}
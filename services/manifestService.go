@@ -0,0 +1,307 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+const ManifestFile = "SHA256SUMS"
+const ManifestMetadataFile = "MANIFEST.json"
+const manifestComponent = "config-manifest"
+
+// ManifestService verifies config drives against the SHA256SUMS manifest at their root, written by sha256sum from the
+// drive's root directory. Drives without a manifest are accepted unless the service is strict, which also refuses
+// files the manifest does not list. With trusted keys loaded the manifest must carry a signature by one of them in
+// SHA256SUMS.sig and is always verified strictly
+type ManifestService interface {
+	initialize(logger *logrus.Logger, osClient clients.OsClient, statusService StatusService)
+	SetStrict(strict bool)
+	LoadTrustedKeys(directory string) error
+	VerifyFilesystem(configs clients.FileSystemWrapper) (*ConfigManifest, error)
+	VerifiedFilesystem(configs clients.FileSystemWrapper, manifest *ConfigManifest) clients.FileSystemWrapper
+}
+
+// ManifestMetadata is read from MANIFEST.json, which has to be listed in the manifest itself
+type ManifestMetadata struct {
+	Revision string    `json:"revision"`
+	Created  time.Time `json:"created"`
+	Source   string    `json:"source"`
+}
+
+// ConfigManifest is a verified manifest, Digest is the sha256 of the manifest file and identifies the config revision
+type ConfigManifest struct {
+	Label    string            `json:"label"`
+	Digest   string            `json:"digest"`
+	Metadata ManifestMetadata  `json:"metadata"`
+	SignedBy string            `json:"signedBy,omitempty"`
+	Files    map[string]string `json:"-"`
+	Verified time.Time         `json:"verified"`
+}
+
+type ManifestServiceImpl struct {
+	logger        *logrus.Logger
+	osClient      clients.OsClient
+	statusService StatusService
+	strict        bool
+	trustedKeys   []TrustedKey
+}
+
+func (manifestService *ManifestServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, statusService StatusService) {
+	manifestService.logger = logger
+	manifestService.osClient = osClient
+	manifestService.statusService = statusService
+	manifestService.strict = false
+	manifestService.trustedKeys = nil
+}
+
+func (manifestService *ManifestServiceImpl) SetStrict(strict bool) {
+	manifestService.strict = strict
+}
+
+// VerifyFilesystem checks the manifest's signature when keys are trusted, that every file listed in the manifest exists
+// and matches its digest, and records the verified manifest in the agent status. It returns nil without a manifest
+// when neither strict nor trusting any keys
+func (manifestService *ManifestServiceImpl) VerifyFilesystem(configs clients.FileSystemWrapper) (*ConfigManifest, error) {
+	label := configs.GetFilesystemLabel()
+	driveFiles, listFilesError := manifestService.listFiles(configs, "")
+
+	if listFilesError != nil {
+		manifestService.logger.Errorf("Failed to list the files of %s: %s", label, listFilesError.Error())
+		return nil, listFilesError
+	}
+
+	if _, hasManifest := driveFiles[ManifestFile]; !hasManifest {
+		if len(manifestService.trustedKeys) > 0 {
+			manifestService.logger.Errorf("%s is not signed, refusing to use it", label)
+			return nil, fmt.Errorf("config drive %s is not signed, it has no %s", label, ManifestFile)
+		} else if manifestService.strict {
+			manifestService.logger.Errorf("%s has no %s, refusing to use it", label, ManifestFile)
+			return nil, fmt.Errorf("config drive %s has no %s", label, ManifestFile)
+		}
+		manifestService.logger.Warnf("%s has no %s, its files are not verified", label, ManifestFile)
+		return nil, nil
+	}
+
+	manifestBytes, readManifestError := readConfigFile(configs, ManifestFile)
+
+	if readManifestError != nil {
+		manifestService.logger.Errorf("Failed to read %s from %s: %s", ManifestFile, label, readManifestError.Error())
+		return nil, readManifestError
+	}
+
+	manifestDigest := sha256.Sum256(manifestBytes)
+	manifest := &ConfigManifest{Label: label, Digest: hex.EncodeToString(manifestDigest[:])}
+
+	if len(manifestService.trustedKeys) > 0 {
+		var verifySignatureError error
+		manifest.SignedBy, verifySignatureError = manifestService.checkSignature(configs, manifestBytes, driveFiles)
+
+		if verifySignatureError != nil {
+			manifestService.logger.Errorf("Refusing config drive %s: %s", label, verifySignatureError.Error())
+			manifestService.statusService.RecordEvent(manifestComponent, fmt.Sprintf("%s rejected: %s", label, verifySignatureError.Error()))
+			return nil, fmt.Errorf("config drive %s: %w", label, verifySignatureError)
+		}
+	}
+
+	var parseError error
+	manifest.Files, parseError = parseManifest(manifestBytes)
+
+	if parseError != nil {
+		manifestService.logger.Errorf("Failed to parse %s on %s: %s", ManifestFile, label, parseError.Error())
+		return nil, parseError
+	}
+
+	verifyError := manifestService.verifyFiles(configs, manifest, driveFiles)
+
+	if verifyError != nil {
+		manifestService.statusService.RecordEvent(manifestComponent, fmt.Sprintf("%s failed verification against manifest %s: %s", label, manifest.Digest, verifyError.Error()))
+		return nil, verifyError
+	}
+
+	if _, hasMetadata := manifest.Files[ManifestMetadataFile]; hasMetadata {
+		metadataBytes, readMetadataError := readConfigFile(configs, ManifestMetadataFile)
+
+		if readMetadataError != nil {
+			return nil, readMetadataError
+		}
+
+		unmarshalError := json.Unmarshal(metadataBytes, &manifest.Metadata)
+
+		if unmarshalError != nil {
+			manifestService.logger.Errorf("Failed to parse %s on %s: %s", ManifestMetadataFile, label, unmarshalError.Error())
+			return nil, unmarshalError
+		}
+	}
+
+	manifest.Verified = time.Now()
+	manifestService.statusService.SetConfigManifest(*manifest)
+	return manifest, nil
+}
+
+// verifyFiles hashes every listed file, a missing or altered file fails verification as does, when strict, a file
+// the manifest does not list
+func (manifestService *ManifestServiceImpl) verifyFiles(configs clients.FileSystemWrapper, manifest *ConfigManifest, driveFiles map[string]bool) error {
+	listedFiles := make([]string, 0, len(manifest.Files))
+	for filePath := range manifest.Files {
+		listedFiles = append(listedFiles, filePath)
+	}
+	sort.Strings(listedFiles)
+
+	for _, filePath := range listedFiles {
+		if !driveFiles[filePath] {
+			manifestService.logger.Errorf("%s is listed in %s but missing from %s", filePath, ManifestFile, manifest.Label)
+			return fmt.Errorf("%s is missing from config drive %s", filePath, manifest.Label)
+		}
+
+		fileDigest, hashError := hashConfigFile(configs, filePath)
+
+		if hashError != nil {
+			manifestService.logger.Errorf("Failed to hash %s on %s: %s", filePath, manifest.Label, hashError.Error())
+			return hashError
+		}
+
+		if fileDigest != manifest.Files[filePath] {
+			manifestService.logger.Errorf("%s on %s has digest %s, the manifest expects %s", filePath, manifest.Label, fileDigest, manifest.Files[filePath])
+			return fmt.Errorf("%s on config drive %s does not match the manifest", filePath, manifest.Label)
+		}
+	}
+
+	for filePath := range driveFiles {
+		if _, listed := manifest.Files[filePath]; listed || filePath == ManifestFile || filePath == ManifestSignatureFile {
+			continue
+		}
+
+		// files outside a signed manifest could be anything
+		if manifestService.strict || manifest.SignedBy != "" {
+			manifestService.logger.Errorf("%s on %s is not listed in %s", filePath, manifest.Label, ManifestFile)
+			return fmt.Errorf("unexpected file %s on config drive %s", filePath, manifest.Label)
+		}
+		manifestService.logger.Warnf("%s on %s is not listed in %s", filePath, manifest.Label, ManifestFile)
+	}
+
+	manifestService.logger.Infof("Verified %d files on %s against manifest %s", len(listedFiles), manifest.Label, manifest.Digest)
+	return nil
+}
+
+// checkSignature verifies SHA256SUMS.sig over the manifest and returns the name of the key that signed it
+func (manifestService *ManifestServiceImpl) checkSignature(configs clients.FileSystemWrapper, manifestBytes []byte, driveFiles map[string]bool) (string, error) {
+	if !driveFiles[ManifestSignatureFile] {
+		return "", fmt.Errorf("the manifest is not signed, %s is missing", ManifestSignatureFile)
+	}
+
+	signatureBytes, readSignatureError := readConfigFile(configs, ManifestSignatureFile)
+
+	if readSignatureError != nil {
+		return "", readSignatureError
+	}
+
+	signedBy, verifyError := manifestService.verifyManifestSignature(manifestBytes, signatureBytes)
+
+	if verifyError != nil {
+		return "", verifyError
+	}
+
+	manifestService.logger.Infof("Manifest on %s is signed by %s", configs.GetFilesystemLabel(), signedBy)
+	return signedBy, nil
+}
+
+// listFiles lists the files beneath directory by their path relative to the drive's root, skipping lost+found
+func (manifestService *ManifestServiceImpl) listFiles(configs clients.FileSystemWrapper, directory string) (map[string]bool, error) {
+	fileInfos, readDirectoryError := configs.ReadDir("/" + directory)
+
+	if readDirectoryError != nil {
+		return nil, readDirectoryError
+	}
+
+	files := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		fileName := fileInfo.Name()
+		if fileName == "." || fileName == ".." || fileName == "lost+found" {
+			continue
+		}
+
+		filePath := path.Join(directory, fileName)
+		if !fileInfo.IsDir() {
+			files[filePath] = true
+			continue
+		}
+
+		childFiles, listChildrenError := manifestService.listFiles(configs, filePath)
+
+		if listChildrenError != nil {
+			return nil, listChildrenError
+		}
+		for childPath := range childFiles {
+			files[childPath] = true
+		}
+	}
+	return files, nil
+}
+
+// parseManifest reads sha256sum output, "<digest>  <path>" with a '*' before the path in binary mode
+func parseManifest(manifestBytes []byte) (map[string]string, error) {
+	files := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(manifestBytes))
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		digest, filePath, found := strings.Cut(line, " ")
+		digest = strings.ToLower(digest)
+		filePath = strings.TrimPrefix(strings.TrimLeft(filePath, " "), "*")
+
+		if _, decodeError := hex.DecodeString(digest); !found || decodeError != nil || len(digest) != sha256.Size*2 || filePath == "" {
+			return nil, fmt.Errorf("line %d of %s is not a sha256 digest and path", lineNumber, ManifestFile)
+		}
+
+		filePath = strings.TrimPrefix(path.Clean("/"+filePath), "/")
+		if _, duplicate := files[filePath]; duplicate {
+			return nil, fmt.Errorf("%s is listed twice in %s", filePath, ManifestFile)
+		}
+		files[filePath] = digest
+	}
+	return files, scanner.Err()
+}
+
+func readConfigFile(configs clients.FileSystemWrapper, filePath string) ([]byte, error) {
+	file, openFileError := configs.OpenFile("/"+filePath, 0)
+
+	if openFileError != nil {
+		return nil, openFileError
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func hashConfigFile(configs clients.FileSystemWrapper, filePath string) (string, error) {
+	file, openFileError := configs.OpenFile("/"+filePath, 0)
+
+	if openFileError != nil {
+		return "", openFileError
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, hashError := io.Copy(hasher, file)
+
+	if hashError != nil {
+		return "", hashError
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
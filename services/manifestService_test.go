@@ -0,0 +1,125 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDigest(contents string) string {
+	digest := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(digest[:])
+}
+
+func newTestManifestService(strict bool) (*ManifestServiceImpl, *StatusServiceImpl) {
+	testStatusService := &StatusServiceImpl{}
+	testStatusService.initialize(&logrus.Logger{})
+	testManifestService := &ManifestServiceImpl{}
+	testManifestService.initialize(&logrus.Logger{}, nil, testStatusService)
+	testManifestService.SetStrict(strict)
+	return testManifestService, testStatusService
+}
+
+func TestParseManifest(t *testing.T) {
+	files, parseError := parseManifest([]byte(fmt.Sprintf("%s  ./haproxy.cfg\n%s *conf.d/a.cfg\n\n", testDigest("a"), strings.ToUpper(testDigest("b")))))
+
+	assert.Nil(t, parseError)
+	assert.Equal(t, map[string]string{"haproxy.cfg": testDigest("a"), "conf.d/a.cfg": testDigest("b")}, files)
+
+	_, parseError = parseManifest([]byte("abc  haproxy.cfg\n"))
+	assert.NotNil(t, parseError)
+
+	_, parseError = parseManifest([]byte(fmt.Sprintf("%s  a\n%s  ./a\n", testDigest("a"), testDigest("a"))))
+	assert.NotNil(t, parseError)
+}
+
+func TestManifestServiceImpl_VerifyFilesystem(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	manifest := fmt.Sprintf("%s  haproxy.cfg\n%s  conf.d/a.cfg\n%s  MANIFEST.json\n", testDigest("global"), testDigest("backend a"), testDigest(`{"revision":"r42"}`))
+	configs := newTestConfigDrive(t, ctrl, "lb-config", map[string]string{
+		"haproxy.cfg":   "global",
+		"conf.d/a.cfg":  "backend a",
+		"MANIFEST.json": `{"revision":"r42"}`,
+		"SHA256SUMS":    manifest,
+	})
+	testManifestService, testStatusService := newTestManifestService(true)
+
+	verifiedManifest, verifyError := testManifestService.VerifyFilesystem(configs)
+
+	assert.Nil(t, verifyError)
+	assert.Equal(t, testDigest(manifest), verifiedManifest.Digest)
+	assert.Equal(t, "r42", verifiedManifest.Metadata.Revision)
+
+	status := testStatusService.GetStatus()
+	assert.Equal(t, testDigest(manifest), status.ConfigManifests["lb-config"].Digest)
+	assert.Contains(t, status.Events[0].Message, testDigest(manifest))
+}
+
+func TestManifestServiceImpl_VerifyFilesystem_mismatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	configs := newTestConfigDrive(t, ctrl, "lb-config", map[string]string{
+		"haproxy.cfg": "tampered",
+		"SHA256SUMS":  fmt.Sprintf("%s  haproxy.cfg\n", testDigest("global")),
+	})
+	testManifestService, testStatusService := newTestManifestService(false)
+
+	_, verifyError := testManifestService.VerifyFilesystem(configs)
+
+	assert.ErrorContains(t, verifyError, "does not match")
+	assert.Empty(t, testStatusService.GetStatus().ConfigManifests)
+}
+
+func TestManifestServiceImpl_VerifyFilesystem_missingFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	configs := newTestConfigDrive(t, ctrl, "lb-config", map[string]string{
+		"SHA256SUMS": fmt.Sprintf("%s  haproxy.cfg\n", testDigest("global")),
+	})
+	testManifestService, _ := newTestManifestService(false)
+
+	_, verifyError := testManifestService.VerifyFilesystem(configs)
+
+	assert.ErrorContains(t, verifyError, "missing")
+}
+
+func TestManifestServiceImpl_VerifyFilesystem_unlistedFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	configs := newTestConfigDrive(t, ctrl, "lb-config", map[string]string{
+		"haproxy.cfg":  "global",
+		"conf.d/x.cfg": "extra",
+		"SHA256SUMS":   fmt.Sprintf("%s  haproxy.cfg\n", testDigest("global")),
+	})
+
+	// extra files are only refused in strict mode
+	testManifestService, _ := newTestManifestService(false)
+	_, verifyError := testManifestService.VerifyFilesystem(configs)
+	assert.Nil(t, verifyError)
+
+	testManifestService.SetStrict(true)
+	_, verifyError = testManifestService.VerifyFilesystem(configs)
+	assert.ErrorContains(t, verifyError, "unexpected file conf.d/x.cfg")
+}
+
+func TestManifestServiceImpl_VerifyFilesystem_noManifest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	configs := newTestConfigDrive(t, ctrl, "lb-config", map[string]string{"haproxy.cfg": "global"})
+
+	testManifestService, _ := newTestManifestService(false)
+	verifiedManifest, verifyError := testManifestService.VerifyFilesystem(configs)
+	assert.Nil(t, verifyError)
+	assert.Nil(t, verifiedManifest)
+
+	testManifestService.SetStrict(true)
+	_, verifyError = testManifestService.VerifyFilesystem(configs)
+	assert.NotNil(t, verifyError)
+}
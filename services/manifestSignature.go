@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ManifestSignatureFile = "SHA256SUMS.sig"
+const DefaultTrustedKeysDirectory = "/etc/zs-vm-agent/trusted-keys"
+
+const minisignUntrustedComment = "untrusted comment:"
+const minisignTrustedComment = "trusted comment: "
+
+// TrustedKey is an ed25519 key config drive manifests may be signed with, minisign keys carry the key id their
+// signatures name
+type TrustedKey struct {
+	Name     string
+	KeyId    []byte
+	Key      ed25519.PublicKey
+	Minisign bool
+}
+
+// LoadTrustedKeys reads the *.pub files of directory, each a minisign public key, an ed25519 PEM public key or a
+// base64 ed25519 key. A missing directory loads no keys, once keys are loaded every config drive must be signed
+func (manifestService *ManifestServiceImpl) LoadTrustedKeys(directory string) error {
+	directoryEntries, readDirectoryError := manifestService.osClient.ReadDir(directory)
+
+	if errors.Is(readDirectoryError, os.ErrNotExist) {
+		manifestService.logger.Debugf("No trusted keys at %s, config drive signatures are not required", directory)
+		manifestService.trustedKeys = nil
+		return nil
+	} else if readDirectoryError != nil {
+		manifestService.logger.Errorf("Failed to read trusted keys from %s: %s", directory, readDirectoryError.Error())
+		return readDirectoryError
+	}
+
+	var trustedKeys []TrustedKey
+	for _, entry := range directoryEntries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pub" {
+			continue
+		}
+
+		keyFile, openKeyError := manifestService.osClient.OpenFile(filepath.Join(directory, entry.Name()))
+
+		if openKeyError != nil {
+			manifestService.logger.Errorf("Failed to open trusted key %s: %s", entry.Name(), openKeyError.Error())
+			return openKeyError
+		}
+
+		keyBytes, readKeyError := io.ReadAll(keyFile)
+		_ = keyFile.Close()
+
+		if readKeyError != nil {
+			manifestService.logger.Errorf("Failed to read trusted key %s: %s", entry.Name(), readKeyError.Error())
+			return readKeyError
+		}
+
+		trustedKey, parseKeyError := parseTrustedKey(entry.Name(), keyBytes)
+
+		if parseKeyError != nil {
+			manifestService.logger.Errorf("Failed to parse trusted key %s: %s", entry.Name(), parseKeyError.Error())
+			return parseKeyError
+		}
+		trustedKeys = append(trustedKeys, *trustedKey)
+	}
+
+	manifestService.logger.Infof("Loaded %d trusted config drive keys from %s", len(trustedKeys), directory)
+	manifestService.trustedKeys = trustedKeys
+	return nil
+}
+
+// verifyManifestSignature checks the manifest was signed by a trusted key and returns the key's name
+func (manifestService *ManifestServiceImpl) verifyManifestSignature(manifestBytes []byte, signatureBytes []byte) (string, error) {
+	lines := nonEmptyLines(signatureBytes)
+
+	if len(lines) == 1 {
+		signature, decodeError := base64.StdEncoding.DecodeString(lines[0])
+
+		if decodeError != nil || len(signature) != ed25519.SignatureSize {
+			return "", fmt.Errorf("%s is not a base64 ed25519 signature", ManifestSignatureFile)
+		}
+
+		for _, trustedKey := range manifestService.trustedKeys {
+			if ed25519.Verify(trustedKey.Key, manifestBytes, signature) {
+				return trustedKey.Name, nil
+			}
+		}
+		return "", fmt.Errorf("%s was not made by a trusted key", ManifestSignatureFile)
+	}
+
+	return manifestService.verifyMinisignSignature(manifestBytes, lines)
+}
+
+// verifyMinisignSignature checks a minisign signature and its signed trusted comment. Only legacy signatures over
+// the manifest itself are supported, the prehashed default needs blake2b
+func (manifestService *ManifestServiceImpl) verifyMinisignSignature(manifestBytes []byte, lines []string) (string, error) {
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], minisignUntrustedComment) || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return "", fmt.Errorf("%s is not a minisign signature", ManifestSignatureFile)
+	}
+
+	signatureBlob, decodeSignatureError := base64.StdEncoding.DecodeString(lines[1])
+	globalSignature, decodeGlobalError := base64.StdEncoding.DecodeString(lines[3])
+
+	if decodeSignatureError != nil || decodeGlobalError != nil || len(signatureBlob) != 10+ed25519.SignatureSize || len(globalSignature) != ed25519.SignatureSize {
+		return "", fmt.Errorf("%s is not a minisign signature", ManifestSignatureFile)
+	}
+
+	algorithm, keyId, signature := string(signatureBlob[:2]), signatureBlob[2:10], signatureBlob[10:]
+
+	if algorithm == "ED" {
+		return "", fmt.Errorf("%s is a prehashed minisign signature, sign the manifest with minisign -S -l", ManifestSignatureFile)
+	} else if algorithm != "Ed" {
+		return "", fmt.Errorf("%s uses unsupported algorithm %q", ManifestSignatureFile, algorithm)
+	}
+
+	for _, trustedKey := range manifestService.trustedKeys {
+		if !trustedKey.Minisign || !bytes.Equal(trustedKey.KeyId, keyId) {
+			continue
+		}
+
+		if !ed25519.Verify(trustedKey.Key, manifestBytes, signature) {
+			return "", fmt.Errorf("%s does not match the manifest", ManifestSignatureFile)
+		}
+
+		trustedComment := strings.TrimPrefix(lines[2], minisignTrustedComment)
+		if !ed25519.Verify(trustedKey.Key, append(append([]byte{}, signature...), trustedComment...), globalSignature) {
+			return "", fmt.Errorf("the trusted comment of %s was altered", ManifestSignatureFile)
+		}
+		return trustedKey.Name, nil
+	}
+	return "", fmt.Errorf("%s was signed by untrusted key %s", ManifestSignatureFile, encodeKeyId(keyId))
+}
+
+func parseTrustedKey(name string, keyBytes []byte) (*TrustedKey, error) {
+	if block, _ := pem.Decode(keyBytes); block != nil {
+		publicKey, parseError := x509.ParsePKIXPublicKey(block.Bytes)
+
+		if parseError != nil {
+			return nil, parseError
+		}
+
+		ed25519Key, isEd25519 := publicKey.(ed25519.PublicKey)
+		if !isEd25519 {
+			return nil, fmt.Errorf("%s is not an ed25519 key", name)
+		}
+		return &TrustedKey{Name: name, Key: ed25519Key}, nil
+	}
+
+	lines := nonEmptyLines(keyBytes)
+	if len(lines) == 2 && strings.HasPrefix(lines[0], minisignUntrustedComment) {
+		keyBlob, decodeError := base64.StdEncoding.DecodeString(lines[1])
+
+		if decodeError != nil || len(keyBlob) != 10+ed25519.PublicKeySize || string(keyBlob[:2]) != "Ed" {
+			return nil, fmt.Errorf("%s is not a minisign public key", name)
+		}
+		return &TrustedKey{Name: name, KeyId: keyBlob[2:10], Key: ed25519.PublicKey(keyBlob[10:]), Minisign: true}, nil
+	}
+
+	if len(lines) == 1 {
+		keyBlob, decodeError := base64.StdEncoding.DecodeString(lines[0])
+
+		if decodeError == nil && len(keyBlob) == ed25519.PublicKeySize {
+			return &TrustedKey{Name: name, Key: ed25519.PublicKey(keyBlob)}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not an ed25519 public key", name)
+}
+
+func nonEmptyLines(contents []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// reverseBytes turns a little endian minisign key id into the form minisign prints
+func reverseBytes(value []byte) []byte {
+	reversed := make([]byte, len(value))
+	for index := range value {
+		reversed[len(value)-1-index] = value[index]
+	}
+	return reversed
+}
+
+func encodeKeyId(keyId []byte) string {
+	return strings.ToUpper(hex.EncodeToString(reverseBytes(keyId)))
+}
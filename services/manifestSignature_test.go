@@ -0,0 +1,128 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMinisignKeyId = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func minisignSignature(privateKey ed25519.PrivateKey, keyId []byte, algorithm string, message []byte) string {
+	signature := ed25519.Sign(privateKey, message)
+	trustedComment := "timestamp:1700000000\tfile:SHA256SUMS"
+	globalSignature := ed25519.Sign(privateKey, append(append([]byte{}, signature...), trustedComment...))
+	return fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), keyId...), signature...)),
+		trustedComment,
+		base64.StdEncoding.EncodeToString(globalSignature))
+}
+
+func newSignedDrive(t *testing.T, ctrl *gomock.Controller, signature func(manifest []byte) string) *clients.MockFileSystemWrapper {
+	manifest := fmt.Sprintf("%s  named.conf\n", testDigest("options {};"))
+	files := map[string]string{"named.conf": "options {};", ManifestFile: manifest}
+	if signature != nil {
+		files[ManifestSignatureFile] = signature([]byte(manifest))
+	}
+	configs := newTestConfigDrive(t, ctrl, "dns-zones", files)
+	return configs
+}
+
+func TestManifestServiceImpl_VerifyFilesystem_signed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherPublicKey, otherPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	testManifestService, _ := newTestManifestService(false)
+	testManifestService.trustedKeys = []TrustedKey{
+		{Name: "other.pub", Key: otherPublicKey},
+		{Name: "release.pub", KeyId: testMinisignKeyId, Key: publicKey, Minisign: true},
+	}
+
+	manifest, verifyError := testManifestService.VerifyFilesystem(newSignedDrive(t, ctrl, func(manifest []byte) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivateKey, manifest))
+	}))
+	assert.Nil(t, verifyError)
+	assert.Equal(t, "other.pub", manifest.SignedBy)
+
+	manifest, verifyError = testManifestService.VerifyFilesystem(newSignedDrive(t, ctrl, func(manifest []byte) string {
+		return minisignSignature(privateKey, testMinisignKeyId, "Ed", manifest)
+	}))
+	assert.Nil(t, verifyError)
+	assert.Equal(t, "release.pub", manifest.SignedBy)
+}
+
+func TestManifestServiceImpl_VerifyFilesystem_rejected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, untrustedPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	testManifestService, testStatusService := newTestManifestService(false)
+	testManifestService.trustedKeys = []TrustedKey{{Name: "release.pub", KeyId: testMinisignKeyId, Key: publicKey, Minisign: true}}
+
+	signatures := map[string]func(manifest []byte) string{
+		"not signed": nil,
+		"was not made by a trusted key": func(manifest []byte) string {
+			return base64.StdEncoding.EncodeToString(ed25519.Sign(untrustedPrivateKey, manifest))
+		},
+		"does not match the manifest": func(manifest []byte) string {
+			return minisignSignature(privateKey, testMinisignKeyId, "Ed", []byte("another manifest"))
+		},
+		"untrusted key 0102030405060708": func(manifest []byte) string {
+			return minisignSignature(untrustedPrivateKey, []byte{8, 7, 6, 5, 4, 3, 2, 1}, "Ed", manifest)
+		},
+		"prehashed": func(manifest []byte) string {
+			return minisignSignature(privateKey, testMinisignKeyId, "ED", manifest)
+		},
+	}
+
+	for expectedError, signature := range signatures {
+		_, verifyError := testManifestService.VerifyFilesystem(newSignedDrive(t, ctrl, signature))
+		assert.ErrorContains(t, verifyError, expectedError)
+	}
+	assert.Empty(t, testStatusService.GetStatus().ConfigManifests)
+
+	// an unsigned drive without a manifest is refused too
+	configs := newTestConfigDrive(t, ctrl, "dns-zones", map[string]string{"named.conf": "options {};"})
+	_, verifyError := testManifestService.VerifyFilesystem(configs)
+	assert.ErrorContains(t, verifyError, "not signed")
+}
+
+func TestManifestServiceImpl_LoadTrustedKeys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	keyDirectory := t.TempDir()
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	pkixKey, _ := x509.MarshalPKIXPublicKey(publicKey)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(keyDirectory, "release.pub"), []byte("untrusted comment: minisign public key 0807060504030201\n"+
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), testMinisignKeyId...), publicKey...))+"\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(keyDirectory, "openssl.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixKey}), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(keyDirectory, "raw.pub"), []byte(base64.StdEncoding.EncodeToString(publicKey)), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(keyDirectory, "README"), []byte("not a key"), 0644))
+
+	testManifestService, _ := newTestManifestService(false)
+	testManifestService.osClient = newTestOsClient(ctrl)
+
+	assert.Nil(t, testManifestService.LoadTrustedKeys(keyDirectory))
+	assert.Equal(t, 3, len(testManifestService.trustedKeys))
+	for _, trustedKey := range testManifestService.trustedKeys {
+		assert.Equal(t, publicKey, trustedKey.Key)
+	}
+
+	assert.Nil(t, testManifestService.LoadTrustedKeys(filepath.Join(keyDirectory, "missing")))
+	assert.Empty(t, testManifestService.trustedKeys)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(keyDirectory, "broken.pub"), []byte("garbage"), 0644))
+	assert.NotNil(t, testManifestService.LoadTrustedKeys(keyDirectory))
+}
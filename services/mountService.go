@@ -0,0 +1,273 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+const systemdUnitDirectory = "/etc/systemd/system"
+const storageComponent = "storage"
+
+// MountService mounts filesystems through generated systemd mount and swap units so they come back on boot without
+// the agent, ordered before the services that use them
+type MountService interface {
+	initialize(logger *logrus.Logger, osClient clients.OsClient, diskService DiskService, filesystemService FileSystemService, systemdService SystemdService, statusService StatusService, encryptionService EncryptionService)
+	PersistMount(devicePath string, mountPath string, filesystem FilesystemSpec, encryption *EncryptionSpec, requiredBy []string) error
+	GrowMount(diskPath string, partitionNumber int, mountPath string, filesystem FilesystemSpec, encryption *EncryptionSpec) error
+	GrowMountedFilesystem(devicePath string, mountPath string, filesystem FilesystemSpec, encryption *EncryptionSpec) error
+}
+
+type MountServiceImpl struct {
+	logger            *logrus.Logger
+	osClient          clients.OsClient
+	diskService       DiskService
+	filesystemService FileSystemService
+	systemdService    SystemdService
+	statusService     StatusService
+	encryptionService EncryptionService
+}
+
+func (mountService *MountServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, diskService DiskService, filesystemService FileSystemService, systemdService SystemdService, statusService StatusService, encryptionService EncryptionService) {
+	mountService.logger = logger
+	mountService.osClient = osClient
+	mountService.diskService = diskService
+	mountService.filesystemService = filesystemService
+	mountService.systemdService = systemdService
+	mountService.statusService = statusService
+	mountService.encryptionService = encryptionService
+}
+
+// PersistMount writes a unit mounting the filesystem on devicePath by uuid at mountPath, starts it and verifies it is
+// active. Services in requiredBy will not start without the mount
+func (mountService *MountServiceImpl) PersistMount(devicePath string, mountPath string, filesystem FilesystemSpec, encryption *EncryptionSpec, requiredBy []string) error {
+	filesystemType := normalizeFilesystemType(filesystem.Type)
+	uuid, readUuidError := mountService.readFilesystemUuid(devicePath, filesystemType)
+
+	if readUuidError != nil {
+		mountService.logger.Errorf("Failed to read the filesystem uuid of %s: %s", devicePath, readUuidError.Error())
+		return readUuidError
+	}
+
+	if filesystemType != "swap" {
+		// fails when another filesystem already occupies mountPath
+		_, checkMountError := mountService.filesystemService.IsMounted(devicePath, mountPath)
+
+		if checkMountError != nil {
+			return checkMountError
+		}
+	}
+
+	// containers keyed from vault only appear once the agent has opened them, so boot must not wait for them
+	bootCritical := encryption == nil || encryption.OpenedAtBoot()
+	unitName, unitContents := renderMountUnit(uuid, mountPath, filesystemType, filesystem.MountOptions, requiredBy, bootCritical)
+	unitPath := filepath.Join(systemdUnitDirectory, unitName)
+
+	unitChanged, writeUnitError := mountService.writeUnit(unitPath, unitContents)
+
+	if writeUnitError != nil {
+		return writeUnitError
+	}
+
+	if unitChanged {
+		reloadError := mountService.systemdService.DaemonReload()
+
+		if reloadError != nil {
+			return reloadError
+		}
+	}
+
+	enableError := mountService.systemdService.EnableService(unitName)
+
+	if enableError != nil {
+		return enableError
+	}
+
+	status, getStatusError := mountService.systemdService.GetServiceStatus(unitName)
+
+	if getStatusError != nil {
+		return getStatusError
+	}
+
+	if status != 1 {
+		mountService.logger.Errorf("Mount unit %s for %s is not active", unitName, devicePath)
+		return fmt.Errorf("mount unit %s for %s is not active", unitName, devicePath)
+	}
+
+	mountService.logger.Infof("Mounted %s through %s", devicePath, unitName)
+	return nil
+}
+
+// GrowMount grows a mounted partition, the LUKS container on it when encrypted, and its filesystem into space added to
+// the disk since it was partitioned. Growth and failures to grow are reported as storage events
+func (mountService *MountServiceImpl) GrowMount(diskPath string, partitionNumber int, mountPath string, filesystem FilesystemSpec, encryption *EncryptionSpec) error {
+	oldSize, newSize, growPartitionError := mountService.diskService.GrowPartition(diskPath, partitionNumber)
+
+	if growPartitionError != nil {
+		mountService.statusService.SetComponentStatus(storageComponent, StateDegraded, fmt.Sprintf("failed to grow %s: %s", mountPath, growPartitionError.Error()))
+		return growPartitionError
+	}
+
+	if newSize == oldSize {
+		return nil
+	}
+
+	growFilesystemError := mountService.GrowMountedFilesystem(mountService.diskService.PartitionDevicePath(diskPath, partitionNumber), mountPath, filesystem, encryption)
+
+	if growFilesystemError != nil {
+		return growFilesystemError
+	}
+
+	message := fmt.Sprintf("grew %s from %d MiB to %d MiB", mountPath, oldSize>>20, newSize>>20)
+	mountService.logger.Info(message)
+	mountService.statusService.RecordEvent(storageComponent, message)
+	return nil
+}
+
+// GrowMountedFilesystem grows the LUKS container on devicePath when encrypted and the filesystem mounted at mountPath
+// to fill a device that has grown
+func (mountService *MountServiceImpl) GrowMountedFilesystem(devicePath string, mountPath string, filesystem FilesystemSpec, encryption *EncryptionSpec) error {
+	if encryption != nil {
+		resizeError := mountService.encryptionService.ResizeEncryptedDevice(*encryption)
+
+		if resizeError != nil {
+			mountService.statusService.SetComponentStatus(storageComponent, StateDegraded, fmt.Sprintf("failed to grow the LUKS container at %s: %s", mountPath, resizeError.Error()))
+			return resizeError
+		}
+		devicePath = encryption.MappedDevicePath()
+	}
+
+	growFilesystemError := mountService.filesystemService.GrowFileSystem(devicePath, mountPath, filesystem.Type)
+
+	if growFilesystemError != nil {
+		mountService.statusService.SetComponentStatus(storageComponent, StateDegraded, fmt.Sprintf("failed to grow the filesystem at %s: %s", mountPath, growFilesystemError.Error()))
+		return growFilesystemError
+	}
+
+	// a grow that failed earlier has now gone through
+	mountService.statusService.SetComponentStatus(storageComponent, StateOk, fmt.Sprintf("%s fills its device", mountPath))
+	return nil
+}
+
+func (mountService *MountServiceImpl) readFilesystemUuid(devicePath string, filesystemType string) (string, error) {
+	device, openDeviceError := mountService.osClient.OpenFile(devicePath)
+
+	if openDeviceError != nil {
+		return "", openDeviceError
+	}
+	defer device.Close()
+
+	return probeFilesystemUuid(device, filesystemType)
+}
+
+// writeUnit writes the unit file unless it already holds the same contents, reporting whether it changed
+func (mountService *MountServiceImpl) writeUnit(unitPath string, unitContents string) (bool, error) {
+	_, statUnitError := mountService.osClient.StatFile(unitPath)
+
+	if statUnitError == nil {
+		existingContents, readUnitError := mountService.filesystemService.ReadFileContents(unitPath)
+
+		if readUnitError != nil {
+			return false, readUnitError
+		}
+
+		if bytes.Equal(existingContents, []byte(unitContents)) {
+			return false, nil
+		}
+	}
+
+	mountService.logger.Infof("Writing mount unit %s", unitPath)
+	writeUnitError := mountService.filesystemService.WriteFileContents(unitPath, []byte(unitContents), 0644)
+
+	if writeUnitError != nil {
+		return false, writeUnitError
+	}
+
+	return true, nil
+}
+
+// renderMountUnit returns the name and contents of the unit mounting the filesystem with the given uuid, swap gets a
+// swap unit named after its by-uuid device instead of a mount unit named after mountPath. Units that are not
+// bootCritical are nofail and neither ordered before nor required by anything, so a device that only the agent can
+// open cannot hold up boot or the services in requiredBy
+func renderMountUnit(uuid string, mountPath string, filesystemType string, mountOptions []string, requiredBy []string, bootCritical bool) (string, string) {
+	devicePath := fmt.Sprintf("/dev/disk/by-uuid/%s", uuid)
+	options := "defaults"
+
+	if len(mountOptions) > 0 {
+		options = strings.Join(mountOptions, ",")
+	}
+
+	if !bootCritical {
+		requiredBy = nil
+		if !slices.Contains(mountOptions, "nofail") {
+			options += ",nofail"
+		}
+	}
+
+	target := "local-fs.target"
+	if filesystemType == "swap" {
+		target = "swap.target"
+	}
+
+	before := requiredBy
+	if bootCritical {
+		before = append([]string{target}, requiredBy...)
+	}
+
+	var unitName, description, section string
+	if filesystemType == "swap" {
+		unitName = escapeSystemdPath(devicePath) + ".swap"
+		description = fmt.Sprintf("Swap on %s", devicePath)
+		section = fmt.Sprintf("[Swap]\nWhat=%s\nOptions=%s\n", devicePath, options)
+	} else {
+		mountPath = filepath.Clean(mountPath)
+		unitName = escapeSystemdPath(mountPath) + ".mount"
+		description = fmt.Sprintf("Mount %s", mountPath)
+		section = fmt.Sprintf("[Mount]\nWhat=%s\nWhere=%s\nType=%s\nOptions=%s\n", devicePath, mountPath, filesystemType, options)
+	}
+
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "# Generated by zs-vm-agent\n[Unit]\nDescription=%s\n", description)
+	if len(before) > 0 {
+		fmt.Fprintf(&unit, "Before=%s\n", strings.Join(before, " "))
+	}
+	fmt.Fprintf(&unit, "\n%s\n[Install]\nWantedBy=%s\n", section, target)
+
+	if len(requiredBy) > 0 {
+		fmt.Fprintf(&unit, "RequiredBy=%s\n", strings.Join(requiredBy, " "))
+	}
+
+	return unitName, unit.String()
+}
+
+// escapeSystemdPath escapes a path into a unit name the way systemd-escape --path does
+func escapeSystemdPath(path string) string {
+	trimmedPath := strings.Trim(filepath.Clean(path), "/")
+
+	if trimmedPath == "" {
+		return "-"
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(trimmedPath); i++ {
+		character := trimmedPath[i]
+
+		switch {
+		case character == '/':
+			escaped.WriteByte('-')
+		case character == '.' && i == 0:
+			escaped.WriteString(`\x2e`)
+		case character >= 'a' && character <= 'z', character >= 'A' && character <= 'Z', character >= '0' && character <= '9', character == ':', character == '_', character == '.':
+			escaped.WriteByte(character)
+		default:
+			fmt.Fprintf(&escaped, `\x%02x`, character)
+		}
+	}
+	return escaped.String()
+}
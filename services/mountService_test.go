@@ -0,0 +1,54 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeSystemdPath(t *testing.T) {
+	assert.Equal(t, "opt-vault", escapeSystemdPath("/opt/vault"))
+	assert.Equal(t, "var-lib-kubelet", escapeSystemdPath("/var/lib/kubelet/"))
+	assert.Equal(t, "-", escapeSystemdPath("/"))
+	assert.Equal(t, `srv-data\x2dbackup-.cache`, escapeSystemdPath("/srv//data-backup/.cache"))
+	assert.Equal(t, `\x2ehidden`, escapeSystemdPath("/.hidden"))
+}
+
+func TestRenderMountUnit(t *testing.T) {
+	unitName, unitContents := renderMountUnit("6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", "/var/lib/kubelet/", "ext4", []string{"noatime", "discard"}, []string{"kubelet.service"}, true)
+
+	assert.Equal(t, "var-lib-kubelet.mount", unitName)
+	assert.Contains(t, unitContents, "Before=local-fs.target kubelet.service\n")
+	assert.Contains(t, unitContents, "What=/dev/disk/by-uuid/6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f\nWhere=/var/lib/kubelet\nType=ext4\nOptions=noatime,discard\n")
+	assert.Contains(t, unitContents, "RequiredBy=kubelet.service\n")
+
+	unitName, unitContents = renderMountUnit("6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", "", "swap", nil, nil, false)
+
+	assert.Equal(t, `dev-disk-by\x2duuid-6f1c2a4e\x2d5b7d\x2d4c1a\x2d9e2f\x2d0a1b2c3d4e5f.swap`, unitName)
+	assert.Contains(t, unitContents, "[Swap]\nWhat=/dev/disk/by-uuid/6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f\nOptions=defaults,nofail\n")
+	assert.NotContains(t, unitContents, "RequiredBy")
+	assert.NotContains(t, unitContents, "Before")
+	assert.Contains(t, unitContents, "WantedBy=swap.target\n")
+
+	// containers opened by the agent must not hold up boot or kubelet while they wait for their key
+	_, unitContents = renderMountUnit("6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", "/var/lib/etcd", "xfs", []string{"noatime"}, []string{"kubelet.service"}, false)
+
+	assert.Contains(t, unitContents, "Options=noatime,nofail\n")
+	assert.NotContains(t, unitContents, "RequiredBy")
+	assert.NotContains(t, unitContents, "Before")
+	assert.Contains(t, unitContents, "WantedBy=local-fs.target\n")
+}
+
+func TestProbeFilesystemUuid(t *testing.T) {
+	device := make([]byte, blockProbeSize)
+	copy(device[32:], []byte{0x6f, 0x1c, 0x2a, 0x4e, 0x5b, 0x7d, 0x4c, 0x1a, 0x9e, 0x2f, 0x0a, 0x1b, 0x2c, 0x3d, 0x4e, 0x5f})
+
+	uuid, probeError := probeFilesystemUuid(bytes.NewReader(device), "xfs")
+
+	assert.Nil(t, probeError)
+	assert.Equal(t, "6f1c2a4e-5b7d-4c1a-9e2f-0a1b2c3d4e5f", uuid)
+
+	_, probeError = probeFilesystemUuid(bytes.NewReader(device), "ext4")
+	assert.NotNil(t, probeError)
+}
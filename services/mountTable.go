@@ -0,0 +1,253 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+const swapsPath = "/proc/swaps"
+
+// MountEntry is a mounted filesystem as listed in /proc/self/mountinfo, Options holds the mount options followed by
+// the superblock options
+type MountEntry struct {
+	Source         string
+	MountPoint     string
+	FilesystemType string
+	Options        []string
+	Major          int
+	Minor          int
+}
+
+// GetMounts lists what is mounted where
+func (filesystemService *FileSystemServiceImpl) GetMounts() ([]MountEntry, error) {
+	mountInfo, openMountInfoError := filesystemService.osClient.OpenFile(mountInfoPath)
+
+	if openMountInfoError != nil {
+		filesystemService.logger.Errorf("Failed to open %s: %s", mountInfoPath, openMountInfoError.Error())
+		return nil, openMountInfoError
+	}
+	defer mountInfo.Close()
+
+	infos, parseError := mountinfo.GetMountsFromReader(mountInfo, nil)
+
+	if parseError != nil {
+		filesystemService.logger.Errorf("Failed to parse %s: %s", mountInfoPath, parseError.Error())
+		return nil, parseError
+	}
+
+	mounts := make([]MountEntry, 0, len(infos))
+	for _, info := range infos {
+		options := strings.Split(info.Options, ",")
+		if info.VFSOptions != "" {
+			options = append(options, strings.Split(info.VFSOptions, ",")...)
+		}
+
+		mounts = append(mounts, MountEntry{
+			Source:         info.Source,
+			MountPoint:     info.Mountpoint,
+			FilesystemType: info.FSType,
+			Options:        options,
+			Major:          info.Major,
+			Minor:          info.Minor,
+		})
+	}
+	return mounts, nil
+}
+
+// DeviceMounts lists the mounts of the filesystem on devicePath
+func (filesystemService *FileSystemServiceImpl) DeviceMounts(devicePath string) ([]MountEntry, error) {
+	mounts, getMountsError := filesystemService.GetMounts()
+
+	if getMountsError != nil {
+		return nil, getMountsError
+	}
+
+	var deviceMounts []MountEntry
+	for _, entry := range mounts {
+		if filesystemService.isMountOfDevice(entry, devicePath) {
+			deviceMounts = append(deviceMounts, entry)
+		}
+	}
+	return deviceMounts, nil
+}
+
+// IsMounted reports whether the filesystem on devicePath is mounted at mountPath. A different filesystem mounted at
+// mountPath is an error rather than a reason to mount over it
+func (filesystemService *FileSystemServiceImpl) IsMounted(devicePath string, mountPath string) (bool, error) {
+	mounts, getMountsError := filesystemService.GetMounts()
+
+	if getMountsError != nil {
+		return false, getMountsError
+	}
+
+	mountPath = filepath.Clean(mountPath)
+
+	// the last mount of a path hides the ones beneath it
+	for index := len(mounts) - 1; index >= 0; index-- {
+		if mounts[index].MountPoint != mountPath {
+			continue
+		}
+
+		if filesystemService.isMountOfDevice(mounts[index], devicePath) {
+			return true, nil
+		}
+
+		filesystemService.logger.Errorf("%s holds %s from %s, expected %s", mountPath, mounts[index].FilesystemType, mounts[index].Source, devicePath)
+		return false, fmt.Errorf("%s holds %s from %s, expected %s", mountPath, mounts[index].FilesystemType, mounts[index].Source, devicePath)
+	}
+	return false, nil
+}
+
+// isSwapActive reports whether the swap on devicePath is listed in /proc/swaps
+func (filesystemService *FileSystemServiceImpl) isSwapActive(devicePath string) (bool, error) {
+	swaps, openSwapsError := filesystemService.osClient.OpenFile(swapsPath)
+
+	if openSwapsError != nil {
+		filesystemService.logger.Errorf("Failed to open %s: %s", swapsPath, openSwapsError.Error())
+		return false, openSwapsError
+	}
+	defer swaps.Close()
+
+	contents, readError := io.ReadAll(swaps)
+
+	if readError != nil {
+		filesystemService.logger.Errorf("Failed to read %s: %s", swapsPath, readError.Error())
+		return false, readError
+	}
+
+	// the first line names the columns, the file name comes first with whitespace escaped as octal
+	lines := strings.Split(string(contents), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if filesystemService.isMountOfDevice(MountEntry{Source: unescapeOctal(fields[0])}, devicePath) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unescapeOctal decodes the \ooo escapes the kernel writes in place of whitespace and backslashes in paths
+func unescapeOctal(text string) string {
+	var unescaped strings.Builder
+	for index := 0; index < len(text); index++ {
+		if text[index] == '\\' && index+4 <= len(text) {
+			if value, parseError := strconv.ParseUint(text[index+1:index+4], 8, 8); parseError == nil {
+				unescaped.WriteByte(byte(value))
+				index += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(text[index])
+	}
+	return unescaped.String()
+}
+
+// PartitionDisk partitions a disk as layout declares, or gives it a single partition when it has none and layout is
+// nil. A disk that cannot be opened exclusively is left alone when mountedDevice is already mounted at mountPath
+func (filesystemService *FileSystemServiceImpl) PartitionDisk(diskPath string, layout *DiskLayout, wipe bool, mountedDevice string, mountPath string) error {
+	dataDrive, getDiskError := filesystemService.diskService.GetDisk(diskPath)
+	if getDiskError != nil && strings.Contains(getDiskError.Error(), "device or resource busy") {
+		return filesystemService.skipBusyDisk(diskPath, mountedDevice, mountPath)
+	} else if getDiskError != nil {
+		return getDiskError
+	}
+
+	partTable, getPartTableError := dataDrive.GetPartitionTable()
+
+	// the disk is opened exclusively so it has to be closed before it can be partitioned
+	closeDiskError := dataDrive.Close()
+
+	if closeDiskError != nil {
+		filesystemService.logger.Errorf("Failed to close disk %s: %s", diskPath, closeDiskError.Error())
+		return closeDiskError
+	}
+
+	if layout != nil {
+		return filesystemService.diskService.ApplyLayout(diskPath, *layout, wipe)
+	} else if (getPartTableError != nil && strings.Contains(getPartTableError.Error(), "unknown disk partition type")) || (getPartTableError == nil && len(partTable.GetPartitions()) == 0) {
+		filesystemService.logger.Debugf("No Partitions found for %s, creating...", diskPath)
+		createDiskPartitionError := filesystemService.diskService.CreatePartition(diskPath)
+
+		if createDiskPartitionError != nil {
+			filesystemService.logger.Errorf("Failed to create partition for disk %s: %s", diskPath, createDiskPartitionError.Error())
+			return createDiskPartitionError
+		}
+	} else if getPartTableError != nil {
+		filesystemService.logger.Errorf("Failed to get Partition Table from disk %s: %s", diskPath, getPartTableError.Error())
+		return getPartTableError
+	}
+
+	return nil
+}
+
+// skipBusyDisk lets a disk that cannot be opened exclusively go unpartitioned only when its filesystem on devicePath is
+// already mounted at mountPath, a disk that is busy for any other reason is an error
+func (filesystemService *FileSystemServiceImpl) skipBusyDisk(diskPath string, devicePath string, mountPath string) error {
+	mounted, checkMountError := filesystemService.IsMounted(devicePath, mountPath)
+
+	if checkMountError != nil {
+		return checkMountError
+	}
+
+	if mounted {
+		filesystemService.logger.Infof("Disk %s is in use by its mount at %s, skipping partitioning", diskPath, mountPath)
+		return nil
+	}
+
+	deviceMounts, getMountsError := filesystemService.DeviceMounts(devicePath)
+
+	if getMountsError != nil {
+		return getMountsError
+	}
+
+	if len(deviceMounts) > 0 {
+		filesystemService.logger.Errorf("Disk %s is busy, %s is mounted at %s instead of %s", diskPath, devicePath, deviceMounts[0].MountPoint, mountPath)
+		return fmt.Errorf("disk %s is busy, %s is mounted at %s instead of %s", diskPath, devicePath, deviceMounts[0].MountPoint, mountPath)
+	}
+
+	filesystemService.logger.Errorf("Disk %s is busy but %s is not mounted, another process holds it", diskPath, devicePath)
+	return fmt.Errorf("disk %s is busy but %s is not mounted, another process holds it", diskPath, devicePath)
+}
+
+// isMountOfDevice matches a mount to a device by device number, falling back to the resolved source path for
+// filesystems such as btrfs that report an anonymous device number
+func (filesystemService *FileSystemServiceImpl) isMountOfDevice(entry MountEntry, devicePath string) bool {
+	resolvedDevice, resolveDeviceError := filesystemService.osClient.EvalSymlinks(devicePath)
+
+	if resolveDeviceError != nil {
+		resolvedDevice = filepath.Clean(devicePath)
+	}
+
+	resolvedSource, resolveSourceError := filesystemService.osClient.EvalSymlinks(entry.Source)
+
+	if resolveSourceError != nil {
+		resolvedSource = filepath.Clean(entry.Source)
+	}
+
+	if resolvedSource == resolvedDevice {
+		return true
+	}
+
+	deviceInfo, statDeviceError := filesystemService.osClient.StatFile(resolvedDevice)
+
+	if statDeviceError != nil || deviceInfo.Mode()&os.ModeDevice == 0 {
+		return false
+	}
+
+	stat, isStat := deviceInfo.Sys().(*syscall.Stat_t)
+
+	return isStat && entry.Major != 0 && int(unix.Major(uint64(stat.Rdev))) == entry.Major && int(unix.Minor(uint64(stat.Rdev))) == entry.Minor
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMountInfo = `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/rl-root rw,attr2,inode64
+65 22 8:17 / /var/lib/kubelet rw,noatime shared:30 - ext4 /dev/sdb1 rw,discard
+66 22 8:33 / /var/lib/etcd rw,relatime shared:31 - xfs /dev/sdc1 rw
+67 66 0:45 / /var/lib/etcd rw,relatime shared:32 - tmpfs tmpfs rw,size=65536k
+`
+
+func newMountTableService(t *testing.T, ctrl *gomock.Controller) *FileSystemServiceImpl {
+	mountInfoPath := filepath.Join(t.TempDir(), "mountinfo")
+	assert.Nil(t, os.WriteFile(mountInfoPath, []byte(testMountInfo), 0600))
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().OpenFile(gomock.Any()).DoAndReturn(func(string) (*os.File, error) { return os.Open(mountInfoPath) }).AnyTimes()
+	mockOsClient.EXPECT().StatFile(gomock.Any()).DoAndReturn(os.Stat).AnyTimes()
+	mockOsClient.EXPECT().EvalSymlinks(gomock.Any()).DoAndReturn(filepath.EvalSymlinks).AnyTimes()
+	return &FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+}
+
+func TestFileSystemServiceImpl_GetMounts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	testFilesystemService := newMountTableService(t, ctrl)
+
+	mounts, getMountsError := testFilesystemService.GetMounts()
+
+	assert.Nil(t, getMountsError)
+	assert.Equal(t, 4, len(mounts))
+	assert.Equal(t, MountEntry{
+		Source:         "/dev/sdb1",
+		MountPoint:     "/var/lib/kubelet",
+		FilesystemType: "ext4",
+		Options:        []string{"rw", "noatime", "rw", "discard"},
+		Major:          8,
+		Minor:          17,
+	}, mounts[1])
+}
+
+func TestFileSystemServiceImpl_IsMounted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	testFilesystemService := newMountTableService(t, ctrl)
+
+	mounted, checkMountError := testFilesystemService.IsMounted("/dev/sdb1", "/var/lib/kubelet/")
+	assert.Nil(t, checkMountError)
+	assert.True(t, mounted)
+
+	mounted, checkMountError = testFilesystemService.IsMounted("/dev/sdd1", "/opt/vault")
+	assert.Nil(t, checkMountError)
+	assert.False(t, mounted)
+
+	// another device on the target is refused
+	_, checkMountError = testFilesystemService.IsMounted("/dev/sdd1", "/var/lib/kubelet")
+	assert.NotNil(t, checkMountError)
+
+	// the tmpfs mounted over etcd's disk hides it
+	_, checkMountError = testFilesystemService.IsMounted("/dev/sdc1", "/var/lib/etcd")
+	assert.NotNil(t, checkMountError)
+
+	deviceMounts, getMountsError := testFilesystemService.DeviceMounts("/dev/sdc1")
+	assert.Nil(t, getMountsError)
+	assert.Equal(t, 1, len(deviceMounts))
+	assert.Equal(t, "/var/lib/etcd", deviceMounts[0].MountPoint)
+}
+
+func TestFileSystemServiceImpl_skipBusyDisk(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	testFilesystemService := newMountTableService(t, ctrl)
+
+	assert.Nil(t, testFilesystemService.skipBusyDisk("/dev/sdb", "/dev/sdb1", "/var/lib/kubelet"))
+
+	// busy through a mount elsewhere
+	skipError := testFilesystemService.skipBusyDisk("/dev/sdc", "/dev/sdc1", "/opt/vault")
+	assert.ErrorContains(t, skipError, "mounted at /var/lib/etcd")
+
+	// busy without being mounted at all
+	skipError = testFilesystemService.skipBusyDisk("/dev/sdd", "/dev/sdd1", "/opt/vault")
+	assert.ErrorContains(t, skipError, "another process holds it")
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Ownership is a resolved owner spec, an id of -1 is left as it is
+type Ownership struct {
+	Uid int
+	Gid int
+}
+
+// ResolveOwnership resolves an owner spec the way chown takes it: "user" keeps the group, "user:group" sets both,
+// "user:" sets the user's login group and ":group" only the group. Users and groups may be names or numeric ids
+func (filesystemService *FileSystemServiceImpl) ResolveOwnership(spec string) (Ownership, error) {
+	owner, group, hasGroup := strings.Cut(spec, ":")
+	ownership := Ownership{Uid: -1, Gid: -1}
+
+	if owner == "" && group == "" {
+		return ownership, fmt.Errorf("owner spec %q names neither a user nor a group", spec)
+	}
+
+	if owner != "" {
+		uid, loginGid, lookupUserError := filesystemService.lookupUser(owner)
+
+		if lookupUserError != nil {
+			return ownership, lookupUserError
+		}
+		ownership.Uid = uid
+
+		if hasGroup && group == "" {
+			if loginGid == -1 {
+				return ownership, fmt.Errorf("cannot use the login group of numeric user %s", owner)
+			}
+			ownership.Gid = loginGid
+		}
+	}
+
+	if group != "" {
+		gid, lookupGroupError := filesystemService.lookupGroup(group)
+
+		if lookupGroupError != nil {
+			return ownership, lookupGroupError
+		}
+		ownership.Gid = gid
+	}
+	return ownership, nil
+}
+
+// lookupUser returns the uid of a user name or numeric id and, for names, the user's login group
+func (filesystemService *FileSystemServiceImpl) lookupUser(owner string) (int, int, error) {
+	if uid, parseError := strconv.Atoi(owner); parseError == nil && uid >= 0 {
+		return uid, -1, nil
+	}
+
+	ownerUser, getUserError := filesystemService.userClient.GetUserByName(owner)
+
+	if getUserError != nil {
+		filesystemService.logger.Errorf("Failed to retrieve UID for user %s: %s", owner, getUserError.Error())
+		return 0, 0, getUserError
+	}
+
+	uid, uidConversionError := strconv.Atoi(ownerUser.Uid)
+
+	if uidConversionError != nil {
+		filesystemService.logger.Errorf("Failed to convert uid string %s to integer: %s", ownerUser.Uid, uidConversionError)
+		return 0, 0, uidConversionError
+	}
+
+	loginGid, gidConversionError := strconv.Atoi(ownerUser.Gid)
+
+	if gidConversionError != nil {
+		loginGid = -1
+	}
+	return uid, loginGid, nil
+}
+
+// lookupGroup returns the gid of a group name or numeric id
+func (filesystemService *FileSystemServiceImpl) lookupGroup(group string) (int, error) {
+	if gid, parseError := strconv.Atoi(group); parseError == nil && gid >= 0 {
+		return gid, nil
+	}
+
+	ownerGroup, getGroupError := filesystemService.userClient.GetGroupByName(group)
+
+	if getGroupError != nil {
+		filesystemService.logger.Errorf("Failed to retrieve GID for group %s: %s", group, getGroupError.Error())
+		return 0, getGroupError
+	}
+
+	gid, gidConversionError := strconv.Atoi(ownerGroup.Gid)
+
+	if gidConversionError != nil {
+		filesystemService.logger.Errorf("Failed to convert gid string %s to integer: %s", ownerGroup.Gid, gidConversionError)
+		return 0, gidConversionError
+	}
+	return gid, nil
+}
+
+// setOwnership changes the owner of path, and of everything beneath it when recursive, without following symlinks.
+// Paths that already have the owner are skipped, it returns how many paths changed
+func (filesystemService *FileSystemServiceImpl) setOwnership(path string, ownership Ownership, recursive bool) (int, error) {
+	fileInfo, getFileInfoError := filesystemService.osClient.LstatFile(path)
+
+	if getFileInfoError != nil {
+		filesystemService.logger.Errorf("Failed to retrieve %s before updating ownership: %s", path, getFileInfoError.Error())
+		return 0, getFileInfoError
+	}
+
+	changed := 0
+	if fileInfo.IsDir() && recursive {
+		directoryEntries, readDirectoryError := filesystemService.osClient.ReadDir(path)
+
+		if readDirectoryError != nil {
+			filesystemService.logger.Errorf("Failed to read directory for recursive ownership change %s: %s", path, readDirectoryError)
+			return changed, readDirectoryError
+		}
+
+		for _, entry := range directoryEntries {
+			entryChanged, setOwnerError := filesystemService.setOwnership(strings.ReplaceAll(fmt.Sprintf("%s/%s", path, entry.Name()), "//", "/"), ownership, recursive)
+			changed += entryChanged
+
+			if setOwnerError != nil {
+				return changed, setOwnerError
+			}
+		}
+	}
+
+	if fileStat, isStat := fileInfo.Sys().(*syscall.Stat_t); isStat &&
+		(ownership.Uid == -1 || ownership.Uid == int(fileStat.Uid)) && (ownership.Gid == -1 || ownership.Gid == int(fileStat.Gid)) {
+		return changed, nil
+	}
+
+	setOwnerError := filesystemService.osClient.SetLinkOwner(path, ownership.Uid, ownership.Gid)
+
+	if setOwnerError != nil {
+		filesystemService.logger.Errorf("Failed to set owner for %s: %s", path, setOwnerError)
+		return changed, setOwnerError
+	}
+	return changed + 1, nil
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const aclAccessXattr = "system.posix_acl_access"
+const aclDefaultXattr = "system.posix_acl_default"
+
+// the xattr form of an ACL is a version header followed by tag, permission and id for each entry, little endian
+const aclXattrVersion = 2
+const aclXattrHeaderSize = 4
+const aclXattrEntrySize = 8
+const aclUndefinedId = 0xffffffff
+
+// aclConditionalExecute is setfacl's X, execute that is only granted on directories and on files that already have
+// an execute bit
+const aclConditionalExecute os.FileMode = 010
+
+type AclTag uint16
+
+const (
+	AclUserObj  AclTag = 0x01
+	AclUser     AclTag = 0x02
+	AclGroupObj AclTag = 0x04
+	AclGroup    AclTag = 0x08
+	AclMask     AclTag = 0x10
+	AclOther    AclTag = 0x20
+)
+
+var aclTagNames = map[AclTag]string{
+	AclUserObj:  "user",
+	AclUser:     "user",
+	AclGroupObj: "group",
+	AclGroup:    "group",
+	AclMask:     "mask",
+	AclOther:    "other",
+}
+
+// AclEntry is one entry of a POSIX ACL in setfacl's text form, such as "user:prometheus:r--" or
+// "default:group:wheel:rwx". The qualifier of a named entry is a name or a numeric id, default entries only apply to
+// directories and are inherited by what is created in them
+type AclEntry struct {
+	Default   bool
+	Tag       AclTag
+	Qualifier string
+	Perms     os.FileMode
+}
+
+// ParseAclEntry reads an entry in setfacl's text form, tags may be abbreviated to their first letter and permissions
+// given as letters or an octal digit. X is kept as aclConditionalExecute and resolved against the file it is set on
+func ParseAclEntry(text string) (AclEntry, error) {
+	entry := AclEntry{}
+	fields := strings.Split(strings.TrimSpace(text), ":")
+
+	if len(fields) > 0 && (fields[0] == "default" || fields[0] == "d") {
+		entry.Default = true
+		fields = fields[1:]
+	}
+
+	// mask and other have no qualifier, setfacl accepts them with or without the empty field
+	if len(fields) == 2 {
+		fields = []string{fields[0], "", fields[1]}
+	}
+
+	if len(fields) != 3 {
+		return entry, fmt.Errorf("ACL entry %q is not of the form tag:qualifier:perms", text)
+	}
+
+	switch fields[0] {
+	case "user", "u":
+		entry.Tag = AclUserObj
+		if fields[1] != "" {
+			entry.Tag = AclUser
+		}
+	case "group", "g":
+		entry.Tag = AclGroupObj
+		if fields[1] != "" {
+			entry.Tag = AclGroup
+		}
+	case "mask", "m":
+		entry.Tag = AclMask
+	case "other", "o":
+		entry.Tag = AclOther
+	default:
+		return entry, fmt.Errorf("ACL entry %q has unknown tag %s", text, fields[0])
+	}
+
+	if (entry.Tag == AclMask || entry.Tag == AclOther) && fields[1] != "" {
+		return entry, fmt.Errorf("ACL entry %q cannot name a user or group", text)
+	}
+	entry.Qualifier = fields[1]
+
+	perms, parsePermsError := parseAclPerms(fields[2])
+
+	if parsePermsError != nil {
+		return entry, fmt.Errorf("ACL entry %q: %w", text, parsePermsError)
+	}
+	entry.Perms = perms
+	return entry, nil
+}
+
+func (entry AclEntry) String() string {
+	prefix := ""
+	if entry.Default {
+		prefix = "default:"
+	}
+
+	perms := []byte("---")
+	for index, letter := range "rwx" {
+		if entry.Perms&(4>>index) != 0 {
+			perms[index] = byte(letter)
+		}
+	}
+	if entry.Perms&1 == 0 && entry.Perms&aclConditionalExecute != 0 {
+		perms[2] = 'X'
+	}
+	return fmt.Sprintf("%s%s:%s:%s", prefix, aclTagNames[entry.Tag], entry.Qualifier, perms)
+}
+
+func (entry AclEntry) MarshalText() ([]byte, error) {
+	return []byte(entry.String()), nil
+}
+
+func (entry *AclEntry) UnmarshalText(text []byte) error {
+	parsedEntry, parseError := ParseAclEntry(string(text))
+
+	if parseError != nil {
+		return parseError
+	}
+	*entry = parsedEntry
+	return nil
+}
+
+func parseAclPerms(text string) (os.FileMode, error) {
+	if octal, parseError := strconv.ParseUint(text, 8, 3); parseError == nil && len(text) == 1 {
+		return os.FileMode(octal), nil
+	}
+
+	var perms os.FileMode
+	for _, letter := range text {
+		switch letter {
+		case 'r':
+			perms |= 4
+		case 'w':
+			perms |= 2
+		case 'x':
+			perms |= 1
+		case 'X':
+			perms |= aclConditionalExecute
+		case '-':
+		default:
+			return 0, fmt.Errorf("%q are not permissions", text)
+		}
+	}
+	return perms, nil
+}
+
+// resolvedAclPerms are the permissions entry grants on a file, X only grants execute when executable
+func resolvedAclPerms(entry AclEntry, executable bool) os.FileMode {
+	perms := entry.Perms & 7
+	if entry.Perms&aclConditionalExecute != 0 && executable {
+		perms |= 1
+	}
+	return perms
+}
+
+// aclXattrEntry is an entry whose qualifier has been resolved to an id
+type aclXattrEntry struct {
+	tag   AclTag
+	perms os.FileMode
+	id    uint32
+}
+
+// encodeAcl completes an ACL the way setfacl does, the owner, group and other entries missing from it are taken from
+// mode and a missing mask is the union of the group class, and encodes it for the kernel
+func encodeAcl(entries []aclXattrEntry, mode os.FileMode) ([]byte, error) {
+	byTag := map[AclTag]bool{}
+	seen := map[aclXattrEntry]bool{}
+	groupClass := os.FileMode(0)
+	for _, entry := range entries {
+		key := aclXattrEntry{tag: entry.tag, id: entry.id}
+		if seen[key] {
+			return nil, fmt.Errorf("ACL has more than one %s entry for id %d", aclTagNames[entry.tag], entry.id)
+		}
+		seen[key] = true
+		byTag[entry.tag] = true
+
+		if entry.tag == AclUser || entry.tag == AclGroupObj || entry.tag == AclGroup {
+			groupClass |= entry.perms
+		}
+	}
+
+	completed := append([]aclXattrEntry{}, entries...)
+	baseEntries := []aclXattrEntry{
+		{tag: AclUserObj, perms: (mode >> 6) & 7, id: aclUndefinedId},
+		{tag: AclGroupObj, perms: (mode >> 3) & 7, id: aclUndefinedId},
+		{tag: AclOther, perms: mode & 7, id: aclUndefinedId},
+	}
+	for _, baseEntry := range baseEntries {
+		if !byTag[baseEntry.tag] {
+			completed = append(completed, baseEntry)
+			if baseEntry.tag == AclGroupObj {
+				groupClass |= baseEntry.perms
+			}
+		}
+	}
+
+	if !byTag[AclMask] && (byTag[AclUser] || byTag[AclGroup]) {
+		completed = append(completed, aclXattrEntry{tag: AclMask, perms: groupClass, id: aclUndefinedId})
+	}
+
+	// the kernel only accepts entries ordered by tag and then id
+	sort.Slice(completed, func(i, j int) bool {
+		if completed[i].tag != completed[j].tag {
+			return completed[i].tag < completed[j].tag
+		}
+		return completed[i].id < completed[j].id
+	})
+
+	encoded := make([]byte, aclXattrHeaderSize+aclXattrEntrySize*len(completed))
+	binary.LittleEndian.PutUint32(encoded, aclXattrVersion)
+	for index, entry := range completed {
+		offset := aclXattrHeaderSize + aclXattrEntrySize*index
+		binary.LittleEndian.PutUint16(encoded[offset:], uint16(entry.tag))
+		binary.LittleEndian.PutUint16(encoded[offset+2:], uint16(entry.perms))
+		binary.LittleEndian.PutUint32(encoded[offset+4:], entry.id)
+	}
+	return encoded, nil
+}
+
+// decodeAcl reads an ACL xattr, named entries are qualified by their numeric id
+func decodeAcl(encoded []byte, isDefault bool) ([]AclEntry, error) {
+	if len(encoded) < aclXattrHeaderSize || (len(encoded)-aclXattrHeaderSize)%aclXattrEntrySize != 0 ||
+		binary.LittleEndian.Uint32(encoded) != aclXattrVersion {
+		return nil, fmt.Errorf("ACL xattr is not a version %d ACL", aclXattrVersion)
+	}
+
+	var entries []AclEntry
+	for offset := aclXattrHeaderSize; offset < len(encoded); offset += aclXattrEntrySize {
+		tag := AclTag(binary.LittleEndian.Uint16(encoded[offset:]))
+
+		if _, knownTag := aclTagNames[tag]; !knownTag {
+			return nil, fmt.Errorf("ACL xattr has unknown tag %#x", uint16(tag))
+		}
+
+		entry := AclEntry{Default: isDefault, Tag: tag, Perms: os.FileMode(binary.LittleEndian.Uint16(encoded[offset+2:]) & 7)}
+		if tag == AclUser || tag == AclGroup {
+			entry.Qualifier = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(encoded[offset+4:])), 10)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
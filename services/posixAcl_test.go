@@ -0,0 +1,115 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAclEntry(t *testing.T) {
+	for text, expected := range map[string]AclEntry{
+		"user:prometheus:r--":   {Tag: AclUser, Qualifier: "prometheus", Perms: 4},
+		"u::rw-":                {Tag: AclUserObj, Perms: 6},
+		"g:wheel:5":             {Tag: AclGroup, Qualifier: "wheel", Perms: 5},
+		"group::r":              {Tag: AclGroupObj, Perms: 4},
+		"mask::rwx":             {Tag: AclMask, Perms: 7},
+		"o:---":                 {Tag: AclOther},
+		"default:user:1000:rwX": {Default: true, Tag: AclUser, Qualifier: "1000", Perms: 6 | aclConditionalExecute},
+		"d:other::r-x":          {Default: true, Tag: AclOther, Perms: 5},
+	} {
+		entry, parseError := ParseAclEntry(text)
+		assert.Nil(t, parseError, text)
+		assert.Equal(t, expected, entry, text)
+	}
+
+	for _, text := range []string{"user", "owner:alice:r--", "mask:alice:r--", "user:alice:rwz", "user:alice:r:x"} {
+		_, parseError := ParseAclEntry(text)
+		assert.NotNil(t, parseError, text)
+	}
+}
+
+func TestResolvedAclPerms(t *testing.T) {
+	entry, _ := ParseAclEntry("group:wheel:rX")
+
+	assert.Equal(t, "group:wheel:r-X", entry.String())
+	assert.Equal(t, os.FileMode(5), resolvedAclPerms(entry, true))
+	assert.Equal(t, os.FileMode(4), resolvedAclPerms(entry, false))
+
+	entry, _ = ParseAclEntry("group:wheel:rxX")
+	assert.Equal(t, os.FileMode(5), resolvedAclPerms(entry, false))
+}
+
+func TestAclEntry_json(t *testing.T) {
+	var attributes FileAttributes
+	unmarshalError := json.Unmarshal([]byte(`{"acl": ["user:prometheus:r", "d:g:wheel:rx"]}`), &attributes)
+
+	assert.Nil(t, unmarshalError)
+	assert.Equal(t, []AclEntry{{Tag: AclUser, Qualifier: "prometheus", Perms: 4}, {Default: true, Tag: AclGroup, Qualifier: "wheel", Perms: 5}}, attributes.Acl)
+
+	marshalled, marshalError := json.Marshal(attributes.Acl)
+	assert.Nil(t, marshalError)
+	assert.Equal(t, `["user:prometheus:r--","default:group:wheel:r-x"]`, string(marshalled))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"acl": ["user:prometheus"]}`), &attributes))
+}
+
+func TestEncodeAcl(t *testing.T) {
+	encoded, encodeError := encodeAcl([]aclXattrEntry{{tag: AclUser, perms: 4, id: 985}}, os.FileMode(0640))
+
+	assert.Nil(t, encodeError)
+	// the owner, group and other entries come from the mode and the mask covers the group class
+	assert.Equal(t, []byte{
+		2, 0, 0, 0,
+		0x01, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0, 4, 0, 0xd9, 0x03, 0, 0,
+		0x04, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		0x10, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}, encoded)
+
+	decoded, decodeError := decodeAcl(encoded, false)
+	assert.Nil(t, decodeError)
+	assert.Equal(t, []AclEntry{
+		{Tag: AclUserObj, Perms: 6},
+		{Tag: AclUser, Qualifier: "985", Perms: 4},
+		{Tag: AclGroupObj, Perms: 4},
+		{Tag: AclMask, Perms: 4},
+		{Tag: AclOther},
+	}, decoded)
+}
+
+func TestEncodeAcl_givenEntriesOverrideMode(t *testing.T) {
+	encoded, encodeError := encodeAcl([]aclXattrEntry{
+		{tag: AclGroup, perms: 7, id: 10},
+		{tag: AclGroup, perms: 5, id: 4},
+		{tag: AclMask, perms: 5, id: aclUndefinedId},
+		{tag: AclOther, perms: 1, id: aclUndefinedId},
+	}, os.FileMode(0700))
+
+	assert.Nil(t, encodeError)
+	decoded, _ := decodeAcl(encoded, true)
+	assert.Equal(t, []AclEntry{
+		{Default: true, Tag: AclUserObj, Perms: 7},
+		{Default: true, Tag: AclGroupObj},
+		{Default: true, Tag: AclGroup, Qualifier: "4", Perms: 5},
+		{Default: true, Tag: AclGroup, Qualifier: "10", Perms: 7},
+		{Default: true, Tag: AclMask, Perms: 5},
+		{Default: true, Tag: AclOther, Perms: 1},
+	}, decoded)
+}
+
+func TestEncodeAcl_duplicateEntry(t *testing.T) {
+	_, encodeError := encodeAcl([]aclXattrEntry{{tag: AclUser, perms: 4, id: 985}, {tag: AclUser, perms: 6, id: 985}}, os.FileMode(0640))
+
+	assert.EqualError(t, encodeError, "ACL has more than one user entry for id 985")
+}
+
+func TestDecodeAcl_invalid(t *testing.T) {
+	_, decodeError := decodeAcl([]byte{1, 0, 0, 0}, false)
+	assert.NotNil(t, decodeError)
+
+	_, decodeError = decodeAcl([]byte{2, 0, 0, 0, 0x40, 0, 0, 0, 0, 0, 0, 0}, false)
+	assert.EqualError(t, decodeError, "ACL xattr has unknown tag 0x40")
+}
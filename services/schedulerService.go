@@ -0,0 +1,92 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SchedulerService runs periodic maintenance tasks registered by roles once their setup has completed,
+// the agent only stays resident when at least one task is scheduled and RUN_SCHEDULER is true
+type SchedulerService interface {
+	initialize(logger *logrus.Logger)
+	Schedule(name string, interval time.Duration, task func() error) error
+	HasTasks() bool
+	Run() error
+}
+
+type scheduledTask struct {
+	name     string
+	interval time.Duration
+	task     func() error
+}
+
+type SchedulerServiceImpl struct {
+	logger *logrus.Logger
+	lock   sync.Mutex
+	tasks  []scheduledTask
+}
+
+func (schedulerService *SchedulerServiceImpl) initialize(logger *logrus.Logger) {
+	schedulerService.logger = logger
+	schedulerService.tasks = nil
+}
+
+// Schedule registers task to run every interval, intervals that are not positive are refused as no ticker can run them
+func (schedulerService *SchedulerServiceImpl) Schedule(name string, interval time.Duration, task func() error) error {
+	if interval <= 0 {
+		schedulerService.logger.Errorf("Cannot schedule task %s every %s", name, interval)
+		return fmt.Errorf("task %s needs a positive interval, got %s", name, interval)
+	}
+
+	schedulerService.lock.Lock()
+	defer schedulerService.lock.Unlock()
+
+	schedulerService.logger.Debugf("Scheduling task %s every %s", name, interval)
+	schedulerService.tasks = append(schedulerService.tasks, scheduledTask{name: name, interval: interval, task: task})
+	return nil
+}
+
+func (schedulerService *SchedulerServiceImpl) HasTasks() bool {
+	schedulerService.lock.Lock()
+	defer schedulerService.lock.Unlock()
+
+	return len(schedulerService.tasks) > 0
+}
+
+// Run blocks forever, executing every scheduled task on its own interval. A failing task is logged and retried
+// on its next tick rather than stopping the other tasks. It only returns when a task cannot be run at all
+func (schedulerService *SchedulerServiceImpl) Run() error {
+	schedulerService.lock.Lock()
+	tasks := make([]scheduledTask, len(schedulerService.tasks))
+	copy(tasks, schedulerService.tasks)
+	schedulerService.lock.Unlock()
+
+	for _, task := range tasks {
+		if task.interval <= 0 {
+			schedulerService.logger.Errorf("Cannot run task %s every %s", task.name, task.interval)
+			return fmt.Errorf("task %s needs a positive interval, got %s", task.name, task.interval)
+		}
+	}
+
+	var waitGroup sync.WaitGroup
+	for _, task := range tasks {
+		waitGroup.Add(1)
+		go func(task scheduledTask) {
+			defer waitGroup.Done()
+			ticker := time.NewTicker(task.interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				schedulerService.logger.Debugf("Running scheduled task %s", task.name)
+				taskError := task.task()
+				if taskError != nil {
+					schedulerService.logger.Errorf("Scheduled task %s failed: %s", task.name, taskError.Error())
+				}
+			}
+		}(task)
+	}
+	waitGroup.Wait()
+	return nil
+}
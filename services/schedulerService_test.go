@@ -0,0 +1,22 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerServiceImpl_Schedule_nonPositiveInterval(t *testing.T) {
+	testSchedulerService := SchedulerServiceImpl{}
+	testSchedulerService.initialize(&logrus.Logger{})
+
+	assert.NotNil(t, testSchedulerService.Schedule("never", 0, func() error { return nil }))
+	assert.NotNil(t, testSchedulerService.Schedule("backwards", -time.Minute, func() error { return nil }))
+	assert.False(t, testSchedulerService.HasTasks())
+
+	// a task that slipped past Schedule is refused before any ticker is built from it
+	testSchedulerService.tasks = []scheduledTask{{name: "never", task: func() error { return nil }}}
+	assert.ErrorContains(t, testSchedulerService.Run(), "positive interval")
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+)
+
+const secretReferenceKey = "vaultSecret"
+
+// SecretService resolves role configuration fields that reference vault KV v2 secrets. A field is declared as
+// {"vaultSecret": "secret/data/k8s/<cluster>", "key": "initToken"}, when key is omitted the field name is used.
+// The vault connection is read from the "vault" object at the root of the same config file
+type SecretService interface {
+	initialize(logger *logrus.Logger, filesystemService FileSystemService, vaultService VaultService)
+	Connect(configs clients.FileSystemWrapper, connection VaultConnectionConfig) (*VaultSession, error)
+	ResolveSecrets(configs clients.FileSystemWrapper, configBytes []byte) ([]byte, error)
+}
+
+type VaultConnectionConfig struct {
+	Address string          `json:"address"`
+	Auth    VaultAuthConfig `json:"auth"`
+}
+
+// VaultAuthConfig mirrors VaultAuth with file names on the config drive in place of the secret material
+type VaultAuthConfig struct {
+	Method         string `json:"method"`
+	MountPath      string `json:"mountPath"`
+	TokenFile      string `json:"tokenFile"`
+	RoleIdFile     string `json:"roleIdFile"`
+	SecretIdFile   string `json:"secretIdFile"`
+	CertName       string `json:"certName"`
+	ClientCertFile string `json:"clientCertFile"`
+	ClientKeyFile  string `json:"clientKeyFile"`
+}
+
+type SecretServiceImpl struct {
+	logger            *logrus.Logger
+	filesystemService FileSystemService
+	vaultService      VaultService
+}
+
+func (secretService *SecretServiceImpl) initialize(logger *logrus.Logger, filesystemService FileSystemService, vaultService VaultService) {
+	secretService.logger = logger
+	secretService.filesystemService = filesystemService
+	secretService.vaultService = vaultService
+}
+
+func (secretService *SecretServiceImpl) Connect(configs clients.FileSystemWrapper, connection VaultConnectionConfig) (*VaultSession, error) {
+	if connection.Address == "" {
+		secretService.logger.Error("No vault address configured")
+		return nil, fmt.Errorf("no vault address configured")
+	}
+
+	auth := VaultAuth{
+		Method:    connection.Auth.Method,
+		MountPath: connection.Auth.MountPath,
+		CertName:  connection.Auth.CertName,
+	}
+
+	var readFileError error
+	var token, roleId, secretId, clientKey []byte
+	for _, authFile := range []struct {
+		fileName    string
+		destination *[]byte
+	}{
+		{connection.Auth.TokenFile, &token},
+		{connection.Auth.RoleIdFile, &roleId},
+		{connection.Auth.SecretIdFile, &secretId},
+		{connection.Auth.ClientCertFile, &auth.ClientCert},
+		{connection.Auth.ClientKeyFile, &clientKey},
+	} {
+		if authFile.fileName == "" {
+			continue
+		}
+
+		*authFile.destination, readFileError = secretService.filesystemService.ReadFileContentsFromFilesystem(configs, authFile.fileName)
+
+		if readFileError != nil {
+			return nil, readFileError
+		}
+	}
+
+	auth.Token = clients.NewSecret(token)
+	auth.RoleId = strings.TrimSpace(string(roleId))
+	auth.SecretId = clients.NewSecret(secretId)
+	auth.ClientKey = clients.NewSecret(clientKey)
+
+	return secretService.vaultService.Login(connection.Address, auth)
+}
+
+// ResolveSecrets replaces every secret reference in the json document with the value read from vault, documents
+// without references are returned unchanged and never contact vault
+func (secretService *SecretServiceImpl) ResolveSecrets(configs clients.FileSystemWrapper, configBytes []byte) ([]byte, error) {
+	var document interface{}
+
+	jsonProcessingError := json.Unmarshal(configBytes, &document)
+
+	if jsonProcessingError != nil {
+		secretService.logger.Errorf("Failed to parse config while resolving secrets: %s", jsonProcessingError.Error())
+		return nil, jsonProcessingError
+	}
+
+	root, isObject := document.(map[string]interface{})
+
+	if !isObject || !containsSecretReference(document) {
+		return configBytes, nil
+	}
+
+	connectionBytes, marshalError := json.Marshal(root["vault"])
+
+	if marshalError != nil {
+		return nil, marshalError
+	}
+
+	var connection VaultConnectionConfig
+	jsonProcessingError = json.Unmarshal(connectionBytes, &connection)
+
+	if jsonProcessingError != nil {
+		secretService.logger.Errorf("Failed to parse vault connection for secret references: %s", jsonProcessingError.Error())
+		return nil, jsonProcessingError
+	}
+
+	session, connectError := secretService.Connect(configs, connection)
+
+	if connectError != nil {
+		return nil, connectError
+	}
+
+	resolved, resolveError := secretService.resolveReferences(document, "", session, map[string]map[string]interface{}{})
+
+	if resolveError != nil {
+		return nil, resolveError
+	}
+
+	return json.Marshal(resolved)
+}
+
+func (secretService *SecretServiceImpl) resolveReferences(node interface{}, fieldName string, session *VaultSession, secretCache map[string]map[string]interface{}) (interface{}, error) {
+	switch typedNode := node.(type) {
+	case map[string]interface{}:
+		if secretPath, isReference := typedNode[secretReferenceKey].(string); isReference {
+			return secretService.readReference(secretPath, typedNode, fieldName, session, secretCache)
+		}
+
+		for childName, child := range typedNode {
+			resolvedChild, resolveError := secretService.resolveReferences(child, childName, session, secretCache)
+
+			if resolveError != nil {
+				return nil, resolveError
+			}
+			typedNode[childName] = resolvedChild
+		}
+	case []interface{}:
+		for index, child := range typedNode {
+			resolvedChild, resolveError := secretService.resolveReferences(child, fieldName, session, secretCache)
+
+			if resolveError != nil {
+				return nil, resolveError
+			}
+			typedNode[index] = resolvedChild
+		}
+	}
+	return node, nil
+}
+
+func (secretService *SecretServiceImpl) readReference(secretPath string, reference map[string]interface{}, fieldName string, session *VaultSession, secretCache map[string]map[string]interface{}) (interface{}, error) {
+	key, keyDeclared := reference["key"].(string)
+	if !keyDeclared {
+		key = fieldName
+	}
+
+	secret, cached := secretCache[secretPath]
+	if !cached {
+		var readSecretError error
+		secret, readSecretError = secretService.vaultService.ReadKvSecret(session, secretPath)
+
+		if readSecretError != nil {
+			return nil, readSecretError
+		}
+		secretCache[secretPath] = secret
+	}
+
+	value, keyFound := secret[key]
+
+	if !keyFound {
+		secretService.logger.Errorf("Secret %s has no key %s required by field %s", secretPath, key, fieldName)
+		return nil, fmt.Errorf("secret %s has no key %s", secretPath, key)
+	}
+
+	if stringValue, isString := value.(string); isString {
+		// registered so the value is redacted should it ever end up in a log line
+		clients.NewSecret([]byte(stringValue))
+	}
+
+	secretService.logger.Debugf("Resolved field %s from secret %s", fieldName, secretPath)
+	return value, nil
+}
+
+func containsSecretReference(node interface{}) bool {
+	switch typedNode := node.(type) {
+	case map[string]interface{}:
+		if _, isReference := typedNode[secretReferenceKey].(string); isReference {
+			return true
+		}
+		for _, child := range typedNode {
+			if containsSecretReference(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range typedNode {
+			if containsSecretReference(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainsSecretReference(t *testing.T) {
+	var withReference, withoutReference interface{}
+	_ = json.Unmarshal([]byte(`{"k8sInitToken": {"vaultSecret": "secret/data/k8s/test"}}`), &withReference)
+	_ = json.Unmarshal([]byte(`{"k8sInitToken": "token", "workerIpAddresses": ["10.1.0.15"]}`), &withoutReference)
+
+	assert.True(t, containsSecretReference(withReference))
+	assert.False(t, containsSecretReference(withoutReference))
+}
+
+func TestSecretServiceImpl_resolveReferences(t *testing.T) {
+	var document interface{}
+	_ = json.Unmarshal([]byte(`{
+		"k8sInitToken": {"vaultSecret": "secret/data/k8s/test"},
+		"k8sCaInitPrivateKey": {"vaultSecret": "secret/data/k8s/test", "key": "caKey"},
+		"podNetworkCidr": "10.5.0.0/16"
+	}`), &document)
+
+	secretCache := map[string]map[string]interface{}{
+		"secret/data/k8s/test": {"k8sInitToken": "abcdef.0123456789abcdef", "caKey": "private key"},
+	}
+
+	testSecretService := SecretServiceImpl{logger: &logrus.Logger{}}
+	resolved, resolveError := testSecretService.resolveReferences(document, "", nil, secretCache)
+
+	assert.Nil(t, resolveError)
+	assert.Equal(t, map[string]interface{}{
+		"k8sInitToken":        "abcdef.0123456789abcdef",
+		"k8sCaInitPrivateKey": "private key",
+		"podNetworkCidr":      "10.5.0.0/16",
+	}, resolved)
+	assert.Equal(t, "--token [REDACTED]", clients.Redact("--token abcdef.0123456789abcdef"))
+}
+
+func TestSecretServiceImpl_resolveReferences_missingKey(t *testing.T) {
+	var document interface{}
+	_ = json.Unmarshal([]byte(`{"k8sInitToken": {"vaultSecret": "secret/data/k8s/test"}}`), &document)
+
+	secretCache := map[string]map[string]interface{}{
+		"secret/data/k8s/test": {"other": "value"},
+	}
+
+	testSecretService := SecretServiceImpl{logger: &logrus.Logger{}}
+	_, resolveError := testSecretService.resolveReferences(document, "", nil, secretCache)
+
+	assert.NotNil(t, resolveError)
+}
@@ -4,19 +4,23 @@ import (
 	"github.com/sirupsen/logrus"
 	"os/exec"
 	"strconv"
+	"zs-vm-agent/clients"
 )
 
 //TODO: Hook into C++ selinux api directly rather than exec commands
 
 type SeLinuxService interface {
-	initialize(logger *logrus.Logger)
+	initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService, offline bool)
 	ChangeContext(path string, u string, r string, t string, recursive bool) error
 	OpenInboundPort(port int, protocol PortProtocol) error
 	AllowAllOutboundConnection() error
 }
 
 type SeLinuxServiceImpl struct {
-	logger *logrus.Logger
+	logger            *logrus.Logger
+	osClient          clients.OsClient
+	filesystemService FileSystemService
+	offline           bool
 }
 
 type PortProtocol = string
@@ -26,18 +30,28 @@ const (
 	UDP PortProtocol = "UDP"
 )
 
-func (selinuxService *SeLinuxServiceImpl) initialize(logger *logrus.Logger) {
+func (selinuxService *SeLinuxServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, filesystemService FileSystemService, offline bool) {
 	selinuxService.logger = logger
+	selinuxService.osClient = osClient
+	selinuxService.filesystemService = filesystemService
+	selinuxService.offline = offline
 }
 
+// OpenInboundPort labels a port for http daemons, offline it is skipped since semanage only changes the policy of the
+// running system and the image policy has to allow the port itself
 func (selinuxService *SeLinuxServiceImpl) OpenInboundPort(port int, protocol PortProtocol) error {
+	if selinuxService.offline {
+		selinuxService.logger.Warnf("Not labelling port %d/%s offline, the image policy has to allow it", port, protocol)
+		return nil
+	}
+
 	args := []string{"port", strconv.FormatInt(int64(port), 10), "--add", "--type", "http_port_t", "--proto", protocol}
 	selinuxService.logger.Debugf("port command is %s %s", "/usr/sbin/semanage", args)
 	command := exec.Command("/usr/sbin/semanage", args...)
 
 	selinuxService.logger.Debugf("Opening port %d/%s", port, protocol)
 
-	outputText, executeCommandError := command.CombinedOutput()
+	outputText, executeCommandError := clients.CombinedOutput(selinuxService.osClient, command)
 
 	selinuxService.logger.Infof("command output: %s", outputText)
 
@@ -48,9 +62,16 @@ func (selinuxService *SeLinuxServiceImpl) OpenInboundPort(port int, protocol Por
 	return nil
 }
 
+// AllowAllOutboundConnection lets haproxy connect to any port, offline it is skipped since setsebool -P only changes
+// the policy of the running system
 func (selinuxService *SeLinuxServiceImpl) AllowAllOutboundConnection() error {
+	if selinuxService.offline {
+		selinuxService.logger.Warn("Not setting haproxy_connect_any offline, the image policy has to set it")
+		return nil
+	}
+
 	command := exec.Command("/sbin/setsebool", "-P", "haproxy_connect_any", "1")
-	outputText, executeCommandError := command.CombinedOutput()
+	outputText, executeCommandError := clients.CombinedOutput(selinuxService.osClient, command)
 
 	selinuxService.logger.Infof("command output: %s", outputText)
 
@@ -61,24 +82,14 @@ func (selinuxService *SeLinuxServiceImpl) AllowAllOutboundConnection() error {
 	return nil
 }
 
+// ChangeContext sets the user, role and type of the SELinux label of path, like chcon -u -r -t, keeping each file's
+// level
 func (selinuxService *SeLinuxServiceImpl) ChangeContext(path string, u string, r string, t string, recursive bool) error {
-	var args []string
-
-	if recursive {
-		args = append(args, "-R")
-	}
+	changeContextError := selinuxService.filesystemService.ChangeSeLinuxContext(path, u, r, t, recursive)
 
-	args = append(args, "-u", u, "-r", r, "-t", t, path)
-
-	command := exec.Command("/usr/bin/chcon", args...)
-
-	outputText, executeCommandError := command.CombinedOutput()
-
-	selinuxService.logger.Info(string(outputText))
-
-	if executeCommandError != nil {
-		selinuxService.logger.Errorf("Failed to chcon on %s: %s", path, executeCommandError.Error())
-		return executeCommandError
+	if changeContextError != nil {
+		selinuxService.logger.Errorf("Failed to change the SELinux context of %s: %s", path, changeContextError.Error())
+		return changeContextError
 	}
 	return nil
 }
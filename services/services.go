@@ -11,13 +11,30 @@ var filesystemService FileSystemServiceImpl
 var systemdService SystemdServiceImpl
 var selinuxService SeLinuxServiceImpl
 var vaultService VaultServiceImpl
+var schedulerService SchedulerServiceImpl
+var statusService StatusServiceImpl
+var secretService SecretServiceImpl
+var certificateService CertificateServiceImpl
+var mountService MountServiceImpl
+var encryptionService EncryptionServiceImpl
+var lvmService LvmServiceImpl
+var manifestService ManifestServiceImpl
 
 func Initialize(logger *logrus.Logger) {
-	diskService.initialize(logger)
-	filesystemService.initialize(logger, clients.GetOsClient(), clients.GetUserClient())
-	systemdService.initialize(logger)
-	selinuxService.initialize(logger)
+	diskService.initialize(logger, clients.GetOsClient())
+	filesystemService.initialize(logger, clients.GetOsClient(), clients.GetUserClient(), &diskService, &manifestService)
+	systemdService.initialize(logger, clients.GetOsClient(), clients.GetHostRoot() != "/")
+	selinuxService.initialize(logger, clients.GetOsClient(), &filesystemService, clients.GetHostRoot() != "/")
 	vaultService.initialize(logger)
+	schedulerService.initialize(logger)
+	statusService.initialize(logger)
+	// the keys config drives are verified with belong to the agent, not to the image it applies roles to
+	manifestService.initialize(logger, clients.GetSystemOsClient(), &statusService)
+	secretService.initialize(logger, &filesystemService, &vaultService)
+	certificateService.initialize(logger, clients.GetOsClient(), &filesystemService, &vaultService, &secretService, &systemdService, &schedulerService)
+	lvmService.initialize(logger, clients.GetOsClient(), &filesystemService)
+	encryptionService.initialize(logger, clients.GetOsClient(), &filesystemService, &systemdService)
+	mountService.initialize(logger, clients.GetOsClient(), &diskService, &filesystemService, &systemdService, &statusService, &encryptionService)
 }
 
 func GetDiskService() DiskService {
@@ -39,3 +56,35 @@ func GetSeLinuxService() SeLinuxService {
 func GetVaultService() VaultService {
 	return &vaultService
 }
+
+func GetSchedulerService() SchedulerService {
+	return &schedulerService
+}
+
+func GetStatusService() StatusService {
+	return &statusService
+}
+
+func GetCertificateService() CertificateService {
+	return &certificateService
+}
+
+func GetSecretService() SecretService {
+	return &secretService
+}
+
+func GetMountService() MountService {
+	return &mountService
+}
+
+func GetEncryptionService() EncryptionService {
+	return &encryptionService
+}
+
+func GetLvmService() LvmService {
+	return &lvmService
+}
+
+func GetManifestService() ManifestService {
+	return &manifestService
+}
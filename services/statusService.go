@@ -0,0 +1,154 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const maxStatusEvents = 100
+
+type ComponentState = string
+
+const (
+	StateOk       ComponentState = "ok"
+	StateDegraded ComponentState = "degraded"
+	StateFailed   ComponentState = "failed"
+)
+
+// StatusService keeps the agent's view of each component it manages along with recent events and serves
+// both as json so monitoring can alert on anything that is not ok
+type StatusService interface {
+	initialize(logger *logrus.Logger)
+	SetComponentStatus(component string, state ComponentState, message string)
+	RecordEvent(component string, message string)
+	SetConfigManifest(manifest ConfigManifest)
+	GetStatus() AgentStatus
+	Serve(listenAddress string)
+}
+
+type ComponentStatus struct {
+	State   ComponentState `json:"state"`
+	Message string         `json:"message"`
+	Updated time.Time      `json:"updated"`
+}
+
+type StatusEvent struct {
+	Component string    `json:"component"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// AgentStatus lists the config manifest each config drive was verified against by the drive's label
+type AgentStatus struct {
+	Components      map[string]ComponentStatus `json:"components"`
+	ConfigManifests map[string]ConfigManifest  `json:"configManifests"`
+	Events          []StatusEvent              `json:"events"`
+}
+
+type StatusServiceImpl struct {
+	logger     *logrus.Logger
+	lock       sync.Mutex
+	components map[string]ComponentStatus
+	manifests  map[string]ConfigManifest
+	events     []StatusEvent
+}
+
+func (statusService *StatusServiceImpl) initialize(logger *logrus.Logger) {
+	statusService.logger = logger
+	statusService.components = make(map[string]ComponentStatus)
+	statusService.manifests = make(map[string]ConfigManifest)
+	statusService.events = nil
+}
+
+func (statusService *StatusServiceImpl) SetComponentStatus(component string, state ComponentState, message string) {
+	statusService.lock.Lock()
+	previous, known := statusService.components[component]
+	statusService.components[component] = ComponentStatus{State: state, Message: message, Updated: time.Now()}
+	statusService.lock.Unlock()
+
+	if !known || previous.State != state {
+		statusService.RecordEvent(component, state+": "+message)
+	}
+}
+
+func (statusService *StatusServiceImpl) RecordEvent(component string, message string) {
+	statusService.lock.Lock()
+	defer statusService.lock.Unlock()
+
+	statusService.logger.Infof("[%s] %s", component, message)
+	statusService.events = append(statusService.events, StatusEvent{Component: component, Message: message, Time: time.Now()})
+	if len(statusService.events) > maxStatusEvents {
+		statusService.events = statusService.events[len(statusService.events)-maxStatusEvents:]
+	}
+}
+
+// SetConfigManifest records the manifest a config drive was verified against, a new digest is recorded as an event
+func (statusService *StatusServiceImpl) SetConfigManifest(manifest ConfigManifest) {
+	statusService.lock.Lock()
+	previous, known := statusService.manifests[manifest.Label]
+	statusService.manifests[manifest.Label] = manifest
+	statusService.lock.Unlock()
+
+	if !known || previous.Digest != manifest.Digest {
+		message := fmt.Sprintf("%s verified against manifest sha256:%s", manifest.Label, manifest.Digest)
+		if manifest.Metadata.Revision != "" {
+			message += " revision " + manifest.Metadata.Revision
+		}
+		statusService.RecordEvent(manifestComponent, message)
+	}
+}
+
+func (statusService *StatusServiceImpl) GetStatus() AgentStatus {
+	statusService.lock.Lock()
+	defer statusService.lock.Unlock()
+
+	status := AgentStatus{
+		Components:      make(map[string]ComponentStatus, len(statusService.components)),
+		ConfigManifests: make(map[string]ConfigManifest, len(statusService.manifests)),
+		Events:          make([]StatusEvent, len(statusService.events)),
+	}
+	for component, componentStatus := range statusService.components {
+		status.Components[component] = componentStatus
+	}
+	for label, manifest := range statusService.manifests {
+		status.ConfigManifests[label] = manifest
+	}
+	copy(status.Events, statusService.events)
+	return status
+}
+
+// Serve exposes the status at /status on the given address in the background, a 503 is returned while any
+// component is failed so simple http checks can alert on it
+func (statusService *StatusServiceImpl) Serve(listenAddress string) {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/status", func(writer http.ResponseWriter, request *http.Request) {
+		status := statusService.GetStatus()
+
+		responseStatus := http.StatusOK
+		for _, componentStatus := range status.Components {
+			if componentStatus.State == StateFailed {
+				responseStatus = http.StatusServiceUnavailable
+			}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(responseStatus)
+		encodeError := json.NewEncoder(writer).Encode(status)
+		if encodeError != nil {
+			statusService.logger.Errorf("Failed to write status response: %s", encodeError.Error())
+		}
+	})
+
+	go func() {
+		statusService.logger.Infof("Serving agent status on %s/status", listenAddress)
+		serveError := http.ListenAndServe(listenAddress, serveMux)
+		if serveError != nil {
+			statusService.logger.Errorf("Status endpoint stopped: %s", serveError.Error())
+		}
+	}()
+}
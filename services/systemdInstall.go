@@ -0,0 +1,222 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const systemdVendorUnitDirectory = "/usr/lib/systemd/system"
+const systemdLegacyUnitDirectory = "/lib/systemd/system"
+
+// systemdUnitSearchPath lists where units are looked for, earlier directories override later ones
+var systemdUnitSearchPath = []string{systemdUnitDirectory, systemdVendorUnitDirectory, systemdLegacyUnitDirectory}
+
+var systemdUnitSuffixes = []string{".service", ".socket", ".target", ".timer", ".mount", ".automount", ".swap", ".path", ".slice"}
+
+// unitLink is a symlink systemctl enable creates for a unit
+type unitLink struct {
+	path   string
+	target string
+}
+
+// enableUnit creates the links systemctl enable would for unitName, from the WantedBy, RequiredBy, Alias and Also
+// settings of its [Install] section
+func (systemdService *SystemdServiceImpl) enableUnit(unitName string) error {
+	links, installLinksError := systemdService.installLinks(normalizeUnitName(unitName), map[string]bool{})
+
+	if installLinksError != nil {
+		return installLinksError
+	}
+
+	for _, link := range links {
+		createLinkError := systemdService.createUnitLink(link)
+
+		if createLinkError != nil {
+			return createLinkError
+		}
+	}
+	systemdService.logger.Infof("Enabled %s offline", unitName)
+	return nil
+}
+
+// unitEnabledStatus returns 1 when every link enabling unitName is in place and -1 otherwise. A unit without an
+// [Install] section has no links and so counts as enabled, as systemctl reports it static
+func (systemdService *SystemdServiceImpl) unitEnabledStatus(unitName string) (int, error) {
+	links, installLinksError := systemdService.installLinks(normalizeUnitName(unitName), map[string]bool{})
+
+	if installLinksError != nil {
+		return -1, installLinksError
+	}
+
+	for _, link := range links {
+		target, readLinkError := systemdService.osClient.ReadLink(link.path)
+
+		if readLinkError != nil || target != link.target {
+			return -1, nil
+		}
+	}
+	return 1, nil
+}
+
+// installLinks lists the links enabling unitName and the units its Also setting names, visited guards against units
+// naming each other
+func (systemdService *SystemdServiceImpl) installLinks(unitName string, visited map[string]bool) ([]unitLink, error) {
+	if visited[unitName] {
+		return nil, nil
+	}
+	visited[unitName] = true
+
+	unitPath, findUnitError := systemdService.findUnit(unitName)
+
+	if findUnitError != nil {
+		return nil, findUnitError
+	}
+
+	unitFile, openError := systemdService.osClient.OpenFile(unitPath)
+
+	if openError != nil {
+		systemdService.logger.Errorf("Failed to open unit %s: %s", unitPath, openError.Error())
+		return nil, openError
+	}
+	defer unitFile.Close()
+
+	contents, readError := io.ReadAll(unitFile)
+
+	if readError != nil {
+		systemdService.logger.Errorf("Failed to read unit %s: %s", unitPath, readError.Error())
+		return nil, readError
+	}
+
+	var links []unitLink
+	install := parseInstallSection(string(contents))
+	for _, wantedBy := range install["WantedBy"] {
+		links = append(links, unitLink{path: filepath.Join(systemdUnitDirectory, wantedBy+".wants", unitName), target: unitPath})
+	}
+	for _, requiredBy := range install["RequiredBy"] {
+		links = append(links, unitLink{path: filepath.Join(systemdUnitDirectory, requiredBy+".requires", unitName), target: unitPath})
+	}
+	for _, alias := range install["Alias"] {
+		links = append(links, unitLink{path: filepath.Join(systemdUnitDirectory, alias), target: unitPath})
+	}
+	for _, also := range install["Also"] {
+		alsoLinks, alsoError := systemdService.installLinks(normalizeUnitName(also), visited)
+
+		if alsoError != nil {
+			return nil, alsoError
+		}
+		links = append(links, alsoLinks...)
+	}
+	return links, nil
+}
+
+// findUnit returns the path of the file defining unitName, which for an instance such as getty@tty1.service is its
+// template getty@.service
+func (systemdService *SystemdServiceImpl) findUnit(unitName string) (string, error) {
+	candidates := []string{unitName}
+	if prefix, instance, isInstance := strings.Cut(unitName, "@"); isInstance && !strings.HasPrefix(instance, ".") {
+		candidates = append(candidates, prefix+"@"+filepath.Ext(unitName))
+	}
+
+	for _, directory := range systemdUnitSearchPath {
+		for _, candidate := range candidates {
+			unitPath := filepath.Join(directory, candidate)
+			fileInfo, statError := systemdService.osClient.LstatFile(unitPath)
+
+			if errors.Is(statError, fs.ErrNotExist) {
+				continue
+			} else if statError != nil {
+				systemdService.logger.Errorf("Failed to look for unit %s: %s", unitPath, statError.Error())
+				return "", statError
+			}
+
+			if fileInfo.Mode()&os.ModeSymlink != 0 {
+				target, _ := systemdService.osClient.ReadLink(unitPath)
+				if target == "/dev/null" {
+					systemdService.logger.Errorf("Unit %s is masked", unitName)
+					return "", fmt.Errorf("unit %s is masked", unitName)
+				}
+			}
+			return unitPath, nil
+		}
+	}
+	systemdService.logger.Errorf("Unit %s not found in %s", unitName, strings.Join(systemdUnitSearchPath, ", "))
+	return "", fmt.Errorf("unit %s not found", unitName)
+}
+
+// createUnitLink links link.path to link.target, replacing a link pointing elsewhere
+func (systemdService *SystemdServiceImpl) createUnitLink(link unitLink) error {
+	existingTarget, readLinkError := systemdService.osClient.ReadLink(link.path)
+
+	if readLinkError == nil && existingTarget == link.target {
+		return nil
+	} else if readLinkError == nil {
+		removeError := systemdService.osClient.Remove(link.path)
+
+		if removeError != nil {
+			systemdService.logger.Errorf("Failed to remove link %s: %s", link.path, removeError.Error())
+			return removeError
+		}
+	} else if !errors.Is(readLinkError, fs.ErrNotExist) {
+		systemdService.logger.Errorf("Failed to read link %s: %s", link.path, readLinkError.Error())
+		return readLinkError
+	}
+
+	// the .wants and .requires directories only exist once something is linked into them
+	mkdirError := systemdService.osClient.Mkdir(filepath.Dir(link.path), 0755)
+
+	if mkdirError != nil && !errors.Is(mkdirError, fs.ErrExist) {
+		systemdService.logger.Errorf("Failed to create directory %s: %s", filepath.Dir(link.path), mkdirError.Error())
+		return mkdirError
+	}
+
+	symlinkError := systemdService.osClient.Symlink(link.target, link.path)
+
+	if symlinkError != nil {
+		systemdService.logger.Errorf("Failed to link %s to %s: %s", link.path, link.target, symlinkError.Error())
+		return symlinkError
+	}
+	return nil
+}
+
+// parseInstallSection returns the settings of the [Install] section of a unit, an empty assignment clears a setting
+func parseInstallSection(contents string) map[string][]string {
+	install := map[string][]string{}
+	inInstall := false
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		} else if strings.HasPrefix(line, "[") {
+			inInstall = line == "[Install]"
+			continue
+		}
+
+		key, value, isSetting := strings.Cut(line, "=")
+		if !inInstall || !isSetting {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		if strings.TrimSpace(value) == "" {
+			delete(install, key)
+			continue
+		}
+		install[key] = append(install[key], strings.Fields(value)...)
+	}
+	return install
+}
+
+// normalizeUnitName adds .service to a unit name without a unit type, as systemctl does
+func normalizeUnitName(unitName string) string {
+	for _, suffix := range systemdUnitSuffixes {
+		if strings.HasSuffix(unitName, suffix) {
+			return unitName
+		}
+	}
+	return unitName + ".service"
+}
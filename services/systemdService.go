@@ -4,28 +4,44 @@ import (
 	"github.com/sirupsen/logrus"
 	"os/exec"
 	"strings"
+	"zs-vm-agent/clients"
 )
 
 //TODO: Hook into systemd and journal directly rather than forking commands
 
 type SystemdService interface {
-	initialize(logger *logrus.Logger)
+	initialize(logger *logrus.Logger, osClient clients.OsClient, offline bool)
 	StartService(serviceName string) error
+	ReloadOrRestartService(serviceName string) error
+	RestartService(serviceName string) error
 	GetServiceStatus(serviceName string) (int, error)
+	EnableService(serviceName string) error
+	DaemonReload() error
 }
 
+// SystemdServiceImpl drives systemctl on the running system. Offline, when roles are applied to an image or chroot
+// no systemd manages, units are enabled by linking them the way systemctl does and nothing is started or reloaded
 type SystemdServiceImpl struct {
-	logger *logrus.Logger
+	logger   *logrus.Logger
+	osClient clients.OsClient
+	offline  bool
 }
 
-func (systemdService *SystemdServiceImpl) initialize(logger *logrus.Logger) {
+func (systemdService *SystemdServiceImpl) initialize(logger *logrus.Logger, osClient clients.OsClient, offline bool) {
 	systemdService.logger = logger
+	systemdService.osClient = osClient
+	systemdService.offline = offline
 }
 
+// StartService starts a unit, offline it is enabled instead so it starts when the image boots
 func (systemdService *SystemdServiceImpl) StartService(serviceName string) error {
+	if systemdService.offline {
+		return systemdService.enableUnit(serviceName)
+	}
+
 	command := exec.Command("/usr/bin/systemctl", "start", serviceName)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
 
 	systemdService.logger.Info(string(outputText))
 
@@ -38,10 +54,91 @@ func (systemdService *SystemdServiceImpl) StartService(serviceName string) error
 	return nil
 }
 
+func (systemdService *SystemdServiceImpl) ReloadOrRestartService(serviceName string) error {
+	if systemdService.offline {
+		systemdService.logger.Debugf("Not reloading %s, no systemd runs offline", serviceName)
+		return nil
+	}
+
+	command := exec.Command("/usr/bin/systemctl", "reload-or-restart", serviceName)
+
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
+
+	systemdService.logger.Info(string(outputText))
+
+	if commandExecutionError != nil {
+		systemdService.logger.Errorf("Failed to reload systemd service %s: %s", serviceName, commandExecutionError.Error())
+		_ = systemdService.getServiceLogs(serviceName)
+
+		return commandExecutionError
+	}
+	return nil
+}
+
+func (systemdService *SystemdServiceImpl) RestartService(serviceName string) error {
+	if systemdService.offline {
+		systemdService.logger.Debugf("Not restarting %s, no systemd runs offline", serviceName)
+		return nil
+	}
+
+	command := exec.Command("/usr/bin/systemctl", "restart", serviceName)
+
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
+
+	systemdService.logger.Info(string(outputText))
+
+	if commandExecutionError != nil {
+		systemdService.logger.Errorf("Failed to restart systemd service %s: %s", serviceName, commandExecutionError.Error())
+		_ = systemdService.getServiceLogs(serviceName)
+
+		return commandExecutionError
+	}
+	return nil
+}
+
+// EnableService enables a unit so it starts on boot and starts it now, offline it is only enabled
+func (systemdService *SystemdServiceImpl) EnableService(serviceName string) error {
+	if systemdService.offline {
+		return systemdService.enableUnit(serviceName)
+	}
+
+	command := exec.Command("/usr/bin/systemctl", "enable", "--now", serviceName)
+
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
+
+	systemdService.logger.Info(string(outputText))
+
+	if commandExecutionError != nil {
+		systemdService.logger.Errorf("Failed to enable systemd service %s: %s", serviceName, commandExecutionError.Error())
+		_ = systemdService.getServiceLogs(serviceName)
+
+		return commandExecutionError
+	}
+	return nil
+}
+
+func (systemdService *SystemdServiceImpl) DaemonReload() error {
+	if systemdService.offline {
+		return nil
+	}
+
+	command := exec.Command("/usr/bin/systemctl", "daemon-reload")
+
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
+
+	systemdService.logger.Info(string(outputText))
+
+	if commandExecutionError != nil {
+		systemdService.logger.Errorf("Failed to reload systemd unit files: %s", commandExecutionError.Error())
+		return commandExecutionError
+	}
+	return nil
+}
+
 func (systemdService *SystemdServiceImpl) getServiceLogs(serviceName string) error {
 	command := exec.Command("/usr/bin/journalctl", "-u", serviceName, "-n", "25")
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
 
 	for _, line := range strings.Split(string(outputText), "\n") {
 		systemdService.logger.Info(line)
@@ -55,10 +152,15 @@ func (systemdService *SystemdServiceImpl) getServiceLogs(serviceName string) err
 
 }
 
+// GetServiceStatus reports whether a unit has started, offline a unit counts as started once it is enabled
 func (systemdService *SystemdServiceImpl) GetServiceStatus(serviceName string) (int, error) { //-1: fail, 0: stil starting, 1: successfully started
+	if systemdService.offline {
+		return systemdService.unitEnabledStatus(serviceName)
+	}
+
 	command := exec.Command("/usr/bin/systemctl", "is-active", serviceName)
 
-	outputText, commandExecutionError := command.CombinedOutput()
+	outputText, commandExecutionError := clients.CombinedOutput(systemdService.osClient, command)
 
 	systemdService.logger.Info(string(outputText))
 
@@ -1 +1,75 @@
 package services
+
+import (
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOfflineSystemdService returns a service enabling units in an image mounted at /mnt/image of host
+func newOfflineSystemdService(host *clients.MemoryOsClient) *SystemdServiceImpl {
+	host.AddDirectory("/mnt/image/etc/systemd/system", 0755)
+	testSystemdService := SystemdServiceImpl{}
+	testSystemdService.initialize(&logrus.Logger{}, clients.NewRootedOsClient("/mnt/image", host), true)
+	return &testSystemdService
+}
+
+func TestSystemdServiceImpl_StartService_offline(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/mnt/image/usr/lib/systemd/system/named.service", []byte("[Unit]\nDescription=BIND\n\n[Service]\nType=forking\n\n[Install]\nWantedBy=multi-user.target\nAlias=bind9.service\nAlso=named-setup.service\n"), 0644)
+	host.AddFile("/mnt/image/usr/lib/systemd/system/named-setup.service", []byte("[Service]\nType=oneshot\n[Install]\nRequiredBy=named.service\n"), 0644)
+	testSystemdService := newOfflineSystemdService(host)
+
+	status, getStatusError := testSystemdService.GetServiceStatus("named")
+	assert.Nil(t, getStatusError)
+	assert.Equal(t, -1, status)
+
+	assert.Nil(t, testSystemdService.StartService("named"))
+	// enabling again leaves the links as they are
+	assert.Nil(t, testSystemdService.EnableService("named.service"))
+
+	for linkPath, target := range map[string]string{
+		"/mnt/image/etc/systemd/system/multi-user.target.wants/named.service":      "/usr/lib/systemd/system/named.service",
+		"/mnt/image/etc/systemd/system/bind9.service":                              "/usr/lib/systemd/system/named.service",
+		"/mnt/image/etc/systemd/system/named.service.requires/named-setup.service": "/usr/lib/systemd/system/named-setup.service",
+	} {
+		link, found := host.Node(linkPath)
+		assert.True(t, found, linkPath)
+		assert.Equal(t, target, link.Target, linkPath)
+	}
+
+	status, getStatusError = testSystemdService.GetServiceStatus("named")
+	assert.Nil(t, getStatusError)
+	assert.Equal(t, 1, status)
+	assert.Nil(t, testSystemdService.RestartService("named"))
+	assert.Nil(t, testSystemdService.DaemonReload())
+}
+
+func TestSystemdServiceImpl_EnableService_offlineInstance(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/mnt/image/usr/lib/systemd/system/getty@.service", []byte("[Install]\nWantedBy=getty.target\n"), 0644)
+	host.AddFile("/mnt/image/etc/systemd/system/getty@tty1.service", []byte("[Install]\nWantedBy=\nWantedBy=multi-user.target\n"), 0644)
+	testSystemdService := newOfflineSystemdService(host)
+
+	assert.Nil(t, testSystemdService.EnableService("getty@tty2"))
+	assert.Nil(t, testSystemdService.EnableService("getty@tty1.service"))
+
+	link, _ := host.Node("/mnt/image/etc/systemd/system/getty.target.wants/getty@tty2.service")
+	assert.Equal(t, "/usr/lib/systemd/system/getty@.service", link.Target)
+	link, _ = host.Node("/mnt/image/etc/systemd/system/multi-user.target.wants/getty@tty1.service")
+	assert.Equal(t, "/etc/systemd/system/getty@tty1.service", link.Target)
+	_, found := host.Node("/mnt/image/etc/systemd/system/getty.target.wants/getty@tty1.service")
+	assert.False(t, found)
+}
+
+func TestSystemdServiceImpl_EnableService_offlineMaskedOrMissing(t *testing.T) {
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/mnt/image/usr/lib/systemd/system/firewalld.service", []byte("[Install]\nWantedBy=multi-user.target\n"), 0644)
+	host.AddSymlink("/mnt/image/etc/systemd/system/firewalld.service", "/dev/null")
+	testSystemdService := newOfflineSystemdService(host)
+
+	assert.EqualError(t, testSystemdService.EnableService("firewalld"), "unit firewalld.service is masked")
+	assert.EqualError(t, testSystemdService.StartService("haproxy"), "unit haproxy.service not found")
+}
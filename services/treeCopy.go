@@ -0,0 +1,206 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"zs-vm-agent/clients"
+)
+
+const defaultDirectoryMode = 0755
+
+// TreeCopyOptions control how CopyTreeToRootFs mirrors a config drive directory. Globs use path.Match syntax, a glob
+// containing a slash matches the path relative to the copied directory and any other glob matches the entry's name, so
+// "lost+found" skips that directory at every level. Exclude applies to files and directories, Include only to files
+type TreeCopyOptions struct {
+	Recursive      bool           `json:"recursive"`
+	DirectoryMode  os.FileMode    `json:"directoryMode"`
+	FileAttributes FileAttributes `json:"fileAttributes"`
+	Include        []string       `json:"include"`
+	Exclude        []string       `json:"exclude"`
+	MirrorDeletes  bool           `json:"mirrorDeletes"`
+}
+
+// CopyTreeToRootFs copies the directory sourcePath to destPath keeping the relative path of every file. Missing
+// directories are created with DirectoryMode (0755 when unset), files are copied with FileAttributes. With
+// MirrorDeletes, files and directories no longer on the config drive are removed from destPath, entries the copy does
+// not manage, such as excluded ones, are left alone. It reports whether anything changed
+func (filesystemService *FileSystemServiceImpl) CopyTreeToRootFs(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, options TreeCopyOptions) (bool, error) {
+	for _, pattern := range append(append([]string{}, options.Include...), options.Exclude...) {
+		if _, matchError := path.Match(pattern, ""); matchError != nil {
+			filesystemService.logger.Errorf("Invalid copy pattern %q: %s", pattern, matchError.Error())
+			return false, fmt.Errorf("invalid copy pattern %q: %w", pattern, matchError)
+		}
+	}
+
+	filesystemService.logger.Infof("Copying tree %s to %s", sourcePath, destPath)
+	fileInfos, readSourceError := sourceFilesystem.ReadDir(sourcePath)
+
+	if readSourceError != nil {
+		filesystemService.logger.Errorf("Failed to read source directory %s: %s", sourcePath, readSourceError.Error())
+		return false, readSourceError
+	}
+
+	return filesystemService.copyTree(sourceFilesystem, sourcePath, destPath, "", fileInfos, options)
+}
+
+// copyTree copies the entries of the source directory at relativePath, whose listing is fileInfos
+func (filesystemService *FileSystemServiceImpl) copyTree(sourceFilesystem clients.FileSystemWrapper, sourcePath string, destPath string, relativePath string, fileInfos []os.FileInfo, options TreeCopyOptions) (bool, error) {
+	sourceDirectory := path.Join(sourcePath, relativePath)
+	destDirectory := filepath.Join(destPath, filepath.FromSlash(relativePath))
+
+	createDirectoryError := filesystemService.ensureDirectory(destDirectory, options.DirectoryMode)
+
+	if createDirectoryError != nil {
+		return false, createDirectoryError
+	}
+
+	changed := false
+	copiedEntries := map[string]bool{}
+	for _, fileInfo := range fileInfos {
+		fileName := fileInfo.Name()
+		entryPath := path.Join(relativePath, fileName)
+
+		if fileName == "." || fileName == ".." || !filesystemService.isCopiedEntry(entryPath, fileInfo.IsDir(), options) {
+			continue
+		}
+		copiedEntries[fileName] = true
+
+		if fileInfo.IsDir() {
+			childInfos, readDirectoryError := sourceFilesystem.ReadDir(path.Join(sourceDirectory, fileName))
+
+			if readDirectoryError != nil {
+				filesystemService.logger.Errorf("Failed to read source directory %s: %s", path.Join(sourceDirectory, fileName), readDirectoryError.Error())
+				return false, readDirectoryError
+			}
+
+			directoryChanged, copyError := filesystemService.copyTree(sourceFilesystem, sourcePath, destPath, entryPath, childInfos, options)
+
+			if copyError != nil {
+				return false, copyError
+			}
+			changed = changed || directoryChanged
+			continue
+		}
+
+		fileChanged, copyFileError := filesystemService.copyFile(sourceFilesystem, path.Join(sourceDirectory, fileName), fileInfo, filepath.Join(destDirectory, fileName), options.FileAttributes)
+
+		if copyFileError != nil {
+			return false, copyFileError
+		}
+		changed = changed || fileChanged
+	}
+
+	if options.MirrorDeletes {
+		removed, removeError := filesystemService.removeStaleEntries(destDirectory, relativePath, copiedEntries, options)
+
+		if removeError != nil {
+			return false, removeError
+		}
+		changed = changed || removed
+	}
+
+	return changed, nil
+}
+
+// removeStaleEntries removes the entries of destDirectory the copy manages but did not copy
+func (filesystemService *FileSystemServiceImpl) removeStaleEntries(destDirectory string, relativePath string, copiedEntries map[string]bool, options TreeCopyOptions) (bool, error) {
+	destEntries, readDestError := filesystemService.osClient.ReadDir(destDirectory)
+
+	if readDestError != nil {
+		filesystemService.logger.Errorf("Failed to read %s to mirror deletes: %s", destDirectory, readDestError.Error())
+		return false, readDestError
+	}
+
+	removed := false
+	for _, destEntry := range destEntries {
+		entryPath := path.Join(relativePath, destEntry.Name())
+
+		if copiedEntries[destEntry.Name()] || !filesystemService.isCopiedEntry(entryPath, destEntry.IsDir(), options) {
+			continue
+		}
+
+		removeError := filesystemService.osClient.RemoveAll(filepath.Join(destDirectory, destEntry.Name()))
+
+		if removeError != nil {
+			filesystemService.logger.Errorf("Failed to remove %s: %s", filepath.Join(destDirectory, destEntry.Name()), removeError.Error())
+			return false, removeError
+		}
+		filesystemService.logger.Infof("Removed %s, it is no longer on the config drive", filepath.Join(destDirectory, destEntry.Name()))
+		removed = true
+	}
+	return removed, nil
+}
+
+// isCopiedEntry reports whether the copy manages the entry at entryPath
+func (filesystemService *FileSystemServiceImpl) isCopiedEntry(entryPath string, isDirectory bool, options TreeCopyOptions) bool {
+	if matchesAnyGlob(options.Exclude, entryPath) {
+		filesystemService.logger.Debugf("Skipping excluded %s", entryPath)
+		return false
+	}
+
+	if isDirectory {
+		return options.Recursive
+	}
+	return len(options.Include) == 0 || matchesAnyGlob(options.Include, entryPath)
+}
+
+// ensureDirectory creates directory and any missing parents with mode, existing directories are left as they are
+func (filesystemService *FileSystemServiceImpl) ensureDirectory(directory string, mode os.FileMode) error {
+	directoryInfo, statDirectoryError := filesystemService.osClient.StatFile(directory)
+
+	if statDirectoryError == nil && directoryInfo.IsDir() {
+		return nil
+	} else if statDirectoryError == nil {
+		filesystemService.logger.Errorf("Cannot copy into %s, it is not a directory", directory)
+		return fmt.Errorf("cannot copy into %s, it is not a directory", directory)
+	} else if !errors.Is(statDirectoryError, os.ErrNotExist) {
+		filesystemService.logger.Errorf("Failed to read directory %s: %s", directory, statDirectoryError.Error())
+		return statDirectoryError
+	}
+
+	if parent := filepath.Dir(directory); parent != directory {
+		createParentError := filesystemService.ensureDirectory(parent, mode)
+
+		if createParentError != nil {
+			return createParentError
+		}
+	}
+
+	if mode == 0 {
+		mode = defaultDirectoryMode
+	}
+
+	createDirectoryError := filesystemService.osClient.Mkdir(directory, int(mode.Perm()))
+
+	if createDirectoryError != nil {
+		filesystemService.logger.Errorf("Failed to create directory %s: %s", directory, createDirectoryError.Error())
+		return createDirectoryError
+	}
+
+	// the mode given to mkdir is masked by the umask
+	setPermissionsError := filesystemService.osClient.SetPermissions(directory, int(mode.Perm()))
+
+	if setPermissionsError != nil {
+		filesystemService.logger.Errorf("Failed to set permissions on %s: %s", directory, setPermissionsError.Error())
+		return setPermissionsError
+	}
+	return nil
+}
+
+func matchesAnyGlob(patterns []string, entryPath string) bool {
+	for _, pattern := range patterns {
+		subject := path.Base(entryPath)
+		if strings.Contains(pattern, "/") {
+			subject = entryPath
+		}
+
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
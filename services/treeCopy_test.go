@@ -0,0 +1,135 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystemServiceImpl_CopyTreeToRootFs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := filepath.Join(t.TempDir(), "etc", "haproxy", "conf.d")
+	sourceFilesystem := newTestConfigDrive(t, ctrl, "", map[string]string{
+		"conf.d/a.cfg":                "a",
+		"conf.d/sites/a.cfg":          "site a",
+		"conf.d/sites/b.cfg":          "site b",
+		"conf.d/sites/README.md":      "readme",
+		"conf.d/lost+found/recovered": "junk",
+	})
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+
+	changed, copyError := testFilesystemService.CopyTreeToRootFs(sourceFilesystem, "conf.d", destPath, TreeCopyOptions{
+		Recursive:     true,
+		DirectoryMode: 0750,
+		Include:       []string{"*.cfg"},
+		Exclude:       []string{"lost+found"},
+	})
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+
+	// nested files keep their relative path rather than overwriting each other
+	for filePath, contents := range map[string]string{"a.cfg": "a", "sites/a.cfg": "site a", "sites/b.cfg": "site b"} {
+		copied, readError := os.ReadFile(filepath.Join(destPath, filePath))
+		assert.Nil(t, readError)
+		assert.Equal(t, contents, string(copied))
+	}
+	assert.NoFileExists(t, filepath.Join(destPath, "sites", "README.md"))
+	assert.NoDirExists(t, filepath.Join(destPath, "lost+found"))
+
+	sitesInfo, _ := os.Stat(filepath.Join(destPath, "sites"))
+	assert.Equal(t, os.FileMode(0750), sitesInfo.Mode().Perm())
+	parentInfo, _ := os.Stat(filepath.Dir(destPath))
+	assert.Equal(t, os.FileMode(0750), parentInfo.Mode().Perm())
+
+	changed, copyError = testFilesystemService.CopyTreeToRootFs(sourceFilesystem, "conf.d", destPath, TreeCopyOptions{Recursive: true, Include: []string{"*.cfg"}})
+	assert.Nil(t, copyError)
+	assert.False(t, changed)
+}
+
+func TestFileSystemServiceImpl_CopyTreeToRootFs_mirrorDeletes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := t.TempDir()
+	for _, stalePath := range []string{"old.cfg", "retired/site.cfg", "sites/gone.cfg", "local.keep", "lost+found/recovered"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(destPath, stalePath)), 0755))
+		assert.Nil(t, os.WriteFile(filepath.Join(destPath, stalePath), []byte("stale"), 0644))
+	}
+	sourceFilesystem := newTestConfigDrive(t, ctrl, "", map[string]string{"a.cfg": "a", "sites/b.cfg": "b"})
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: newTestOsClient(ctrl)}
+
+	changed, copyError := testFilesystemService.CopyTreeToRootFs(sourceFilesystem, "/", destPath, TreeCopyOptions{
+		Recursive:     true,
+		Include:       []string{"*.cfg"},
+		Exclude:       []string{"lost+found"},
+		MirrorDeletes: true,
+	})
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+	assert.FileExists(t, filepath.Join(destPath, "sites", "b.cfg"))
+	assert.NoFileExists(t, filepath.Join(destPath, "old.cfg"))
+	assert.NoFileExists(t, filepath.Join(destPath, "sites", "gone.cfg"))
+	assert.NoDirExists(t, filepath.Join(destPath, "retired"))
+
+	// files the copy does not manage are left alone
+	assert.FileExists(t, filepath.Join(destPath, "local.keep"))
+	assert.FileExists(t, filepath.Join(destPath, "lost+found", "recovered"))
+}
+
+func TestFileSystemServiceImpl_CopyTreeToRootFs_invalidPattern(t *testing.T) {
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}}
+
+	_, copyError := testFilesystemService.CopyTreeToRootFs(nil, "conf.d", "/etc/haproxy/conf.d", TreeCopyOptions{Exclude: []string{"[a-"}})
+
+	assert.NotNil(t, copyError)
+}
+
+func TestMatchesAnyGlob(t *testing.T) {
+	assert.True(t, matchesAnyGlob([]string{"lost+found"}, "sites/lost+found"))
+	assert.True(t, matchesAnyGlob([]string{"sites/*.cfg"}, "sites/a.cfg"))
+	assert.False(t, matchesAnyGlob([]string{"sites/*.cfg"}, "other/sites/a.cfg"))
+	assert.False(t, matchesAnyGlob(nil, "a.cfg"))
+}
+
+func TestFileSystemServiceImpl_CopyTreeToRootFs_memoryHost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	host := clients.NewMemoryOsClient()
+	host.AddFile("/etc/haproxy/conf.d/stale.cfg", []byte("stale"), 0644)
+	sourceFilesystem := newTestConfigDrive(t, ctrl, "", map[string]string{
+		"conf.d/a.cfg":       "a",
+		"conf.d/sites/b.cfg": "site b",
+	})
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: host}
+
+	changed, copyError := testFilesystemService.CopyTreeToRootFs(sourceFilesystem, "conf.d", "/etc/haproxy/conf.d", TreeCopyOptions{
+		Recursive:      true,
+		DirectoryMode:  0750,
+		FileAttributes: FileAttributes{Mode: 0640, SeLinuxLabel: "system_u:object_r:haproxy_etc_t:s0"},
+		MirrorDeletes:  true,
+	})
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+
+	copied, found := host.Node("/etc/haproxy/conf.d/sites/b.cfg")
+	assert.True(t, found)
+	assert.Equal(t, "site b", string(copied.Contents))
+	assert.Equal(t, os.FileMode(0640), copied.Mode.Perm())
+	assert.Equal(t, []byte("system_u:object_r:haproxy_etc_t:s0"), copied.Xattrs[seLinuxXattr])
+
+	sites, _ := host.Node("/etc/haproxy/conf.d/sites")
+	assert.Equal(t, os.FileMode(0750), sites.Mode.Perm())
+
+	_, found = host.Node("/etc/haproxy/conf.d/stale.cfg")
+	assert.False(t, found)
+	entries, _ := host.ReadDir("/etc/haproxy/conf.d")
+	assert.Equal(t, 2, len(entries))
+}
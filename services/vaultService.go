@@ -1,7 +1,14 @@
 package services
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
 	"zs-vm-agent/clients"
 
 	"github.com/sirupsen/logrus"
@@ -9,9 +16,80 @@ import (
 
 type VaultService interface {
 	initialize(logger *logrus.Logger)
-	UnsealVault(vaultApiUrl string, unsealKeys []string) error
+	UnsealVault(vaultApiUrl string, unsealKeys []*clients.Secret) error
+	GetSealStatus(vaultApiUrl string) (*clients.VaultStatusResponse, error)
+	FindRaftLeader(peerApiUrls []string) (*string, error)
+	JoinRaftCluster(vaultApiUrl string, leaderApiUrl string, tlsMaterial RaftTlsMaterial) error
+	VerifyRaftMembership(vaultApiUrl string, nodeId string, token *clients.Secret) error
+	WaitForRaftLeader(vaultApiUrl string, leaderApiUrl string) error
+	LoginAppRole(vaultApiUrl string, mountPath string, roleId string, secretId *clients.Secret) (*clients.Secret, error)
+	WaitForUnseal(vaultApiUrl string, timeout time.Duration) error
+	Authenticate(vaultApiUrl string, auth VaultAuth) (*clients.Secret, error)
+	Login(vaultApiUrl string, auth VaultAuth) (*VaultSession, error)
+	SessionToken(session *VaultSession) (*clients.Secret, error)
+	ReadKvSecret(session *VaultSession, secretPath string) (map[string]interface{}, error)
+	DownloadRaftSnapshot(session *VaultSession, writer io.Writer) (int64, error)
+	RestoreRaftSnapshot(session *VaultSession, snapshot io.Reader, force bool) error
+	ApplyAuditDevices(session *VaultSession, desired map[string]clients.VaultAuditDevice) error
+	ApplyAuthMethods(session *VaultSession, desired map[string]clients.VaultAuthMount) error
+	ApplyAclPolicies(session *VaultSession, desired map[string]string) error
+	IssueCertificate(vaultApiUrl string, token *clients.Secret, mountPath string, role string, issueRequest clients.PkiIssueRequest) (*clients.PkiIssueResponse, error)
 }
 
+type VaultAuthMethod = string
+
+const (
+	AppRoleAuth VaultAuthMethod = "approle"
+	CertAuth    VaultAuthMethod = "cert"
+	TokenAuth   VaultAuthMethod = "token"
+)
+
+// VaultAuth describes how the agent logs into vault, role and secret ids are used for approle, the PEM
+// encoded client certificate and key are used for cert auth and Token is used as is for token auth
+type VaultAuth struct {
+	Method     VaultAuthMethod
+	Token      *clients.Secret
+	MountPath  string
+	RoleId     string
+	SecretId   *clients.Secret
+	CertName   string
+	ClientCert []byte
+	ClientKey  *clients.Secret
+}
+
+// VaultSession tracks a token obtained through VaultAuth so it can be renewed or replaced before it expires
+type VaultSession struct {
+	Address       string
+	auth          VaultAuth
+	lock          sync.Mutex
+	token         *clients.Secret
+	renewable     bool
+	leaseDuration time.Duration
+	expiresAt     time.Time
+}
+
+// update replaces the session token, a token that changed is destroyed so it no longer lingers in memory
+func (session *VaultSession) update(token *clients.Secret, renewable bool, leaseSeconds int) {
+	if session.token != token {
+		session.token.Destroy()
+	}
+	session.token = token
+	session.renewable = renewable
+	session.leaseDuration = time.Duration(leaseSeconds) * time.Second
+	session.expiresAt = time.Now().Add(session.leaseDuration)
+}
+
+// RaftTlsMaterial holds the PEM encoded certificates handed to the joining node so it can
+// establish trust with the leader, all fields are optional
+type RaftTlsMaterial struct {
+	LeaderCaCert     string
+	LeaderClientCert string
+	LeaderClientKey  *clients.Secret
+}
+
+const vaultPollInterval = 2 * time.Second
+const vaultPollAttempts = 30
+
 type VaultServiceImpl struct {
 	logger      *logrus.Logger
 	vaultClient clients.VaultClient
@@ -22,12 +100,14 @@ func (vaultService *VaultServiceImpl) initialize(logger *logrus.Logger) {
 	vaultService.vaultClient = clients.GetVaultClient()
 }
 
-func (vaultService *VaultServiceImpl) UnsealVault(vaultApiUrl string, unsealKeys []string) error {
+func (vaultService *VaultServiceImpl) UnsealVault(vaultApiUrl string, unsealKeys []*clients.Secret) error {
 	//         curl -i --request PUT --data @/var/zevrant-services/vault-keys/vault-key-1 https://${URL}/v1/sys/unseal
 	//		   status=$(curl https://${URL}/v1/sys/seal-status | jq .sealed)
 
 	//Checking if vault is up
 	initialized := false
+	migrate := false
+	// vault is initialized by whoever holds the unseal keys, however long that takes
 	for !initialized {
 		vaultStatus, getVaultStatusError := vaultService.vaultClient.GetVaultStatus(vaultApiUrl)
 
@@ -35,10 +115,20 @@ func (vaultService *VaultServiceImpl) UnsealVault(vaultApiUrl string, unsealKeys
 			return getVaultStatusError
 		}
 		initialized = vaultStatus.Initialized
+		// vault started with an auto-unseal seal over a shamir sealed store only takes the shamir keys to migrate it
+		migrate = vaultStatus.Migration
+		if !initialized {
+			vaultService.logger.Debugf("Vault at %s is not initialized yet, waiting...", vaultApiUrl)
+			time.Sleep(vaultPollInterval)
+		}
+	}
+
+	if migrate {
+		vaultService.logger.Infof("Vault at %s is migrating its seal, submitting the shamir keys to migrate it", vaultApiUrl)
 	}
 
 	for _, key := range unsealKeys {
-		submitUnsealKeyError := vaultService.vaultClient.SubmitUnsealKey(vaultApiUrl, key)
+		submitUnsealKeyError := vaultService.vaultClient.SubmitUnsealKey(vaultApiUrl, key, migrate)
 
 		if submitUnsealKeyError != nil {
 			return submitUnsealKeyError
@@ -51,10 +141,458 @@ func (vaultService *VaultServiceImpl) UnsealVault(vaultApiUrl string, unsealKeys
 		return getVaultStatusError
 	}
 
-	if !vaultStatus.Sealed {
+	if vaultStatus.Sealed {
 		vaultService.logger.Errorf("Vault was not unsealed after uploading all unseal keys")
 		return errors.New("vault was not unsealed after uploading all unseal keys")
 	}
 
 	return nil
 }
+
+func (vaultService *VaultServiceImpl) GetSealStatus(vaultApiUrl string) (*clients.VaultStatusResponse, error) {
+	return vaultService.vaultClient.GetVaultStatus(vaultApiUrl)
+}
+
+// FindRaftLeader asks each peer who the active node is and returns the api address of the first leader reported,
+// nil is returned when no peer knows of a leader
+func (vaultService *VaultServiceImpl) FindRaftLeader(peerApiUrls []string) (*string, error) {
+	for _, peerApiUrl := range peerApiUrls {
+		leaderResponse, getLeaderError := vaultService.vaultClient.GetLeader(peerApiUrl)
+
+		if getLeaderError != nil {
+			vaultService.logger.Warnf("Unable to retrieve leader from raft peer %s: %s", peerApiUrl, getLeaderError.Error())
+			continue
+		}
+
+		if leaderResponse.HaEnabled && leaderResponse.LeaderAddress != "" {
+			vaultService.logger.Debugf("Raft peer %s reports leader %s", peerApiUrl, leaderResponse.LeaderAddress)
+			leaderAddress := leaderResponse.LeaderAddress
+			return &leaderAddress, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (vaultService *VaultServiceImpl) JoinRaftCluster(vaultApiUrl string, leaderApiUrl string, tlsMaterial RaftTlsMaterial) error {
+	vaultService.logger.Infof("Joining raft cluster led by %s", leaderApiUrl)
+
+	joinResponse, joinError := vaultService.vaultClient.JoinRaftCluster(vaultApiUrl, clients.RaftJoinRequest{
+		LeaderApiAddr:    leaderApiUrl,
+		LeaderCaCert:     tlsMaterial.LeaderCaCert,
+		LeaderClientCert: tlsMaterial.LeaderClientCert,
+		LeaderClientKey:  string(tlsMaterial.LeaderClientKey.Bytes()),
+		Retry:            false,
+	})
+
+	if joinError != nil {
+		return joinError
+	}
+
+	if !joinResponse.Joined {
+		vaultService.logger.Errorf("Vault at %s was not joined to the raft cluster led by %s", vaultApiUrl, leaderApiUrl)
+		return fmt.Errorf("vault at %s was not joined to the raft cluster led by %s", vaultApiUrl, leaderApiUrl)
+	}
+
+	return nil
+}
+
+// VerifyRaftMembership confirms the node is listed as a voter in the raft configuration, the configuration
+// endpoint requires a token so it is read through the cluster rather than the local node
+func (vaultService *VaultServiceImpl) VerifyRaftMembership(vaultApiUrl string, nodeId string, token *clients.Secret) error {
+	for attempt := 0; attempt < vaultPollAttempts; attempt++ {
+		configuration, getConfigurationError := vaultService.vaultClient.GetRaftConfiguration(vaultApiUrl, token)
+
+		if getConfigurationError != nil {
+			return getConfigurationError
+		}
+
+		for _, server := range configuration.Data.Config.Servers {
+			if server.NodeId == nodeId && server.Voter {
+				vaultService.logger.Infof("Vault node %s is a voting member of the raft cluster", nodeId)
+				return nil
+			}
+		}
+
+		vaultService.logger.Debugf("Vault node %s not yet a voter in the raft configuration, waiting...", nodeId)
+		time.Sleep(vaultPollInterval)
+	}
+
+	vaultService.logger.Errorf("Vault node %s never became a voting member of the raft cluster", nodeId)
+	return fmt.Errorf("vault node %s never became a voting member of the raft cluster", nodeId)
+}
+
+// WaitForRaftLeader is the unauthenticated fallback for membership verification, it waits for the local node
+// to report the expected leader which only happens once it has caught up with the cluster
+func (vaultService *VaultServiceImpl) WaitForRaftLeader(vaultApiUrl string, leaderApiUrl string) error {
+	for attempt := 0; attempt < vaultPollAttempts; attempt++ {
+		leaderResponse, getLeaderError := vaultService.vaultClient.GetLeader(vaultApiUrl)
+
+		if getLeaderError != nil {
+			return getLeaderError
+		}
+
+		if leaderResponse.LeaderAddress == leaderApiUrl && leaderResponse.RaftAppliedIndex > 0 {
+			vaultService.logger.Infof("Vault at %s follows raft leader %s", vaultApiUrl, leaderApiUrl)
+			return nil
+		}
+
+		vaultService.logger.Debugf("Vault at %s reports leader %q, waiting for %s", vaultApiUrl, leaderResponse.LeaderAddress, leaderApiUrl)
+		time.Sleep(vaultPollInterval)
+	}
+
+	vaultService.logger.Errorf("Vault at %s never reported %s as its raft leader", vaultApiUrl, leaderApiUrl)
+	return fmt.Errorf("vault at %s never reported %s as its raft leader", vaultApiUrl, leaderApiUrl)
+}
+
+func (vaultService *VaultServiceImpl) LoginAppRole(vaultApiUrl string, mountPath string, roleId string, secretId *clients.Secret) (*clients.Secret, error) {
+	if mountPath == "" {
+		mountPath = "approle"
+	}
+
+	authResponse, loginError := vaultService.vaultClient.LoginAppRole(vaultApiUrl, mountPath, roleId, secretId)
+
+	if loginError != nil {
+		return nil, loginError
+	}
+
+	if authResponse.Auth.ClientToken.IsEmpty() {
+		vaultService.logger.Errorf("Approle login at %s returned no client token", vaultApiUrl)
+		return nil, fmt.Errorf("approle login at %s returned no client token", vaultApiUrl)
+	}
+
+	return authResponse.Auth.ClientToken, nil
+}
+
+// WaitForUnseal waits up to timeout for a vault using auto-unseal to report itself as unsealed, no keys are submitted
+func (vaultService *VaultServiceImpl) WaitForUnseal(vaultApiUrl string, timeout time.Duration) error {
+	for deadline := time.Now().Add(timeout); ; {
+		vaultStatus, getVaultStatusError := vaultService.vaultClient.GetVaultStatus(vaultApiUrl)
+
+		if getVaultStatusError != nil {
+			vaultService.logger.Debugf("Vault at %s not yet responding: %s", vaultApiUrl, getVaultStatusError.Error())
+		} else if vaultStatus.Initialized && !vaultStatus.Sealed {
+			vaultService.logger.Infof("Vault at %s is unsealed using %s seal", vaultApiUrl, vaultStatus.Type)
+			return nil
+		}
+
+		if time.Now().Add(vaultPollInterval).After(deadline) {
+			vaultService.logger.Errorf("Vault at %s did not come up unsealed within %s", vaultApiUrl, timeout)
+			return fmt.Errorf("vault at %s did not come up unsealed within %s", vaultApiUrl, timeout)
+		}
+		time.Sleep(vaultPollInterval)
+	}
+}
+
+func (vaultService *VaultServiceImpl) Authenticate(vaultApiUrl string, auth VaultAuth) (*clients.Secret, error) {
+	session, loginError := vaultService.Login(vaultApiUrl, auth)
+
+	if loginError != nil {
+		return nil, loginError
+	}
+
+	return session.token, nil
+}
+
+// Login authenticates against vault and returns a session whose token is renewed, or replaced by logging in
+// again, whenever it is requested through SessionToken close to expiring
+func (vaultService *VaultServiceImpl) Login(vaultApiUrl string, auth VaultAuth) (*VaultSession, error) {
+	session := &VaultSession{Address: vaultApiUrl, auth: auth}
+
+	loginError := vaultService.login(session)
+
+	if loginError != nil {
+		return nil, loginError
+	}
+
+	return session, nil
+}
+
+func (vaultService *VaultServiceImpl) login(session *VaultSession) error {
+	var authResponse *clients.VaultAuthResponse
+	var loginError error
+
+	switch session.auth.Method {
+	case TokenAuth:
+		lookupResponse, lookupError := vaultService.vaultClient.LookupSelfToken(session.Address, session.auth.Token)
+
+		if lookupError != nil {
+			return lookupError
+		}
+		session.update(session.auth.Token, lookupResponse.Data.Renewable, lookupResponse.Data.Ttl)
+		return nil
+	case AppRoleAuth:
+		mountPath := session.auth.MountPath
+		if mountPath == "" {
+			mountPath = "approle"
+		}
+		authResponse, loginError = vaultService.vaultClient.LoginAppRole(session.Address, mountPath, session.auth.RoleId, session.auth.SecretId)
+	case CertAuth:
+		mountPath := session.auth.MountPath
+		if mountPath == "" {
+			mountPath = "cert"
+		}
+
+		clientCertificate, loadKeyPairError := tls.X509KeyPair(session.auth.ClientCert, session.auth.ClientKey.Bytes())
+
+		if loadKeyPairError != nil {
+			vaultService.logger.Errorf("Failed to load client certificate for cert auth: %s", loadKeyPairError.Error())
+			return loadKeyPairError
+		}
+
+		authResponse, loginError = vaultService.vaultClient.LoginCert(session.Address, mountPath, session.auth.CertName, clientCertificate)
+	default:
+		vaultService.logger.Errorf("Unsupported vault auth method %q", session.auth.Method)
+		return fmt.Errorf("unsupported vault auth method %q", session.auth.Method)
+	}
+
+	if loginError != nil {
+		return loginError
+	}
+
+	if authResponse.Auth.ClientToken.IsEmpty() {
+		vaultService.logger.Errorf("%s login at %s returned no client token", session.auth.Method, session.Address)
+		return fmt.Errorf("%s login at %s returned no client token", session.auth.Method, session.Address)
+	}
+
+	session.update(authResponse.Auth.ClientToken, authResponse.Auth.Renewable, authResponse.Auth.LeaseDuration)
+	return nil
+}
+
+// SessionToken returns a copy of the session token for the caller to destroy once it is used, the session destroys
+// its own token when it is replaced while a caller may still hold it. The token is renewed once less than a third of
+// its lease remains and replaced by logging in again when renewal is not possible
+func (vaultService *VaultServiceImpl) SessionToken(session *VaultSession) (*clients.Secret, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	refreshError := vaultService.refreshToken(session)
+
+	if refreshError != nil {
+		return nil, refreshError
+	}
+
+	return clients.NewSecret(bytes.Clone(session.token.Bytes())), nil
+}
+
+func (vaultService *VaultServiceImpl) refreshToken(session *VaultSession) error {
+	if session.leaseDuration == 0 || time.Until(session.expiresAt) > session.leaseDuration/3 {
+		return nil
+	}
+
+	if session.renewable {
+		renewResponse, renewError := vaultService.vaultClient.RenewSelfToken(session.Address, session.token)
+
+		if renewError == nil {
+			vaultService.logger.Debugf("Renewed vault token for %s, lease is now %ds", session.Address, renewResponse.Auth.LeaseDuration)
+			// renewal returns the same token, the copy in the response is not needed
+			renewResponse.Auth.ClientToken.Destroy()
+			session.update(session.token, renewResponse.Auth.Renewable, renewResponse.Auth.LeaseDuration)
+			return nil
+		}
+		vaultService.logger.Warnf("Failed to renew vault token for %s, logging in again: %s", session.Address, renewError.Error())
+	}
+
+	if session.auth.Method == TokenAuth && time.Now().After(session.expiresAt) {
+		vaultService.logger.Errorf("Vault token for %s has expired and cannot be replaced", session.Address)
+		return fmt.Errorf("vault token for %s has expired", session.Address)
+	}
+
+	return vaultService.login(session)
+}
+
+func (vaultService *VaultServiceImpl) ReadKvSecret(session *VaultSession, secretPath string) (map[string]interface{}, error) {
+	token, getTokenError := vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return nil, getTokenError
+	}
+	defer token.Destroy()
+
+	secretResponse, readSecretError := vaultService.vaultClient.ReadKvSecret(session.Address, token, strings.Trim(secretPath, "/"))
+
+	if readSecretError != nil {
+		return nil, readSecretError
+	}
+
+	if secretResponse.Data.Data == nil {
+		vaultService.logger.Errorf("Secret %s has no data, is it a KV v2 path including the data segment?", secretPath)
+		return nil, fmt.Errorf("secret %s has no data", secretPath)
+	}
+
+	vaultService.logger.Debugf("Read version %d of secret %s", secretResponse.Data.Metadata.Version, secretPath)
+	return secretResponse.Data.Data, nil
+}
+
+func (vaultService *VaultServiceImpl) IssueCertificate(vaultApiUrl string, token *clients.Secret, mountPath string, role string, issueRequest clients.PkiIssueRequest) (*clients.PkiIssueResponse, error) {
+	issueResponse, issueError := vaultService.vaultClient.IssueCertificate(vaultApiUrl, token, strings.Trim(mountPath, "/"), role, issueRequest)
+
+	if issueError != nil {
+		return nil, issueError
+	}
+
+	if issueResponse.Data.Certificate == "" || issueResponse.Data.PrivateKey.IsEmpty() {
+		issueResponse.Data.PrivateKey.Destroy()
+		vaultService.logger.Errorf("Vault returned an incomplete certificate from %s/issue/%s", mountPath, role)
+		return nil, fmt.Errorf("vault returned an incomplete certificate from %s/issue/%s", mountPath, role)
+	}
+
+	return issueResponse, nil
+}
+
+func (vaultService *VaultServiceImpl) DownloadRaftSnapshot(session *VaultSession, writer io.Writer) (int64, error) {
+	token, getTokenError := vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return 0, getTokenError
+	}
+	defer token.Destroy()
+
+	return vaultService.vaultClient.DownloadRaftSnapshot(session.Address, token, writer)
+}
+
+func (vaultService *VaultServiceImpl) RestoreRaftSnapshot(session *VaultSession, snapshot io.Reader, force bool) error {
+	token, getTokenError := vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return getTokenError
+	}
+	defer token.Destroy()
+
+	vaultService.logger.Infof("Restoring raft snapshot to %s", session.Address)
+	return vaultService.vaultClient.RestoreRaftSnapshot(session.Address, token, snapshot, force)
+}
+
+// ApplyAuditDevices enables every desired audit device that is missing. Audit devices cannot be changed in place and
+// disabling one drops its log, so a device that differs from the desired one is reported and left alone
+func (vaultService *VaultServiceImpl) ApplyAuditDevices(session *VaultSession, desired map[string]clients.VaultAuditDevice) error {
+	token, getTokenError := vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return getTokenError
+	}
+	defer token.Destroy()
+
+	current, listError := vaultService.vaultClient.ListAuditDevices(session.Address, token)
+
+	if listError != nil {
+		return listError
+	}
+
+	for path, auditDevice := range desired {
+		path = strings.Trim(path, "/")
+		existing, enabled := current[path+"/"]
+
+		if !enabled {
+			vaultService.logger.Infof("Enabling %s audit device at %s", auditDevice.Type, path)
+			enableError := vaultService.vaultClient.EnableAuditDevice(session.Address, token, path, auditDevice)
+
+			if enableError != nil {
+				return enableError
+			}
+			continue
+		}
+
+		if existing.Type != auditDevice.Type || !optionsMatch(existing.Options, auditDevice.Options) {
+			vaultService.logger.Warnf("Audit device %s differs from its desired configuration and must be replaced manually", path)
+			continue
+		}
+		vaultService.logger.Debugf("Audit device %s is up to date", path)
+	}
+	return nil
+}
+
+// ApplyAuthMethods enables every desired auth method that is missing, a path already mounted with another type
+// is an error since remounting it would invalidate every token issued by it
+func (vaultService *VaultServiceImpl) ApplyAuthMethods(session *VaultSession, desired map[string]clients.VaultAuthMount) error {
+	token, getTokenError := vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return getTokenError
+	}
+	defer token.Destroy()
+
+	current, listError := vaultService.vaultClient.ListAuthMethods(session.Address, token)
+
+	if listError != nil {
+		return listError
+	}
+
+	for path, authMount := range desired {
+		path = strings.Trim(path, "/")
+		existing, enabled := current[path+"/"]
+
+		if !enabled {
+			vaultService.logger.Infof("Enabling %s auth method at %s", authMount.Type, path)
+			enableError := vaultService.vaultClient.EnableAuthMethod(session.Address, token, path, authMount)
+
+			if enableError != nil {
+				return enableError
+			}
+			continue
+		}
+
+		if existing.Type != authMount.Type {
+			vaultService.logger.Errorf("Auth path %s is mounted as %s but %s is desired", path, existing.Type, authMount.Type)
+			return fmt.Errorf("auth path %s is mounted as %s, not %s", path, existing.Type, authMount.Type)
+		}
+		vaultService.logger.Debugf("Auth method %s is up to date", path)
+	}
+	return nil
+}
+
+// ApplyAclPolicies writes each desired policy that is missing or whose text differs, policies that are not
+// declared are left untouched
+func (vaultService *VaultServiceImpl) ApplyAclPolicies(session *VaultSession, desired map[string]string) error {
+	token, getTokenError := vaultService.SessionToken(session)
+
+	if getTokenError != nil {
+		return getTokenError
+	}
+	defer token.Destroy()
+
+	current, listError := vaultService.vaultClient.ListAclPolicies(session.Address, token)
+
+	if listError != nil {
+		return listError
+	}
+
+	for name, policy := range desired {
+		exists := false
+		for _, currentName := range current {
+			exists = exists || currentName == name
+		}
+
+		if exists {
+			currentPolicy, readError := vaultService.vaultClient.ReadAclPolicy(session.Address, token, name)
+
+			if readError != nil {
+				return readError
+			}
+
+			if strings.TrimSpace(currentPolicy) == strings.TrimSpace(policy) {
+				vaultService.logger.Debugf("Policy %s is up to date", name)
+				continue
+			}
+			vaultService.logger.Infof("Updating policy %s", name)
+		} else {
+			vaultService.logger.Infof("Creating policy %s", name)
+		}
+
+		writeError := vaultService.vaultClient.WriteAclPolicy(session.Address, token, name, policy)
+
+		if writeError != nil {
+			return writeError
+		}
+	}
+	return nil
+}
+
+func optionsMatch(current map[string]string, desired map[string]string) bool {
+	for key, value := range desired {
+		if current[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVaultService(vaultClient clients.VaultClient) *VaultServiceImpl {
+	return &VaultServiceImpl{logger: &logrus.Logger{}, vaultClient: vaultClient}
+}
+
+func TestVaultServiceImpl_UnsealVault(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	testUrl := "https://vault:8200"
+	key1 := clients.NewSecret([]byte("key1"))
+	key2 := clients.NewSecret([]byte("key2"))
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	gomock.InOrder(
+		mockVaultClient.EXPECT().GetVaultStatus(testUrl).Return(&clients.VaultStatusResponse{Initialized: true, Sealed: true}, nil),
+		mockVaultClient.EXPECT().SubmitUnsealKey(testUrl, key1, false).Return(nil),
+		mockVaultClient.EXPECT().SubmitUnsealKey(testUrl, key2, false).Return(nil),
+		mockVaultClient.EXPECT().GetVaultStatus(testUrl).Return(&clients.VaultStatusResponse{Initialized: true, Sealed: false}, nil),
+	)
+
+	unsealError := newTestVaultService(mockVaultClient).UnsealVault(testUrl, []*clients.Secret{key1, key2})
+
+	assert.Nil(t, unsealError)
+}
+
+func TestVaultServiceImpl_UnsealVault_stillSealed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	testUrl := "https://vault:8200"
+	key1 := clients.NewSecret([]byte("key1"))
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	gomock.InOrder(
+		mockVaultClient.EXPECT().GetVaultStatus(testUrl).Return(&clients.VaultStatusResponse{Initialized: true, Sealed: true}, nil),
+		mockVaultClient.EXPECT().SubmitUnsealKey(testUrl, key1, false).Return(nil),
+		mockVaultClient.EXPECT().GetVaultStatus(testUrl).Return(&clients.VaultStatusResponse{Initialized: true, Sealed: true}, nil),
+	)
+
+	unsealError := newTestVaultService(mockVaultClient).UnsealVault(testUrl, []*clients.Secret{key1})
+
+	assert.NotNil(t, unsealError)
+}
+
+func TestVaultServiceImpl_UnsealVault_migration(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	testUrl := "https://vault:8200"
+	key1 := clients.NewSecret([]byte("key1"))
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	gomock.InOrder(
+		mockVaultClient.EXPECT().GetVaultStatus(testUrl).Return(&clients.VaultStatusResponse{Type: "shamir", Initialized: true, Sealed: true, Migration: true}, nil),
+		mockVaultClient.EXPECT().SubmitUnsealKey(testUrl, key1, true).Return(nil),
+		mockVaultClient.EXPECT().GetVaultStatus(testUrl).Return(&clients.VaultStatusResponse{Type: "transit", Initialized: true, Sealed: false}, nil),
+	)
+
+	unsealError := newTestVaultService(mockVaultClient).UnsealVault(testUrl, []*clients.Secret{key1})
+
+	assert.Nil(t, unsealError)
+}
+
+func TestVaultServiceImpl_FindRaftLeader(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().GetLeader("https://peer1:8200").Return(nil, errors.New("connection refused"))
+	mockVaultClient.EXPECT().GetLeader("https://peer2:8200").Return(&clients.VaultLeaderResponse{HaEnabled: true, LeaderAddress: "https://peer3:8200"}, nil)
+
+	leader, findLeaderError := newTestVaultService(mockVaultClient).FindRaftLeader([]string{"https://peer1:8200", "https://peer2:8200"})
+
+	assert.Nil(t, findLeaderError)
+	assert.Equal(t, "https://peer3:8200", *leader)
+}
+
+func TestVaultServiceImpl_FindRaftLeader_noLeader(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().GetLeader("https://peer1:8200").Return(&clients.VaultLeaderResponse{HaEnabled: true}, nil)
+
+	leader, findLeaderError := newTestVaultService(mockVaultClient).FindRaftLeader([]string{"https://peer1:8200"})
+
+	assert.Nil(t, findLeaderError)
+	assert.Nil(t, leader)
+}
+
+func TestVaultServiceImpl_JoinRaftCluster_notJoined(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().
+		JoinRaftCluster("https://vault:8200", clients.RaftJoinRequest{LeaderApiAddr: "https://leader:8200", LeaderCaCert: "ca"}).
+		Return(&clients.RaftJoinResponse{Joined: false}, nil)
+
+	joinError := newTestVaultService(mockVaultClient).JoinRaftCluster("https://vault:8200", "https://leader:8200", RaftTlsMaterial{LeaderCaCert: "ca"})
+
+	assert.NotNil(t, joinError)
+}
+
+func TestVaultServiceImpl_VerifyRaftMembership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	configuration := clients.RaftConfigurationResponse{}
+	configuration.Data.Config.Servers = []clients.RaftServer{
+		{NodeId: "vault-1", Leader: true, Voter: true},
+		{NodeId: "vault-2", Voter: true},
+	}
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().GetRaftConfiguration("https://leader:8200", clients.NewSecret([]byte("token"))).Return(&configuration, nil)
+
+	verifyError := newTestVaultService(mockVaultClient).VerifyRaftMembership("https://leader:8200", "vault-2", clients.NewSecret([]byte("token")))
+
+	assert.Nil(t, verifyError)
+}
+
+func TestVaultServiceImpl_WaitForUnseal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().GetVaultStatus("https://vault:8200").Return(&clients.VaultStatusResponse{Type: "transit", Initialized: true, Sealed: false}, nil)
+
+	waitError := newTestVaultService(mockVaultClient).WaitForUnseal("https://vault:8200", time.Minute)
+
+	assert.Nil(t, waitError)
+}
+
+func TestVaultServiceImpl_WaitForUnseal_timeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().GetVaultStatus("https://vault:8200").Return(&clients.VaultStatusResponse{Type: "transit", Initialized: true, Sealed: true}, nil)
+
+	waitError := newTestVaultService(mockVaultClient).WaitForUnseal("https://vault:8200", time.Second)
+
+	assert.ErrorContains(t, waitError, "did not come up unsealed within 1s")
+}
+
+func TestVaultServiceImpl_LoginAppRole_noToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().LoginAppRole("https://vault:8200", "approle", "role", clients.NewSecret([]byte("secret"))).Return(&clients.VaultAuthResponse{}, nil)
+
+	token, loginError := newTestVaultService(mockVaultClient).LoginAppRole("https://vault:8200", "", "role", clients.NewSecret([]byte("secret")))
+
+	assert.NotNil(t, loginError)
+	assert.Nil(t, token)
+}
+
+func TestVaultServiceImpl_SessionToken_renewsNearExpiry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	renewResponse := clients.VaultAuthResponse{}
+	renewResponse.Auth.LeaseDuration = 3600
+	renewResponse.Auth.Renewable = true
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().RenewSelfToken("https://vault:8200", clients.NewSecret([]byte("token"))).Return(&renewResponse, nil)
+
+	session := &VaultSession{Address: "https://vault:8200", auth: VaultAuth{Method: AppRoleAuth}}
+	session.update(clients.NewSecret([]byte("token")), true, 3600)
+	session.expiresAt = session.expiresAt.Add(-session.leaseDuration)
+
+	token, getTokenError := newTestVaultService(mockVaultClient).SessionToken(session)
+
+	assert.Nil(t, getTokenError)
+	assert.Equal(t, "token", token.Reveal())
+}
+
+func TestVaultServiceImpl_SessionToken_valid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	session := &VaultSession{Address: "https://vault:8200"}
+	session.update(clients.NewSecret([]byte("token")), true, 3600)
+
+	token, getTokenError := newTestVaultService(clients.NewMockVaultClient(ctrl)).SessionToken(session)
+
+	assert.Nil(t, getTokenError)
+	assert.Equal(t, "token", token.Reveal())
+
+	// callers destroy their copy without touching the session token
+	token.Destroy()
+	assert.Equal(t, "token", session.token.Reveal())
+}
+
+func TestVaultServiceImpl_ApplyAuditDevices(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	session := &VaultSession{Address: "https://vault:8200"}
+	session.update(clients.NewSecret([]byte("token")), false, 0)
+	fileAudit := clients.VaultAuditDevice{Type: "file", Options: map[string]string{"file_path": "/var/log/vault/audit.log"}}
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().ListAuditDevices("https://vault:8200", clients.NewSecret([]byte("token"))).Return(map[string]clients.VaultAuditDevice{"file/": fileAudit}, nil)
+	mockVaultClient.EXPECT().EnableAuditDevice("https://vault:8200", clients.NewSecret([]byte("token")), "syslog", clients.VaultAuditDevice{Type: "syslog"}).Return(nil)
+
+	applyError := newTestVaultService(mockVaultClient).ApplyAuditDevices(session, map[string]clients.VaultAuditDevice{
+		"file":    fileAudit,
+		"syslog/": {Type: "syslog"},
+	})
+
+	assert.Nil(t, applyError)
+}
+
+func TestVaultServiceImpl_ApplyAuthMethods_typeConflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	session := &VaultSession{Address: "https://vault:8200"}
+	session.update(clients.NewSecret([]byte("token")), false, 0)
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().ListAuthMethods("https://vault:8200", clients.NewSecret([]byte("token"))).Return(map[string]clients.VaultAuthMount{"approle/": {Type: "userpass"}}, nil)
+
+	applyError := newTestVaultService(mockVaultClient).ApplyAuthMethods(session, map[string]clients.VaultAuthMount{"approle": {Type: "approle"}})
+
+	assert.NotNil(t, applyError)
+}
+
+func TestVaultServiceImpl_ApplyAclPolicies(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	session := &VaultSession{Address: "https://vault:8200"}
+	session.update(clients.NewSecret([]byte("token")), false, 0)
+
+	mockVaultClient := clients.NewMockVaultClient(ctrl)
+	mockVaultClient.EXPECT().ListAclPolicies("https://vault:8200", clients.NewSecret([]byte("token"))).Return([]string{"default", "root", "admin", "k8s"}, nil)
+	mockVaultClient.EXPECT().ReadAclPolicy("https://vault:8200", clients.NewSecret([]byte("token")), "admin").Return("path \"*\" {}\n", nil)
+	mockVaultClient.EXPECT().ReadAclPolicy("https://vault:8200", clients.NewSecret([]byte("token")), "k8s").Return("path \"secret/*\" {}", nil)
+	mockVaultClient.EXPECT().WriteAclPolicy("https://vault:8200", clients.NewSecret([]byte("token")), "k8s", "path \"secret/k8s/*\" {}").Return(nil)
+	mockVaultClient.EXPECT().WriteAclPolicy("https://vault:8200", clients.NewSecret([]byte("token")), "backup", "path \"sys/storage/raft/snapshot\" {}").Return(nil)
+
+	applyError := newTestVaultService(mockVaultClient).ApplyAclPolicies(session, map[string]string{
+		"admin":  "path \"*\" {}",
+		"k8s":    "path \"secret/k8s/*\" {}",
+		"backup": "path \"sys/storage/raft/snapshot\" {}",
+	})
+
+	assert.Nil(t, applyError)
+}
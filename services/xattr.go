@@ -0,0 +1,279 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const defaultSeLinuxLevel = "s0"
+
+// GetRootFsXattr reads an extended attribute of path, symlinks are not followed
+func (filesystemService *FileSystemServiceImpl) GetRootFsXattr(path string, name string) ([]byte, error) {
+	value, getXattrError := filesystemService.osClient.GetXattr(path, name)
+
+	if getXattrError != nil {
+		filesystemService.logger.Errorf("Failed to read xattr %s of %s: %s", name, path, getXattrError.Error())
+		return nil, getXattrError
+	}
+	return value, nil
+}
+
+// SetRootFsXattr sets an extended attribute of path, symlinks are not followed
+func (filesystemService *FileSystemServiceImpl) SetRootFsXattr(path string, name string, value []byte) error {
+	setXattrError := filesystemService.osClient.SetXattr(path, name, value)
+
+	if setXattrError != nil {
+		filesystemService.logger.Errorf("Failed to set xattr %s of %s: %s", name, path, setXattrError.Error())
+		return setXattrError
+	}
+	return nil
+}
+
+// ListRootFsXattrs lists the names of the extended attributes of path
+func (filesystemService *FileSystemServiceImpl) ListRootFsXattrs(path string) ([]string, error) {
+	names, listXattrsError := filesystemService.osClient.ListXattrs(path)
+
+	if listXattrsError != nil {
+		filesystemService.logger.Errorf("Failed to list the xattrs of %s: %s", path, listXattrsError.Error())
+		return nil, listXattrsError
+	}
+	return names, nil
+}
+
+// RemoveRootFsXattr removes an extended attribute of path, one that is not set is not an error
+func (filesystemService *FileSystemServiceImpl) RemoveRootFsXattr(path string, name string) error {
+	removeXattrError := filesystemService.osClient.RemoveXattr(path, name)
+
+	if removeXattrError != nil && !errors.Is(removeXattrError, syscall.ENODATA) {
+		filesystemService.logger.Errorf("Failed to remove xattr %s of %s: %s", name, path, removeXattrError.Error())
+		return removeXattrError
+	}
+	return nil
+}
+
+// GetRootFsAcl reads the access ACL of path and, for a directory, its default ACL. A path without an ACL returns the
+// entries its mode implies
+func (filesystemService *FileSystemServiceImpl) GetRootFsAcl(path string) ([]AclEntry, error) {
+	fileInfo, statError := filesystemService.osClient.LstatFile(path)
+
+	if statError != nil {
+		filesystemService.logger.Errorf("Failed to retrieve %s to read its ACL: %s", path, statError.Error())
+		return nil, statError
+	}
+
+	var acl []AclEntry
+	for _, xattr := range []string{aclAccessXattr, aclDefaultXattr} {
+		isDefault := xattr == aclDefaultXattr
+		if isDefault && !fileInfo.IsDir() {
+			continue
+		}
+
+		encoded, getXattrError := filesystemService.osClient.GetXattr(path, xattr)
+
+		if errors.Is(getXattrError, syscall.ENODATA) && !isDefault {
+			mode := fileInfo.Mode().Perm()
+			acl = append(acl,
+				AclEntry{Tag: AclUserObj, Perms: (mode >> 6) & 7},
+				AclEntry{Tag: AclGroupObj, Perms: (mode >> 3) & 7},
+				AclEntry{Tag: AclOther, Perms: mode & 7})
+			continue
+		} else if errors.Is(getXattrError, syscall.ENODATA) {
+			continue
+		} else if getXattrError != nil {
+			filesystemService.logger.Errorf("Failed to read the ACL of %s: %s", path, getXattrError.Error())
+			return nil, getXattrError
+		}
+
+		entries, decodeError := decodeAcl(encoded, isDefault)
+
+		if decodeError != nil {
+			filesystemService.logger.Errorf("Failed to decode the ACL of %s: %s", path, decodeError.Error())
+			return nil, decodeError
+		}
+		acl = append(acl, entries...)
+	}
+	return acl, nil
+}
+
+// SetRootFsAcl replaces the access ACL of path, and its default ACL when acl has default entries. Owner, group and
+// other entries missing from acl are taken from the mode of path and the mask is computed when there are named
+// entries, as setfacl does
+func (filesystemService *FileSystemServiceImpl) SetRootFsAcl(path string, acl []AclEntry) error {
+	fileInfo, statError := filesystemService.osClient.LstatFile(path)
+
+	if statError != nil {
+		filesystemService.logger.Errorf("Failed to retrieve %s to set its ACL: %s", path, statError.Error())
+		return statError
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		filesystemService.logger.Errorf("Cannot set an ACL on symlink %s", path)
+		return fmt.Errorf("cannot set an ACL on symlink %s", path)
+	}
+	return filesystemService.applyAcl(path, acl, fileInfo.Mode().Perm(), fileInfo.IsDir())
+}
+
+// applyAcl sets acl on path, whose mode is mode
+func (filesystemService *FileSystemServiceImpl) applyAcl(path string, acl []AclEntry, mode os.FileMode, isDirectory bool) error {
+	var accessEntries, defaultEntries []AclEntry
+	for _, entry := range acl {
+		if entry.Default {
+			defaultEntries = append(defaultEntries, entry)
+		} else {
+			accessEntries = append(accessEntries, entry)
+		}
+	}
+
+	if len(defaultEntries) > 0 && !isDirectory {
+		filesystemService.logger.Errorf("Cannot set a default ACL on %s, it is not a directory", path)
+		return fmt.Errorf("cannot set a default ACL on %s, it is not a directory", path)
+	}
+
+	for _, xattrAcl := range []struct {
+		xattr   string
+		entries []AclEntry
+	}{{aclAccessXattr, accessEntries}, {aclDefaultXattr, defaultEntries}} {
+		if len(xattrAcl.entries) == 0 {
+			continue
+		}
+
+		// as with setfacl, X applies to directories and to files with an execute bit
+		resolvedEntries, resolveError := filesystemService.resolveAclEntries(xattrAcl.entries, isDirectory || mode&0111 != 0)
+
+		if resolveError != nil {
+			return resolveError
+		}
+
+		encoded, encodeError := encodeAcl(resolvedEntries, mode)
+
+		if encodeError != nil {
+			filesystemService.logger.Errorf("Invalid ACL for %s: %s", path, encodeError.Error())
+			return encodeError
+		}
+
+		setAclError := filesystemService.osClient.SetXattr(path, xattrAcl.xattr, encoded)
+
+		if setAclError != nil {
+			filesystemService.logger.Errorf("Failed to set the ACL of %s: %s", path, setAclError.Error())
+			return setAclError
+		}
+	}
+	return nil
+}
+
+// resolveAclEntries looks up the users and groups named by ACL entries and resolves X against whether the file is
+// executable
+func (filesystemService *FileSystemServiceImpl) resolveAclEntries(entries []AclEntry, executable bool) ([]aclXattrEntry, error) {
+	resolvedEntries := make([]aclXattrEntry, 0, len(entries))
+	for _, entry := range entries {
+		resolvedEntry := aclXattrEntry{tag: entry.Tag, perms: resolvedAclPerms(entry, executable), id: aclUndefinedId}
+
+		if entry.Tag == AclUser {
+			uid, _, lookupUserError := filesystemService.lookupUser(entry.Qualifier)
+
+			if lookupUserError != nil {
+				return nil, lookupUserError
+			}
+			resolvedEntry.id = uint32(uid)
+		} else if entry.Tag == AclGroup {
+			gid, lookupGroupError := filesystemService.lookupGroup(entry.Qualifier)
+
+			if lookupGroupError != nil {
+				return nil, lookupGroupError
+			}
+			resolvedEntry.id = uint32(gid)
+		}
+		resolvedEntries = append(resolvedEntries, resolvedEntry)
+	}
+	return resolvedEntries, nil
+}
+
+// GetSeLinuxLabel reads the SELinux label of path, such as "system_u:object_r:etc_t:s0"
+func (filesystemService *FileSystemServiceImpl) GetSeLinuxLabel(path string) (string, error) {
+	label, getLabelError := filesystemService.osClient.GetXattr(path, seLinuxXattr)
+
+	if getLabelError != nil {
+		filesystemService.logger.Errorf("Failed to read the SELinux label of %s: %s", path, getLabelError.Error())
+		return "", getLabelError
+	}
+	// the kernel terminates labels with a NUL
+	return strings.TrimRight(string(label), "\x00"), nil
+}
+
+// SetSeLinuxLabel sets the SELinux label of path, and of everything beneath it when recursive, without following
+// symlinks
+func (filesystemService *FileSystemServiceImpl) SetSeLinuxLabel(path string, label string, recursive bool) error {
+	return filesystemService.walkRootFs(path, recursive, func(entryPath string, _ os.FileInfo) error {
+		setLabelError := filesystemService.osClient.SetXattr(entryPath, seLinuxXattr, []byte(label))
+
+		if setLabelError != nil {
+			filesystemService.logger.Errorf("Failed to set the SELinux label of %s: %s", entryPath, setLabelError.Error())
+			return setLabelError
+		}
+		return nil
+	})
+}
+
+// ChangeSeLinuxContext sets the user, role and type of the SELinux label of path, and of everything beneath it when
+// recursive, keeping the level each file has. Files without a label get level s0
+func (filesystemService *FileSystemServiceImpl) ChangeSeLinuxContext(path string, seUser string, seRole string, seType string, recursive bool) error {
+	return filesystemService.walkRootFs(path, recursive, func(entryPath string, _ os.FileInfo) error {
+		level := defaultSeLinuxLevel
+		existingLabel, getLabelError := filesystemService.osClient.GetXattr(entryPath, seLinuxXattr)
+
+		if getLabelError != nil && !errors.Is(getLabelError, syscall.ENODATA) {
+			filesystemService.logger.Errorf("Failed to read the SELinux label of %s: %s", entryPath, getLabelError.Error())
+			return getLabelError
+		}
+
+		// a label is user:role:type:level and the level may itself contain colons
+		if labelFields := strings.SplitN(strings.TrimRight(string(existingLabel), "\x00"), ":", 4); len(labelFields) == 4 {
+			level = labelFields[3]
+		}
+
+		label := fmt.Sprintf("%s:%s:%s:%s", seUser, seRole, seType, level)
+		setLabelError := filesystemService.osClient.SetXattr(entryPath, seLinuxXattr, []byte(label))
+
+		if setLabelError != nil {
+			filesystemService.logger.Errorf("Failed to set the SELinux label of %s: %s", entryPath, setLabelError.Error())
+			return setLabelError
+		}
+		return nil
+	})
+}
+
+// walkRootFs calls visit for path and, when recursive, everything beneath it. Symlinks are visited but not followed
+func (filesystemService *FileSystemServiceImpl) walkRootFs(path string, recursive bool, visit func(path string, fileInfo os.FileInfo) error) error {
+	fileInfo, statError := filesystemService.osClient.LstatFile(path)
+
+	if statError != nil {
+		filesystemService.logger.Errorf("Failed to retrieve %s: %s", path, statError.Error())
+		return statError
+	}
+
+	visitError := visit(path, fileInfo)
+
+	if visitError != nil || !recursive || !fileInfo.IsDir() {
+		return visitError
+	}
+
+	directoryEntries, readDirectoryError := filesystemService.osClient.ReadDir(path)
+
+	if readDirectoryError != nil {
+		filesystemService.logger.Errorf("Failed to read directory %s: %s", path, readDirectoryError.Error())
+		return readDirectoryError
+	}
+
+	for _, entry := range directoryEntries {
+		walkError := filesystemService.walkRootFs(filepath.Join(path, entry.Name()), recursive, visit)
+
+		if walkError != nil {
+			return walkError
+		}
+	}
+	return nil
+}
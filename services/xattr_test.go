@@ -0,0 +1,173 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"zs-vm-agent/clients"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystemServiceImpl_SetRootFsAcl(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockFileInfo := NewMockFileInfo(ctrl)
+	mockFileInfo.EXPECT().Mode().Return(os.FileMode(0640)).AnyTimes()
+	mockFileInfo.EXPECT().IsDir().Return(true)
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().LstatFile("/etc/haproxy").Return(mockFileInfo, nil)
+	mockOsClient.EXPECT().SetXattr("/etc/haproxy", aclAccessXattr, gomock.Any()).DoAndReturn(func(path string, name string, value []byte) error {
+		entries, _ := decodeAcl(value, false)
+		assert.Contains(t, entries, AclEntry{Tag: AclUser, Qualifier: "985", Perms: 4})
+		return nil
+	})
+	mockOsClient.EXPECT().SetXattr("/etc/haproxy", aclDefaultXattr, gomock.Any()).DoAndReturn(func(path string, name string, value []byte) error {
+		entries, _ := decodeAcl(value, true)
+		assert.Contains(t, entries, AclEntry{Default: true, Tag: AclGroup, Qualifier: "10", Perms: 5})
+		return nil
+	})
+
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("prometheus").Return(&user.User{Uid: "985"}, nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient, userClient: mockUserClient}
+
+	setAclError := testFilesystemService.SetRootFsAcl("/etc/haproxy", []AclEntry{
+		{Tag: AclUser, Qualifier: "prometheus", Perms: 4},
+		{Default: true, Tag: AclGroup, Qualifier: "10", Perms: 5},
+	})
+
+	assert.Nil(t, setAclError)
+}
+
+func TestFileSystemServiceImpl_SetRootFsAcl_defaultOnFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockFileInfo := NewMockFileInfo(ctrl)
+	mockFileInfo.EXPECT().Mode().Return(os.FileMode(0640)).AnyTimes()
+	mockFileInfo.EXPECT().IsDir().Return(false)
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().LstatFile("/etc/haproxy/haproxy.cfg").Return(mockFileInfo, nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	setAclError := testFilesystemService.SetRootFsAcl("/etc/haproxy/haproxy.cfg", []AclEntry{{Default: true, Tag: AclOther, Perms: 4}})
+
+	assert.EqualError(t, setAclError, "cannot set a default ACL on /etc/haproxy/haproxy.cfg, it is not a directory")
+}
+
+func TestFileSystemServiceImpl_GetRootFsAcl_noAcl(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockFileInfo := NewMockFileInfo(ctrl)
+	mockFileInfo.EXPECT().Mode().Return(os.FileMode(0750)).AnyTimes()
+	mockFileInfo.EXPECT().IsDir().Return(true).AnyTimes()
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().LstatFile("/etc/named").Return(mockFileInfo, nil)
+	mockOsClient.EXPECT().GetXattr("/etc/named", gomock.Any()).Return(nil, syscall.ENODATA).Times(2)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	acl, getAclError := testFilesystemService.GetRootFsAcl("/etc/named")
+
+	assert.Nil(t, getAclError)
+	assert.Equal(t, []AclEntry{{Tag: AclUserObj, Perms: 7}, {Tag: AclGroupObj, Perms: 5}, {Tag: AclOther}}, acl)
+}
+
+func TestFileSystemServiceImpl_GetSeLinuxLabel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().GetXattr("/etc/named.conf", seLinuxXattr).Return([]byte("system_u:object_r:named_conf_t:s0\x00"), nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	label, getLabelError := testFilesystemService.GetSeLinuxLabel("/etc/named.conf")
+
+	assert.Nil(t, getLabelError)
+	assert.Equal(t, "system_u:object_r:named_conf_t:s0", label)
+}
+
+func TestFileSystemServiceImpl_ChangeSeLinuxContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rootPath := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(rootPath, "haproxy.cfg"), []byte("global\n"), 0644))
+	assert.Nil(t, os.Symlink("/etc/passwd", filepath.Join(rootPath, "link")))
+
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().LstatFile(gomock.Any()).DoAndReturn(os.Lstat).AnyTimes()
+	mockOsClient.EXPECT().ReadDir(gomock.Any()).DoAndReturn(os.ReadDir).AnyTimes()
+	mockOsClient.EXPECT().GetXattr(rootPath, seLinuxXattr).Return([]byte("unconfined_u:object_r:user_tmp_t:s0:c1,c2\x00"), nil)
+	mockOsClient.EXPECT().GetXattr(filepath.Join(rootPath, "haproxy.cfg"), seLinuxXattr).Return(nil, syscall.ENODATA)
+	mockOsClient.EXPECT().GetXattr(filepath.Join(rootPath, "link"), seLinuxXattr).Return([]byte("system_u:object_r:etc_t:s0"), nil)
+	// each file keeps its level and the symlink is labelled rather than followed
+	mockOsClient.EXPECT().SetXattr(rootPath, seLinuxXattr, []byte("system_u:object_r:etc_t:s0:c1,c2")).Return(nil)
+	mockOsClient.EXPECT().SetXattr(filepath.Join(rootPath, "haproxy.cfg"), seLinuxXattr, []byte("system_u:object_r:etc_t:s0")).Return(nil)
+	mockOsClient.EXPECT().SetXattr(filepath.Join(rootPath, "link"), seLinuxXattr, []byte("system_u:object_r:etc_t:s0")).Return(nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+	testSeLinuxService := SeLinuxServiceImpl{}
+	testSeLinuxService.initialize(&logrus.Logger{}, mockOsClient, &testFilesystemService, false)
+
+	changeContextError := testSeLinuxService.ChangeContext(rootPath, "system_u", "object_r", "etc_t", true)
+
+	assert.Nil(t, changeContextError)
+}
+
+func TestFileSystemServiceImpl_ChangeSeLinuxContext_setLabelError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockFileInfo := NewMockFileInfo(ctrl)
+	mockOsClient := clients.NewMockOsClient(ctrl)
+	mockOsClient.EXPECT().LstatFile("/etc/keepalived").Return(mockFileInfo, nil)
+	mockOsClient.EXPECT().GetXattr("/etc/keepalived", seLinuxXattr).Return(nil, syscall.ENODATA)
+	mockOsClient.EXPECT().SetXattr("/etc/keepalived", seLinuxXattr, gomock.Any()).Return(syscall.EOPNOTSUPP)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient}
+
+	changeContextError := testFilesystemService.ChangeSeLinuxContext("/etc/keepalived", "system_u", "object_r", "keepalived_var_run_t", false)
+
+	assert.True(t, errors.Is(changeContextError, syscall.EOPNOTSUPP))
+}
+
+func TestFileSystemServiceImpl_CopyFileToRootFs_aclAndXattrs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	destPath := filepath.Join(t.TempDir(), "stats.cfg")
+
+	mockUserClient := clients.NewMockUserClient(ctrl)
+	mockUserClient.EXPECT().GetUserByName("prometheus").Return(&user.User{Uid: "985"}, nil)
+	mockOsClient := newTestOsClient(ctrl)
+	mockOsClient.EXPECT().SetXattr(gomock.Not(destPath), aclAccessXattr, gomock.Any()).DoAndReturn(func(path string, name string, value []byte) error {
+		entries, _ := decodeAcl(value, false)
+		assert.Equal(t, []AclEntry{
+			{Tag: AclUserObj, Perms: 6},
+			{Tag: AclUser, Qualifier: "985", Perms: 4},
+			{Tag: AclGroupObj, Perms: 4},
+			{Tag: AclMask, Perms: 4},
+			{Tag: AclOther},
+		}, entries)
+		return nil
+	})
+	mockOsClient.EXPECT().SetXattr(gomock.Not(destPath), "user.origin", []byte("config-drive")).Return(nil)
+	testFilesystemService := FileSystemServiceImpl{logger: &logrus.Logger{}, osClient: mockOsClient, userClient: mockUserClient}
+
+	changed, copyError := testFilesystemService.CopyFileToRootFs(newTestConfigDrive(t, ctrl, "", map[string]string{"config.yaml": "stats\n"}), "config.yaml", destPath, FileAttributes{
+		Mode:   0640,
+		Acl:    []AclEntry{{Tag: AclUser, Qualifier: "prometheus", Perms: 4}},
+		Xattrs: map[string]string{"user.origin": "config-drive"},
+	})
+
+	assert.Nil(t, copyError)
+	assert.True(t, changed)
+}